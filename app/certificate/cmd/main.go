@@ -1,14 +1,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 	"meross_iot/app/certificate/config"
+	"meross_iot/app/certificate/internal/ca"
+	"meross_iot/app/certificate/internal/interface/http"
+	"meross_iot/app/certificate/internal/interface/http/controller"
+	"meross_iot/library/app"
 	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/hook"
+	"meross_iot/library/cache/redis/ratelimit"
 	"meross_iot/library/configurator"
+	"meross_iot/library/configurator/remote"
 	"meross_iot/library/db/mysql"
+	"meross_iot/library/health"
 	"meross_iot/library/logger"
+	"meross_iot/library/metrics"
+	"os"
+	"reflect"
 )
 
 const (
@@ -16,18 +28,178 @@ const (
 )
 
 func main()  {
-	config.Init()
-	c := mysql.NewConfig()
-	configurator.Is("global").UnmarshalKey("mainDb", c)
-	//fmt.Printf("%+v\n", c)
-	mysql.New(c)
-	cc := redis.NewConfig()
-	configurator.Is("global").UnmarshalKey("mainCache", cc)
-	fmt.Printf("%+v\n", cc)
-	redis.New(cc)
-	logger.Init(AppName, zerolog.ErrorLevel)
+	err := config.Init()
+	settings := (*config.Settings)(nil)
+	if err == nil {
+		settings, err = config.Load()
+	}
+	remoteSrc := (*remote.Source)(nil)
+	if err == nil {
+		remoteSrc, err = config.InitRemote(settings)
+	}
+	if err == nil && remoteSrc != nil {
+		// 加上共享配置后重新读取
+		settings, err = config.Load()
+	}
+	if *config.DumpOnly && err == nil {
+		dump, err := config.Dump()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(dump)
+		os.Exit(0)
+	}
+	if *config.CheckOnly {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("config ok")
+		os.Exit(0)
+	}
+	if err != nil {
+		panic(fmt.Errorf("fatal error, %s\n", err))
+	}
+	level, _ := zerolog.ParseLevel(settings.Log.Level)
+	if settings.Log.BufferSize > 0 {
+		logger.SetOutput(logger.NewBufferedWriter(os.Stderr, settings.Log.BufferSize, logger.DefaultFlushInterval))
+	}
+	logger.Init(AppName, level)
+	controller.SetProfiles(settings.Profiles)
+	a := app.New(AppName, settings.HTTP)
+	// stop hook逆序执行：先摘流量、排空请求，再关闭连接，最后flush日志
+	a.OnStop("logger", func(ctx context.Context) error {
+		return logger.Flush()
+	})
+	db := mysql.New(settings.MainDb)
+	a.OnStop("mysql", func(ctx context.Context) error {
+		return db.Close()
+	})
+	probe, err := mysql.NewProbe(settings.MainDb)
+	if err != nil {
+		panic(fmt.Errorf("init mysql probe failed with error: %s\n", err))
+	}
+	a.OnStop("mysql probe", func(ctx context.Context) error {
+		return probe.Close()
+	})
+	logger.Debug().Str("config", settings.MainCache.String()).Msg("mainCache config")
+	rc := redis.New(settings.MainCache)
+	a.OnStop("redis", func(ctx context.Context) error {
+		return rc.Pool().Close()
+	})
+	// CA加载失败不退出，由readyz报告不可用
+	authority, err := ca.Load(settings.CA.Cert, settings.CA.Key)
+	if err != nil {
+		logger.Error().Err(err).Msg("fail to load ca")
+	} else {
+		controller.Init(authority)
+	}
+
+	metrics.RegisterDB("mainDb", db.Master())
+	metrics.RegisterRedisPool("mainCache", rc.Pool())
+	rc.AddHook(hook.NewSlowLog(hook.DefaultSlowThreshold), metrics.RedisHook("mainCache"))
+	h := health.New(health.DefaultTimeout)
+	for _, node := range probe.Nodes() {
+		node := node
+		h.Register("mysql.mainDb."+node, func(ctx context.Context) error {
+			return probe.PingNode(ctx, node)
+		})
+	}
+	h.Register("redis.mainCache", rc.Ping)
+	h.Register("ca", ca.Checker(controller.Authority, settings.CA.MinValidity))
+
+	watchConfig(rc, settings.MainCache)
+	if remoteSrc != nil {
+		remoteSrc.OnError(func(err error) {
+			logger.Error().Err(err).Msg("remote config error")
+		})
+		if err := remoteSrc.Watch("app"); err != nil {
+			logger.Error().Err(err).Msg("fail to watch remote config")
+		}
+		a.OnStop("remote config", func(ctx context.Context) error {
+			return remoteSrc.Close()
+		})
+	}
+
 	r := gin.Default()
-	//http.InitRouter(r)
-	r.Run() // listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
+	r.Use(metrics.GinMiddleware())
+	r.GET("/metrics", metrics.GinHandler())
+	r.GET("/healthz", h.LivenessHandler())
+	r.GET("/readyz", h.ReadinessHandler())
+	http.InitRouter(r, issueMiddlewares(rc, settings.RateLimit)...)
+	a.Serve(r)
+	a.OnStop("health", func(ctx context.Context) error {
+		h.Shutdown()
+		return nil
+	})
+	if err := a.Run(); err != nil {
+		logger.Error().Err(err).Msg("certificate service exited with error")
+		logger.Flush()
+		os.Exit(1)
+	}
 }
 
+// rateLimit段启用时按调用方IP和设备uuid限制签发证书的频率
+func issueMiddlewares(rc *redis.Redis, c *config.RateLimit) []gin.HandlerFunc {
+	if !c.Enabled {
+		return nil
+	}
+	limiter := ratelimit.New(rc, AppName+":ratelimit:")
+	callerKey := ratelimit.KeyFunc(ratelimit.KeyByIP)
+	if len(c.TrustedProxies) > 0 {
+		// 配置已经校验过
+		callerKey, _ = ratelimit.KeyByForwardedIP(c.TrustedProxies...)
+	}
+	return []gin.HandlerFunc{limiter.GinMiddleware(
+		&ratelimit.Rule{Name: "caller", Limit: c.Caller, Key: callerKey},
+		&ratelimit.Rule{Name: "device", Limit: c.Device, Key: ratelimit.KeyByParam("uuid")},
+	)}
+}
+
+// 配置文件变化时热加载：日志级别、证书profile和redis连接池大小立即生效，其他配置需要重启
+func watchConfig(rc *redis.Redis, cacheConf *redis.Config) {
+	configurator.OnError(func(name string, err error) {
+		logger.Error().Err(err).Str("config", name).Msg("fail to reload config, keep using the old one")
+	})
+	configurator.OnChange("app", "log.level", func(old, new interface{}) {
+		l, err := config.LoadLog()
+		if err != nil {
+			logger.Error().Err(err).Msg("invalid log config, keep using the old one")
+			return
+		}
+		level, _ := zerolog.ParseLevel(l.Level)
+		logger.SetLevel(level)
+	})
+	configurator.OnChange("app", "profiles", func(old, new interface{}) {
+		p, err := config.LoadProfiles()
+		if err != nil {
+			logger.Error().Err(err).Msg("invalid profiles config, keep using the old one")
+			return
+		}
+		controller.SetProfiles(p)
+	})
+	// 当前生效的连接池大小，只在变化时调整，redigo调整时会重建pool
+	maxActive, maxIdle := cacheConf.MaxActiveConns, cacheConf.MaxIdleConns
+	configurator.OnChange("app", "mainCache", func(old, new interface{}) {
+		c, err := config.MainCache()
+		if err != nil {
+			logger.Error().Err(err).Msg("invalid mainCache config, keep using the old one")
+			return
+		}
+		if c.MaxActiveConns != maxActive || c.MaxIdleConns != maxIdle {
+			if err := rc.Pool().SetLimits(c.MaxActiveConns, c.MaxIdleConns); err != nil {
+				logger.Error().Err(err).Msg("fail to resize mainCache pool")
+				return
+			}
+			maxActive, maxIdle = c.MaxActiveConns, c.MaxIdleConns
+		}
+		c.MaxActiveConns, c.MaxIdleConns = cacheConf.MaxActiveConns, cacheConf.MaxIdleConns
+		if !reflect.DeepEqual(c, cacheConf) {
+			logger.Warn().Msg("mainCache config changed, restart to apply changes other than pool limits")
+		}
+	})
+	if err := configurator.Watch(); err != nil {
+		logger.Error().Err(err).Msg("fail to watch config files")
+	}
+}
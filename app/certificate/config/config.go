@@ -1,23 +1,264 @@
 package config
 
 import (
+	"flag"
 	"fmt"
+	"meross_iot/library/app"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/ratelimit"
 	"meross_iot/library/configurator"
+	"meross_iot/library/configurator/remote"
+	"meross_iot/library/configurator/validate"
+	"meross_iot/library/db/mysql"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"time"
 )
 
+const (
+	AppConfigEnv    = "CERTIFICATE_CONFIG"
+	GlobalConfigEnv = "MEROSS_GLOBAL_CONFIG"
+	// 覆盖配置项的环境变量前缀，如CERTIFICATE_MAINDB_PASSWORD覆盖mainDb.password
+	EnvPrefix = "CERTIFICATE"
+)
+
+var (
+	appConfigFlag    = flag.String("config", "", "certificate config file, or set env "+AppConfigEnv)
+	globalConfigFlag = flag.String("global-config", "", "global config file, or set env "+GlobalConfigEnv)
+	// CheckOnly 只校验配置，不启动服务
+	CheckOnly = flag.Bool("check-config", false, "validate config files and exit")
+	// DumpOnly 输出实际生效的配置(敏感配置项被隐藏)，不启动服务
+	DumpOnly = flag.Bool("dump-config", false, "print the effective config with secrets masked and exit")
+)
+
+const (
+	DefaultCAMinValidity = 30 * 24 * time.Hour
+	DefaultLogLevel      = "error"
+	DefaultProfile       = "device"
+)
+
+// CA app配置中的ca段
+type CA struct {
+	Cert        string        `validate:"required"`
+	Key         string        `validate:"required"`
+	MinValidity time.Duration `validate:"min=0"`
+}
+
+// Log app配置中的log段
+type Log struct {
+	Level string `validate:"oneof=trace debug info warn error fatal panic disabled"`
+	// 输出缓冲区的字节数，为0时不缓冲；缓冲的日志每秒写出一次，退出前flush
+	BufferSize int `validate:"min=0"`
+}
+
+// Profile 证书签发profile，决定证书的subject、有效期和密钥长度
+type Profile struct {
+	Country            string `validate:"required"`
+	Organization       string `validate:"required"`
+	OrganizationalUnit string
+	ValidYears         int `validate:"min=1,max=50"`
+	KeyBits            int `validate:"oneof=2048 3072 4096"`
+}
+
+// Profiles 以profile名为key，必须包含默认的device profile
+type Profiles map[string]*Profile
+
+// Validate 按名称顺序校验所有profile
+func (p *Profiles) Validate(section string) error {
+	if _, ok := (*p)[DefaultProfile]; !ok {
+		return &validate.FieldError{Key: section + "." + DefaultProfile, Message: "is required"}
+	}
+	names := make([]string, 0, len(*p))
+	for name := range *p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := validate.Errors{}
+	for _, name := range names {
+		errs.Append(section+"."+name, validate.Struct(section+"."+name, (*p)[name]))
+	}
+	return errs.Err()
+}
+
+// Remote app配置中的remote段，启用后从mainCache读取多实例共享的配置
+type Remote struct {
+	Enabled       bool
+	remote.Config `mapstructure:",squash"`
+}
+
+// Validate 未启用时不校验
+func (r *Remote) Validate(section string) error {
+	if !r.Enabled {
+		return nil
+	}
+	return r.Config.Validate(section)
+}
+
+// RateLimit app配置中的rateLimit段，限制签发证书的频率，计数保存在mainCache中
+type RateLimit struct {
+	Enabled bool
+	// 按调用方IP限流
+	Caller *ratelimit.Limit
+	// 按设备uuid限流
+	Device *ratelimit.Limit
+	// 反向代理的IP或CIDR，对端是这些代理时才从X-Forwarded-For读取调用方IP
+	TrustedProxies []string
+}
+
+// Validate 未启用时不校验
+func (r *RateLimit) Validate(section string) error {
+	if !r.Enabled {
+		return nil
+	}
+	errs := validate.Errors{}
+	errs.Append(section+".caller", r.Caller.Validate(section+".caller"))
+	errs.Append(section+".device", r.Device.Validate(section+".device"))
+	_, err := ratelimit.KeyByForwardedIP(r.TrustedProxies...)
+	errs.Append(section+".trustedProxies", err)
+	return errs.Err()
+}
+
+// Settings 服务用到的所有配置段
+type Settings struct {
+	MainDb    *mysql.Config
+	MainCache *redis.Config
+	HTTP      *app.Config
+	CA        *CA
+	Log       *Log
+	Profiles  Profiles
+	Remote    *Remote
+	RateLimit *RateLimit
+}
+
 var configPath = make(map[string]string)
 
-func Init()  {
+// 配置文件优先从命令行参数和环境变量获取，都没有设置时依次尝试：
+// 工作目录为cmd时的相对路径，工作目录为项目根目录时的相对路径，可执行文件放在cmd时的相对路径
+// 配置项(包括只有默认值的)都可以用带EnvPrefix前缀的环境变量覆盖，如CERTIFICATE_MAINDB_PASSWORD覆盖mainDb.password
+func Init() error {
+	if !flag.Parsed() {
+		flag.Parse()
+	}
 	wd, err := os.Getwd()
 	if err != nil {
 		panic(fmt.Errorf("fatal error, fail to get work directory"))
 	}
-	//这里的路径设定，可运行文件必须放在cmd或同级目录下才行
-	configPath["app"] = path.Clean(wd + "/../config/config.toml")
-	configPath["global"] = path.Clean(wd + "/../../../config/config.toml")
+	exeDir := wd
+	if exe, err := os.Executable(); err == nil {
+		exeDir = filepath.Dir(exe)
+	}
+
+	configPath["app"], err = configurator.Locate(*appConfigFlag, AppConfigEnv,
+		path.Join(wd, "../config/config.toml"),
+		path.Join(wd, "app/certificate/config/config.toml"),
+		path.Join(exeDir, "../config/config.toml"),
+	)
+	if err != nil {
+		return fmt.Errorf("fail to locate app config: %s", err)
+	}
+	configPath["global"], err = configurator.Locate(*globalConfigFlag, GlobalConfigEnv,
+		path.Join(wd, "../../../config/config.toml"),
+		path.Join(wd, "config/config.toml"),
+		path.Join(exeDir, "../../../config/config.toml"),
+	)
+	if err != nil {
+		return fmt.Errorf("fail to locate global config: %s", err)
+	}
+
+	configurator.SetEnvPrefix(EnvPrefix)
+	if err := configurator.TryLoad(configPath); err != nil {
+		return err
+	}
+	// app配置继承global配置，服务只从app读取配置
+	return configurator.Extend("app", "global")
+}
+
+// Dump 输出app配置合并global配置和环境overlay后实际生效的配置
+func Dump() (string, error) {
+	return configurator.Dump("app")
+}
+
+// Load 读取并校验所有配置段，返回所有配置段的聚合错误
+func Load() (*Settings, error) {
+	s := &Settings{
+		MainDb:    mysql.NewConfig(),
+		MainCache: redis.NewConfig(),
+		HTTP:      app.NewConfig(),
+		CA:        &CA{MinValidity: DefaultCAMinValidity},
+		Log:       &Log{Level: DefaultLogLevel},
+		Profiles:  make(Profiles),
+		Remote:    &Remote{Config: *remote.NewConfig()},
+		RateLimit: &RateLimit{
+			Caller: &ratelimit.Limit{Algorithm: ratelimit.AlgorithmTokenBucket, Rate: 60, Period: time.Minute, Burst: 20},
+			Device: &ratelimit.Limit{Algorithm: ratelimit.AlgorithmSlidingWindow, Rate: 5, Period: time.Hour},
+		},
+	}
+	errs := validate.Errors{}
+	errs.Append("mainDb", configurator.Bind("app", "mainDb", s.MainDb))
+	errs.Append("mainCache", configurator.Bind("app", "mainCache", s.MainCache))
+	errs.Append("http", configurator.Bind("app", "http", s.HTTP))
+	errs.Append("ca", configurator.Bind("app", "ca", s.CA))
+	errs.Append("log", configurator.Bind("app", "log", s.Log))
+	errs.Append("profiles", configurator.Bind("app", "profiles", &s.Profiles))
+	errs.Append("remote", configurator.Bind("app", "remote", s.Remote))
+	errs.Append("rateLimit", configurator.Bind("app", "rateLimit", s.RateLimit))
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	s.CA.Cert = ResolvePath(s.CA.Cert)
+	s.CA.Key = ResolvePath(s.CA.Key)
+	return s, nil
+}
+
+// InitRemote remote段启用时，把mainCache中保存的共享配置覆盖到app配置上，之后需要重新Load
+// 共享配置的优先级高于配置文件，低于环境变量；mainCache和remote段的连接配置以配置文件为准
+func InitRemote(s *Settings) (*remote.Source, error) {
+	if !s.Remote.Enabled {
+		return nil, nil
+	}
+	// Source使用单独的连接池，在Close时关闭
+	src := remote.Open(s.MainCache, &s.Remote.Config)
+	if err := configurator.AddSource("app", src); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// 以下按配置段读取，配置文件热加载后用于重新读取单个配置段
 
-	configurator.Load(configPath)
+// MainCache 读取并校验mainCache段，app配置中的同名配置项覆盖global配置
+func MainCache() (*redis.Config, error) {
+	c := redis.NewConfig()
+	if err := configurator.Bind("app", "mainCache", c); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
+// LoadLog 读取并校验app配置中的log段，未配置时默认为error级别
+func LoadLog() (*Log, error) {
+	l := &Log{Level: DefaultLogLevel}
+	if err := configurator.Bind("app", "log", l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// LoadProfiles 读取并校验app配置中的profiles段
+func LoadProfiles() (Profiles, error) {
+	p := make(Profiles)
+	if err := configurator.Bind("app", "profiles", &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ResolvePath 配置中的相对路径以app配置文件所在目录为准
+func ResolvePath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(filepath.Dir(configurator.Path("app")), p)
+}
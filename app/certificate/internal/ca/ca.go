@@ -0,0 +1,74 @@
+package ca
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	ErrNotLoaded   = errors.New("ca is not loaded")
+	ErrKeyMismatch = errors.New("ca key does not match ca certificate")
+)
+
+// Authority 签发设备证书用的根证书和私钥
+type Authority struct {
+	Cert *x509.Certificate
+	Key  *rsa.PrivateKey
+}
+
+// Load 读取PEM格式的CA证书和PKCS1私钥，并校验两者是否匹配
+func Load(certPath, keyPath string) (*Authority, error) {
+	caFile, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	caBlock, _ := pem.Decode(caFile)
+	if caBlock == nil {
+		return nil, fmt.Errorf("ca file [%s] is wrong pem format", certPath)
+	}
+	cert, err := x509.ParseCertificate(caBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyFile, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyFile)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("ca key file [%s] is wrong pem format", keyPath)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || pub.N.Cmp(key.N) != 0 || pub.E != key.E {
+		return nil, ErrKeyMismatch
+	}
+	return &Authority{Cert: cert, Key: key}, nil
+}
+
+// Checker 生成健康检查函数：CA已加载，且证书剩余有效期不少于minValidity
+func Checker(get func() *Authority, minValidity time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		a := get()
+		if a == nil {
+			return ErrNotLoaded
+		}
+		now := time.Now()
+		if now.Before(a.Cert.NotBefore) {
+			return fmt.Errorf("ca certificate is not valid before %s", a.Cert.NotBefore.Format(time.RFC3339))
+		}
+		if a.Cert.NotAfter.Sub(now) < minValidity {
+			return fmt.Errorf("ca certificate expires at %s", a.Cert.NotAfter.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
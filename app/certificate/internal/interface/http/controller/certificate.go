@@ -7,78 +7,89 @@ import (
 	"encoding/pem"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"io/ioutil"
 	"math/big"
 	"crypto/rand"
+	"meross_iot/app/certificate/config"
+	"meross_iot/app/certificate/internal/ca"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
+var authority *ca.Authority
+
+// 配置热加载时整体替换，签发中的请求使用替换前的profile
+var profiles atomic.Value
+
+// SetProfiles 设置可用的证书profile
+func SetProfiles(p map[string]*config.Profile) {
+	profiles.Store(p)
+}
+
+func profile(name string) *config.Profile {
+	p, _ := profiles.Load().(map[string]*config.Profile)
+	return p[name]
+}
+
+// Init 设置签发证书用的CA，未设置时接口返回1001
+func Init(a *ca.Authority) {
+	authority = a
+}
+
+// Authority 返回当前使用的CA
+func Authority() *ca.Authority {
+	return authority
+}
+
 func Create(c *gin.Context)  {
 	uuid := c.Param("uuid")
 
-	rootCaPath := "../ca/meross_demo_ca.cert"
-	caFile, err := ioutil.ReadFile(rootCaPath)
-	if err != nil {
-		c.JSON(200, gin.H{"code":1001, "message":"io error"})
+	if authority == nil {
+		c.JSON(200, gin.H{"code":1001, "message":"ca is not loaded"})
 		return
 	}
-	caBlock, _ := pem.Decode(caFile)
-	if caBlock == nil {
-		c.JSON(200, gin.H{"code":1002, "message":"ca file is wrong pem format"})
-		return
-	}
-	rootCert, err := x509.ParseCertificate(caBlock.Bytes)
-	if err != nil {
-		c.JSON(200, gin.H{"code":1003, "message":"fail to parse caBlock"})
-		return
-	}
-
-	rootKeyPath := "../ca/meross_demo_ca.key"
-	keyFile, err := ioutil.ReadFile(rootKeyPath)
-	if err != nil {
-		c.JSON(200, gin.H{"code":1001, "message":"io error"})
-		return
-	}
-	keyBlock, _ := pem.Decode(keyFile)
-	if keyBlock == nil {
-		c.JSON(200, gin.H{"code":1004, "message":"ca key file is wrong pem format"})
-		return
-	}
-	rootKey, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
-	if err != nil {
-		c.JSON(200, gin.H{"code":1005, "message":"fail to parse ca key"})
+	profileName := c.DefaultQuery("profile", config.DefaultProfile)
+	p := profile(profileName)
+	if p == nil {
+		c.JSON(200, gin.H{"code":1008, "message":"unknown profile"})
 		return
 	}
+	keyAlgorithm := fmt.Sprintf("rsa%d", p.KeyBits)
+	rootCert := authority.Cert
+	rootKey := authority.Key
 
 	max := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNum, _ := rand.Int(rand.Reader, max)
 	certTemplate := &x509.Certificate{
 		SerialNumber: serialNum,
 		Subject: pkix.Name{
-			Country:            []string{"CN"},
-			Organization:       []string{"Chengdu Meross Technology Co., Ltd."},
-			OrganizationalUnit: []string{"Iot Rd"},
+			Country:            []string{p.Country},
+			Organization:       []string{p.Organization},
+			OrganizationalUnit: []string{p.OrganizationalUnit},
 			CommonName:         uuid,
 		},
 		NotBefore: time.Now(),
-		NotAfter: time.Now().AddDate(30, 0, 0),
+		NotAfter: time.Now().AddDate(p.ValidYears, 0, 0),
 		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageDataEncipherment,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		IsCA: false,
 	}
 
-	devicePrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	keyGenStart := time.Now()
+	devicePrivKey, err := rsa.GenerateKey(rand.Reader, p.KeyBits)
+	keyGenDuration.WithLabelValues(keyAlgorithm).Observe(time.Since(keyGenStart).Seconds())
 	if err != nil {
 		c.JSON(200, gin.H{"code":1006, "message":"fail to generate private key"})
 		return
 	}
 	deviceCert, err := x509.CreateCertificate(rand.Reader,certTemplate,rootCert,&devicePrivKey.PublicKey,rootKey)
 	if err != nil {
+		signErrorCounter.WithLabelValues(profileName, keyAlgorithm).Inc()
 		c.JSON(200, gin.H{"code":1007, "message":"fail to create device certificate"})
 		return
 	}
+	issuedCounter.WithLabelValues(profileName, keyAlgorithm).Inc()
 	pemCert := &pem.Block{
 		Type:    "CERTIFICATE",
 		Bytes:   deviceCert,
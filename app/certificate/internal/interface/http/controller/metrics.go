@@ -0,0 +1,22 @@
+package controller
+
+import (
+	"meross_iot/library/metrics"
+)
+
+const (
+	metricsSubsystem = "certificate"
+)
+
+var (
+	// 证书签发数，按profile和密钥算法区分
+	issuedCounter = metrics.NewCounterVec(metricsSubsystem, "issued_total",
+		"Total number of issued certificates.", "profile", "algorithm")
+	// 设备私钥生成耗时，RSA 2048通常在几十到几百毫秒之间
+	keyGenDuration = metrics.NewHistogramVec(metricsSubsystem, "key_generation_duration_seconds",
+		"Device private key generation duration in seconds.",
+		[]float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5}, "algorithm")
+	// CA签名失败数
+	signErrorCounter = metrics.NewCounterVec(metricsSubsystem, "ca_sign_errors_total",
+		"Total number of CA signing errors.", "profile", "algorithm")
+)
@@ -5,13 +5,14 @@ import (
 	"meross_iot/app/certificate/internal/interface/http/controller"
 )
 
-func InitRouter(e *gin.Engine)  {
+// issue为签发证书之前执行的中间件，如限流
+func InitRouter(e *gin.Engine, issue ...gin.HandlerFunc)  {
 	v1 := e.Group("/v1")
 	{
 		// 获取证书
 		//v1.GET("/device/certificate/:uuid")
 		// 生成证书
-		v1.PUT("device/certificate/:uuid", controller.Create)
+		v1.PUT("device/certificate/:uuid", append(issue, controller.Create)...)
 	}
 }
 
@@ -0,0 +1,220 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"meross_iot/library/configurator/validate"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultAddr            = ":8080"
+	DefaultReadTimeout     = 10 * time.Second
+	DefaultWriteTimeout    = 30 * time.Second
+	DefaultIdleTimeout     = 2 * time.Minute
+	DefaultStartTimeout    = 15 * time.Second
+	DefaultShutdownTimeout = 15 * time.Second
+)
+
+// http server和生命周期总配置
+type Config struct {
+	Addr         string        `validate:"required"`
+	ReadTimeout  time.Duration `validate:"min=0"`
+	WriteTimeout time.Duration `validate:"min=0"`
+	IdleTimeout  time.Duration `validate:"min=0"`
+	// 所有start hook的总超时
+	StartTimeout time.Duration `validate:"gt=0"`
+	// 等待请求处理完毕和执行所有stop hook的总超时
+	ShutdownTimeout time.Duration `validate:"gt=0"`
+}
+
+// Hook 生命周期钩子，OnStart按注册顺序执行，OnStop按注册的逆序执行
+type Hook struct {
+	Name    string
+	OnStart func(ctx context.Context) error
+	OnStop  func(ctx context.Context) error
+}
+
+type App struct {
+	name     string
+	conf     *Config
+	mu       sync.Mutex
+	hooks    []Hook
+	started  int
+	err      error
+	shutdown chan struct{}
+	once     sync.Once
+}
+
+// 获取默认配置
+func NewConfig() *Config {
+	return &Config{
+		Addr:            DefaultAddr,
+		ReadTimeout:     DefaultReadTimeout,
+		WriteTimeout:    DefaultWriteTimeout,
+		IdleTimeout:     DefaultIdleTimeout,
+		StartTimeout:    DefaultStartTimeout,
+		ShutdownTimeout: DefaultShutdownTimeout,
+	}
+}
+
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (c *Config) Validate(section string) error {
+	return validate.Struct(section, c)
+}
+
+func New(name string, c *Config) *App {
+	if c == nil {
+		panic(fmt.Errorf("app config is empty"))
+	}
+	if err := c.Validate("app"); err != nil {
+		panic(fmt.Errorf("wrong app config, %s\n", err))
+	}
+	return &App{
+		name:     name,
+		conf:     c,
+		shutdown: make(chan struct{}),
+	}
+}
+
+func (a *App) Name() string {
+	return a.name
+}
+
+// Append 注册hook，Run之后注册的hook不会被执行
+func (a *App) Append(h Hook) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hooks = append(a.hooks, h)
+}
+
+// OnStop 注册只有关闭动作的hook，如关闭连接池
+func (a *App) OnStop(name string, fn func(ctx context.Context) error) {
+	a.Append(Hook{Name: name, OnStop: fn})
+}
+
+// Serve 注册http server，server启动后才执行之后注册的hook，关闭时先于之前注册的hook排空请求
+func (a *App) Serve(handler http.Handler) {
+	srv := &http.Server{
+		Addr:         a.conf.Addr,
+		Handler:      handler,
+		ReadTimeout:  a.conf.ReadTimeout,
+		WriteTimeout: a.conf.WriteTimeout,
+		IdleTimeout:  a.conf.IdleTimeout,
+	}
+	a.Append(Hook{
+		Name: "http",
+		// 在启动阶段同步监听，监听失败(如端口被占用)时启动失败
+		OnStart: func(ctx context.Context) error {
+			ln, err := net.Listen("tcp", srv.Addr)
+			if err != nil {
+				return err
+			}
+			go func() {
+				if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+					a.fail(fmt.Errorf("http server failed: %s", err))
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return srv.Shutdown(ctx)
+		},
+	})
+}
+
+// Shutdown 触发关闭流程，可重复调用
+func (a *App) Shutdown() {
+	a.once.Do(func() {
+		close(a.shutdown)
+	})
+}
+
+// 运行中出错时记录错误并触发关闭，Run返回第一个错误
+func (a *App) fail(err error) {
+	a.mu.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.mu.Unlock()
+	a.Shutdown()
+}
+
+// Run 依次执行start hook，然后阻塞直到收到SIGINT/SIGTERM或Shutdown被调用，最后逆序执行stop hook
+// 任意start hook失败时，已启动的hook会被关闭，并返回该错误
+// 执行start hook之前已经开始监听信号，start hook执行期间收到的信号不会丢失
+func (a *App) Run() error {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	a.mu.Lock()
+	hooks := a.hooks
+	a.mu.Unlock()
+
+	startErr := a.start(hooks)
+	if startErr == nil {
+		select {
+		case <-signals:
+		case <-a.shutdown:
+		}
+	}
+
+	// 关闭过程中再次收到信号时取消stop hook的ctx，不再等待请求处理完毕
+	ctx, cancel := context.WithTimeout(context.Background(), a.conf.ShutdownTimeout)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-stopped:
+		}
+	}()
+	stopErr := a.stop(ctx, hooks)
+	close(stopped)
+	if startErr != nil {
+		return startErr
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	return stopErr
+}
+
+func (a *App) start(hooks []Hook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.conf.StartTimeout)
+	defer cancel()
+	for _, h := range hooks {
+		if h.OnStart != nil {
+			if err := h.OnStart(ctx); err != nil {
+				return fmt.Errorf("start hook [%s] failed: %s", h.Name, err)
+			}
+		}
+		a.started++
+	}
+	return nil
+}
+
+// 只关闭已启动的hook，一个hook失败不影响其他hook关闭，返回第一个错误
+func (a *App) stop(ctx context.Context, hooks []Hook) error {
+	var firstErr error
+	for i := a.started - 1; i >= 0; i-- {
+		h := hooks[i]
+		if h.OnStop == nil {
+			continue
+		}
+		if err := h.OnStop(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stop hook [%s] failed: %s", h.Name, err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,183 @@
+package app_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"meross_iot/library/app"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type testAppSuite struct {
+	suite.Suite
+}
+
+func freeAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recorder) hook(name string, startErr error) app.Hook {
+	return app.Hook{
+		Name: name,
+		OnStart: func(ctx context.Context) error {
+			r.add("start " + name)
+			return startErr
+		},
+		OnStop: func(ctx context.Context) error {
+			r.add("stop " + name)
+			return nil
+		},
+	}
+}
+
+func (r *recorder) add(e string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+/*
+ * 1. 测试hook按顺序启动，逆序关闭
+ */
+func (s *testAppSuite) TestHookOrder() {
+	assrt := assert.New(s.T())
+	a := app.New("test", app.NewConfig())
+	r := &recorder{}
+	a.Append(r.hook("a", nil))
+	a.Append(r.hook("b", nil))
+	a.OnStop("c", func(ctx context.Context) error {
+		r.add("stop c")
+		return nil
+	})
+	go a.Shutdown()
+	assrt.NoError(a.Run())
+	assrt.Equal([]string{"start a", "start b", "stop c", "stop b", "stop a"}, r.events)
+}
+
+/*
+ * 2. 测试启动失败时只关闭已启动的hook
+ */
+func (s *testAppSuite) TestStartFailure() {
+	assrt := assert.New(s.T())
+	a := app.New("test", app.NewConfig())
+	r := &recorder{}
+	a.Append(r.hook("a", nil))
+	a.Append(r.hook("b", errors.New("boom")))
+	a.Append(r.hook("c", nil))
+	err := a.Run()
+	assrt.Error(err)
+	assrt.Contains(err.Error(), "boom")
+	assrt.Equal([]string{"start a", "start b", "stop a"}, r.events)
+}
+
+/*
+ * 3. 测试关闭时等待处理中的请求完成
+ */
+func (s *testAppSuite) TestDrain() {
+	assrt := assert.New(s.T())
+	c := app.NewConfig()
+	c.Addr = freeAddr()
+	a := app.New("test", c)
+	inFlight := make(chan struct{})
+	a.Serve(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(inFlight)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	runErr := make(chan error)
+	go func() {
+		runErr <- a.Run()
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + c.Addr)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-inFlight
+	a.Shutdown()
+	assrt.Equal("done", <-body)
+	assrt.NoError(<-runErr)
+	_, err := http.Get("http://" + c.Addr)
+	assrt.Error(err)
+}
+
+/*
+ * 4. 测试端口被占用时启动失败
+ */
+func (s *testAppSuite) TestListenFailure() {
+	assrt := assert.New(s.T())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assrt.NoError(err)
+	defer l.Close()
+	c := app.NewConfig()
+	c.Addr = l.Addr().String()
+	a := app.New("test", c)
+	a.Serve(http.NotFoundHandler())
+	assrt.Error(a.Run())
+}
+
+/*
+ * 5. 测试关闭过程中再次收到信号时取消stop hook的ctx
+ */
+func (s *testAppSuite) TestSecondSignal() {
+	assrt := assert.New(s.T())
+	a := app.New("test", app.NewConfig())
+	// start hook在Run监听信号之后执行，之后发送的信号不会丢失
+	started := make(chan struct{})
+	a.Append(app.Hook{Name: "ready", OnStart: func(ctx context.Context) error {
+		close(started)
+		return nil
+	}})
+	stopping := make(chan struct{})
+	a.OnStop("slow", func(ctx context.Context) error {
+		close(stopping)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	runErr := make(chan error)
+	go func() {
+		runErr <- a.Run()
+	}()
+	<-started
+	p, _ := os.FindProcess(os.Getpid())
+	assrt.NoError(p.Signal(syscall.SIGTERM))
+	<-stopping
+	assrt.NoError(p.Signal(syscall.SIGTERM))
+	select {
+	case err := <-runErr:
+		assrt.Error(err)
+		assrt.Contains(err.Error(), "context canceled")
+	case <-time.After(time.Second):
+		assrt.Fail("Run should return after the second signal")
+	}
+}
+
+func TestAppSuite(t *testing.T) {
+	suite.Run(t, new(testAppSuite))
+}
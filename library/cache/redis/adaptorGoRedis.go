@@ -0,0 +1,799 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	goredis "github.com/redis/go-redis/v9"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// go-redis的pool等待超时错误没有导出
+const goRedisPoolTimeout = "redis: connection pool timeout"
+
+// 生成go-redis的Options，0值的含义与redigo保持一致，每次建立连接时通过addr获取地址
+func genGoRedisOptions(c *Config, addr func() (string, error)) *goredis.Options {
+	opt := &goredis.Options{
+		Addr:     c.Host + ":" + strconv.Itoa(c.Port),
+		Password: c.Password,
+		DB:       c.Database,
+		// 使用RESP2，返回值的类型与redigo一致
+		Protocol:    2,
+		DialTimeout: c.Timeout,
+		Dialer: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			address, err := addr()
+			if err != nil {
+				return nil, err
+			}
+			d := &net.Dialer{Timeout: c.Timeout, KeepAlive: c.Keepalive}
+			return d.DialContext(ctx, network, address)
+		},
+		ReadTimeout:  goRedisTimeout(c.ReadTimeout),
+		WriteTimeout: goRedisTimeout(c.WriteTimeout),
+		// BorrowWithContext、Pipeline和Script的ctx要能取消等待和读写
+		ContextTimeoutEnabled: true,
+		// redigo不重试，保持一致
+		MaxRetries:      -1,
+		PoolSize:        c.MaxActiveConns,
+		MaxIdleConns:    c.MaxIdleConns,
+		ConnMaxIdleTime: goRedisTimeout(c.IdleTimeout),
+		ConnMaxLifetime: c.ConnMaxLife,
+	}
+	// idle不能超过active
+	if opt.PoolSize > 0 && opt.MaxIdleConns > opt.PoolSize {
+		opt.MaxIdleConns = opt.PoolSize
+	}
+	return opt
+}
+
+// redigo中0表示不超时，go-redis中0表示使用默认值，-1表示不超时
+func goRedisTimeout(t time.Duration) time.Duration {
+	if t == 0 {
+		return -1
+	}
+	return t
+}
+
+// 返回status reply的命令，其他命令的string返回值都是bulk string
+// key为命令名或"命令名 子命令"
+var goRedisStatusCommands = map[string]bool{
+	"SET": true, "SETEX": true, "PSETEX": true, "MSET": true, "PING": true, "TYPE": true,
+	"SELECT": true, "AUTH": true, "FLUSHDB": true, "FLUSHALL": true, "RENAME": true,
+	"LSET": true, "LTRIM": true, "HMSET": true, "QUIT": true, "WATCH": true, "UNWATCH": true,
+	"MULTI": true, "DISCARD": true, "RESTORE": true, "SAVE": true, "BGSAVE": true,
+	"BGREWRITEAOF": true, "SWAPDB": true, "MIGRATE": true, "READONLY": true, "READWRITE": true,
+	"PFMERGE": true, "SCRIPT FLUSH": true, "SCRIPT KILL": true, "CONFIG SET": true,
+	"CONFIG RESETSTAT": true, "CONFIG REWRITE": true, "CLIENT SETNAME": true, "CLIENT KILL": true,
+	"XGROUP CREATE": true, "XGROUP SETID": true,
+}
+
+func isGoRedisStatusCommand(command string, args []interface{}) bool {
+	command = strings.ToUpper(command)
+	switch command {
+	case "PING":
+		// PING带参数时返回bulk string
+		return len(args) == 0
+	case "SET":
+		// SET ... GET返回旧值，只检查key和value之后的选项
+		if len(args) < 2 {
+			return true
+		}
+		for _, arg := range args[2:] {
+			if s, ok := arg.(string); ok && strings.EqualFold(s, "GET") {
+				return false
+			}
+		}
+		return true
+	}
+	if goRedisStatusCommands[command] {
+		return true
+	}
+	if len(args) > 0 {
+		if sub, ok := args[0].(string); ok {
+			return goRedisStatusCommands[command+" "+strings.ToUpper(sub)]
+		}
+	}
+	return false
+}
+
+// go-redis对bulk string和status reply都返回string，redigo对bulk string返回[]byte，
+// 按命令把返回值转换成与redigo一致：nil reply返回(nil, nil)，服务端错误转换为Error
+func convertGoRedisReply(command string, args []interface{}, v interface{}, err error) (interface{}, error) {
+	if err == goredis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, convertGoRedisError(err)
+	}
+	if s, ok := v.(string); ok && isGoRedisStatusCommand(command, args) {
+		return s, nil
+	}
+	return convertGoRedisValue(v), nil
+}
+
+func convertGoRedisValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return []byte(v)
+	case []interface{}:
+		for i, e := range v {
+			v[i] = convertGoRedisValue(e)
+		}
+		return v
+	case goredis.Error:
+		return Error(v.Error())
+	default:
+		return v
+	}
+}
+
+func convertGoRedisError(err error) error {
+	var re goredis.Error
+	if errors.As(err, &re) {
+		return Error(re.Error())
+	}
+	if err.Error() == goRedisPoolTimeout {
+		return ErrPoolExhausted
+	}
+	return err
+}
+
+func goRedisArgs(command string, args []interface{}) []interface{} {
+	cmdArgs := make([]interface{}, 0, len(args)+1)
+	cmdArgs = append(cmdArgs, command)
+	return append(cmdArgs, args...)
+}
+
+// goredis.Conn没有Do方法
+func goRedisConnDo(ctx context.Context, conn *goredis.Conn, command string, args []interface{}) (interface{}, error) {
+	cmd := goredis.NewCmd(ctx, goRedisArgs(command, args)...)
+	conn.Process(ctx, cmd)
+	return cmd.Result()
+}
+
+func newGoRedisPool(c *Config, st *sentinel) *goRedisPool {
+	return &goRedisPool{
+		conf: *c,
+		st:   st,
+		gen:  newGoRedisGen(c, st),
+	}
+}
+
+func newGoRedisPubSubConn(c *Config, st *sentinel) (*goRedisPubSub, error) {
+	client, err := dialGoRedisClient(c, genAddrFunc(c, st, false))
+	if err != nil {
+		return nil, err
+	}
+	return &goRedisPubSub{client: client, ps: client.Subscribe(context.Background())}, nil
+}
+
+func newGoRedisBlockedConn(c *Config, st *sentinel) (*goRedisBlockedConn, error) {
+	client, err := dialGoRedisClient(c, genAddrFunc(c, st, false))
+	if err != nil {
+		return nil, err
+	}
+	return &goRedisBlockedConn{client: client, conn: client.Conn()}, nil
+}
+
+// 独占一个连接的client，用于pubsub和阻塞命令，创建时建立连接，与redigo一样立即返回连接和认证错误
+func dialGoRedisClient(c *Config, addr func() (string, error)) (*goredis.Client, error) {
+	opt := genGoRedisOptions(c, addr)
+	opt.PoolSize = 1
+	opt.MaxIdleConns = 1
+	// 阻塞命令和订阅由调用方指定超时时间
+	opt.ReadTimeout = -1
+	client := goredis.NewClient(opt)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, convertGoRedisError(err)
+	}
+	return client, nil
+}
+
+/* *********************************
+ * ******** interface Pool *********
+ * *********************************/
+
+/*
+ * go-redis的client关闭时会同时关闭借出的连接，SetLimits和Close时旧client要等借出的连接都归还后再关闭，
+ * 与redigo的行为保持一致
+ */
+type goRedisGen struct {
+	client *goredis.Client
+	// 开启ReplicaReads时只读命令使用的client
+	replica  *goredis.Client
+	mu       sync.Mutex
+	borrowed int
+	retired  bool
+	// 借出连接的名额，限制借出的连接数不超过maxActiveConns，为nil时不限制
+	slots chan struct{}
+	// 最近一次归还连接的时间(UnixNano)，所有连接共用，为0时还没有归还过连接
+	returned int64
+}
+
+func newGoRedisGen(c *Config, st *sentinel) *goRedisGen {
+	g := &goRedisGen{client: goredis.NewClient(genGoRedisOptions(c, genAddrFunc(c, st, false)))}
+	if c.MaxActiveConns > 0 {
+		g.slots = make(chan struct{}, c.MaxActiveConns)
+	}
+	if st != nil && c.ReplicaReads {
+		g.replica = goredis.NewClient(genGoRedisOptions(c, genAddrFunc(c, st, true)))
+	}
+	return g
+}
+
+func (g *goRedisGen) close() error {
+	if g.replica != nil {
+		g.replica.Close()
+	}
+	return g.client.Close()
+}
+
+func (g *goRedisGen) acquire() {
+	g.mu.Lock()
+	g.borrowed++
+	g.mu.Unlock()
+}
+
+func (g *goRedisGen) release() error {
+	g.mu.Lock()
+	g.borrowed--
+	closeNow := g.retired && g.borrowed == 0
+	g.mu.Unlock()
+	if closeNow {
+		return g.close()
+	}
+	return nil
+}
+
+// 等待借出连接的名额，pool用尽时与redigo一样一直等待，直到ctx结束
+func (g *goRedisGen) take(ctx context.Context) error {
+	if g.slots == nil {
+		return nil
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *goRedisGen) put() {
+	atomic.StoreInt64(&g.returned, time.Now().UnixNano())
+	if g.slots != nil {
+		<-g.slots
+	}
+}
+
+/*
+ * go-redis不暴露借出的是哪个连接，只能按最近一次归还的时间近似判断：
+ * 距最近一次归还超过span或还没有归还过连接时PING。有多个空闲连接时，取到的连接可能空闲更久却不PING，
+ * 不等同于redigo按连接检查的TestOnBorrow；go-redis取连接时会自行丢弃超过idleTimeout或已断开的连接
+ */
+func (g *goRedisGen) needPing(span time.Duration) bool {
+	if span <= 0 {
+		return false
+	}
+	returned := atomic.LoadInt64(&g.returned)
+	return returned == 0 || time.Since(time.Unix(0, returned)) >= span
+}
+
+func (g *goRedisGen) retire() error {
+	g.mu.Lock()
+	if g.retired {
+		g.mu.Unlock()
+		return nil
+	}
+	g.retired = true
+	closeNow := g.borrowed == 0
+	g.mu.Unlock()
+	if closeNow {
+		return g.close()
+	}
+	return nil
+}
+
+type goRedisPool struct {
+	mu     sync.RWMutex
+	conf   Config
+	st     *sentinel
+	gen    *goRedisGen
+	closed bool
+}
+
+// 用当前配置创建新的client并替换，旧client在借出的连接都归还后关闭，调用时需持有写锁
+func (p *goRedisPool) rebuild() *goRedisGen {
+	old := p.gen
+	p.gen = newGoRedisGen(&p.conf, p.st)
+	return old
+}
+
+// 连接出错时在后台重新查询master，master切换后重建client，之后借出的连接都连接到新的master
+func (p *goRedisPool) failover(err error) {
+	if p.st == nil || !isFailoverError(err) {
+		return
+	}
+	p.st.refreshAsync(p.switchMaster)
+}
+
+func (p *goRedisPool) switchMaster() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	old := p.rebuild()
+	p.mu.Unlock()
+	old.retire()
+}
+
+// 返回当前的client并增加借出计数，用完后必须调用release
+func (p *goRedisPool) acquire() (*goRedisGen, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return nil, goredis.ErrClosed
+	}
+	p.gen.acquire()
+	return p.gen, nil
+}
+
+/*
+ * go-redis的Conn在第一次执行命令时才从pool取连接，借出的连接数由slots限制，pool用尽时的等待与redigo一致
+ * 按pingOnBorrow检查空闲的连接，不需要检查时不发送PING，第一次执行命令时才建立连接
+ */
+func (p *goRedisPool) Borrow() (Connection, error) {
+	return p.BorrowWithContext(context.Background())
+}
+
+func (p *goRedisPool) BorrowWithContext(ctx context.Context) (Connection, error) {
+	gen, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	if err := gen.take(ctx); err != nil {
+		gen.release()
+		return nil, err
+	}
+	conn := gen.client.Conn()
+	if gen.needPing(p.conf.PingOnBorrow) {
+		if err := conn.Ping(ctx).Err(); err != nil {
+			conn.Close()
+			gen.put()
+			gen.release()
+			err = convertGoRedisError(err)
+			p.failover(err)
+			return nil, err
+		}
+	}
+	return &goRedisConn{pool: p, gen: gen, conn: conn}, nil
+}
+
+func (p *goRedisPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return p.gen.retire()
+}
+
+func (p *goRedisPool) Stat() *PoolStat {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ps := p.gen.client.PoolStats()
+	return &PoolStat{
+		ActiveCount: int(ps.TotalConns),
+		IdleCount:   int(ps.IdleConns),
+	}
+}
+
+func (p *goRedisPool) SetLimits(maxActive, maxIdle int) error {
+	if maxActive < 0 || maxIdle < 0 {
+		return fmt.Errorf("wrong redis pool limits: maxActive [%d] maxIdle [%d]", maxActive, maxIdle)
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return goredis.ErrClosed
+	}
+	p.conf.MaxActiveConns = maxActive
+	p.conf.MaxIdleConns = maxIdle
+	old := p.rebuild()
+	p.mu.Unlock()
+	return old.retire()
+}
+
+func (p *goRedisPool) Tx(ctx context.Context) (Tx, error) {
+	return newTx(ctx, p)
+}
+
+func (p *goRedisPool) Pipeline() Pipeline {
+	return &goRedisPipeline{pool: p}
+}
+
+func (p *goRedisPool) Script(keyCnt int, src string) Script {
+	h := sha1.New()
+	h.Write([]byte(src))
+	return &goRedisScript{
+		pool:     p,
+		keyCount: keyCnt,
+		src:      src,
+		hash:     hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+/* *********************************
+ * ****** interface Connection *****
+ * *********************************/
+
+type goRedisConn struct {
+	pool *goRedisPool
+	gen  *goRedisGen
+	conn *goredis.Conn
+	// 第一次执行只读命令时从replica的client借出
+	replica *goredis.Conn
+	tx      txState
+	once    sync.Once
+	// 连接出错(非服务端错误)后记录，与redigo的Err一致
+	err error
+	// 命令被ctx取消后不为nil，命令在后台结束后关闭
+	canceled chan struct{}
+}
+
+// 有被取消的命令时，等待命令结束后再归还连接
+func (c *goRedisConn) Close() error {
+	if c.canceled != nil {
+		go func(pending chan struct{}) {
+			<-pending
+			c.close()
+		}(c.canceled)
+		return nil
+	}
+	return c.close()
+}
+
+func (c *goRedisConn) close() error {
+	err := error(nil)
+	c.once.Do(func() {
+		if c.replica != nil {
+			c.replica.Close()
+		}
+		err = c.conn.Close()
+		c.gen.put()
+		if rerr := c.gen.release(); err == nil {
+			err = rerr
+		}
+	})
+	return err
+}
+
+func (c *goRedisConn) Error() error {
+	return c.err
+}
+
+func (c *goRedisConn) Do(command string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), command, args...)
+}
+
+// go-redis开启了ContextTimeoutEnabled，ctx的deadline和ReadTimeout中较早的作为读超时
+func (c *goRedisConn) DoContext(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	if c.canceled != nil {
+		return nil, ErrConnCanceled
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.gen.replica != nil && !c.tx.inTx() && isReadOnlyCommand(command) {
+		if c.replica == nil {
+			c.replica = c.gen.replica.Conn()
+		}
+		v, err := c.doContext(ctx, c.replica, command, args)
+		if c.canceled != nil {
+			return nil, err
+		}
+		return convertGoRedisReply(command, args, v, err)
+	}
+	v, err := c.doContext(ctx, c.conn, command, args)
+	if c.canceled != nil {
+		return nil, err
+	}
+	if err == nil && c.tx.queued != nil && strings.EqualFold(command, "EXEC") {
+		v = convertGoRedisExecReply(c.tx.queued, v)
+	} else {
+		v, err = convertGoRedisReply(command, args, v, err)
+	}
+	c.tx.track(command, args, err)
+	if _, ok := err.(Error); err != nil && !ok {
+		c.err = err
+	}
+	if ctx.Err() == nil {
+		c.pool.failover(err)
+	}
+	return v, err
+}
+
+func (c *goRedisConn) doContext(ctx context.Context, conn *goredis.Conn, command string, args []interface{}) (interface{}, error) {
+	v, pending, err := doContext(ctx, nil, func() (interface{}, error) {
+		return goRedisConnDo(ctx, conn, command, args)
+	})
+	if pending != nil {
+		c.canceled = pending
+		c.err = ErrConnCanceled
+	}
+	return v, err
+}
+
+// EXEC的结果按入队的命令分别转换
+func convertGoRedisExecReply(cmds []*cmd, v interface{}) interface{} {
+	results, ok := v.([]interface{})
+	if !ok || len(results) != len(cmds) {
+		return convertGoRedisValue(v)
+	}
+	for i, r := range results {
+		if re, ok := r.(goredis.Error); ok {
+			results[i] = Error(re.Error())
+			continue
+		}
+		results[i], _ = convertGoRedisReply(cmds[i].command, cmds[i].args, r, nil)
+	}
+	return results
+}
+
+/* *********************************
+ * ****** interface BlockedConn ****
+ * *********************************/
+
+type goRedisBlockedConn struct {
+	client *goredis.Client
+	conn   *goredis.Conn
+	// 命令被ctx取消后不为nil，连接已经关闭
+	canceled chan struct{}
+}
+
+/*
+ * 超时后go-redis会关闭底层连接，与redigo一致
+ */
+func (c *goRedisBlockedConn) DoWithTimeout(t time.Duration, command string, args ...interface{}) (interface{}, error) {
+	ctx := context.Background()
+	if t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+	v, err := goRedisConnDo(ctx, c.conn, command, args)
+	return convertGoRedisReply(command, args, v, err)
+}
+
+// ctx取消时关闭client中断阻塞的命令，client只有这一个连接
+func (c *goRedisBlockedConn) DoContext(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	if c.canceled != nil {
+		return nil, ErrConnCanceled
+	}
+	v, pending, err := doContext(ctx, func() { c.client.Close() }, func() (interface{}, error) {
+		return goRedisConnDo(ctx, c.conn, command, args)
+	})
+	if pending != nil {
+		c.canceled = pending
+		return nil, err
+	}
+	return convertGoRedisReply(command, args, v, err)
+}
+
+// 被取消的命令已经关闭了client，等待命令结束后关闭连接
+func (c *goRedisBlockedConn) Close() error {
+	if c.canceled != nil {
+		go func(pending chan struct{}) {
+			<-pending
+			c.conn.Close()
+		}(c.canceled)
+		return nil
+	}
+	c.conn.Close()
+	return c.client.Close()
+}
+
+/* *********************************
+ * ******* interface pipeline ******
+ * *********************************/
+
+type goRedisPipeline struct {
+	pool *goRedisPool
+	cmds []*cmd
+}
+
+func (p *goRedisPipeline) Send(command string, keyAndArg ...interface{}) {
+	p.cmds = append(p.cmds, &cmd{command: command, args: keyAndArg})
+}
+
+func (p *goRedisPipeline) Exec(ctx context.Context) (*Replies, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return &Replies{}, nil
+	}
+	gen, err := p.pool.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer gen.release()
+	pipe := gen.client.Pipeline()
+	grCmds := make([]*goredis.Cmd, 0, len(cmds))
+	for _, c := range cmds {
+		grCmds = append(grCmds, pipe.Do(ctx, goRedisArgs(c.command, c.args)...))
+	}
+	// 单个命令的服务端错误放在对应的reply中，连接错误时整体失败
+	if _, err := pipe.Exec(ctx); err != nil && err != goredis.Nil {
+		var re goredis.Error
+		if !errors.As(err, &re) {
+			err = convertGoRedisError(err)
+			p.pool.failover(err)
+			return nil, err
+		}
+	}
+	rps := make([]*reply, 0, len(cmds))
+	connErr := error(nil)
+	for i, c := range cmds {
+		v, err := convertGoRedisReply(c.command, c.args, grCmds[i].Val(), grCmds[i].Err())
+		if connErr == nil && isFailoverError(err) {
+			connErr = err
+		}
+		rps = append(rps, &reply{cmd: c, reply: v, err: err})
+	}
+	p.pool.failover(connErr)
+	return &Replies{replies: rps}, nil
+}
+
+/* *********************************
+ * ******* interface script ********
+ * *********************************/
+
+/*
+ * 与redigo.Script一致：先EVALSHA，脚本不存在时再EVAL；keyCount小于0时由调用方在参数中给出key的数量
+ */
+type goRedisScript struct {
+	pool     *goRedisPool
+	keyCount int
+	src      string
+	hash     string
+}
+
+func (s *goRedisScript) args(command, spec string, keysAndArgs []interface{}) []interface{} {
+	args := make([]interface{}, 0, len(keysAndArgs)+3)
+	args = append(args, command, spec)
+	if s.keyCount >= 0 {
+		args = append(args, s.keyCount)
+	}
+	return append(args, keysAndArgs...)
+}
+
+func (s *goRedisScript) Do(ctx context.Context, keysAndArgs ...interface{}) (interface{}, error) {
+	gen, err := s.pool.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer gen.release()
+	v, err := gen.client.Do(ctx, s.args("EVALSHA", s.hash, keysAndArgs)...).Result()
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+		v, err = gen.client.Do(ctx, s.args("EVAL", s.src, keysAndArgs)...).Result()
+	}
+	v, err = convertGoRedisReply("EVAL", nil, v, err)
+	s.pool.failover(err)
+	return v, err
+}
+
+func (s *goRedisScript) Hash() string {
+	return s.hash
+}
+
+func (s *goRedisScript) Load(ctx context.Context) error {
+	gen, err := s.pool.acquire()
+	if err != nil {
+		return err
+	}
+	defer gen.release()
+	if err := gen.client.Do(ctx, "SCRIPT", "LOAD", s.src).Err(); err != nil {
+		return convertGoRedisError(err)
+	}
+	return nil
+}
+
+/* *********************************
+ * ******* interface pubsub ********
+ * *********************************/
+
+// Receive返回SubMsg、PsubMsg、Subscription、Pong或error，与redigo的包装一致
+type goRedisPubSub struct {
+	client *goredis.Client
+	ps     *goredis.PubSub
+	r      ctxReceiver
+}
+
+func (c *goRedisPubSub) Close() error {
+	c.ps.Close()
+	return c.client.Close()
+}
+
+func (c *goRedisPubSub) Subscribe(channels ...interface{}) error {
+	return c.ps.Subscribe(context.Background(), goRedisChannels(channels)...)
+}
+
+func (c *goRedisPubSub) Unsubscribe(channels ...interface{}) error {
+	return c.ps.Unsubscribe(context.Background(), goRedisChannels(channels)...)
+}
+
+func (c *goRedisPubSub) PSubscribe(channels ...interface{}) error {
+	return c.ps.PSubscribe(context.Background(), goRedisChannels(channels)...)
+}
+
+func (c *goRedisPubSub) PUnsubscribe(channels ...interface{}) error {
+	return c.ps.PUnsubscribe(context.Background(), goRedisChannels(channels)...)
+}
+
+func (c *goRedisPubSub) Receive() interface{} {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *goRedisPubSub) ReceiveWithTimeout(timeout time.Duration) interface{} {
+	return c.r.receiveWithTimeout(timeout, func(t time.Duration) interface{} {
+		return convertGoRedisPubSubReply(c.ps.ReceiveTimeout(context.Background(), t))
+	})
+}
+
+func (c *goRedisPubSub) ReceiveContext(ctx context.Context) interface{} {
+	return c.r.receive(ctx, func() interface{} {
+		return convertGoRedisPubSubReply(c.ps.Receive(context.Background()))
+	})
+}
+
+func (c *goRedisPubSub) Ping(data string) error {
+	if data == "" {
+		return c.ps.Ping(context.Background())
+	}
+	return c.ps.Ping(context.Background(), data)
+}
+
+func goRedisChannels(channels []interface{}) []string {
+	strs := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		switch ch := ch.(type) {
+		case string:
+			strs = append(strs, ch)
+		case []byte:
+			strs = append(strs, string(ch))
+		default:
+			strs = append(strs, fmt.Sprint(ch))
+		}
+	}
+	return strs
+}
+
+func convertGoRedisPubSubReply(rp interface{}, err error) interface{} {
+	if err != nil {
+		return convertGoRedisError(err)
+	}
+	switch rp := rp.(type) {
+	case *goredis.Message:
+		if rp.Pattern != "" {
+			return PsubMsg{Pattern: rp.Pattern, Channel: rp.Channel, Data: []byte(rp.Payload)}
+		}
+		return SubMsg{Channel: rp.Channel, Data: []byte(rp.Payload)}
+	case *goredis.Subscription:
+		return Subscription{Kind: rp.Kind, Channel: rp.Channel, Count: rp.Count}
+	case *goredis.Pong:
+		return Pong{Data: rp.Payload}
+	default:
+		return rp
+	}
+}
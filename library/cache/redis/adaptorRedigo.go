@@ -2,8 +2,9 @@ package redis
 
 import (
 	"context"
+	"fmt"
 	redigo "github.com/gomodule/redigo/redis"
-	"strconv"
+	"sync"
 	"time"
 )
 
@@ -23,10 +24,13 @@ func genTestOnBorrowFunc(span time.Duration) borrowFunc {
 	}
 }
 
-// 生成Dial函数
-func genDialFunc(c *Config) dialFunc {
+// 生成Dial函数，每次建立连接时通过addr获取地址，使用sentinel时为当前master或replica的地址
+func genDialFunc(c *Config, addr func() (string, error)) dialFunc {
 	return func() (conn redigo.Conn, err error) {
-		address := c.Host + ":" + strconv.Itoa(c.Port)
+		address, err := addr()
+		if err != nil {
+			return nil, err
+		}
 		dialOptions := ([]redigo.DialOption)(nil)
 		dialOptions = append(dialOptions, redigo.DialConnectTimeout(c.Timeout))
 		dialOptions = append(dialOptions, redigo.DialReadTimeout(c.ReadTimeout))
@@ -39,7 +43,25 @@ func genDialFunc(c *Config) dialFunc {
 	}
 }
 
-func newRedigoPool(c *Config) *redigoPool {
+func newRedigoPool(c *Config, st *sentinel) *redigoPool {
+	p := &redigoPool{
+		conf: *c,
+		st:   st,
+	}
+	p.rp, p.replicas = p.build()
+	return p
+}
+
+// 创建master的pool，开启ReplicaReads时同时创建replica的pool
+func (p *redigoPool) build() (*redigo.Pool, *redigo.Pool) {
+	rp := buildRedigoPool(&p.conf, genDialFunc(&p.conf, genAddrFunc(&p.conf, p.st, false)))
+	if p.st == nil || !p.conf.ReplicaReads {
+		return rp, nil
+	}
+	return rp, buildRedigoPool(&p.conf, genDialFunc(&p.conf, genAddrFunc(&p.conf, p.st, true)))
+}
+
+func buildRedigoPool(c *Config, dial dialFunc) *redigo.Pool {
 	// idle不能超过active
 	if c.MaxIdleConns > c.MaxActiveConns {
 		c.MaxIdleConns = c.MaxActiveConns
@@ -53,21 +75,21 @@ func newRedigoPool(c *Config) *redigoPool {
 	if c.PingOnBorrow != 0 {
 		pool.TestOnBorrow = genTestOnBorrowFunc(c.PingOnBorrow)
 	}
-	pool.Dial = genDialFunc(c)
-	return &redigoPool{rp:pool}
+	pool.Dial = dial
+	return pool
 }
 
-func newRedigoPubSubConn(c *Config) (*redigo.PubSubConn, error) {
-	dial := genDialFunc(c)
+func newRedigoPubSubConn(c *Config, st *sentinel) (*redigoPubSub, error) {
+	dial := genDialFunc(c, genAddrFunc(c, st, false))
 	conn, err := dial()
 	if err != nil {
 		return nil, err
 	}
-	return &redigo.PubSubConn{Conn:conn}, nil
+	return &redigoPubSub{PubSubConn: redigo.PubSubConn{Conn:conn}}, nil
 }
 
-func newRedigoBlockedConn(c *Config) (*redigoConn, error) {
-	dial := genDialFunc(c)
+func newRedigoBlockedConn(c *Config, st *sentinel) (*redigoConn, error) {
+	dial := genDialFunc(c, genAddrFunc(c, st, false))
 	conn, err := dial()
 	if err != nil {
 		return nil, err
@@ -82,51 +104,122 @@ func newRedigoBlockedConn(c *Config) (*redigoConn, error) {
  * *********************************/
 
 type redigoPool struct {
-	rp *redigo.Pool
+	mu   sync.RWMutex
+	conf Config
+	rp   *redigo.Pool
+	// 开启ReplicaReads时只读命令使用的pool
+	replicas *redigo.Pool
+	st       *sentinel
+	closed   bool
+}
+
+func (p *redigoPool) current() *redigo.Pool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rp
+}
+
+func (p *redigoPool) currentReplicas() *redigo.Pool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.replicas
+}
+
+// 用当前配置重建pool并替换，旧pool被关闭，已借出的连接归还时直接关闭
+func (p *redigoPool) rebuild() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	old, oldReplicas := p.rp, p.replicas
+	p.rp, p.replicas = p.build()
+	p.mu.Unlock()
+	if oldReplicas != nil {
+		oldReplicas.Close()
+	}
+	return old.Close()
+}
+
+// 连接出错时在后台重新查询master，master切换后重建pool，之后借出的连接都连接到新的master
+func (p *redigoPool) failover(err error) {
+	if p.st != nil && isFailoverError(err) {
+		p.st.refreshAsync(func() {
+			p.rebuild()
+		})
+	}
 }
 
 /*
  * 如果pool用尽，该函数会直接返回一个错误
  */
 func (p *redigoPool) Borrow() (Connection, error) {
-	rc := p.rp.Get()
+	rc := p.current().Get()
 	if rc.Err() != nil {
+		p.failover(rc.Err())
 		return nil, rc.Err()
 	}
-	return &redigoConn{rc}, nil
+	return &redigoConn{rc: rc, pool: p}, nil
 }
 
 func (p *redigoPool) BorrowWithContext(ctx context.Context) (Connection, error) {
-	rc, err := p.rp.GetContext(ctx)
+	rc, err := p.current().GetContext(ctx)
 	if err != nil {
+		p.failover(err)
 		return nil, err
 	}
 	conn := &redigoConn{
-		rc,
+		rc:   rc,
+		pool: p,
 	}
 	return conn, nil
 }
 
 func (p *redigoPool) Close() error {
-	return p.rp.Close()
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	if replicas := p.currentReplicas(); replicas != nil {
+		replicas.Close()
+	}
+	return p.current().Close()
 }
 
 func (p *redigoPool) Stat() *PoolStat {
-	ps := p.rp.Stats()
+	ps := p.current().Stats()
 	return &PoolStat{
 		ActiveCount: ps.ActiveCount,
 		IdleCount:   ps.IdleCount,
 	}
 }
 
+/*
+ * redigo在第一次使用时按MaxActive创建等待队列，之后修改MaxActive不会生效，
+ * 所以用新的limit重建pool并替换。旧pool被关闭，已借出的连接归还时直接关闭
+ */
+func (p *redigoPool) SetLimits(maxActive, maxIdle int) error {
+	if maxActive < 0 || maxIdle < 0 {
+		return fmt.Errorf("wrong redis pool limits: maxActive [%d] maxIdle [%d]", maxActive, maxIdle)
+	}
+	p.mu.Lock()
+	p.conf.MaxActiveConns = maxActive
+	p.conf.MaxIdleConns = maxIdle
+	p.mu.Unlock()
+	return p.rebuild()
+}
+
+func (p *redigoPool) Tx(ctx context.Context) (Tx, error) {
+	return newTx(ctx, p)
+}
+
 func (p *redigoPool) Pipeline() Pipeline {
-	return &redigoPipeline{pool:p.rp}
+	return &redigoPipeline{pool: p}
 }
 
 func (p *redigoPool) Script(keyCnt int, src string) Script {
 	rs := redigo.NewScript(keyCnt, src)
 	return &redigoScript{
-		p.rp,
+		p,
 		rs,
 	}
 }
@@ -137,25 +230,118 @@ func (p *redigoPool) Script(keyCnt int, src string) Script {
 
 type redigoConn struct {
 	rc redigo.Conn
+	// BlockedConn没有pool
+	pool *redigoPool
+	// 第一次执行只读命令时从replica的pool借出
+	replica redigo.Conn
+	tx      txState
+	// 命令被ctx取消后不为nil，命令在后台结束后关闭
+	canceled chan struct{}
 }
 
+// 有被取消的命令时，等待命令结束后再归还连接
 func (c *redigoConn) Close() error {
+	if c.canceled != nil {
+		go func(pending chan struct{}) {
+			<-pending
+			c.close()
+		}(c.canceled)
+		return nil
+	}
+	return c.close()
+}
+
+func (c *redigoConn) close() error {
+	if c.replica != nil {
+		c.replica.Close()
+	}
 	return c.rc.Close()
 }
 
 func (c *redigoConn) Error() error {
+	if c.canceled != nil {
+		return ErrConnCanceled
+	}
 	return c.rc.Err()
 }
 
 func (c *redigoConn) Do(command string, args ...interface{}) (interface{}, error) {
-	return c.rc.Do(command, args...)
+	return c.DoContext(context.Background(), command, args...)
+}
+
+func (c *redigoConn) DoContext(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	if c.canceled != nil {
+		return nil, ErrConnCanceled
+	}
+	if c.pool == nil {
+		return c.doContext(ctx, func() { c.rc.Close() }, func() (interface{}, error) {
+			if ctx.Done() == nil {
+				return c.rc.Do(command, args...)
+			}
+			// BlockedConn没有deadline时不限制读超时，ctx取消时关闭连接
+			t, _ := contextTimeout(ctx, 0)
+			return redigo.DoWithTimeout(c.rc, t, command, args...)
+		})
+	}
+	rc := c.rc
+	if !c.tx.inTx() && isReadOnlyCommand(command) {
+		if replicas := c.pool.currentReplicas(); replicas != nil {
+			if c.replica == nil {
+				c.replica = replicas.Get()
+			}
+			rc = c.replica
+		}
+	}
+	v, err := c.doContext(ctx, nil, func() (interface{}, error) {
+		if t, ok := contextTimeout(ctx, c.pool.conf.ReadTimeout); ok {
+			return redigo.DoWithTimeout(rc, t, command, args...)
+		}
+		return rc.Do(command, args...)
+	})
+	if rc == c.replica || ctx.Err() != nil {
+		return v, err
+	}
+	c.tx.track(command, args, err)
+	c.pool.failover(err)
+	return v, err
+}
+
+func (c *redigoConn) doContext(ctx context.Context, abort func(), do func() (interface{}, error)) (interface{}, error) {
+	v, pending, err := doContext(ctx, abort, do)
+	if pending != nil {
+		c.canceled = pending
+		return nil, err
+	}
+	return convertRedigoReply(v, err)
 }
 
 /*
  * redigo的conn当timeout之后，会将底层连接关闭
  */
 func (c *redigoConn) DoWithTimeout(t time.Duration, cmd string, args ...interface{}) (interface{}, error) {
-	return redigo.DoWithTimeout(c.rc, t, cmd, args...)
+	return convertRedigoReply(redigo.DoWithTimeout(c.rc, t, cmd, args...))
+}
+
+// 服务端错误转换为Error，与go-redis driver一致，调用方不依赖redigo的类型
+func convertRedigoReply(v interface{}, err error) (interface{}, error) {
+	if re, ok := err.(redigo.Error); ok {
+		return nil, Error(re)
+	}
+	return convertRedigoValue(v), err
+}
+
+func convertRedigoValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case redigo.Error:
+		return Error(v)
+	case []interface{}:
+		for i, e := range v {
+			v[i] = convertRedigoValue(e)
+		}
+		return v
+	default:
+		return v
+	}
 }
 
 /* *********************************
@@ -163,7 +349,7 @@ func (c *redigoConn) DoWithTimeout(t time.Duration, cmd string, args ...interfac
  * *********************************/
 
 type redigoPipeline struct {
-	pool *redigo.Pool
+	pool *redigoPool
 	cmds []*cmd
 }
 
@@ -172,33 +358,34 @@ func (p *redigoPipeline) Send(command string, keyAndArg ...interface{})  {
 }
 
 func (p *redigoPipeline) Exec(ctx context.Context) (*Replies, error) {
-	n := len(p.cmds)
-	if n == 0 {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
 		return &Replies{}, nil
 	}
-	c, err := p.pool.GetContext(ctx)
+	c, err := p.pool.current().GetContext(ctx)
 	defer c.Close()
 	if err != nil {
-		p.cmds = p.cmds[:0]
 		return nil, err
 	}
-	for len(p.cmds) > 0 {
-		cmd := p.cmds[0]
-		p.cmds = p.cmds[1:]
+	for _, cmd := range cmds {
 		if err := c.Send(cmd.command, cmd.args...); err != nil {
-			p.cmds = p.cmds[:0]
 			return nil, err
 		}
 	}
 	if err = c.Flush(); err != nil {
-		p.cmds = p.cmds[:0]
 		return nil, err
 	}
-	rps := make([]*reply, 0, n)
-	for i := 0; i < n; i++ {
-		rp, err := c.Receive()
-		rps = append(rps, &reply{reply: rp, err: err})
+	rps := make([]*reply, 0, len(cmds))
+	connErr := error(nil)
+	for _, cmd := range cmds {
+		rp, err := convertRedigoReply(c.Receive())
+		if connErr == nil && isFailoverError(err) {
+			connErr = err
+		}
+		rps = append(rps, &reply{cmd: cmd, reply: rp, err: err})
 	}
+	p.pool.failover(connErr)
 	rs := &Replies{
 		replies: rps,
 	}
@@ -210,20 +397,19 @@ func (p *redigoPipeline) Exec(ctx context.Context) (*Replies, error) {
  * *********************************/
 
 type redigoScript struct {
-	pool *redigo.Pool
+	pool *redigoPool
 	script *redigo.Script
 }
 
 func (s *redigoScript) Do(ctx context.Context, keysAndArgs ...interface{}) (interface{}, error) {
-	c, err := s.pool.GetContext(ctx)
+	c, err := s.pool.current().GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-	v, err := s.script.Do(c, keysAndArgs...)
-	if err != nil {
-		return nil, err
-	}
-	return v, nil
+	defer c.Close()
+	v, err := convertRedigoReply(s.script.Do(c, keysAndArgs...))
+	s.pool.failover(err)
+	return v, err
 }
 
 func (s *redigoScript) Hash() string {
@@ -231,10 +417,11 @@ func (s *redigoScript) Hash() string {
 }
 
 func (s *redigoScript) Load(ctx context.Context) error {
-	c, err := s.pool.GetContext(ctx)
+	c, err := s.pool.current().GetContext(ctx)
 	if err != nil {
 		return err
 	}
+	defer c.Close()
 	err = s.script.Load(c)
 	if err != nil {
 		return err
@@ -245,6 +432,42 @@ func (s *redigoScript) Load(ctx context.Context) error {
  * ******* interface pubsub ********
  * *********************************/
 
-// 直接使用redigo.PubSubConn满足接口
+// 包装redigo.PubSubConn，Receive返回SubMsg、PsubMsg、Subscription、Pong或error，调用方不依赖redigo的类型
+type redigoPubSub struct {
+	redigo.PubSubConn
+	r ctxReceiver
+}
+
+func (c *redigoPubSub) Receive() interface{} {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *redigoPubSub) ReceiveWithTimeout(timeout time.Duration) interface{} {
+	return c.r.receiveWithTimeout(timeout, func(t time.Duration) interface{} {
+		return convertRedigoPubSubReply(c.PubSubConn.ReceiveWithTimeout(t))
+	})
+}
+
+func (c *redigoPubSub) ReceiveContext(ctx context.Context) interface{} {
+	return c.r.receive(ctx, func() interface{} {
+		return convertRedigoPubSubReply(c.PubSubConn.Receive())
+	})
+}
+
+func convertRedigoPubSubReply(rp interface{}) interface{} {
+	switch rp := rp.(type) {
+	case redigo.Message:
+		if rp.Pattern != "" {
+			return PsubMsg{Pattern: rp.Pattern, Channel: rp.Channel, Data: rp.Data}
+		}
+		return SubMsg{Channel: rp.Channel, Data: rp.Data}
+	case redigo.Subscription:
+		return Subscription{Kind: rp.Kind, Channel: rp.Channel, Count: rp.Count}
+	case redigo.Pong:
+		return Pong{Data: rp.Data}
+	default:
+		return rp
+	}
+}
 
 
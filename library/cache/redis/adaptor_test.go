@@ -0,0 +1,705 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/cache/redis"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 每个driver运行同一组测试，保证不同driver的行为一致
+type testAdaptorSuite struct {
+	suite.Suite
+	driver string
+	c *redis.Config
+	mr *miniredis.Miniredis
+}
+
+func (s *testAdaptorSuite) SetupSuite()  {
+	mr, err := miniredis.Run()
+	s.Require().NoError(err)
+	s.mr = mr
+	s.c = redis.NewConfig()
+	s.c.Driver = s.driver
+	parts := strings.Split(mr.Addr(), ":")
+	s.c.Host = parts[0]
+	s.c.Port, _ = strconv.Atoi(parts[1])
+	s.c.MaxActiveConns = 3
+	s.c.MaxIdleConns = 2
+}
+
+func (s *testAdaptorSuite) TearDownSuite() {
+	s.mr.Close()
+}
+
+/*
+ * 1. 测试Pool的borrow方法
+ */
+func (s *testAdaptorSuite) TestPoolBorrow()  {
+	assrt := assert.New(s.T())
+	r := redis.New(s.c)
+	p := r.Pool()
+	stat := p.Stat()
+	assrt.Equal(0, stat.ActiveCount)
+	assrt.Equal(0, stat.IdleCount)
+	conn1, _ := p.Borrow()
+	stat = p.Stat()
+	assrt.Equal(1, stat.ActiveCount)
+	assrt.Equal(0, stat.IdleCount)
+	conn2, _ := p.Borrow()
+	stat = p.Stat()
+	assrt.Equal(2, stat.ActiveCount)
+	assrt.Equal(0, stat.IdleCount)
+	conn3, _ := p.Borrow()
+	stat = p.Stat()
+	assrt.Equal(3, stat.ActiveCount)
+	assrt.Equal(0, stat.IdleCount)
+	conn1.Close()
+	stat = p.Stat()
+	assrt.Equal(3, stat.ActiveCount)
+	assrt.Equal(1, stat.IdleCount)
+	conn2.Close()
+	stat = p.Stat()
+	assrt.Equal(3, stat.ActiveCount)
+	assrt.Equal(2, stat.IdleCount)
+	conn3.Close()
+	stat = p.Stat()
+	assrt.Equal(2, stat.ActiveCount)
+	assrt.Equal(2, stat.IdleCount)
+	// 测试关闭
+	p.Close()
+	stat = p.Stat()
+	assrt.Equal(0, stat.ActiveCount)
+	assrt.Equal(0, stat.IdleCount)
+}
+
+/*
+ * 2. 测试pool用尽
+ */
+func (s *testAdaptorSuite) TestPoolExhaustedBorrow()  {
+	assrt := assert.New(s.T())
+	r := redis.New(s.c)
+	p := r.Pool()
+	ch := make(chan int)
+	p.Borrow()
+	p.Borrow()
+	p.Borrow()
+	go func() {
+		p.Borrow()
+		ch<-1
+	}()
+	select {
+	case <-ch:
+		assrt.Fail("Borrowed a connection when pool exhausted")
+	case <-time.After(500 * time.Millisecond):
+		assrt.Equal(1, 1)
+	}
+	p.Close()
+}
+
+/*
+ * 3. 测试BorrowWithContext
+ */
+func (s *testAdaptorSuite) TestPoolExhaustedBorrowWithContext()  {
+	assrt := assert.New(s.T())
+	r := redis.New(s.c)
+	p := r.Pool()
+	ch := make(chan int)
+	ctx := context.Background()
+	p.BorrowWithContext(ctx)
+	p.BorrowWithContext(ctx)
+	p.BorrowWithContext(ctx)
+	go func() {
+		p.BorrowWithContext(ctx)
+		ch<-1
+	}()
+	select {
+	case <-ch:
+		assrt.Fail("Borrowed a connection with context when pool exhausted")
+	case <-time.After(500 * time.Millisecond):
+		assrt.Equal(1, 1)
+	}
+	p.Close()
+}
+
+/*
+ * 4. 测试pool用尽之后，BorrowWithContext被取消的场景
+ */
+func (s *testAdaptorSuite) TestPoolCancelBorrowWithContext() {
+	assrt := assert.New(s.T())
+	r := redis.New(s.c)
+	p := r.Pool()
+	bctx := context.Background()
+	ctx, cancel := context.WithTimeout(bctx, 100 * time.Millisecond)
+	defer cancel()
+	p.BorrowWithContext(bctx)
+	p.BorrowWithContext(bctx)
+	p.BorrowWithContext(bctx)
+	conn, err := p.BorrowWithContext(ctx)
+	assrt.Nil(conn)
+	assrt.Error(err)
+	p.Close()
+}
+
+/*
+ * 5. 测试conn的Do接口
+ */
+func (s *testAdaptorSuite) TestConnectionDo() {
+	assrt := assert.New(s.T())
+	r := redis.New(s.c)
+	p := r.Pool()
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	conn, _ := p.BorrowWithContext(ctx)
+	// SET & GET
+	reply, err := conn.Do("SET", "foo", "a")
+	assrt.Equal(nil, err)
+	assrt.Equal("OK", reply)
+	reply, err = conn.Do("GET", "foo")
+	assrt.Equal(nil, err)
+	assrt.NotEqual("a", reply)
+	reply, err = redis.String(reply, err)
+	assrt.Equal(nil, err)
+	assrt.Equal("a", reply)
+	// TTL
+	reply, err = conn.Do("Del", "foo")
+	assrt.Equal(nil, err)
+	assrt.Equal(int64(1), reply)
+	reply, err = conn.Do("SET", "foo", "a", "ex", 100)
+	assrt.Equal(nil, err)
+	assrt.Equal("OK", reply)
+	reply, err = conn.Do("TTL", "foo")
+	assrt.Equal(nil, err)
+	assrt.Equal(int64(100), reply)
+	// HASH
+	reply, err = conn.Do("Del", "myhash")
+	reply, err = conn.Do("HSET", "myhash", "mykey", "myvalue")
+	assrt.Equal(nil, err)
+	assrt.Equal(int64(1), reply)
+	reply, err = conn.Do("HGET", "myhash", "mykey")
+	assrt.Equal(nil, err)
+	assrt.NotEqual("myvalue", reply)
+	reply, err = redis.String(reply, err)
+	assrt.Equal(nil, err)
+	assrt.Equal("myvalue", reply)
+
+	reply, err = conn.Do("Del", "foo")
+	reply, err = conn.Do("Del", "myhash")
+	p.Close()
+}
+
+/*
+ * 6. 测试conn的DoWithTimeout接口
+ */
+func (s *testAdaptorSuite) TestConnectionDoWithTimeout() {
+	assrt := assert.New(s.T())
+	r := redis.New(s.c)
+	bc, err := r.BlockedConn()
+	assrt.NoError(err)
+	assrt.NotNil(bc)
+	//block timeout，miniredis不会清理超时断开的阻塞命令，使用不同的key
+	reply, err := bc.DoWithTimeout(100 * time.Millisecond, "BLpop", "test:listTimeout", 100)
+	assrt.Equal(nil, reply)
+	assrt.Error(err)
+	bc.Close()
+	//block and get data
+	go func() {
+		select {
+		case <- time.After(100 * time.Millisecond):
+			p := r.Pool()
+			c, _ := p.Borrow()
+			c.Do("Lpush", "test:list", "aaa")
+			p.Close()
+		}
+	}()
+	bc, err = r.BlockedConn()
+	assrt.NoError(err)
+	assrt.NotNil(bc)
+	reply, err = bc.DoWithTimeout(200 * time.Millisecond, "BLpop", "test:list", 200)
+	assrt.NoError(err)
+	replies, err := redis.Strings(reply, err)
+	assrt.NoError(err)
+	assrt.Equal("test:list", replies[0])
+	assrt.Equal("aaa", replies[1])
+	// 测试blockConn的close方法
+	err = bc.Close()
+	assrt.NoError(err)
+}
+
+/*
+ * 7. 测试运行时调整pool大小，借出的连接不受影响
+ */
+func (s *testAdaptorSuite) TestPoolSetLimits() {
+	assrt := assert.New(s.T())
+	r := redis.New(s.c)
+	p := r.Pool()
+	conn1, err := p.Borrow()
+	assrt.NoError(err)
+	assrt.Error(p.SetLimits(-1, 1))
+	assrt.NoError(p.SetLimits(1, 1))
+	// 旧pool借出的连接仍可使用
+	_, err = conn1.Do("SET", "test:limits", "1")
+	assrt.NoError(err)
+	conn1.Close()
+	conn2, err := p.Borrow()
+	assrt.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = p.BorrowWithContext(ctx)
+	assrt.Error(err)
+	conn2.Close()
+	p.Close()
+}
+
+/*
+ * 8. 测试pubsub返回的消息类型
+ */
+func (s *testAdaptorSuite) TestPubSubReceive() {
+	assrt := assert.New(s.T())
+	r := redis.New(s.c)
+	ps, err := r.PubSubConn()
+	assrt.NoError(err)
+	defer ps.Close()
+	assrt.NoError(ps.Subscribe("test:channel"))
+	assrt.Equal(redis.Subscription{Kind: "subscribe", Channel: "test:channel", Count: 1}, ps.Receive())
+	assrt.NoError(ps.PSubscribe("test:p*"))
+	assrt.Equal(redis.Subscription{Kind: "psubscribe", Channel: "test:p*", Count: 2}, ps.Receive())
+
+	conn, err := r.Pool().Borrow()
+	assrt.NoError(err)
+	conn.Do("PUBLISH", "test:channel", "a")
+	conn.Do("PUBLISH", "test:pattern", "b")
+	conn.Close()
+	// 频道和模式订阅的消息到达顺序不确定
+	assrt.ElementsMatch([]interface{}{
+		redis.SubMsg{Channel: "test:channel", Data: []byte("a")},
+		redis.PsubMsg{Pattern: "test:p*", Channel: "test:pattern", Data: []byte("b")},
+	}, []interface{}{ps.Receive(), ps.Receive()})
+	assrt.NoError(ps.Ping("hi"))
+	assrt.Equal(redis.Pong{Data: "hi"}, ps.Receive())
+	_, ok := ps.ReceiveWithTimeout(50 * time.Millisecond).(error)
+	assrt.True(ok)
+}
+
+/*
+ * 9. 测试返回值类型：status reply为string，bulk string为[]byte，nil reply为nil，服务端错误为redis.Error
+ */
+func (s *testAdaptorSuite) TestReplyTypes() {
+	assrt := assert.New(s.T())
+	p := redis.New(s.c).Pool()
+	defer p.Close()
+	conn, err := p.Borrow()
+	assrt.NoError(err)
+	defer conn.Close()
+	reply, err := conn.Do("SET", "test:types", "a")
+	assrt.NoError(err)
+	assrt.Equal("OK", reply)
+	reply, err = conn.Do("GET", "test:types")
+	assrt.NoError(err)
+	assrt.Equal([]byte("a"), reply)
+	// key或value为get时仍是status reply
+	reply, err = conn.Do("SET", "test:typesGet", "get")
+	assrt.NoError(err)
+	assrt.Equal("OK", reply)
+	reply, err = conn.Do("SET", "get", "a")
+	assrt.NoError(err)
+	assrt.Equal("OK", reply)
+	reply, err = conn.Do("GET", "test:notExists")
+	assrt.NoError(err)
+	assrt.Nil(reply)
+	reply, err = conn.Do("TYPE", "test:types")
+	assrt.NoError(err)
+	assrt.Equal("string", reply)
+	reply, err = conn.Do("PING", "hi")
+	assrt.NoError(err)
+	assrt.Equal([]byte("hi"), reply)
+	reply, err = conn.Do("RPUSH", "test:typesList", "a", "b")
+	assrt.NoError(err)
+	assrt.Equal(int64(2), reply)
+	reply, err = conn.Do("LRANGE", "test:typesList", 0, -1)
+	assrt.NoError(err)
+	assrt.Equal([]interface{}{[]byte("a"), []byte("b")}, reply)
+	// 服务端错误不影响连接
+	_, err = conn.Do("INCR", "test:types")
+	_, ok := err.(redis.Error)
+	assrt.True(ok)
+	assrt.NoError(conn.Error())
+	conn.Do("DEL", "test:types", "test:typesList", "test:typesGet", "get")
+}
+
+/*
+ * 10. 测试script，脚本未加载时自动EVAL
+ */
+func (s *testAdaptorSuite) TestScript() {
+	assrt := assert.New(s.T())
+	p := redis.New(s.c).Pool()
+	defer p.Close()
+	ctx := context.Background()
+	script := p.Script(1, "return redis.call('SET', KEYS[1], ARGV[1])")
+	// go-redis无法区分脚本返回的status reply和bulk string，统一用String转换
+	reply, err := redis.String(script.Do(ctx, "test:script", "a"))
+	assrt.NoError(err)
+	assrt.Equal("OK", reply)
+	assrt.NoError(script.Load(ctx))
+	// keyCount小于0时key的数量在参数中
+	script = p.Script(-1, "return redis.call('GET', KEYS[1])")
+	reply, err = redis.String(script.Do(ctx, 1, "test:script"))
+	assrt.NoError(err)
+	assrt.Equal("a", reply)
+	_, err = p.Script(0, "return redis.error_reply('oops')").Do(ctx)
+	_, ok := err.(redis.Error)
+	assrt.True(ok)
+}
+
+/*
+ * 11. 测试pipeline的结果访问和错误定位
+ */
+func (s *testAdaptorSuite) TestPipelineReplies() {
+	assrt := assert.New(s.T())
+	p := redis.New(s.c).Pool()
+	defer p.Close()
+	ctx := context.Background()
+	replies, err := p.Pipeline().Exec(ctx)
+	assrt.NoError(err)
+	assrt.Equal(0, replies.Len())
+	assrt.NoError(replies.FirstError())
+
+	pipe := p.Pipeline()
+	pipe.Send("SET", "test:pipe", "a")
+	pipe.Send("GET", "test:pipe")
+	pipe.Send("INCR", "test:pipe")
+	pipe.Send("HSET", "test:pipeHash", "f", 1)
+	pipe.Send("HGETALL", "test:pipeHash")
+	pipe.Send("GET", "test:pipeNotExists")
+	pipe.Send("DEL", "test:pipe", "test:pipeHash")
+	replies, err = pipe.Exec(ctx)
+	assrt.NoError(err)
+	assrt.Equal(7, replies.Len())
+	v, err := replies.At(0)
+	assrt.NoError(err)
+	assrt.Equal("OK", v)
+	str, err := replies.String(1)
+	assrt.NoError(err)
+	assrt.Equal("a", str)
+	_, err = replies.Int(2)
+	_, ok := err.(redis.Error)
+	assrt.True(ok)
+	m, err := replies.IntMap(4)
+	assrt.NoError(err)
+	assrt.Equal(map[string]int{"f": 1}, m)
+	_, err = replies.String(5)
+	assrt.Equal(redis.ErrNil, err)
+	n, err := replies.Int(6)
+	assrt.NoError(err)
+	assrt.Equal(2, n)
+	_, err = replies.At(7)
+	assrt.Error(err)
+
+	// 错误定位到命令
+	err = replies.FirstError()
+	cmdErr, ok := err.(*redis.CommandError)
+	assrt.True(ok)
+	assrt.Equal(2, cmdErr.Index)
+	assrt.Equal("INCR", cmdErr.Command)
+	assrt.Equal("test:pipe", cmdErr.Key)
+	assrt.True(errors.As(err, new(redis.Error)))
+	assrt.Len(replies.Errors(), 1)
+	count := 0
+	replies.Each(func(i int, reply interface{}, err error) bool {
+		count++
+		return i < 3
+	})
+	assrt.Equal(4, count)
+}
+
+/*
+ * 12. 测试MULTI/EXEC事务，WATCH的key被修改时返回ErrTxConflict
+ */
+func (s *testAdaptorSuite) TestTx() {
+	assrt := assert.New(s.T())
+	p := redis.New(s.c).Pool()
+	defer p.Close()
+	ctx := context.Background()
+	tx, err := p.Tx(ctx)
+	assrt.NoError(err)
+	assrt.NoError(tx.Watch("test:tx"))
+	_, err = tx.Do("GET", "test:tx")
+	assrt.NoError(err)
+	tx.Send("SET", "test:tx", "a")
+	tx.Send("GET", "test:tx")
+	tx.Send("INCR", "test:tx")
+	tx.Send("GET", "test:txNotExists")
+	replies, err := tx.Exec()
+	assrt.NoError(err)
+	assrt.Equal(4, replies.Len())
+	v, err := replies.At(0)
+	assrt.NoError(err)
+	assrt.Equal("OK", v)
+	v, err = replies.At(1)
+	assrt.NoError(err)
+	assrt.Equal([]byte("a"), v)
+	_, err = replies.At(2)
+	_, ok := err.(redis.Error)
+	assrt.True(ok)
+	v, err = replies.At(3)
+	assrt.NoError(err)
+	assrt.Nil(v)
+	assrt.Equal(2, replies.FirstError().(*redis.CommandError).Index)
+	_, err = tx.Exec()
+	assrt.Error(err)
+	assrt.NoError(tx.Close())
+
+	// 入队出错时不执行事务
+	tx, err = p.Tx(ctx)
+	assrt.NoError(err)
+	tx.Send("SET", "test:tx", "b")
+	tx.Send("SET", "test:tx")
+	_, err = tx.Exec()
+	cmdErr, ok := err.(*redis.CommandError)
+	assrt.True(ok)
+	assrt.Equal(1, cmdErr.Index)
+	tx.Close()
+
+	// 冲突
+	tx, err = p.Tx(ctx)
+	assrt.NoError(err)
+	assrt.NoError(tx.Watch("test:tx"))
+	s.mr.Set("test:tx", "c")
+	tx.Send("SET", "test:tx", "d")
+	_, err = tx.Exec()
+	assrt.Equal(redis.ErrTxConflict, err)
+	tx.Close()
+	v, _ = s.mr.Get("test:tx")
+	assrt.Equal("c", v)
+
+	// 没有执行EXEC时归还的连接不带WATCH
+	tx, err = p.Tx(ctx)
+	assrt.NoError(err)
+	assrt.NoError(tx.Watch("test:tx"))
+	tx.Close()
+	s.mr.Del("test:tx")
+}
+
+/*
+ * 13. 测试RunTx在冲突时重试
+ */
+func (s *testAdaptorSuite) TestRunTx() {
+	assrt := assert.New(s.T())
+	p := redis.New(s.c).Pool()
+	defer p.Close()
+	ctx := context.Background()
+	s.mr.Set("test:cas", "1")
+	attempts := 0
+	incr := func(tx redis.Tx) error {
+		attempts++
+		if err := tx.Watch("test:cas"); err != nil {
+			return err
+		}
+		n, err := redis.Int(tx.Do("GET", "test:cas"))
+		if err != nil {
+			return err
+		}
+		// 第一次执行时被其他客户端修改
+		if attempts == 1 {
+			s.mr.Set("test:cas", "10")
+		}
+		tx.Send("SET", "test:cas", n*2)
+		return nil
+	}
+	replies, err := redis.RunTx(ctx, p, 3, incr)
+	assrt.NoError(err)
+	assrt.Equal(1, replies.Len())
+	assrt.Equal(2, attempts)
+	v, _ := s.mr.Get("test:cas")
+	assrt.Equal("20", v)
+
+	attempts = 0
+	_, err = redis.RunTx(ctx, p, 0, incr)
+	assrt.True(errors.Is(err, redis.ErrTxConflict))
+	assrt.Equal(1, attempts)
+
+	stop := errors.New("stop")
+	_, err = redis.RunTx(ctx, p, 3, func(tx redis.Tx) error {
+		return stop
+	})
+	assrt.Equal(stop, err)
+	s.mr.Del("test:cas")
+}
+
+/*
+ * 14. 测试conn的DoContext：deadline作为读超时，取消后立即返回且连接不能继续使用
+ */
+func (s *testAdaptorSuite) TestConnectionDoContext() {
+	assrt := assert.New(s.T())
+	p := redis.New(s.c).Pool()
+	defer p.Close()
+	conn, err := p.Borrow()
+	assrt.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = conn.DoContext(ctx, "SET", "test:ctx", "a")
+	assrt.NoError(err)
+	v, err := redis.String(conn.DoContext(ctx, "GET", "test:ctx"))
+	assrt.NoError(err)
+	assrt.Equal("a", v)
+	conn.Close()
+
+	conn, _ = p.Borrow()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = conn.DoContext(ctx, "BLPOP", "test:ctx:list", 1)
+	assrt.Error(err)
+	assrt.True(time.Since(start) < 500*time.Millisecond)
+	assrt.Error(conn.Error())
+	conn.Close()
+
+	conn, _ = p.Borrow()
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	_, err = conn.DoContext(ctx, "BLPOP", "test:ctx:list", 1)
+	assrt.Equal(context.Canceled, err)
+	assrt.True(time.Since(start) < 500*time.Millisecond)
+	assrt.Equal(redis.ErrConnCanceled, conn.Error())
+	_, err = conn.DoContext(context.Background(), "GET", "test:ctx")
+	assrt.Equal(redis.ErrConnCanceled, err)
+	_, err = conn.Do("GET", "test:ctx")
+	assrt.Equal(redis.ErrConnCanceled, err)
+	assrt.NoError(conn.Close())
+	// 已经结束的ctx不发送命令
+	conn, _ = p.Borrow()
+	_, err = conn.DoContext(ctx, "DEL", "test:ctx")
+	assrt.Equal(context.Canceled, err)
+	assrt.NoError(conn.Error())
+	v, _ = redis.String(conn.Do("GET", "test:ctx"))
+	assrt.Equal("a", v)
+	conn.Close()
+}
+
+/*
+ * 15. 测试BlockedConn的DoContext，取消时中断阻塞的命令
+ */
+func (s *testAdaptorSuite) TestBlockedConnDoContext() {
+	assrt := assert.New(s.T())
+	r := redis.New(s.c)
+	defer r.Pool().Close()
+	bc, err := r.BlockedConn()
+	assrt.NoError(err)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		conn, _ := r.Pool().Borrow()
+		conn.Do("RPUSH", "test:ctx:blocked", "a")
+		conn.Close()
+	}()
+	// 没有deadline时不受ReadTimeout限制
+	v, err := redis.Strings(bc.DoContext(context.Background(), "BLPOP", "test:ctx:blocked", 0))
+	assrt.NoError(err)
+	assrt.Equal([]string{"test:ctx:blocked", "a"}, v)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = bc.DoContext(ctx, "BLPOP", "test:ctx:blocked", 0)
+	assrt.Error(err)
+	assrt.True(time.Since(start) < 500*time.Millisecond)
+	bc.Close()
+
+	bc, err = r.BlockedConn()
+	assrt.NoError(err)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	_, err = bc.DoContext(ctx, "BLPOP", "test:ctx:blocked", 0)
+	assrt.Equal(context.Canceled, err)
+	assrt.True(time.Since(start) < 500*time.Millisecond)
+	_, err = bc.DoContext(context.Background(), "PING")
+	assrt.Equal(redis.ErrConnCanceled, err)
+	assrt.NoError(bc.Close())
+}
+
+/*
+ * 16. 测试pubsub的ReceiveContext，ctx结束时不关闭连接，消息由下一次Receive返回
+ */
+func (s *testAdaptorSuite) TestPubSubReceiveContext() {
+	assrt := assert.New(s.T())
+	r := redis.New(s.c)
+	defer r.Pool().Close()
+	ps, err := r.PubSubConn()
+	assrt.NoError(err)
+	defer ps.Close()
+	assrt.NoError(ps.Subscribe("test:ctx:channel"))
+	assrt.Equal(redis.Subscription{Kind: "subscribe", Channel: "test:ctx:channel", Count: 1}, ps.ReceiveContext(context.Background()))
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		assrt.Equal(context.DeadlineExceeded, ps.ReceiveContext(ctx))
+		cancel()
+	}
+	_, ok := ps.ReceiveWithTimeout(30 * time.Millisecond).(error)
+	assrt.True(ok)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assrt.Equal(context.Canceled, ps.ReceiveContext(ctx))
+
+	conn, _ := r.Pool().Borrow()
+	conn.Do("PUBLISH", "test:ctx:channel", "a")
+	conn.Do("PUBLISH", "test:ctx:channel", "b")
+	conn.Close()
+	assrt.Equal(redis.SubMsg{Channel: "test:ctx:channel", Data: []byte("a")}, ps.Receive())
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assrt.Equal(redis.SubMsg{Channel: "test:ctx:channel", Data: []byte("b")}, ps.ReceiveContext(ctx))
+}
+
+/*
+ * 17. 测试pingOnBorrow：连接空闲时间不超过pingOnBorrow时借出不发送PING
+ */
+func (s *testAdaptorSuite) TestPingOnBorrow() {
+	assrt := assert.New(s.T())
+	borrowGet := func(p redis.Pool) int {
+		conn, err := p.Borrow()
+		assrt.NoError(err)
+		_, err = conn.Do("GET", "test:ping")
+		assrt.NoError(err)
+		conn.Close()
+		return s.mr.CommandCount()
+	}
+
+	c := *s.c
+	c.PingOnBorrow = time.Hour
+	p := redis.New(&c).Pool()
+	borrowGet(p)
+	cnt := s.mr.CommandCount()
+	assrt.Equal(cnt+1, borrowGet(p))
+	p.Close()
+
+	c.PingOnBorrow = time.Millisecond
+	p = redis.New(&c).Pool()
+	defer p.Close()
+	borrowGet(p)
+	cnt = s.mr.CommandCount()
+	time.Sleep(5 * time.Millisecond)
+	assrt.Equal(cnt+2, borrowGet(p))
+}
+
+func TestAdaptorRedigoSuite(t *testing.T) {
+	suite.Run(t, &testAdaptorSuite{driver: redis.DriverRedigo})
+}
+
+func TestAdaptorGoRedisSuite(t *testing.T) {
+	suite.Run(t, &testAdaptorSuite{driver: redis.DriverGoRedis})
+}
+
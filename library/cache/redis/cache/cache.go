@@ -0,0 +1,317 @@
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/configurator/validate"
+	"meross_iot/library/logger"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPrefix         = "cache:"
+	DefaultTTL            = 10 * time.Minute
+	DefaultJitter         = 0.1
+	DefaultNotFoundTTL    = time.Minute
+	DefaultRefreshTimeout = 10 * time.Second
+	DefaultCodec          = CodecJSON
+)
+
+// ErrNotFound LoadFunc返回该错误表示数据不存在，NotFoundTTL大于0时缓存不存在的结果
+var ErrNotFound = errors.New("cache: not found")
+
+// LoadFunc 缓存没有命中时从数据源(如mysql)加载，返回值按Codec序列化后写入redis
+type LoadFunc func(ctx context.Context) (interface{}, error)
+
+// Config 缓存的配置
+type Config struct {
+	// key的前缀
+	Prefix string
+	// 缓存的有效期
+	TTL time.Duration `validate:"gt=0"`
+	// 有效期随机增加0到TTL*Jitter，避免同时写入的key同时过期
+	Jitter float64 `validate:"min=0,max=1"`
+	// 数据不存在时缓存的时间，为0时不缓存
+	NotFoundTTL time.Duration `validate:"min=0"`
+	// 超过有效期后继续返回旧值的时间，期间在后台刷新，为0时不启用
+	StaleTTL time.Duration `validate:"min=0"`
+	// 没有命中时加载和后台刷新的超时时间，加载不受调用方ctx取消的影响
+	RefreshTimeout time.Duration `validate:"gt=0"`
+	Codec          string        `validate:"oneof=json msgpack protobuf"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Prefix:         DefaultPrefix,
+		TTL:            DefaultTTL,
+		Jitter:         DefaultJitter,
+		NotFoundTTL:    DefaultNotFoundTTL,
+		RefreshTimeout: DefaultRefreshTimeout,
+		Codec:          DefaultCodec,
+	}
+}
+
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (c *Config) Validate(section string) error {
+	return validate.Struct(section, c)
+}
+
+/*
+ * Cache cache-aside：先读redis，没有命中时调用LoadFunc加载并写入redis
+ * 同一个进程内同一个key同时只有一个加载，其他调用等待并共享结果
+ * redis读写出错时不影响返回结果，直接使用LoadFunc加载，错误通过OnError报告
+ */
+type Cache struct {
+	conf  *Config
+	pool  redis.Pool
+	codec Codec
+	group group
+
+	mu      sync.Mutex
+	onError func(err error)
+}
+
+func New(r *redis.Redis, c *Config) *Cache {
+	if err := c.Validate("cache"); err != nil {
+		panic(fmt.Errorf("wrong cache config, %s\n", err))
+	}
+	return &Cache{
+		conf:    c,
+		pool:    r.Pool(),
+		codec:   codecs[c.Codec],
+		onError: logger.ErrorReporter("cache", c.Prefix),
+	}
+}
+
+// OnError 设置redis读写出错、后台刷新失败时的回调
+func (c *Cache) OnError(fn func(err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onError = fn
+}
+
+/*
+ * Get 把key对应的值解析到dst，dst为指针，protobuf时为proto.Message
+ * 数据不存在时返回ErrNotFound；值超过有效期但在StaleTTL内时返回旧值，并在后台调用load刷新
+ * 多个调用共享同一次加载，加载使用不会被取消的ctx(保留调用方ctx中的值)，超时为RefreshTimeout
+ * 调用方的ctx结束时直接返回ctx的错误，加载继续进行，结果写入redis并返回给其他等待的调用
+ */
+func (c *Cache) Get(ctx context.Context, key string, dst interface{}, load LoadFunc) error {
+	key = c.conf.Prefix + key
+	e, err := c.read(ctx, key)
+	if err != nil {
+		c.report(fmt.Errorf("fail to read [%s]: %s", key, err))
+	}
+	if e != nil {
+		if time.Now().After(e.freshUntil) {
+			c.refresh(key, load)
+		}
+		return c.decode(e, dst)
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err, _ := c.group.do(key, func() ([]byte, error) {
+			lctx, cancel := context.WithTimeout(detach(ctx), c.conf.RefreshTimeout)
+			defer cancel()
+			return c.load(lctx, key, load)
+		})
+		done <- result{data: data, err: err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	e, err = decodeEntry(r.data)
+	if err != nil {
+		return err
+	}
+	return c.decode(e, dst)
+}
+
+// Set 直接写入缓存，用于数据更新后主动刷新
+func (c *Cache) Set(ctx context.Context, key string, v interface{}) error {
+	payload, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.write(ctx, c.conf.Prefix+key, kindValue, payload)
+	return err
+}
+
+// Delete 删除缓存，用于数据更新或删除后让下次Get重新加载
+func (c *Cache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, c.conf.Prefix+key)
+	}
+	conn, err := c.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.DoContext(ctx, "DEL", args...)
+	return err
+}
+
+// key不存在时返回nil
+func (c *Cache) read(ctx context.Context, key string) (*entry, error) {
+	conn, err := c.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	data, err := redis.Bytes(conn.DoContext(ctx, "GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEntry(data)
+}
+
+// 调用load并写入redis，返回编码后的entry，写入失败不影响返回值
+func (c *Cache) load(ctx context.Context, key string, load LoadFunc) ([]byte, error) {
+	v, err := load(ctx)
+	kind, payload := kindValue, []byte(nil)
+	switch {
+	case err == ErrNotFound:
+		kind = kindNotFound
+	case err != nil:
+		return nil, err
+	default:
+		if payload, err = c.codec.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	data, err := c.write(ctx, key, kind, payload)
+	if err != nil {
+		c.report(fmt.Errorf("fail to write [%s]: %s", key, err))
+	}
+	return data, nil
+}
+
+// 数据不存在且NotFoundTTL为0时不写入
+func (c *Cache) write(ctx context.Context, key string, kind byte, payload []byte) ([]byte, error) {
+	ttl, expire := c.conf.NotFoundTTL, c.conf.NotFoundTTL
+	if kind == kindValue {
+		ttl = c.conf.TTL
+		if c.conf.Jitter > 0 {
+			ttl += time.Duration(rand.Int63n(int64(float64(ttl)*c.conf.Jitter) + 1))
+		}
+		expire = ttl + c.conf.StaleTTL
+	}
+	e := &entry{kind: kind, freshUntil: time.Now().Add(ttl), payload: payload}
+	data := e.encode()
+	if expire <= 0 {
+		return data, nil
+	}
+	conn, err := c.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return data, err
+	}
+	defer conn.Close()
+	_, err = conn.DoContext(ctx, "SET", key, data, "PX", expire.Milliseconds())
+	return data, err
+}
+
+// 在后台重新加载，已经在加载时不重复发起
+func (c *Cache) refresh(key string, load LoadFunc) {
+	if c.group.inflight(key) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.conf.RefreshTimeout)
+		defer cancel()
+		_, err, _ := c.group.do(key, func() ([]byte, error) {
+			return c.load(ctx, key, load)
+		})
+		if err != nil {
+			c.report(fmt.Errorf("fail to refresh [%s]: %s", key, err))
+		}
+	}()
+}
+
+// 保留ctx中的值(如链路追踪的span)，不继承ctx的取消和超时
+type detachedContext struct {
+	context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c *Cache) decode(e *entry, dst interface{}) error {
+	if e.kind == kindNotFound {
+		return ErrNotFound
+	}
+	return c.codec.Unmarshal(e.payload, dst)
+}
+
+func (c *Cache) report(err error) {
+	c.mu.Lock()
+	fn := c.onError
+	c.mu.Unlock()
+	fn(err)
+}
+
+const (
+	kindValue    byte = 1
+	kindNotFound byte = 2
+
+	entryHeaderLen = 9
+)
+
+// redis中保存的值：1字节类型 + 8字节有效期(unix毫秒) + 序列化后的值
+type entry struct {
+	kind       byte
+	freshUntil time.Time
+	payload    []byte
+}
+
+func (e *entry) encode() []byte {
+	b := make([]byte, entryHeaderLen, entryHeaderLen+len(e.payload))
+	b[0] = e.kind
+	binary.BigEndian.PutUint64(b[1:], uint64(e.freshUntil.UnixMilli()))
+	return append(b, e.payload...)
+}
+
+func decodeEntry(b []byte) (*entry, error) {
+	if len(b) < entryHeaderLen || (b[0] != kindValue && b[0] != kindNotFound) {
+		return nil, fmt.Errorf("cache: malformed cache entry")
+	}
+	return &entry{
+		kind:       b[0],
+		freshUntil: time.UnixMilli(int64(binary.BigEndian.Uint64(b[1:]))),
+		payload:    b[entryHeaderLen:],
+	}, nil
+}
@@ -0,0 +1,295 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/cache"
+	"meross_iot/library/internal/redistest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type device struct {
+	UUID string
+	Name string
+	Port int
+}
+
+type testCacheSuite struct {
+	suite.Suite
+	mr *miniredis.Miniredis
+	rc *redis.Redis
+}
+
+func (s *testCacheSuite) SetupTest() {
+	mr, err := miniredis.Run()
+	s.Require().NoError(err)
+	s.mr = mr
+	c := redistest.Config(mr.Addr(), "")
+	s.rc = redis.New(c)
+}
+
+func (s *testCacheSuite) TearDownTest() {
+	s.rc.Pool().Close()
+	s.mr.Close()
+}
+
+func (s *testCacheSuite) conf() *cache.Config {
+	c := cache.NewConfig()
+	c.TTL = time.Minute
+	return c
+}
+
+// 返回的LoadFunc每次调用时计数
+func counting(n *int32, v interface{}, err error) cache.LoadFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(n, 1)
+		return v, err
+	}
+}
+
+/*
+ * 1. 测试没有命中时加载并写入，有效期带随机抖动
+ */
+func (s *testCacheSuite) TestGet() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	c := cache.New(s.rc, s.conf())
+	loads := int32(0)
+	load := counting(&loads, &device{UUID: "d1", Name: "plug", Port: 1}, nil)
+	for i := 0; i < 3; i++ {
+		d := &device{}
+		assrt.NoError(c.Get(ctx, "device:d1", d, load))
+		assrt.Equal(&device{UUID: "d1", Name: "plug", Port: 1}, d)
+	}
+	assrt.Equal(int32(1), loads)
+	ttl := s.mr.TTL("cache:device:d1")
+	assrt.True(ttl >= time.Minute && ttl <= time.Minute+6*time.Second)
+
+	// 加载出错时不缓存
+	loadErr := errors.New("db is down")
+	assrt.Equal(loadErr, c.Get(ctx, "device:d2", &device{}, counting(&loads, nil, loadErr)))
+	assrt.False(s.mr.Exists("cache:device:d2"))
+
+	// 主动更新和删除
+	assrt.NoError(c.Set(ctx, "device:d1", &device{UUID: "d1", Name: "bulb"}))
+	d := &device{}
+	assrt.NoError(c.Get(ctx, "device:d1", d, load))
+	assrt.Equal("bulb", d.Name)
+	assrt.NoError(c.Delete(ctx, "device:d1", "device:d2"))
+	assrt.False(s.mr.Exists("cache:device:d1"))
+	assrt.NoError(c.Get(ctx, "device:d1", d, load))
+	assrt.Equal("plug", d.Name)
+	assrt.Equal(int32(3), loads)
+}
+
+/*
+ * 2. 测试msgpack和protobuf
+ */
+func (s *testCacheSuite) TestCodec() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	conf := s.conf()
+	conf.Codec = cache.CodecMsgpack
+	c := cache.New(s.rc, conf)
+	loads := int32(0)
+	load := counting(&loads, &device{UUID: "d1", Name: "plug", Port: 1}, nil)
+	for i := 0; i < 2; i++ {
+		d := &device{}
+		assrt.NoError(c.Get(ctx, "device:d1", d, load))
+		assrt.Equal(&device{UUID: "d1", Name: "plug", Port: 1}, d)
+	}
+	assrt.Equal(int32(1), loads)
+
+	conf = s.conf()
+	conf.Prefix = "pb:"
+	conf.Codec = cache.CodecProtobuf
+	c = cache.New(s.rc, conf)
+	load = counting(&loads, &wrapperspb.StringValue{Value: "plug"}, nil)
+	for i := 0; i < 2; i++ {
+		v := &wrapperspb.StringValue{}
+		assrt.NoError(c.Get(ctx, "name", v, load))
+		assrt.Equal("plug", v.Value)
+	}
+	assrt.Equal(int32(2), loads)
+	assrt.Error(c.Get(ctx, "name", &device{}, load))
+
+	conf.Codec = "xml"
+	assrt.Error(conf.Validate("cache"))
+	assrt.Panics(func() {
+		cache.New(s.rc, conf)
+	})
+}
+
+/*
+ * 3. 测试缓存不存在的结果
+ */
+func (s *testCacheSuite) TestNotFound() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	conf := s.conf()
+	conf.NotFoundTTL = 30 * time.Second
+	c := cache.New(s.rc, conf)
+	loads := int32(0)
+	load := counting(&loads, nil, cache.ErrNotFound)
+	for i := 0; i < 2; i++ {
+		assrt.Equal(cache.ErrNotFound, c.Get(ctx, "device:none", &device{}, load))
+	}
+	assrt.Equal(int32(1), loads)
+	assrt.Equal(30*time.Second, s.mr.TTL("cache:device:none"))
+
+	conf.NotFoundTTL = 0
+	c = cache.New(s.rc, conf)
+	for i := 0; i < 2; i++ {
+		assrt.Equal(cache.ErrNotFound, c.Get(ctx, "device:none2", &device{}, load))
+	}
+	assrt.Equal(int32(3), loads)
+	assrt.False(s.mr.Exists("cache:device:none2"))
+}
+
+/*
+ * 4. 测试并发没有命中时只加载一次
+ */
+func (s *testCacheSuite) TestSingleflight() {
+	assrt := assert.New(s.T())
+	c := cache.New(s.rc, s.conf())
+	loads := int32(0)
+	start := make(chan struct{})
+	load := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		<-start
+		return &device{UUID: "d1"}, nil
+	}
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := &device{}
+			err := c.Get(context.Background(), "device:d1", d, load)
+			if err == nil && d.UUID != "d1" {
+				err = errors.New("wrong value")
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assrt.NoError(err)
+	}
+	assrt.Equal(int32(1), loads)
+}
+
+/*
+ * 5. 测试过期后在StaleTTL内返回旧值并在后台刷新
+ */
+func (s *testCacheSuite) TestStaleWhileRevalidate() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	conf := s.conf()
+	conf.TTL = 50 * time.Millisecond
+	conf.Jitter = 0
+	conf.StaleTTL = time.Minute
+	c := cache.New(s.rc, conf)
+	assrt.NoError(c.Set(ctx, "device:d1", &device{Name: "old"}))
+	assrt.Equal(conf.TTL+conf.StaleTTL, s.mr.TTL("cache:device:d1"))
+	time.Sleep(60 * time.Millisecond)
+
+	loads := int32(0)
+	refreshed := make(chan struct{})
+	load := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		<-refreshed
+		return &device{Name: "new"}, nil
+	}
+	// 刷新完成前都返回旧值，只刷新一次
+	for i := 0; i < 3; i++ {
+		d := &device{}
+		assrt.NoError(c.Get(ctx, "device:d1", d, load))
+		assrt.Equal("old", d.Name)
+	}
+	close(refreshed)
+	assrt.Eventually(func() bool {
+		d := &device{}
+		return c.Get(ctx, "device:d1", d, load) == nil && d.Name == "new"
+	}, time.Second, 10*time.Millisecond)
+	assrt.Equal(int32(1), atomic.LoadInt32(&loads))
+}
+
+/*
+ * 6. 测试redis不可用时直接加载
+ */
+func (s *testCacheSuite) TestRedisDown() {
+	assrt := assert.New(s.T())
+	c := cache.New(s.rc, s.conf())
+	errs := int32(0)
+	c.OnError(func(err error) {
+		atomic.AddInt32(&errs, 1)
+	})
+	s.mr.Close()
+	loads := int32(0)
+	d := &device{}
+	assrt.NoError(c.Get(context.Background(), "device:d1", d, counting(&loads, &device{UUID: "d1"}, nil)))
+	assrt.Equal("d1", d.UUID)
+	assrt.Equal(int32(1), loads)
+	// 读取和写入各报告一次
+	assrt.Equal(int32(2), errs)
+}
+
+/*
+ * 7. 测试第一个调用取消后共享的加载继续进行，加载的超时为RefreshTimeout
+ */
+func (s *testCacheSuite) TestLoadDetached() {
+	assrt := assert.New(s.T())
+	conf := s.conf()
+	conf.RefreshTimeout = time.Second
+	c := cache.New(s.rc, conf)
+	type ctxKey struct{}
+	start := make(chan struct{})
+	deadline := make(chan time.Duration, 1)
+	load := func(ctx context.Context) (interface{}, error) {
+		<-start
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		d, _ := ctx.Deadline()
+		deadline <- time.Until(d)
+		return &device{UUID: ctx.Value(ctxKey{}).(string)}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "d1"))
+	first := make(chan error, 1)
+	go func() {
+		first <- c.Get(ctx, "device:d1", &device{}, load)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	second := make(chan error, 1)
+	d := &device{}
+	go func() {
+		second <- c.Get(context.Background(), "device:d1", d, load)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	assrt.Equal(context.Canceled, <-first)
+	close(start)
+	assrt.NoError(<-second)
+	assrt.Equal("d1", d.UUID)
+	left := <-deadline
+	assrt.True(left > 0 && left <= time.Second)
+	assrt.True(s.mr.Exists("cache:device:d1"))
+}
+
+func TestCacheSuite(t *testing.T) {
+	suite.Run(t, new(testCacheSuite))
+}
@@ -0,0 +1,49 @@
+package cache
+
+import "sync"
+
+// 同一个key同时只有一个加载，其他调用等待并共享结果
+type call struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+type group struct {
+	mu sync.Mutex
+	m  map[string]*call
+}
+
+// do 返回fn的结果，shared表示结果来自其他调用发起的加载
+func (g *group) do(key string, fn func() ([]byte, error)) (val []byte, err error, shared bool) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	if c, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
+
+// inflight key正在加载
+func (g *group) inflight(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.m[key]
+	return ok
+}
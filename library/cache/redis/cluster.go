@@ -0,0 +1,931 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	redigo "github.com/gomodule/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ClusterSlots cluster的slot数量
+	ClusterSlots = 16384
+	// 一次请求最多跟随MOVED/ASK的次数
+	maxRedirects = 5
+)
+
+var errClusterClosed = errors.New("redis: cluster pool is closed")
+
+var crc16Table = func() (t [256]uint16) {
+	for i := range t {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return
+}()
+
+// CRC16-CCITT(XMODEM)，与redis cluster一致
+func crc16(b []byte) uint16 {
+	crc := uint16(0)
+	for _, c := range b {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^c]
+	}
+	return crc
+}
+
+// Slot 计算key所属的slot，key中包含非空的{tag}时只计算tag，用于把相关的key放到同一个slot
+func Slot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16([]byte(key)) % ClusterSlots)
+}
+
+// 不带key的命令，在cluster中发送到任意节点
+var keylessCommands = map[string]bool{
+	"PING": true, "ECHO": true, "INFO": true, "TIME": true, "CLUSTER": true, "SCRIPT": true,
+	"FLUSHALL": true, "FLUSHDB": true, "DBSIZE": true, "RANDOMKEY": true, "KEYS": true,
+	"SCAN": true, "CONFIG": true, "CLIENT": true, "PUBLISH": true, "SELECT": true, "AUTH": true,
+	"MULTI": true, "EXEC": true, "DISCARD": true, "UNWATCH": true, "WAIT": true, "ROLE": true,
+	"READONLY": true, "READWRITE": true, "ASKING": true, "QUIT": true, "COMMAND": true,
+	"SLOWLOG": true, "LASTSAVE": true, "SAVE": true, "BGSAVE": true, "DEBUG": true,
+}
+
+// 返回命令中用于计算slot的key，多key命令只取第一个key，所有key需要在同一个slot
+func commandKey(command string, args []interface{}) (string, bool) {
+	command = strings.ToUpper(command)
+	if keylessCommands[command] {
+		return "", false
+	}
+	pos := 0
+	switch command {
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, err := strconv.Atoi(keyString(args[1])); err != nil || n <= 0 {
+			return "", false
+		}
+		pos = 2
+	case "BITOP", "OBJECT", "MEMORY", "XGROUP", "XINFO":
+		pos = 1
+	case "XREAD", "XREADGROUP":
+		pos = -1
+		for i, arg := range args {
+			if strings.EqualFold(keyString(arg), "STREAMS") {
+				pos = i + 1
+				break
+			}
+		}
+	}
+	if pos < 0 || pos >= len(args) {
+		return "", false
+	}
+	return keyString(args[pos]), true
+}
+
+func keyString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	default:
+		return fmt.Sprint(arg)
+	}
+}
+
+// 解析MOVED和ASK错误，如"MOVED 3999 127.0.0.1:6381"
+func parseRedirect(err error) (kind string, slot int, addr string, ok bool) {
+	re, isErr := err.(Error)
+	if !isErr {
+		return "", 0, "", false
+	}
+	parts := strings.Fields(string(re))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, e := strconv.Atoi(parts[1])
+	if e != nil {
+		return "", 0, "", false
+	}
+	return parts[0], slot, parts[2], true
+}
+
+/* *********************************
+ * ********* cluster slots *********
+ * *********************************/
+
+/*
+ * 保存slot到master节点地址的映射，通过CLUSTER SLOTS查询
+ * 第一次使用时加载；收到MOVED时先更新对应的slot，再在后台重新加载全部映射
+ */
+type cluster struct {
+	conf       *Config
+	mu         sync.RWMutex
+	seeds      []string
+	slots      []string
+	refreshing int32
+}
+
+func newCluster(c *Config) *cluster {
+	if len(c.ClusterAddrs) == 0 {
+		return nil
+	}
+	seeds := make([]string, len(c.ClusterAddrs))
+	copy(seeds, c.ClusterAddrs)
+	return &cluster{conf: c, seeds: seeds}
+}
+
+// 节点的配置，只替换地址
+func (cl *cluster) nodeConf(addr string) *Config {
+	c := *cl.conf
+	host, port, _ := net.SplitHostPort(addr)
+	c.Host = host
+	c.Port, _ = strconv.Atoi(port)
+	c.ClusterAddrs = nil
+	return &c
+}
+
+// 已知的master节点和初始节点，去重
+func (cl *cluster) addrs() []string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	seen := make(map[string]bool)
+	addrs := make([]string, 0, len(cl.seeds))
+	for _, addr := range cl.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, addr := range cl.seeds {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// masters 返回slot映射中的所有master节点
+func (cl *cluster) masters() ([]string, error) {
+	if err := cl.load(); err != nil {
+		return nil, err
+	}
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	seen := make(map[string]bool)
+	addrs := make([]string, 0)
+	for _, addr := range cl.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// 依次向已知节点查询CLUSTER SLOTS，替换slot映射
+func (cl *cluster) refresh() error {
+	errs := make([]string, 0)
+	for _, addr := range cl.addrs() {
+		slots, err := cl.querySlots(addr)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+			continue
+		}
+		cl.mu.Lock()
+		cl.slots = slots
+		cl.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("fail to load cluster slots: %s", strings.Join(errs, "; "))
+}
+
+func (cl *cluster) refreshAsync() {
+	if !atomic.CompareAndSwapInt32(&cl.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&cl.refreshing, 0)
+		cl.refresh()
+	}()
+}
+
+func (cl *cluster) querySlots(addr string) ([]string, error) {
+	c := cl.nodeConf(addr)
+	conn, err := genDialFunc(c, genAddrFunc(c, nil, false))()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ranges, err := redigo.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]string, ClusterSlots)
+	for _, r := range ranges {
+		// [start, end, [ip, port, id], replicas...]
+		parts, err := redigo.Values(r, nil)
+		if err != nil || len(parts) < 3 {
+			return nil, fmt.Errorf("unexpected CLUSTER SLOTS reply")
+		}
+		start, err1 := redigo.Int(parts[0], nil)
+		end, err2 := redigo.Int(parts[1], nil)
+		node, err3 := redigo.Values(parts[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(node) < 2 || start < 0 || end >= ClusterSlots || start > end {
+			return nil, fmt.Errorf("unexpected CLUSTER SLOTS reply")
+		}
+		host, _ := redigo.String(node[0], nil)
+		port, _ := redigo.Int(node[1], nil)
+		// 节点地址为空时表示被查询的节点本身
+		if host == "" {
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		master := net.JoinHostPort(host, strconv.Itoa(port))
+		for i := start; i <= end; i++ {
+			slots[i] = master
+		}
+	}
+	return slots, nil
+}
+
+// 第一次使用时加载slot映射
+func (cl *cluster) load() error {
+	cl.mu.RLock()
+	loaded := cl.slots != nil
+	cl.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+	return cl.refresh()
+}
+
+func (cl *cluster) nodeAddr(slot int) (string, error) {
+	if err := cl.load(); err != nil {
+		return "", err
+	}
+	cl.mu.RLock()
+	addr := cl.slots[slot]
+	cl.mu.RUnlock()
+	if addr == "" {
+		cl.refreshAsync()
+		return "", fmt.Errorf("cluster slot %d is not served", slot)
+	}
+	return addr, nil
+}
+
+// 不带key的命令使用第一个master节点
+func (cl *cluster) anyAddr() (string, error) {
+	addrs, err := cl.masters()
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("cluster has no master")
+	}
+	return addrs[0], nil
+}
+
+// 命令对应的节点地址，不带key的命令返回空
+func (cl *cluster) commandAddr(command string, args []interface{}) (string, error) {
+	key, ok := commandKey(command, args)
+	if !ok {
+		return "", nil
+	}
+	return cl.nodeAddr(Slot(key))
+}
+
+func (cl *cluster) moved(slot int, addr string) {
+	cl.mu.Lock()
+	if cl.slots != nil {
+		cl.slots[slot] = addr
+	}
+	cl.mu.Unlock()
+	cl.refreshAsync()
+}
+
+var errClusterTxBroken = errors.New("redis: cluster transaction aborted, node connection is broken")
+
+/* *********************************
+ * ******** interface Pool *********
+ * *********************************/
+
+// 每个master节点一个redigo pool，连接数限制对每个节点分别生效
+type clusterPool struct {
+	cl     *cluster
+	mu     sync.Mutex
+	conf   Config
+	nodes  map[string]*redigoPool
+	closed bool
+}
+
+func newClusterPool(cl *cluster) *clusterPool {
+	return &clusterPool{
+		cl:    cl,
+		conf:  *cl.conf,
+		nodes: make(map[string]*redigoPool),
+	}
+}
+
+func (p *clusterPool) node(addr string) (*redigoPool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errClusterClosed
+	}
+	np, ok := p.nodes[addr]
+	if !ok {
+		c := p.cl.nodeConf(addr)
+		c.MaxActiveConns, c.MaxIdleConns = p.conf.MaxActiveConns, p.conf.MaxIdleConns
+		np = newRedigoPool(c, nil)
+		p.nodes[addr] = np
+	}
+	return np, nil
+}
+
+/*
+ * 借出时不建立连接，执行命令时按key所在的节点从对应的pool借出
+ */
+func (p *clusterPool) Borrow() (Connection, error) {
+	return p.BorrowWithContext(context.Background())
+}
+
+func (p *clusterPool) BorrowWithContext(ctx context.Context) (Connection, error) {
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return nil, errClusterClosed
+	}
+	if err := p.cl.load(); err != nil {
+		return nil, err
+	}
+	return &clusterConn{pool: p, ctx: ctx}, nil
+}
+
+func (p *clusterPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, np := range p.nodes {
+		np.Close()
+	}
+	return nil
+}
+
+func (p *clusterPool) Stat() *PoolStat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stat := &PoolStat{}
+	for _, np := range p.nodes {
+		ns := np.Stat()
+		stat.ActiveCount += ns.ActiveCount
+		stat.IdleCount += ns.IdleCount
+	}
+	return stat
+}
+
+func (p *clusterPool) SetLimits(maxActive, maxIdle int) error {
+	if maxActive < 0 || maxIdle < 0 {
+		return fmt.Errorf("wrong redis pool limits: maxActive [%d] maxIdle [%d]", maxActive, maxIdle)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conf.MaxActiveConns, p.conf.MaxIdleConns = maxActive, maxIdle
+	for _, np := range p.nodes {
+		if err := np.SetLimits(maxActive, maxIdle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *clusterPool) Tx(ctx context.Context) (Tx, error) {
+	return newTx(ctx, p)
+}
+
+func (p *clusterPool) Pipeline() Pipeline {
+	return &clusterPipeline{pool: p}
+}
+
+func (p *clusterPool) Script(keyCnt int, src string) Script {
+	h := sha1.New()
+	h.Write([]byte(src))
+	return &clusterScript{
+		pool:     p,
+		keyCount: keyCnt,
+		src:      src,
+		hash:     hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+/* *********************************
+ * ****** interface Connection *****
+ * *********************************/
+
+/*
+ * 按命令的key把命令发送到对应节点的连接，跟随MOVED和ASK重定向
+ * 不带key的命令发送到上一个命令使用的节点，没有时发送到任意节点
+ * WATCH或MULTI之后进入事务，事务固定在第一个key所在的节点，MULTI推迟到第一个命令时发送，见txDo
+ */
+type clusterConn struct {
+	pool  *clusterPool
+	ctx   context.Context
+	conns map[string]Connection
+	last  string
+	err   error
+	// 事务固定的节点和slot，不在事务中时txAddr为空；hasSlot为false时事务还没有带key的命令
+	txAddr  string
+	txSlot  int
+	hasSlot bool
+	// 收到MULTI，multiSent为true时已经发送到txAddr
+	multi     bool
+	multiSent bool
+	// txAddr的连接出错后已关闭，WATCH和已入队的命令丢失，事务不能继续
+	txBroken bool
+}
+
+func (c *clusterConn) conn(addr string) (Connection, error) {
+	if conn, ok := c.conns[addr]; ok {
+		return conn, nil
+	}
+	np, err := c.pool.node(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := np.BorrowWithContext(c.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.conns == nil {
+		c.conns = make(map[string]Connection)
+	}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+// 关闭出错的节点连接，之后发送到该节点的命令重新借出连接
+func (c *clusterConn) drop(addr string) {
+	if addr == c.txAddr {
+		c.txBroken = true
+	}
+	if conn, ok := c.conns[addr]; ok {
+		conn.Close()
+		delete(c.conns, addr)
+	}
+}
+
+func (c *clusterConn) Close() error {
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+	return nil
+}
+
+func (c *clusterConn) Error() error {
+	return c.err
+}
+
+func (c *clusterConn) Do(command string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), command, args...)
+}
+
+func (c *clusterConn) DoContext(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	switch strings.ToUpper(command) {
+	case "MULTI":
+		if c.multi {
+			return nil, Error("ERR MULTI calls can not be nested")
+		}
+		c.multi = true
+		return "OK", nil
+	case "EXEC":
+		return c.exec(ctx)
+	case "DISCARD":
+		return c.discard(ctx)
+	case "UNWATCH":
+		if !c.multi {
+			return c.unwatch(ctx)
+		}
+	case "WATCH":
+	default:
+		// WATCH之后MULTI之前的命令不在事务中，按key发送
+		if !c.multi {
+			return c.do(ctx, command, args)
+		}
+	}
+	return c.txDo(ctx, command, args)
+}
+
+func (c *clusterConn) do(ctx context.Context, command string, args []interface{}) (interface{}, error) {
+	cl := c.pool.cl
+	addr, err := cl.commandAddr(command, args)
+	if err != nil {
+		return nil, err
+	}
+	if addr == "" {
+		addr = c.last
+	}
+	if addr == "" {
+		if addr, err = cl.anyAddr(); err != nil {
+			return nil, err
+		}
+	}
+	asking := false
+	for i := 0; i <= maxRedirects; i++ {
+		conn, err := c.conn(addr)
+		if err != nil {
+			cl.refreshAsync()
+			return nil, err
+		}
+		c.last = addr
+		if asking {
+			if _, err := conn.DoContext(ctx, "ASKING"); err != nil {
+				if isFailoverError(err) || conn.Error() != nil {
+					c.drop(addr)
+				}
+				return nil, err
+			}
+		}
+		v, err := conn.DoContext(ctx, command, args...)
+		kind, slot, to, ok := parseRedirect(err)
+		if !ok {
+			if isFailoverError(err) || conn.Error() != nil {
+				c.drop(addr)
+			}
+			if ctx.Err() == nil && isFailoverError(err) {
+				c.err = err
+				cl.refreshAsync()
+			}
+			return v, err
+		}
+		// ASK只对下一个命令生效，不更新slot映射
+		asking = kind == "ASK"
+		if !asking {
+			cl.moved(slot, to)
+		}
+		addr = to
+	}
+	return nil, fmt.Errorf("too many cluster redirects for command [%s]", command)
+}
+
+/*
+ * 事务中的命令都发送到txAddr，不跟随重定向：MULTI之后收到MOVED时命令入队失败，EXEC拒绝执行整个事务
+ * key不在事务的slot时不发送，直接返回错误，避免命令在其他节点上不经过事务执行
+ */
+func (c *clusterConn) txDo(ctx context.Context, command string, args []interface{}) (interface{}, error) {
+	if c.txBroken {
+		return nil, errClusterTxBroken
+	}
+	if err := c.pin(command, args); err != nil {
+		return nil, err
+	}
+	if c.multi && !c.multiSent {
+		if _, err := c.send(ctx, c.txAddr, "MULTI", nil); err != nil {
+			return nil, err
+		}
+		c.multiSent = true
+	}
+	return c.send(ctx, c.txAddr, command, args)
+}
+
+// 第一个带key的命令确定事务的节点，没有key时使用上一个命令的节点
+func (c *clusterConn) pin(command string, args []interface{}) error {
+	cl := c.pool.cl
+	key, ok := commandKey(command, args)
+	if !ok {
+		if c.txAddr != "" {
+			return nil
+		}
+		addr := c.last
+		if addr == "" {
+			var err error
+			if addr, err = cl.anyAddr(); err != nil {
+				return err
+			}
+		}
+		c.txAddr = addr
+		return nil
+	}
+	slot := Slot(key)
+	if c.hasSlot {
+		if slot != c.txSlot {
+			return fmt.Errorf("key [%s] of command [%s] is not in the slot %d of the transaction", key, strings.ToUpper(command), c.txSlot)
+		}
+		return nil
+	}
+	addr, err := cl.nodeAddr(slot)
+	if err != nil {
+		return err
+	}
+	if c.txAddr != "" && addr != c.txAddr {
+		return fmt.Errorf("key [%s] of command [%s] is not on the node %s of the transaction", key, strings.ToUpper(command), c.txAddr)
+	}
+	c.txAddr, c.txSlot, c.hasSlot = addr, slot, true
+	return nil
+}
+
+func (c *clusterConn) send(ctx context.Context, addr, command string, args []interface{}) (interface{}, error) {
+	conn, err := c.conn(addr)
+	if err != nil {
+		c.pool.cl.refreshAsync()
+		return nil, err
+	}
+	c.last = addr
+	v, err := conn.DoContext(ctx, command, args...)
+	if isFailoverError(err) || conn.Error() != nil {
+		c.drop(addr)
+		if ctx.Err() == nil && isFailoverError(err) {
+			c.err = err
+			c.pool.cl.refreshAsync()
+		}
+	}
+	return v, err
+}
+
+func (c *clusterConn) endTx() {
+	c.txAddr, c.txSlot, c.hasSlot = "", 0, false
+	c.multi, c.multiSent, c.txBroken = false, false, false
+}
+
+// 没有发送过MULTI时补发MULTI，事务中没有命令也没有WATCH时不需要发送
+func (c *clusterConn) exec(ctx context.Context) (interface{}, error) {
+	if !c.multi {
+		return nil, Error("ERR EXEC without MULTI")
+	}
+	defer c.endTx()
+	if c.txBroken {
+		return nil, errClusterTxBroken
+	}
+	if c.txAddr == "" {
+		return []interface{}{}, nil
+	}
+	if !c.multiSent {
+		if _, err := c.send(ctx, c.txAddr, "MULTI", nil); err != nil {
+			return nil, err
+		}
+	}
+	return c.send(ctx, c.txAddr, "EXEC", nil)
+}
+
+// 没有发送过MULTI时只需要取消WATCH
+func (c *clusterConn) discard(ctx context.Context) (interface{}, error) {
+	if !c.multi {
+		return nil, Error("ERR DISCARD without MULTI")
+	}
+	if !c.multiSent || c.txBroken {
+		return c.unwatch(ctx)
+	}
+	defer c.endTx()
+	return c.send(ctx, c.txAddr, "DISCARD", nil)
+}
+
+func (c *clusterConn) unwatch(ctx context.Context) (interface{}, error) {
+	addr, broken := c.txAddr, c.txBroken
+	c.endTx()
+	if addr == "" || broken {
+		return "OK", nil
+	}
+	return c.send(ctx, addr, "UNWATCH", nil)
+}
+
+/* *********************************
+ * ****** interface BlockedConn ****
+ * *********************************/
+
+// 按key把阻塞命令发送到对应节点的独占连接
+type clusterBlockedConn struct {
+	cl    *cluster
+	conns map[string]*redigoConn
+}
+
+func newClusterBlockedConn(cl *cluster) *clusterBlockedConn {
+	return &clusterBlockedConn{cl: cl, conns: make(map[string]*redigoConn)}
+}
+
+func (c *clusterBlockedConn) DoWithTimeout(t time.Duration, command string, args ...interface{}) (interface{}, error) {
+	return c.do(command, args, func(conn *redigoConn) (interface{}, error) {
+		return conn.DoWithTimeout(t, command, args...)
+	})
+}
+
+func (c *clusterBlockedConn) DoContext(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	return c.do(command, args, func(conn *redigoConn) (interface{}, error) {
+		return conn.DoContext(ctx, command, args...)
+	})
+}
+
+// 超时或取消后节点的连接已经关闭，下次使用时重新建立
+func (c *clusterBlockedConn) do(command string, args []interface{}, do func(conn *redigoConn) (interface{}, error)) (interface{}, error) {
+	addr, err := c.cl.commandAddr(command, args)
+	if err == nil && addr == "" {
+		addr, err = c.cl.anyAddr()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i <= maxRedirects; i++ {
+		conn, ok := c.conns[addr]
+		if !ok {
+			if conn, err = newRedigoBlockedConn(c.cl.nodeConf(addr), nil); err != nil {
+				c.cl.refreshAsync()
+				return nil, err
+			}
+			c.conns[addr] = conn
+		}
+		v, err := do(conn)
+		if err != nil && conn.Error() != nil {
+			conn.Close()
+			delete(c.conns, addr)
+		}
+		kind, slot, to, ok := parseRedirect(err)
+		if !ok {
+			return v, err
+		}
+		if kind == "ASK" {
+			if _, err := conn.Do("ASKING"); err != nil {
+				return nil, err
+			}
+		} else {
+			c.cl.moved(slot, to)
+		}
+		addr = to
+	}
+	return nil, fmt.Errorf("too many cluster redirects for command [%s]", command)
+}
+
+func (c *clusterBlockedConn) Close() error {
+	for addr, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, addr)
+	}
+	return nil
+}
+
+/* *********************************
+ * ******* interface pipeline ******
+ * *********************************/
+
+/*
+ * 按key所在的节点拆分命令，每个节点使用一个pipeline并发执行，返回结果的顺序与Send的顺序一致
+ * 返回MOVED或ASK的命令在各节点执行完毕后逐个重新执行
+ */
+type clusterPipeline struct {
+	pool *clusterPool
+	cmds []*cmd
+}
+
+func (p *clusterPipeline) Send(command string, keyAndArg ...interface{}) {
+	p.cmds = append(p.cmds, &cmd{command: command, args: keyAndArg})
+}
+
+func (p *clusterPipeline) Exec(ctx context.Context) (*Replies, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return &Replies{}, nil
+	}
+	cl := p.pool.cl
+	// 节点地址 -> 命令在cmds中的下标
+	groups := make(map[string][]int)
+	for i, c := range cmds {
+		addr, err := cl.commandAddr(c.command, c.args)
+		if err == nil && addr == "" {
+			addr, err = cl.anyAddr()
+		}
+		if err != nil {
+			return nil, err
+		}
+		groups[addr] = append(groups[addr], i)
+	}
+	rps := make([]*reply, len(cmds))
+	errs := make(chan error, len(groups))
+	for addr, idx := range groups {
+		go func(addr string, idx []int) {
+			errs <- p.execNode(ctx, addr, cmds, idx, rps)
+		}(addr, idx)
+	}
+	execErr := error(nil)
+	for range groups {
+		if err := <-errs; err != nil && execErr == nil {
+			execErr = err
+		}
+	}
+	if execErr != nil {
+		cl.refreshAsync()
+		return nil, execErr
+	}
+	redirected := (*clusterConn)(nil)
+	for i, rp := range rps {
+		if _, _, _, ok := parseRedirect(rp.err); !ok {
+			continue
+		}
+		if redirected == nil {
+			redirected = &clusterConn{pool: p.pool, ctx: ctx}
+			defer redirected.Close()
+		}
+		v, err := redirected.Do(cmds[i].command, cmds[i].args...)
+		rps[i] = &reply{cmd: cmds[i], reply: v, err: err}
+	}
+	return &Replies{replies: rps}, nil
+}
+
+// 在一个节点上执行一组命令，结果写入rps中对应的位置
+func (p *clusterPipeline) execNode(ctx context.Context, addr string, cmds []*cmd, idx []int, rps []*reply) error {
+	np, err := p.pool.node(addr)
+	if err != nil {
+		return err
+	}
+	pipe := np.Pipeline().(*redigoPipeline)
+	for _, i := range idx {
+		pipe.Send(cmds[i].command, cmds[i].args...)
+	}
+	replies, err := pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("node %s: %w", addr, err)
+	}
+	for j, i := range idx {
+		rps[i] = replies.replies[j]
+	}
+	return nil
+}
+
+/* *********************************
+ * ******* interface script ********
+ * *********************************/
+
+/*
+ * 按第一个key所在的节点执行，所有key需要在同一个slot；先EVALSHA，脚本不存在时再EVAL
+ */
+type clusterScript struct {
+	pool     *clusterPool
+	keyCount int
+	src      string
+	hash     string
+}
+
+func (s *clusterScript) args(spec string, keysAndArgs []interface{}) []interface{} {
+	args := make([]interface{}, 0, len(keysAndArgs)+2)
+	args = append(args, spec)
+	if s.keyCount >= 0 {
+		args = append(args, s.keyCount)
+	}
+	return append(args, keysAndArgs...)
+}
+
+func (s *clusterScript) Do(ctx context.Context, keysAndArgs ...interface{}) (interface{}, error) {
+	conn := &clusterConn{pool: s.pool, ctx: ctx}
+	defer conn.Close()
+	v, err := conn.Do("EVALSHA", s.args(s.hash, keysAndArgs)...)
+	if re, ok := err.(Error); ok && strings.HasPrefix(string(re), "NOSCRIPT ") {
+		v, err = conn.Do("EVAL", s.args(s.src, keysAndArgs)...)
+	}
+	return v, err
+}
+
+func (s *clusterScript) Hash() string {
+	return s.hash
+}
+
+// Load 在所有master节点上加载脚本
+func (s *clusterScript) Load(ctx context.Context) error {
+	addrs, err := s.pool.cl.masters()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		np, err := s.pool.node(addr)
+		if err != nil {
+			return err
+		}
+		conn, err := np.BorrowWithContext(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Do("SCRIPT", "LOAD", s.src)
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("node %s: %w", addr, err)
+		}
+	}
+	return nil
+}
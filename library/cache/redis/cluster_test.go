@@ -0,0 +1,513 @@
+package redis_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/internal/redistest"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟cluster：每个节点检查key所在slot的归属，返回MOVED或ASK，其他命令转发给节点的miniredis
+type fakeCluster struct {
+	mu    sync.Mutex
+	nodes []*fakeNode
+	owner [redis.ClusterSlots]int
+	// 迁移中的slot -> 目标节点
+	migrating map[int]int
+}
+
+type fakeNode struct {
+	fc  *fakeCluster
+	idx int
+	ln  net.Listener
+	mr  *miniredis.Miniredis
+	// miniredis关闭后Addr不可用，后台刷新slot映射时可能还有新连接
+	backend string
+	mu      sync.Mutex
+	clients []net.Conn
+}
+
+// 节点平分slot
+func newFakeCluster(n int) (*fakeCluster, error) {
+	fc := &fakeCluster{migrating: make(map[int]int)}
+	for i := 0; i < n; i++ {
+		mr, err := miniredis.Run()
+		if err != nil {
+			return nil, err
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		node := &fakeNode{fc: fc, idx: i, ln: ln, mr: mr, backend: mr.Addr()}
+		fc.nodes = append(fc.nodes, node)
+		go node.serve()
+	}
+	for slot := range fc.owner {
+		fc.owner[slot] = slot * n / redis.ClusterSlots
+	}
+	return fc, nil
+}
+
+func (fc *fakeCluster) Close() {
+	for _, node := range fc.nodes {
+		node.ln.Close()
+		node.mr.Close()
+	}
+}
+
+func (fc *fakeCluster) Addr(i int) string {
+	return fc.nodes[i].ln.Addr().String()
+}
+
+// Owner 返回key所在的节点
+func (fc *fakeCluster) Owner(key string) *fakeNode {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.nodes[fc.owner[redis.Slot(key)]]
+}
+
+// Move 把key所在的slot迁移到节点to，只迁移这个key的数据
+func (fc *fakeCluster) Move(key string, to int) {
+	from := fc.Owner(key)
+	if v, err := from.mr.Get(key); err == nil {
+		fc.nodes[to].mr.Set(key, v)
+		from.mr.Del(key)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.owner[redis.Slot(key)] = to
+}
+
+// Migrate 把key所在的slot标记为正在迁移到节点to，key的数据已经迁移
+func (fc *fakeCluster) Migrate(key string, to int) {
+	from := fc.Owner(key)
+	if v, err := from.mr.Get(key); err == nil {
+		fc.nodes[to].mr.Set(key, v)
+		from.mr.Del(key)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.migrating[redis.Slot(key)] = to
+}
+
+func (fc *fakeCluster) slotsReply() string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	ranges := make([]string, 0)
+	start := 0
+	for slot := 1; slot <= redis.ClusterSlots; slot++ {
+		if slot < redis.ClusterSlots && fc.owner[slot] == fc.owner[start] {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(fc.nodes[fc.owner[start]].ln.Addr().String())
+		ranges = append(ranges, fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*3\r\n%s:%s\r\n%s", start, slot-1, redistest.Bulk(host), port, redistest.Bulk("id")))
+		start = slot
+	}
+	return fmt.Sprintf("*%d\r\n%s", len(ranges), strings.Join(ranges, ""))
+}
+
+func (n *fakeNode) serve() {
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		n.clients = append(n.clients, conn)
+		n.mu.Unlock()
+		go n.handle(conn)
+	}
+}
+
+// Kick 断开节点上所有客户端的连接
+func (n *fakeNode) Kick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, conn := range n.clients {
+		conn.Close()
+	}
+	n.clients = nil
+}
+
+func (n *fakeNode) handle(conn net.Conn) {
+	defer conn.Close()
+	backend, err := redigo.Dial("tcp", n.backend)
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+	r := bufio.NewReader(conn)
+	asking := false
+	for {
+		args, err := redistest.ReadCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "CLUSTER":
+			io.WriteString(conn, n.fc.slotsReply())
+		case cmd == "ASKING":
+			asking = true
+			io.WriteString(conn, "+OK\r\n")
+		default:
+			if redirect := n.redirect(cmd, args[1:], asking); redirect != "" {
+				io.WriteString(conn, "-"+redirect+"\r\n")
+			} else {
+				cmdArgs := make([]interface{}, 0, len(args)-1)
+				for _, arg := range args[1:] {
+					cmdArgs = append(cmdArgs, arg)
+				}
+				io.WriteString(conn, encodeReply(backend.Do(cmd, cmdArgs...)))
+			}
+			asking = false
+		}
+	}
+}
+
+// 需要重定向时返回MOVED或ASK错误
+func (n *fakeNode) redirect(cmd string, args []string, asking bool) string {
+	key := ""
+	switch cmd {
+	case "PING", "SCRIPT", "PUBLISH":
+		return ""
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 || args[1] == "0" {
+			return ""
+		}
+		key = args[2]
+	default:
+		if len(args) == 0 {
+			return ""
+		}
+		key = args[0]
+	}
+	slot := redis.Slot(key)
+	n.fc.mu.Lock()
+	defer n.fc.mu.Unlock()
+	owner := n.fc.owner[slot]
+	to, migrating := n.fc.migrating[slot]
+	switch {
+	case owner == n.idx && migrating:
+		return fmt.Sprintf("ASK %d %s", slot, n.fc.nodes[to].ln.Addr())
+	case owner == n.idx:
+		return ""
+	case asking && migrating && to == n.idx:
+		return ""
+	default:
+		return fmt.Sprintf("MOVED %d %s", slot, n.fc.nodes[owner].ln.Addr())
+	}
+}
+
+// 转发backend的回复，redigo的status reply为string
+func encodeReply(v interface{}, err error) string {
+	if err != nil {
+		if _, ok := err.(redigo.Error); !ok {
+			err = redistest.Error("ERR " + err.Error())
+		}
+		return redistest.Encode(err)
+	}
+	return redistest.Encode(statusReply(v))
+}
+
+func statusReply(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return redistest.Status(v)
+	case []interface{}:
+		for i, e := range v {
+			v[i] = statusReply(e)
+		}
+		return v
+	}
+	return v
+}
+
+type testClusterSuite struct {
+	suite.Suite
+	fc *fakeCluster
+	r  *redis.Redis
+}
+
+func (s *testClusterSuite) SetupTest() {
+	fc, err := newFakeCluster(2)
+	s.Require().NoError(err)
+	s.fc = fc
+	c := redis.NewConfig()
+	// 第一个节点不可用
+	c.ClusterAddrs = []string{"127.0.0.1:1", fc.Addr(1)}
+	c.PingOnBorrow = 0
+	s.r = redis.New(c)
+}
+
+func (s *testClusterSuite) TearDownTest() {
+	s.r.Pool().Close()
+	s.fc.Close()
+}
+
+/*
+ * 1. 测试slot计算，与redis cluster一致
+ */
+func (s *testClusterSuite) TestSlot() {
+	assrt := assert.New(s.T())
+	assrt.Equal(12182, redis.Slot("foo"))
+	assrt.Equal(0x31C3, redis.Slot("123456789"))
+	assrt.Equal(redis.Slot("user1000"), redis.Slot("{user1000}.following"))
+	assrt.Equal(redis.Slot("{user1000}.followers"), redis.Slot("{user1000}.following"))
+	// 空tag时计算整个key
+	assrt.NotEqual(redis.Slot(""), redis.Slot("foo{}{bar}"))
+}
+
+/*
+ * 2. 测试按key所在的slot把命令发送到对应的节点
+ */
+func (s *testClusterSuite) TestRoute() {
+	assrt := assert.New(s.T())
+	p := s.r.Pool()
+	conn, err := p.Borrow()
+	assrt.NoError(err)
+	defer conn.Close()
+	for _, key := range []string{"foo", "bar"} {
+		reply, err := conn.Do("SET", key, key)
+		assrt.NoError(err)
+		assrt.Equal("OK", reply)
+		v, err := s.fc.Owner(key).mr.Get(key)
+		assrt.NoError(err)
+		assrt.Equal(key, v)
+		v2, err := redis.String(conn.Do("GET", key))
+		assrt.NoError(err)
+		assrt.Equal(key, v2)
+	}
+	assrt.NotEqual(s.fc.Owner("foo"), s.fc.Owner("bar"))
+	reply, err := conn.Do("PING")
+	assrt.NoError(err)
+	assrt.Equal("PONG", reply)
+	assrt.Equal(2, p.Stat().ActiveCount)
+}
+
+/*
+ * 3. 测试slot迁移后跟随MOVED和ASK重定向
+ */
+func (s *testClusterSuite) TestRedirect() {
+	assrt := assert.New(s.T())
+	conn, err := s.r.Pool().Borrow()
+	assrt.NoError(err)
+	defer conn.Close()
+	_, err = conn.Do("SET", "foo", "a")
+	assrt.NoError(err)
+	_, err = conn.Do("SET", "bar", "b")
+	assrt.NoError(err)
+
+	from := s.fc.Owner("foo").idx
+	s.fc.Move("foo", 1-from)
+	reply, err := redis.String(conn.Do("GET", "foo"))
+	assrt.NoError(err)
+	assrt.Equal("a", reply)
+
+	from = s.fc.Owner("bar").idx
+	s.fc.Migrate("bar", 1-from)
+	reply, err = redis.String(conn.Do("GET", "bar"))
+	assrt.NoError(err)
+	assrt.Equal("b", reply)
+	// ASK不改变slot的归属
+	assrt.Equal(from, s.fc.Owner("bar").idx)
+}
+
+/*
+ * 4. 测试pipeline按节点拆分，重定向的命令重新执行
+ */
+func (s *testClusterSuite) TestPipeline() {
+	assrt := assert.New(s.T())
+	conn, err := s.r.Pool().Borrow()
+	assrt.NoError(err)
+	defer conn.Close()
+	_, err = conn.Do("PING")
+	assrt.NoError(err)
+	s.fc.Move("key:3", 1-s.fc.Owner("key:3").idx)
+
+	pipe := s.r.Pool().Pipeline()
+	for i := 0; i < 20; i++ {
+		pipe.Send("SET", "key:"+strconv.Itoa(i), i)
+	}
+	replies, err := pipe.Exec(context.Background())
+	assrt.NoError(err)
+	assrt.NoError(replies.FirstError())
+	assrt.Equal(20, replies.Len())
+	owners := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		key := "key:" + strconv.Itoa(i)
+		node := s.fc.Owner(key)
+		owners[node.idx] = true
+		v, err := node.mr.Get(key)
+		assrt.NoError(err)
+		assrt.Equal(strconv.Itoa(i), v)
+	}
+	assrt.Len(owners, 2)
+
+	// 结果的顺序与Send的顺序一致
+	for i := 0; i < 20; i++ {
+		pipe.Send("GET", "key:"+strconv.Itoa(i))
+	}
+	replies, err = pipe.Exec(context.Background())
+	assrt.NoError(err)
+	for i := 0; i < 20; i++ {
+		n, err := replies.Int(i)
+		assrt.NoError(err)
+		assrt.Equal(i, n)
+	}
+}
+
+/*
+ * 5. 测试script按第一个key所在的节点执行
+ */
+func (s *testClusterSuite) TestScript() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	s.fc.Owner("foo").mr.Set("foo", "a")
+	s.fc.Owner("bar").mr.Set("bar", "b")
+	script := s.r.Pool().Script(1, "return redis.call('GET', KEYS[1])")
+	reply, err := redis.String(script.Do(ctx, "foo"))
+	assrt.NoError(err)
+	assrt.Equal("a", reply)
+	reply, err = redis.String(script.Do(ctx, "bar"))
+	assrt.NoError(err)
+	assrt.Equal("b", reply)
+	assrt.NoError(script.Load(ctx))
+	reply, err = redis.String(s.r.Pool().Script(-1, "return redis.call('GET', KEYS[1])").Do(ctx, 1, "bar"))
+	assrt.NoError(err)
+	assrt.Equal("b", reply)
+}
+
+/*
+ * 6. 测试事务固定在第一个key所在的节点，key需要在同一个slot
+ */
+func (s *testClusterSuite) TestTx() {
+	assrt := assert.New(s.T())
+	replies, err := redis.RunTx(context.Background(), s.r.Pool(), 1, func(tx redis.Tx) error {
+		if err := tx.Watch("{user:1}:name", "{user:1}:age"); err != nil {
+			return err
+		}
+		tx.Send("SET", "{user:1}:name", "a")
+		tx.Send("INCR", "{user:1}:age")
+		return nil
+	})
+	assrt.NoError(err)
+	assrt.NoError(replies.FirstError())
+	node := s.fc.Owner("{user:1}:name")
+	v, _ := node.mr.Get("{user:1}:age")
+	assrt.Equal("1", v)
+
+	// 没有WATCH时MULTI发送到第一个命令的key所在的节点，foo和bar在不同的节点
+	for _, tag := range []string{"{foo}", "{bar}"} {
+		replies, err = redis.RunTx(context.Background(), s.r.Pool(), 0, func(tx redis.Tx) error {
+			tx.Send("SET", tag+":name", "b")
+			tx.Send("INCR", tag+":age")
+			return nil
+		})
+		assrt.NoError(err)
+		assrt.Equal(2, replies.Len())
+		assrt.NoError(replies.FirstError())
+		v, _ = s.fc.Owner(tag).mr.Get(tag + ":age")
+		assrt.Equal("1", v)
+	}
+
+	// key不在同一个slot时返回错误，事务中的命令都不执行
+	_, err = redis.RunTx(context.Background(), s.r.Pool(), 0, func(tx redis.Tx) error {
+		tx.Send("SET", "{foo}:cross", "c")
+		tx.Send("SET", "{bar}:cross", "c")
+		return nil
+	})
+	assrt.Error(err)
+	assrt.False(s.fc.Owner("{foo}").mr.Exists("{foo}:cross"))
+	assrt.False(s.fc.Owner("{bar}").mr.Exists("{bar}:cross"))
+	tx, err := s.r.Pool().Tx(context.Background())
+	assrt.NoError(err)
+	defer tx.Close()
+	assrt.NoError(tx.Watch("{foo}:name"))
+	assrt.Error(tx.Watch("{bar}:name"))
+}
+
+/*
+ * 7. 测试BlockedConn按key发送到对应节点，PubSubConn连接任意节点
+ */
+func (s *testClusterSuite) TestBlockedConn() {
+	assrt := assert.New(s.T())
+	s.fc.Owner("test:list").mr.Lpush("test:list", "aaa")
+	bc, err := s.r.BlockedConn()
+	assrt.NoError(err)
+	defer bc.Close()
+	replies, err := redis.Strings(bc.DoWithTimeout(time.Second, "BLPOP", "test:list", 1))
+	assrt.NoError(err)
+	assrt.Equal([]string{"test:list", "aaa"}, replies)
+
+	ps, err := s.r.PubSubConn()
+	assrt.NoError(err)
+	ps.Close()
+}
+
+/*
+ * 8. 测试节点连接断开后关闭该连接，同一个Connection之后的命令重新借出节点的连接
+ */
+func (s *testClusterSuite) TestBrokenNodeConn() {
+	assrt := assert.New(s.T())
+	p := s.r.Pool()
+	conn, err := p.Borrow()
+	assrt.NoError(err)
+	defer conn.Close()
+	_, err = conn.Do("SET", "foo", "a")
+	assrt.NoError(err)
+	_, err = conn.Do("SET", "bar", "b")
+	assrt.NoError(err)
+	assrt.Equal(2, p.Stat().ActiveCount)
+
+	s.fc.Owner("foo").Kick()
+	_, err = conn.Do("SET", "foo", "c")
+	assrt.Error(err)
+	assrt.Equal(1, p.Stat().ActiveCount)
+	_, err = conn.Do("SET", "foo", "c")
+	assrt.NoError(err)
+	v, _ := s.fc.Owner("foo").mr.Get("foo")
+	assrt.Equal("c", v)
+}
+
+/*
+ * 9. 测试cluster的配置校验
+ */
+func (s *testClusterSuite) TestConfig() {
+	assrt := assert.New(s.T())
+	c := redis.NewConfig()
+	c.ClusterAddrs = []string{"127.0.0.1:7000"}
+	assrt.NoError(c.Validate("mainCache"))
+	c.Driver = redis.DriverGoRedis
+	assrt.Error(c.Validate("mainCache"))
+	assrt.Panics(func() {
+		redis.New(c)
+	})
+	c.Driver = redis.DriverRedigo
+	c.SentinelAddrs = []string{"127.0.0.1:26379"}
+	c.MasterName = "mymaster"
+	assrt.Error(c.Validate("mainCache"))
+
+	// 所有节点都不可用
+	c = redis.NewConfig()
+	c.ClusterAddrs = []string{"127.0.0.1:1"}
+	_, err := redis.New(c).Pool().Borrow()
+	assrt.Error(err)
+}
+
+func TestClusterSuite(t *testing.T) {
+	suite.Run(t, new(testClusterSuite))
+}
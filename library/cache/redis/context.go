@@ -0,0 +1,104 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrConnCanceled 命令被ctx取消后，连接上可能还有没有读取的回复，不能继续使用
+var ErrConnCanceled = errors.New("redis: connection is unusable after a canceled command")
+
+/*
+ * 执行do直到完成或ctx结束，ctx结束时立即返回ctx.Err()，不等待redis的回复
+ * abort不为nil时在ctx结束后调用，用于关闭独占的连接，中断阻塞的读
+ * 返回的pending不为nil表示do还在后台执行，结束后关闭，调用方在此之后才能归还连接
+ */
+func doContext(ctx context.Context, abort func(), do func() (interface{}, error)) (interface{}, chan struct{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if ctx.Done() == nil {
+		v, err := do()
+		return v, nil, err
+	}
+	type result struct {
+		v   interface{}
+		err error
+	}
+	ch := make(chan result, 1)
+	pending := make(chan struct{})
+	go func() {
+		defer close(pending)
+		v, err := do()
+		ch <- result{v, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.v, nil, r.err
+	case <-ctx.Done():
+		if abort != nil {
+			abort()
+		}
+		return nil, pending, ctx.Err()
+	}
+}
+
+// ctx的剩余时间作为读超时，不超过limit；limit为0时不限制
+func contextTimeout(ctx context.Context, limit time.Duration) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return limit, limit > 0
+	}
+	t := time.Until(deadline)
+	if limit > 0 && limit < t {
+		t = limit
+	}
+	return t, true
+}
+
+/*
+ * 可以被ctx中断的Receive，中断时后台的Receive继续执行，结果由下一次Receive返回
+ * 中断不会关闭订阅连接，也不会丢失消息；与Receive一样只能在一个goroutine中调用
+ */
+type ctxReceiver struct {
+	pending chan interface{}
+}
+
+func (r *ctxReceiver) receive(ctx context.Context, recv func() interface{}) interface{} {
+	ch := r.pending
+	r.pending = nil
+	if ch == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if ctx.Done() == nil {
+			return recv()
+		}
+		ch = make(chan interface{}, 1)
+		go func() {
+			ch <- recv()
+		}()
+	}
+	select {
+	case m := <-ch:
+		return m
+	case <-ctx.Done():
+		r.pending = ch
+		return ctx.Err()
+	}
+}
+
+// 有没有返回的Receive时等待它的结果，最多等待timeout
+func (r *ctxReceiver) receiveWithTimeout(timeout time.Duration, recv func(time.Duration) interface{}) interface{} {
+	if r.pending == nil {
+		return recv(timeout)
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return r.receive(ctx, nil)
+}
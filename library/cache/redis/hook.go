@@ -0,0 +1,205 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Hook 在Connection的命令、Pipeline的Exec和Script的Do前后调用，用于日志、指标和链路追踪
+ * 多个Hook按注册顺序调用Before，逆序调用After；BlockedConn和PubSub的命令不经过Hook
+ */
+type Hook interface {
+	// 命令执行前调用，返回的ctx传给后面的Hook、命令本身和这个Hook的After
+	Before(ctx context.Context, info *CmdInfo) context.Context
+	// 命令执行后调用，info.Duration和info.Err已经设置
+	After(ctx context.Context, info *CmdInfo)
+}
+
+// CmdInfo 传给Hook的命令信息
+type CmdInfo struct {
+	// 大写的命令名，Pipeline为PIPELINE，Script为EVALSHA
+	Name string
+	// 第一个key，没有key的命令为空；Pipeline为第一个命令的key
+	Key string
+	// 命令的参数，Pipeline为nil
+	Args []interface{}
+	// Pipeline中的命令数，其他为1
+	Count    int
+	Duration time.Duration
+	// 连接错误或服务端错误，Pipeline为Exec的错误或第一个命令的错误
+	Err error
+}
+
+const (
+	pipelineCmdName = "PIPELINE"
+	scriptCmdName   = "EVALSHA"
+)
+
+// AddHook 注册Hook，可以在Pool创建之后调用，对已经借出的连接也生效
+func (r *Redis) AddHook(hooks ...Hook) {
+	r.hooks.add(hooks...)
+}
+
+// copy-on-write，执行命令时不加锁
+type hookChain struct {
+	mu    sync.Mutex
+	hooks atomic.Value
+}
+
+func (c *hookChain) add(hooks ...Hook) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.load()
+	c.hooks.Store(append(old[:len(old):len(old)], hooks...))
+}
+
+func (c *hookChain) load() []Hook {
+	hooks, _ := c.hooks.Load().([]Hook)
+	return hooks
+}
+
+// 每个Hook的After收到自己的Before返回的ctx
+func (c *hookChain) process(ctx context.Context, hooks []Hook, info *CmdInfo, fn func(ctx context.Context) error) {
+	ctxs := make([]context.Context, len(hooks))
+	for i, h := range hooks {
+		ctx = h.Before(ctx, info)
+		ctxs[i] = ctx
+	}
+	start := time.Now()
+	info.Err = fn(ctx)
+	info.Duration = time.Since(start)
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i].After(ctxs[i], info)
+	}
+}
+
+func newCmdInfo(command string, args []interface{}) *CmdInfo {
+	key, _ := commandKey(command, args)
+	return &CmdInfo{Name: strings.ToUpper(command), Key: key, Args: args, Count: 1}
+}
+
+/* *********************************
+ * ******** pool with hooks ********
+ * *********************************/
+
+// 包装driver和cluster的Pool，没有注册Hook时直接调用
+type hookPool struct {
+	Pool
+	chain *hookChain
+}
+
+func newHookPool(p Pool, chain *hookChain) *hookPool {
+	return &hookPool{Pool: p, chain: chain}
+}
+
+func (p *hookPool) Borrow() (Connection, error) {
+	conn, err := p.Pool.Borrow()
+	if err != nil {
+		return nil, err
+	}
+	return &hookConn{Connection: conn, chain: p.chain}, nil
+}
+
+func (p *hookPool) BorrowWithContext(ctx context.Context) (Connection, error) {
+	conn, err := p.Pool.BorrowWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &hookConn{Connection: conn, chain: p.chain}, nil
+}
+
+func (p *hookPool) Pipeline() Pipeline {
+	return &hookPipeline{Pipeline: p.Pool.Pipeline(), chain: p.chain}
+}
+
+func (p *hookPool) Script(keyCnt int, src string) Script {
+	return &hookScript{Script: p.Pool.Script(keyCnt, src), chain: p.chain, keyCnt: keyCnt}
+}
+
+// 事务中的命令通过hookConn执行，MULTI、EXEC分别调用Hook
+func (p *hookPool) Tx(ctx context.Context) (Tx, error) {
+	return newTx(ctx, p)
+}
+
+type hookConn struct {
+	Connection
+	chain *hookChain
+}
+
+func (c *hookConn) Do(command string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), command, args...)
+}
+
+func (c *hookConn) DoContext(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	hooks := c.chain.load()
+	if len(hooks) == 0 {
+		return c.Connection.DoContext(ctx, command, args...)
+	}
+	info := newCmdInfo(command, args)
+	v := interface{}(nil)
+	c.chain.process(ctx, hooks, info, func(ctx context.Context) (err error) {
+		v, err = c.Connection.DoContext(ctx, command, args...)
+		return err
+	})
+	return v, info.Err
+}
+
+type hookPipeline struct {
+	Pipeline
+	chain *hookChain
+	count int
+	key   string
+}
+
+func (p *hookPipeline) Send(command string, args ...interface{}) {
+	if p.count == 0 {
+		p.key, _ = commandKey(command, args)
+	}
+	p.count++
+	p.Pipeline.Send(command, args...)
+}
+
+func (p *hookPipeline) Exec(ctx context.Context) (*Replies, error) {
+	info := &CmdInfo{Name: pipelineCmdName, Key: p.key, Count: p.count}
+	p.count, p.key = 0, ""
+	hooks := p.chain.load()
+	if len(hooks) == 0 || info.Count == 0 {
+		return p.Pipeline.Exec(ctx)
+	}
+	var rs *Replies
+	err := error(nil)
+	p.chain.process(ctx, hooks, info, func(ctx context.Context) error {
+		if rs, err = p.Pipeline.Exec(ctx); err != nil {
+			return err
+		}
+		return rs.FirstError()
+	})
+	return rs, err
+}
+
+type hookScript struct {
+	Script
+	chain  *hookChain
+	keyCnt int
+}
+
+func (s *hookScript) Do(ctx context.Context, keysAndArgs ...interface{}) (interface{}, error) {
+	hooks := s.chain.load()
+	if len(hooks) == 0 {
+		return s.Script.Do(ctx, keysAndArgs...)
+	}
+	info := &CmdInfo{Name: scriptCmdName, Args: keysAndArgs, Count: 1}
+	if s.keyCnt > 0 && len(keysAndArgs) > 0 {
+		info.Key = keyString(keysAndArgs[0])
+	}
+	v := interface{}(nil)
+	s.chain.process(ctx, hooks, info, func(ctx context.Context) (err error) {
+		v, err = s.Script.Do(ctx, keysAndArgs...)
+		return err
+	})
+	return v, info.Err
+}
@@ -0,0 +1,222 @@
+package hook_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/hook"
+	"meross_iot/library/internal/redistest"
+	"testing"
+	"time"
+)
+
+type ctxKey string
+
+// 按调用顺序记录Before和After
+type recorder struct {
+	name  string
+	calls *[]string
+	infos []redis.CmdInfo
+	// After收到的ctx
+	ctxs []context.Context
+}
+
+func (h *recorder) Before(ctx context.Context, info *redis.CmdInfo) context.Context {
+	*h.calls = append(*h.calls, h.name+".before")
+	return context.WithValue(ctx, ctxKey(h.name), info.Name)
+}
+
+func (h *recorder) After(ctx context.Context, info *redis.CmdInfo) {
+	*h.calls = append(*h.calls, h.name+".after")
+	h.ctxs = append(h.ctxs, ctx)
+	if ctx.Value(ctxKey(h.name)) == info.Name {
+		h.infos = append(h.infos, *info)
+	}
+}
+
+type testHookSuite struct {
+	suite.Suite
+	driver string
+	mr     *miniredis.Miniredis
+	rc     *redis.Redis
+}
+
+func (s *testHookSuite) SetupTest() {
+	mr, err := miniredis.Run()
+	s.Require().NoError(err)
+	s.mr = mr
+	c := redistest.Config(mr.Addr(), s.driver)
+	s.rc = redis.New(c)
+}
+
+func (s *testHookSuite) TearDownTest() {
+	s.rc.Pool().Close()
+	s.mr.Close()
+}
+
+/*
+ * 1. 测试Hook的调用顺序、After收到的ctx和命令信息，包括Do、Pipeline、Script和事务
+ */
+func (s *testHookSuite) TestChain() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	conn, err := s.rc.Pool().Borrow()
+	assrt.NoError(err)
+	defer conn.Close()
+	// 注册之前借出的连接也生效
+	calls := make([]string, 0)
+	a, b := &recorder{name: "a", calls: &calls}, &recorder{name: "b", calls: &calls}
+	s.rc.AddHook(a, b)
+	_, err = conn.Do("set", "test:a", "1")
+	assrt.NoError(err)
+	assrt.Equal([]string{"a.before", "b.before", "b.after", "a.after"}, calls)
+	assrt.Equal(1, len(a.infos))
+	// 每个Hook的After收到自己的Before返回的ctx
+	assrt.Nil(a.ctxs[0].Value(ctxKey("b")))
+	assrt.Equal("SET", b.ctxs[0].Value(ctxKey("a")))
+	assrt.Equal("SET", b.ctxs[0].Value(ctxKey("b")))
+	info := b.infos[0]
+	assrt.Equal("SET", info.Name)
+	assrt.Equal("test:a", info.Key)
+	assrt.Equal([]interface{}{"test:a", "1"}, info.Args)
+	assrt.Equal(1, info.Count)
+	assrt.True(info.Duration > 0)
+	assrt.NoError(info.Err)
+
+	_, err = conn.Do("LPUSH", "test:a", "2")
+	assrt.Error(err)
+	assrt.Equal(err, b.infos[1].Err)
+	conn.Do("PING")
+	assrt.Equal("", b.infos[2].Key)
+
+	pipe := s.rc.Pool().Pipeline()
+	pipe.Send("GET", "test:a")
+	pipe.Send("INCR", "test:a")
+	pipe.Send("INCR", "test:b")
+	rs, err := pipe.Exec(ctx)
+	assrt.NoError(err)
+	assrt.Equal(3, rs.Len())
+	info = b.infos[3]
+	assrt.Equal(redis.CmdInfo{Name: "PIPELINE", Key: "test:a", Count: 3, Duration: info.Duration, Err: rs.FirstError()}, info)
+	// 没有命令的pipeline不调用Hook
+	_, err = pipe.Exec(ctx)
+	assrt.NoError(err)
+	assrt.Equal(4, len(b.infos))
+
+	v, err := redis.Int(s.rc.Pool().Script(1, "return redis.call('INCR', KEYS[1])").Do(ctx, "test:b"))
+	assrt.NoError(err)
+	assrt.Equal(2, v)
+	info = b.infos[4]
+	assrt.Equal("EVALSHA", info.Name)
+	assrt.Equal("test:b", info.Key)
+
+	tx, err := s.rc.Pool().Tx(ctx)
+	assrt.NoError(err)
+	tx.Send("INCR", "test:b")
+	_, err = tx.Exec()
+	assrt.NoError(err)
+	tx.Close()
+	names := make([]string, 0)
+	for _, info := range b.infos[5:] {
+		names = append(names, info.Name)
+	}
+	assrt.Equal([]string{"MULTI", "INCR", "EXEC"}, names)
+	assrt.Equal(len(b.infos), len(a.infos))
+}
+
+/*
+ * 2. 测试只记录超过阈值的命令
+ */
+func (s *testHookSuite) TestSlowLog() {
+	assrt := assert.New(s.T())
+	buf := &bytes.Buffer{}
+	slow := hook.NewSlowLog(time.Hour)
+	slow.SetLogger(zerolog.New(buf))
+	s.rc.AddHook(slow)
+	conn, _ := s.rc.Pool().Borrow()
+	conn.Do("SET", "test:a", "1")
+	assrt.Equal(0, buf.Len())
+
+	slow = hook.NewSlowLog(time.Nanosecond)
+	slow.SetLogger(zerolog.New(buf))
+	s.rc.AddHook(slow)
+	conn.Do("LPUSH", "test:a", "1")
+	conn.Close()
+	entry := make(map[string]interface{})
+	assrt.NoError(json.Unmarshal(buf.Bytes(), &entry))
+	assrt.Equal("warn", entry["level"])
+	assrt.Equal("LPUSH", entry["cmd"])
+	assrt.Equal("test:a", entry["key"])
+	assrt.Contains(entry["error"], "WRONGTYPE")
+	assrt.Equal("slow redis command", entry["message"])
+	assrt.NotContains(buf.String(), `"1"`)
+
+	buf.Reset()
+	pipe := s.rc.Pool().Pipeline()
+	pipe.Send("GET", "test:a")
+	pipe.Send("GET", "test:b")
+	pipe.Exec(context.Background())
+	entry = make(map[string]interface{})
+	assrt.NoError(json.Unmarshal(buf.Bytes(), &entry))
+	assrt.Equal("PIPELINE", entry["cmd"])
+	assrt.Equal(float64(2), entry["count"])
+}
+
+/*
+ * 3. 测试每个命令一个client span，出错时记录错误状态，span的parent为调用方的span
+ */
+func (s *testHookSuite) TestTracing() {
+	assrt := assert.New(s.T())
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	s.rc.AddHook(hook.NewTracing(tp))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	conn, _ := s.rc.Pool().BorrowWithContext(ctx)
+	conn.DoContext(ctx, "SET", "test:a", "1")
+	conn.DoContext(ctx, "LPUSH", "test:a", "1")
+	conn.Close()
+	pipe := s.rc.Pool().Pipeline()
+	pipe.Send("GET", "test:a")
+	pipe.Send("GET", "test:b")
+	pipe.Exec(ctx)
+	parent.End()
+
+	spans := sr.Ended()
+	assrt.Equal(4, len(spans))
+	set := spans[0]
+	assrt.Equal("SET", set.Name())
+	assrt.Equal(trace.SpanKindClient, set.SpanKind())
+	assrt.Equal(parent.SpanContext().SpanID(), set.Parent().SpanID())
+	assrt.Equal(codes.Unset, set.Status().Code)
+	assrt.Contains(set.Attributes(), attribute.String("db.system", "redis"))
+	assrt.Contains(set.Attributes(), attribute.String("db.statement", "SET test:a"))
+
+	lpush := spans[1]
+	assrt.Equal(codes.Error, lpush.Status().Code)
+	assrt.Contains(lpush.Status().Description, "WRONGTYPE")
+	assrt.Equal(1, len(lpush.Events()))
+
+	pipeline := spans[2]
+	assrt.Equal("PIPELINE", pipeline.Name())
+	assrt.Contains(pipeline.Attributes(), attribute.Int("db.redis.pipeline_length", 2))
+	assrt.Equal("request", spans[3].Name())
+}
+
+func TestHookRedigoSuite(t *testing.T) {
+	suite.Run(t, &testHookSuite{driver: redis.DriverRedigo})
+}
+
+func TestHookGoRedisSuite(t *testing.T) {
+	suite.Run(t, &testHookSuite{driver: redis.DriverGoRedis})
+}
@@ -0,0 +1,56 @@
+package hook
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/logger"
+	"sync"
+	"time"
+)
+
+const DefaultSlowThreshold = 100 * time.Millisecond
+
+// SlowLog 记录耗时超过阈值的命令，默认通过library/logger以warn级别输出
+type SlowLog struct {
+	threshold time.Duration
+	mu        sync.Mutex
+	log       func() *zerolog.Event
+}
+
+// NewSlowLog threshold为0时使用DefaultSlowThreshold
+func NewSlowLog(threshold time.Duration) *SlowLog {
+	if threshold <= 0 {
+		threshold = DefaultSlowThreshold
+	}
+	return &SlowLog{threshold: threshold, log: logger.Warn}
+}
+
+// SetLogger 使用指定的logger输出，用于需要单独输出慢命令日志的场景
+func (h *SlowLog) SetLogger(l zerolog.Logger) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.log = l.Warn
+}
+
+func (h *SlowLog) Before(ctx context.Context, info *redis.CmdInfo) context.Context {
+	return ctx
+}
+
+// 只记录key，不记录参数，避免日志中出现缓存的内容
+func (h *SlowLog) After(ctx context.Context, info *redis.CmdInfo) {
+	if info.Duration < h.threshold {
+		return
+	}
+	h.mu.Lock()
+	log := h.log
+	h.mu.Unlock()
+	e := log().Str("cmd", info.Name).Dur("cost", info.Duration)
+	if info.Key != "" {
+		e = e.Str("key", info.Key)
+	}
+	if info.Count > 1 {
+		e = e.Int("count", info.Count)
+	}
+	e.Err(info.Err).Msg("slow redis command")
+}
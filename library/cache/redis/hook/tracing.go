@@ -0,0 +1,53 @@
+package hook
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"meross_iot/library/cache/redis"
+)
+
+const tracerName = "meross_iot/library/cache/redis"
+
+var pipelineLengthKey = attribute.Key("db.redis.pipeline_length")
+
+// Tracing 为每个命令创建一个client span，span名为命令名，pipeline为PIPELINE
+type Tracing struct {
+	tracer trace.Tracer
+}
+
+// NewTracing tp为nil时使用otel的全局TracerProvider
+func NewTracing(tp trace.TracerProvider) *Tracing {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Tracing{tracer: tp.Tracer(tracerName)}
+}
+
+// 只记录命令名和key，不记录参数
+func (h *Tracing) Before(ctx context.Context, info *redis.CmdInfo) context.Context {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemRedis,
+		semconv.DBOperationKey.String(info.Name),
+	}
+	if info.Key != "" {
+		attrs = append(attrs, semconv.DBStatementKey.String(info.Name+" "+info.Key))
+	}
+	if info.Count > 1 {
+		attrs = append(attrs, pipelineLengthKey.Int(info.Count))
+	}
+	ctx, _ = h.tracer.Start(ctx, info.Name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return ctx
+}
+
+func (h *Tracing) After(ctx context.Context, info *redis.CmdInfo) {
+	span := trace.SpanFromContext(ctx)
+	if info.Err != nil {
+		span.RecordError(info.Err)
+		span.SetStatus(codes.Error, info.Err.Error())
+	}
+	span.End()
+}
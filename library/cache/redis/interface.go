@@ -18,10 +18,14 @@ type Connection interface {
 	Close() error
 	Error() error
 	Do(command string, args ...interface{}) (reply interface{}, err error)
+	// ctx的deadline作为读超时(不超过配置的ReadTimeout)，ctx取消时立即返回ctx.Err()，之后连接只能Close
+	DoContext(ctx context.Context, command string, args ...interface{}) (reply interface{}, err error)
 }
 
 type BlockedConn interface {
 	DoWithTimeout(timeout time.Duration, command string, args ...interface{}) (reply interface{}, err error)
+	// ctx的deadline作为读超时，ctx取消时关闭连接中断阻塞的命令，之后连接只能Close
+	DoContext(ctx context.Context, command string, args ...interface{}) (reply interface{}, err error)
 	Close() error
 }
 
@@ -30,8 +34,12 @@ type Pool interface {
 	BorrowWithContext(ctx context.Context) (Connection, error)
 	Close() error
 	Stat() *PoolStat
+	// 运行中调整连接数上限，用于配置热加载
+	SetLimits(maxActive, maxIdle int) error
 	Pipeline() Pipeline
 	Script(int, string) Script
+	// 借出一个连接执行MULTI/EXEC事务，用完后必须Close
+	Tx(ctx context.Context) (Tx, error)
 }
 
 /* *********************************
@@ -49,14 +57,31 @@ type cmd struct {
 }
 
 type reply struct {
+	cmd   *cmd
 	reply interface{}
 	err   error
 }
 
+// Replies pipeline的执行结果，顺序与Send的顺序一致，访问方法见replies.go
 type Replies struct {
 	replies []*reply
 }
 
+/* *********************************
+ * ******* redis transaction *******
+ * *********************************/
+
+type Tx interface {
+	// 在事务之前监视key，key在EXEC之前被修改时Exec返回ErrTxConflict
+	Watch(keys ...interface{}) error
+	// 在事务之前立即执行命令，用于读取监视的key
+	Do(cmd string, args ...interface{}) (reply interface{}, err error)
+	// 将命令加入事务，Exec时执行
+	Send(cmd string, args ...interface{})
+	Exec() (*Replies, error)
+	Close() error
+}
+
 /* *********************************
  * ********* redis script **********
  * *********************************/
@@ -108,5 +133,7 @@ type PubSub interface {
 	PUnsubscribe(channels ...interface{}) error
 	Receive() interface{}
 	ReceiveWithTimeout(timeout time.Duration) interface{}
+	// ctx结束时返回ctx.Err()，不关闭连接，还没有收到的消息由下一次Receive返回
+	ReceiveContext(ctx context.Context) interface{}
 	Ping(string) error
 }
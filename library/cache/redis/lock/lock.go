@@ -0,0 +1,375 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/configurator/validate"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPrefix     = "lock:"
+	DefaultTTL        = 10 * time.Second
+	DefaultRetryDelay = 100 * time.Millisecond
+
+	// 各实例之间的时钟漂移，按TTL的比例加上固定值计算，见Redlock算法
+	clockDriftFactor = 0.01
+	clockDriftMin    = 2 * time.Millisecond
+)
+
+var (
+	// ErrNotObtained 锁被其他客户端持有
+	ErrNotObtained = errors.New("redis lock: not obtained")
+	// ErrNotHeld 锁已过期或被其他客户端获取，续期和释放失败
+	ErrNotHeld = errors.New("redis lock: not held")
+)
+
+// token相同时才删除，避免删除其他客户端获取的锁
+const releaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+const extendScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`
+
+// Config 分布式锁的配置
+type Config struct {
+	// key的前缀
+	Prefix string
+	// 锁的过期时间，持有锁的进程异常退出后最多TTL后锁被释放
+	TTL time.Duration `validate:"gt=0"`
+	// 持有期间每隔TTL/3自动续期
+	AutoExtend bool
+	// Obtain获取失败后重试的间隔
+	RetryDelay time.Duration `validate:"gt=0"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Prefix:     DefaultPrefix,
+		TTL:        DefaultTTL,
+		AutoExtend: true,
+		RetryDelay: DefaultRetryDelay,
+	}
+}
+
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (c *Config) Validate(section string) error {
+	return validate.Struct(section, c)
+}
+
+/*
+ * Locker 基于SET NX PX的分布式锁
+ * 传入多个相互独立的Redis实例时使用Redlock算法，在多数实例上获取成功才算获取到锁，实例数量建议为奇数
+ */
+type Locker struct {
+	conf      *Config
+	instances []*instance
+	quorum    int
+}
+
+type instance struct {
+	pool    redis.Pool
+	release redis.Script
+	extend  redis.Script
+}
+
+func New(c *Config, rs ...*redis.Redis) *Locker {
+	if err := c.Validate("lock"); err != nil {
+		panic(fmt.Errorf("wrong lock config, %s\n", err))
+	}
+	if len(rs) == 0 {
+		panic(fmt.Errorf("lock needs at least one redis instance\n"))
+	}
+	l := &Locker{conf: c, quorum: len(rs)/2 + 1}
+	for _, r := range rs {
+		p := r.Pool()
+		l.instances = append(l.instances, &instance{
+			pool:    p,
+			release: p.Script(1, releaseScript),
+			extend:  p.Script(1, extendScript),
+		})
+	}
+	return l
+}
+
+// TryObtain 只尝试一次，锁被其他客户端持有时返回ErrNotObtained
+func (l *Locker) TryObtain(ctx context.Context, key string) (*Lock, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	key = l.conf.Prefix + key
+	start := time.Now()
+	ok, err := l.each(ctx, func(ctx context.Context, in *instance) (bool, error) {
+		v, err := in.do(ctx, "SET", key, token, "NX", "PX", l.conf.TTL.Milliseconds())
+		return v != nil, err
+	})
+	until := l.validUntil(start)
+	if ok < l.quorum || !time.Now().Before(until) {
+		// 释放在部分实例上获取到的锁
+		l.release(context.Background(), key, token)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrNotObtained
+	}
+	lk := &Lock{
+		l:     l,
+		key:   key,
+		token: token,
+		until: until,
+		lost:  make(chan struct{}),
+		stop:  make(chan struct{}),
+	}
+	if l.conf.AutoExtend {
+		go lk.autoExtend()
+	}
+	return lk, nil
+}
+
+// Obtain 每隔RetryDelay重试直到获取成功，ctx结束时返回ctx.Err()
+func (l *Locker) Obtain(ctx context.Context, key string) (*Lock, error) {
+	for {
+		lk, err := l.TryObtain(ctx, key)
+		if err != ErrNotObtained {
+			return lk, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.conf.RetryDelay):
+		}
+	}
+}
+
+/*
+ * Run 获取锁后执行fn，fn返回后释放锁，用于只能在一个实例上运行的任务
+ * 续期失败、锁丢失时取消传给fn的ctx，fn应该尽快返回
+ */
+func (l *Locker) Run(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	lk, err := l.Obtain(ctx, key)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-lk.Lost():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	fnErr := fn(ctx)
+	// ctx可能已经取消，释放锁使用新的ctx
+	rctx, rcancel := context.WithTimeout(context.Background(), l.conf.TTL)
+	defer rcancel()
+	if err := lk.Release(rctx); err != nil && err != ErrNotHeld && fnErr == nil {
+		return err
+	}
+	return fnErr
+}
+
+// 减去获取用的时间和时钟漂移后锁的有效期
+func (l *Locker) validUntil(start time.Time) time.Time {
+	drift := time.Duration(float64(l.conf.TTL)*clockDriftFactor) + clockDriftMin
+	return start.Add(l.conf.TTL - drift)
+}
+
+// 在所有实例上并发执行fn，返回成功的数量；无法达到多数时返回第一个错误
+func (l *Locker) each(ctx context.Context, fn func(ctx context.Context, in *instance) (bool, error)) (int, error) {
+	type result struct {
+		ok  bool
+		err error
+	}
+	results := make(chan result, len(l.instances))
+	for _, in := range l.instances {
+		go func(in *instance) {
+			ok, err := fn(ctx, in)
+			results <- result{ok, err}
+		}(in)
+	}
+	ok, failed := 0, 0
+	firstErr := error(nil)
+	for range l.instances {
+		r := <-results
+		switch {
+		case r.err != nil:
+			failed++
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		case r.ok:
+			ok++
+		}
+	}
+	if failed > len(l.instances)-l.quorum {
+		return ok, firstErr
+	}
+	return ok, nil
+}
+
+func (l *Locker) release(ctx context.Context, key, token string) (int, error) {
+	return l.each(ctx, func(ctx context.Context, in *instance) (bool, error) {
+		n, err := redis.Int(in.release.Do(ctx, key, token))
+		return n == 1, err
+	})
+}
+
+func (in *instance) do(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	conn, err := in.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.DoContext(ctx, command, args...)
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Lock 已获取的锁，用完后必须Release
+type Lock struct {
+	l     *Locker
+	key   string
+	token string
+
+	mu       sync.Mutex
+	until    time.Time
+	released bool
+	// 锁丢失或释放后关闭
+	lost chan struct{}
+	// 停止自动续期
+	stop chan struct{}
+}
+
+// Key 包含前缀的完整key
+func (lk *Lock) Key() string {
+	return lk.key
+}
+
+// Token 锁的随机值，用于区分持有者
+func (lk *Lock) Token() string {
+	return lk.token
+}
+
+// TTL 剩余的有效期，已过期或释放时为0
+func (lk *Lock) TTL() time.Duration {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	if lk.released {
+		return 0
+	}
+	if d := time.Until(lk.until); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Lost 锁丢失(续期失败直到过期)或释放后关闭
+func (lk *Lock) Lost() <-chan struct{} {
+	return lk.lost
+}
+
+// Extend 把有效期重置为TTL，锁已被其他客户端获取时返回ErrNotHeld
+func (lk *Lock) Extend(ctx context.Context) error {
+	lk.mu.Lock()
+	released := lk.released
+	lk.mu.Unlock()
+	if released {
+		return ErrNotHeld
+	}
+	start := time.Now()
+	ttl := lk.l.conf.TTL.Milliseconds()
+	ok, err := lk.l.each(ctx, func(ctx context.Context, in *instance) (bool, error) {
+		n, err := redis.Int(in.extend.Do(ctx, lk.key, lk.token, ttl))
+		return n == 1, err
+	})
+	if err != nil {
+		return err
+	}
+	until := lk.l.validUntil(start)
+	if ok < lk.l.quorum || !time.Now().Before(until) {
+		lk.markLost()
+		return ErrNotHeld
+	}
+	lk.mu.Lock()
+	lk.until = until
+	lk.mu.Unlock()
+	return nil
+}
+
+// Release 释放锁并停止自动续期，锁已过期或被其他客户端获取时返回ErrNotHeld
+func (lk *Lock) Release(ctx context.Context) error {
+	lk.mu.Lock()
+	if lk.released {
+		lk.mu.Unlock()
+		return ErrNotHeld
+	}
+	lk.released = true
+	close(lk.stop)
+	lk.mu.Unlock()
+	lk.markLost()
+	ok, err := lk.l.release(ctx, lk.key, lk.token)
+	if err != nil {
+		return err
+	}
+	if ok < lk.l.quorum {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+func (lk *Lock) markLost() {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	select {
+	case <-lk.lost:
+	default:
+		close(lk.lost)
+	}
+}
+
+// 续期出错(如网络中断)时继续重试，直到有效期结束才认为锁丢失
+func (lk *Lock) autoExtend() {
+	interval := lk.l.conf.TTL / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lk.stop:
+			return
+		case <-lk.lost:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := lk.Extend(ctx)
+		cancel()
+		if err == ErrNotHeld {
+			return
+		}
+		if err != nil && lk.TTL() == 0 {
+			lk.markLost()
+			return
+		}
+	}
+}
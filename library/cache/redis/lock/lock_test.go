@@ -0,0 +1,209 @@
+package lock_test
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/lock"
+	"meross_iot/library/internal/redistest"
+	"testing"
+	"time"
+)
+
+type testLockSuite struct {
+	suite.Suite
+	mrs []*miniredis.Miniredis
+	rs  []*redis.Redis
+}
+
+// 3个实例，单实例的测试只使用第一个
+func (s *testLockSuite) SetupTest() {
+	s.mrs, s.rs = nil, nil
+	for i := 0; i < 3; i++ {
+		mr, err := miniredis.Run()
+		s.Require().NoError(err)
+		c := redistest.Config(mr.Addr(), "")
+		s.mrs = append(s.mrs, mr)
+		s.rs = append(s.rs, redis.New(c))
+	}
+}
+
+func (s *testLockSuite) TearDownTest() {
+	for i := range s.mrs {
+		s.rs[i].Pool().Close()
+		s.mrs[i].Close()
+	}
+}
+
+func (s *testLockSuite) conf() *lock.Config {
+	c := lock.NewConfig()
+	c.TTL = time.Second
+	c.AutoExtend = false
+	c.RetryDelay = 20 * time.Millisecond
+	return c
+}
+
+/*
+ * 1. 测试获取和释放锁
+ */
+func (s *testLockSuite) TestObtainRelease() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	l := lock.New(s.conf(), s.rs[0])
+	lk, err := l.TryObtain(ctx, "job")
+	assrt.NoError(err)
+	assrt.Equal("lock:job", lk.Key())
+	v, _ := s.mrs[0].Get("lock:job")
+	assrt.Equal(lk.Token(), v)
+	assrt.True(lk.TTL() > 900*time.Millisecond)
+
+	_, err = l.TryObtain(ctx, "job")
+	assrt.Equal(lock.ErrNotObtained, err)
+
+	assrt.NoError(lk.Release(ctx))
+	assrt.False(s.mrs[0].Exists("lock:job"))
+	assrt.Equal(time.Duration(0), lk.TTL())
+	assrt.Equal(lock.ErrNotHeld, lk.Release(ctx))
+	select {
+	case <-lk.Lost():
+	default:
+		assrt.Fail("lost channel should be closed after release")
+	}
+
+	// 锁过期后被其他客户端获取，不能释放其他客户端的锁
+	lk, err = l.TryObtain(ctx, "job")
+	assrt.NoError(err)
+	s.mrs[0].Set("lock:job", "other")
+	assrt.Equal(lock.ErrNotHeld, lk.Extend(ctx))
+	assrt.Equal(lock.ErrNotHeld, lk.Release(ctx))
+	v, _ = s.mrs[0].Get("lock:job")
+	assrt.Equal("other", v)
+}
+
+/*
+ * 2. 测试Obtain等待锁释放，ctx结束时返回
+ */
+func (s *testLockSuite) TestObtainWait() {
+	assrt := assert.New(s.T())
+	l := lock.New(s.conf(), s.rs[0])
+	lk, err := l.Obtain(context.Background(), "job")
+	assrt.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = l.Obtain(ctx, "job")
+	cancel()
+	assrt.Equal(context.DeadlineExceeded, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lk.Release(context.Background())
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	lk2, err := l.Obtain(ctx, "job")
+	assrt.NoError(err)
+	assrt.NotEqual(lk.Token(), lk2.Token())
+	lk2.Release(ctx)
+}
+
+/*
+ * 3. 测试自动续期，锁被其他客户端获取后Run取消fn的ctx
+ */
+func (s *testLockSuite) TestAutoExtend() {
+	assrt := assert.New(s.T())
+	c := s.conf()
+	c.TTL = 300 * time.Millisecond
+	c.AutoExtend = true
+	l := lock.New(c, s.rs[0])
+	lk, err := l.TryObtain(context.Background(), "job")
+	assrt.NoError(err)
+	// miniredis的过期时间不会自动减少，用FastForward模拟时间流逝
+	s.mrs[0].FastForward(250 * time.Millisecond)
+	assrt.True(s.mrs[0].TTL("lock:job") <= 50*time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	assrt.Equal(300*time.Millisecond, s.mrs[0].TTL("lock:job"))
+	assrt.True(lk.TTL() > 0)
+	lk.Release(context.Background())
+
+	err = l.Run(context.Background(), "job", func(ctx context.Context) error {
+		s.mrs[0].Set("lock:job", "other")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	})
+	assrt.Equal(context.Canceled, err)
+	v, _ := s.mrs[0].Get("lock:job")
+	assrt.Equal("other", v)
+
+	// 正常返回后释放锁
+	err = l.Run(context.Background(), "task", func(ctx context.Context) error {
+		assrt.True(s.mrs[0].Exists("lock:task"))
+		return nil
+	})
+	assrt.NoError(err)
+	assrt.False(s.mrs[0].Exists("lock:task"))
+}
+
+/*
+ * 4. 测试Redlock，多数实例获取成功才算获取到锁
+ */
+func (s *testLockSuite) TestRedlock() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	l := lock.New(s.conf(), s.rs...)
+	lk, err := l.TryObtain(ctx, "job")
+	assrt.NoError(err)
+	for _, mr := range s.mrs {
+		v, _ := mr.Get("lock:job")
+		assrt.Equal(lk.Token(), v)
+	}
+	assrt.NoError(lk.Extend(ctx))
+	assrt.NoError(lk.Release(ctx))
+
+	// 两个实例上被其他客户端持有，获取失败后释放第三个实例上的锁
+	s.mrs[0].Set("lock:job", "other")
+	s.mrs[1].Set("lock:job", "other")
+	_, err = l.TryObtain(ctx, "job")
+	assrt.Equal(lock.ErrNotObtained, err)
+	assrt.False(s.mrs[2].Exists("lock:job"))
+	s.mrs[0].Del("lock:job")
+	s.mrs[1].Del("lock:job")
+
+	// 一个实例不可用时仍然可以获取
+	s.mrs[2].Close()
+	lk, err = l.TryObtain(ctx, "job")
+	assrt.NoError(err)
+	assrt.NoError(lk.Release(ctx))
+
+	// 多数实例不可用时返回错误
+	s.mrs[1].Close()
+	_, err = l.TryObtain(ctx, "job")
+	assrt.Error(err)
+	assrt.NotEqual(lock.ErrNotObtained, err)
+	assrt.False(s.mrs[0].Exists("lock:job"))
+}
+
+/*
+ * 5. 测试配置错误
+ */
+func (s *testLockSuite) TestWrongConfig() {
+	assrt := assert.New(s.T())
+	c := s.conf()
+	c.TTL = 0
+	assrt.Error(c.Validate("lock"))
+	assrt.Panics(func() {
+		lock.New(c, s.rs[0])
+	})
+	assrt.Panics(func() {
+		lock.New(s.conf())
+	})
+}
+
+func TestLockSuite(t *testing.T) {
+	suite.Run(t, new(testLockSuite))
+}
@@ -0,0 +1,95 @@
+package nearcache
+
+import (
+	"container/list"
+	"time"
+)
+
+// 进程内的LRU，不是并发安全的，由Cache加锁
+type lru struct {
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type item struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newLRU(size int, ttl time.Duration) *lru {
+	return &lru{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get 返回值的副本和是否命中，过期的值被删除，expired表示因为过期没有命中
+func (l *lru) get(key string, now time.Time) (value []byte, ok bool, expired bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false, false
+	}
+	it := e.Value.(*item)
+	if !now.Before(it.expires) {
+		l.removeElement(e)
+		return nil, false, true
+	}
+	l.ll.MoveToFront(e)
+	return clone(it.value), true, false
+}
+
+// add 保存value的副本，调用方之后修改value不影响缓存；返回因为超过容量被淘汰的数量
+func (l *lru) add(key string, value []byte, ttl time.Duration, now time.Time) int {
+	if ttl <= 0 || ttl > l.ttl {
+		ttl = l.ttl
+	}
+	value = clone(value)
+	if e, ok := l.items[key]; ok {
+		it := e.Value.(*item)
+		it.value, it.expires = value, now.Add(ttl)
+		l.ll.MoveToFront(e)
+		return 0
+	}
+	l.items[key] = l.ll.PushFront(&item{key: key, value: value, expires: now.Add(ttl)})
+	evicted := 0
+	for l.ll.Len() > l.size {
+		l.removeElement(l.ll.Back())
+		evicted++
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) bool {
+	e, ok := l.items[key]
+	if ok {
+		l.removeElement(e)
+	}
+	return ok
+}
+
+func (l *lru) clear() {
+	l.ll.Init()
+	l.items = make(map[string]*list.Element)
+}
+
+func (l *lru) len() int {
+	return l.ll.Len()
+}
+
+// 本地缓存的值不和调用方共享底层数组
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
+
+func (l *lru) removeElement(e *list.Element) {
+	l.ll.Remove(e)
+	delete(l.items, e.Value.(*item).key)
+}
@@ -0,0 +1,382 @@
+package nearcache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/pubsub"
+	"meross_iot/library/configurator/validate"
+	"meross_iot/library/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultSize       = 10000
+	DefaultTTL        = time.Minute
+	DefaultChannel    = "nearcache:invalidate"
+	DefaultRetryDelay = time.Second
+)
+
+// Config 本地缓存的配置
+type Config struct {
+	// 本地最多缓存的key数量，超过时淘汰最久没有访问的key
+	Size int `validate:"min=1"`
+	// 本地缓存的最长时间，redis中的key过期不会通知其他实例，应小于redis中的有效期
+	TTL time.Duration `validate:"gt=0"`
+	// 发布失效通知的channel，共享同一批key的实例使用同一个channel
+	Channel string `validate:"required"`
+	// 订阅断开后重连的间隔
+	RetryDelay time.Duration `validate:"gt=0"`
+	// 每隔PingInterval在订阅连接上发送PING，超过PingInterval+PingTimeout没有收到回复时认为订阅已经断开
+	PingInterval time.Duration `validate:"gt=0"`
+	PingTimeout  time.Duration `validate:"gt=0"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Size:         DefaultSize,
+		TTL:          DefaultTTL,
+		Channel:      DefaultChannel,
+		RetryDelay:   DefaultRetryDelay,
+		PingInterval: pubsub.DefaultPingInterval,
+		PingTimeout:  pubsub.DefaultPingTimeout,
+	}
+}
+
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (c *Config) Validate(section string) error {
+	return validate.Struct(section, c)
+}
+
+// Stats 本地缓存的统计
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+	// 超过Size被淘汰的数量
+	Evictions uint64
+	// 收到其他实例的失效通知删除的数量
+	Invalidations uint64
+	Size          int
+}
+
+// 失效通知，Keys为空时清空本地缓存
+type message struct {
+	Src  string   `json:"src"`
+	Keys []string `json:"keys"`
+}
+
+/*
+ * Cache redis前面的进程内LRU缓存
+ * 通过Cache写入和删除key时发布失效通知，其他实例收到后删除本地的key
+ * Start之前和订阅断开期间不使用本地缓存，重新订阅后清空本地缓存，避免使用断开期间被修改的值
+ * 订阅由pubsub.Subscriber管理，健康检查失败时同样认为订阅已经断开
+ */
+type Cache struct {
+	conf *Config
+	pool redis.Pool
+	sub  *pubsub.Subscriber
+	id   string
+
+	mu    sync.Mutex
+	local *lru
+	// 订阅正常时才使用本地缓存
+	active bool
+	// 每次失效加1，从redis读取期间有失效通知时不写入本地缓存
+	gen uint64
+
+	// Start之后不为nil，cancel结束Subscriber的Run，Run返回后关闭stopped
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	closed  bool
+	onError func(err error)
+
+	hits, misses, evictions, invalidations uint64
+}
+
+func New(r *redis.Redis, c *Config) *Cache {
+	if err := c.Validate("nearcache"); err != nil {
+		panic(fmt.Errorf("wrong nearcache config, %s\n", err))
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &Cache{
+		conf: c,
+		pool: r.Pool(),
+		sub: pubsub.New(r, &pubsub.Config{
+			PingInterval:  c.PingInterval,
+			PingTimeout:   c.PingTimeout,
+			MinRetryDelay: c.RetryDelay,
+			MaxRetryDelay: c.RetryDelay,
+		}),
+		id:      hex.EncodeToString(b),
+		local:   newLRU(c.Size, c.TTL),
+		onError: logger.ErrorReporter("nearcache", c.Channel),
+	}
+}
+
+// OnError 设置订阅断开、失效通知错误时的回调，需在Start之前设置
+func (c *Cache) OnError(fn func(err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onError = fn
+}
+
+// Start 订阅失效通知，收到订阅确认后返回，之后开始使用本地缓存；第一次订阅失败时返回错误，可以重新Start
+func (c *Cache) Start() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return fmt.Errorf("nearcache is closed")
+	}
+	if c.cancel != nil {
+		c.mu.Unlock()
+		return fmt.Errorf("nearcache is already started")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	c.cancel, c.stopped = cancel, stopped
+	c.mu.Unlock()
+
+	once := sync.Once{}
+	ready := make(chan error, 1)
+	c.sub.OnConnect(func() {
+		c.activate()
+		once.Do(func() { ready <- nil })
+	})
+	c.sub.OnError(func(err error) {
+		c.deactivate()
+		first := false
+		once.Do(func() {
+			first = true
+			ready <- err
+		})
+		if !first {
+			c.report(err)
+		}
+	})
+	c.sub.Subscribe(c.conf.Channel, c.handle)
+	go func() {
+		defer close(stopped)
+		c.sub.Run(ctx)
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			c.stop()
+			c.deactivate()
+			return err
+		}
+		return nil
+	case <-stopped:
+		return fmt.Errorf("nearcache is closed")
+	}
+}
+
+// Close 停止订阅并清空本地缓存
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.active = false
+	c.local.clear()
+	c.mu.Unlock()
+	c.stop()
+	return nil
+}
+
+// 结束Subscriber的Run并等待返回，之后可以重新Start
+func (c *Cache) stop() {
+	c.mu.Lock()
+	cancel, stopped := c.cancel, c.stopped
+	c.cancel, c.stopped = nil, nil
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-stopped
+	}
+}
+
+// Get 先读本地缓存，没有命中时读redis并写入本地缓存，key不存在时返回redis.ErrNil；返回的值可以修改，不影响本地缓存
+func (c *Cache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	active, gen := c.active, c.gen
+	if active {
+		if v, ok, _ := c.local.get(key, time.Now()); ok {
+			c.mu.Unlock()
+			atomic.AddUint64(&c.hits, 1)
+			return v, nil
+		}
+	}
+	c.mu.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	conn, err := c.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := redis.Bytes(conn.DoContext(ctx, "GET", key))
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.active && c.gen == gen {
+		c.evicted(c.local.add(key, v, 0, time.Now()))
+	}
+	c.mu.Unlock()
+	return v, nil
+}
+
+// Set 写入redis和本地缓存，ttl为redis中的有效期，为0时不过期；本地缓存保存value的副本
+func (c *Cache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	conn, err := c.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if ttl > 0 {
+		_, err = conn.DoContext(ctx, "SET", key, value, "PX", ttl.Milliseconds())
+	} else {
+		_, err = conn.DoContext(ctx, "SET", key, value)
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.gen++
+	if c.active {
+		c.evicted(c.local.add(key, value, ttl, time.Now()))
+	}
+	c.mu.Unlock()
+	return c.publish(ctx, conn, []string{key})
+}
+
+// Delete 删除redis和所有实例本地缓存中的key
+func (c *Cache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	conn, err := c.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	args := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	if _, err := conn.DoContext(ctx, "DEL", args...); err != nil {
+		return err
+	}
+	c.removeLocal(keys)
+	return c.publish(ctx, conn, keys)
+}
+
+// Invalidate 只删除所有实例本地缓存中的key，用于没有通过Cache修改redis的场景；keys为空时清空
+func (c *Cache) Invalidate(ctx context.Context, keys ...string) error {
+	conn, err := c.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c.removeLocal(keys)
+	return c.publish(ctx, conn, keys)
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	size := c.local.len()
+	c.mu.Unlock()
+	return Stats{
+		Hits:          atomic.LoadUint64(&c.hits),
+		Misses:        atomic.LoadUint64(&c.misses),
+		Evictions:     atomic.LoadUint64(&c.evictions),
+		Invalidations: atomic.LoadUint64(&c.invalidations),
+		Size:          size,
+	}
+}
+
+func (c *Cache) publish(ctx context.Context, conn redis.Connection, keys []string) error {
+	data, err := json.Marshal(&message{Src: c.id, Keys: keys})
+	if err != nil {
+		return err
+	}
+	_, err = conn.DoContext(ctx, "PUBLISH", c.conf.Channel, data)
+	return err
+}
+
+// 删除本地的key，返回删除的数量；keys为空时清空
+func (c *Cache) removeLocal(keys []string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if len(keys) == 0 {
+		n := c.local.len()
+		c.local.clear()
+		return n
+	}
+	n := 0
+	for _, key := range keys {
+		if c.local.remove(key) {
+			n++
+		}
+	}
+	return n
+}
+
+// 调用方持有c.mu
+func (c *Cache) evicted(n int) {
+	if n > 0 {
+		atomic.AddUint64(&c.evictions, uint64(n))
+	}
+}
+
+func (c *Cache) handle(ctx context.Context, m *pubsub.Message) {
+	msg := &message{}
+	if err := json.Unmarshal(m.Data, msg); err != nil {
+		c.report(fmt.Errorf("wrong invalidation message: %s", err))
+		return
+	}
+	// 自己发布的通知在写入时已经处理
+	if msg.Src == c.id {
+		return
+	}
+	if n := c.removeLocal(msg.Keys); n > 0 {
+		atomic.AddUint64(&c.invalidations, uint64(n))
+	}
+}
+
+// 断开期间的通知已经丢失，停止使用并清空本地缓存
+func (c *Cache) deactivate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = false
+	c.gen++
+	c.local.clear()
+}
+
+// 订阅成功后开始使用本地缓存，断开期间的通知已经丢失，本地缓存在断开时已经清空
+func (c *Cache) activate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.active = true
+	c.gen++
+}
+
+func (c *Cache) report(err error) {
+	c.mu.Lock()
+	fn := c.onError
+	c.mu.Unlock()
+	fn(err)
+}
@@ -0,0 +1,309 @@
+package nearcache_test
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/nearcache"
+	"meross_iot/library/internal/redistest"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testNearCacheSuite struct {
+	suite.Suite
+	mr *miniredis.Miniredis
+	rc *redis.Redis
+}
+
+func (s *testNearCacheSuite) SetupTest() {
+	mr, err := miniredis.Run()
+	s.Require().NoError(err)
+	s.mr = mr
+	c := redistest.Config(mr.Addr(), "")
+	s.rc = redis.New(c)
+}
+
+func (s *testNearCacheSuite) TearDownTest() {
+	s.rc.Pool().Close()
+	s.mr.Close()
+}
+
+func (s *testNearCacheSuite) conf() *nearcache.Config {
+	c := nearcache.NewConfig()
+	c.RetryDelay = 20 * time.Millisecond
+	return c
+}
+
+// 模拟一个服务实例
+func (s *testNearCacheSuite) start(c *nearcache.Config) *nearcache.Cache {
+	nc := nearcache.New(s.rc, c)
+	s.Require().NoError(nc.Start())
+	return nc
+}
+
+/*
+ * 1. 测试本地命中、淘汰和过期
+ */
+func (s *testNearCacheSuite) TestLocal() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	c := s.conf()
+	c.Size = 2
+	nc := s.start(c)
+	defer nc.Close()
+	s.mr.Set("device:d1", "plug")
+	s.mr.Set("device:d2", "bulb")
+	s.mr.Set("device:d3", "hub")
+	for i := 0; i < 3; i++ {
+		v, err := nc.Get(ctx, "device:d1")
+		assrt.NoError(err)
+		assrt.Equal([]byte("plug"), v)
+	}
+	assrt.Equal(nearcache.Stats{Hits: 2, Misses: 1, Size: 1}, nc.Stats())
+	// 直接修改redis时本地缓存不变
+	s.mr.Set("device:d1", "socket")
+	v, _ := nc.Get(ctx, "device:d1")
+	assrt.Equal([]byte("plug"), v)
+
+	// d2最久没有访问，被淘汰
+	nc.Get(ctx, "device:d2")
+	nc.Get(ctx, "device:d1")
+	nc.Get(ctx, "device:d3")
+	stats := nc.Stats()
+	assrt.Equal(uint64(1), stats.Evictions)
+	assrt.Equal(2, stats.Size)
+	nc.Get(ctx, "device:d2")
+	assrt.Equal(stats.Misses+1, nc.Stats().Misses)
+
+	_, err := nc.Get(ctx, "device:none")
+	assrt.Equal(redis.ErrNil, err)
+
+	// 修改Get返回的值和Set写入的值不影响本地缓存
+	v, _ = nc.Get(ctx, "device:d2")
+	v[0] = 'X'
+	v, _ = nc.Get(ctx, "device:d2")
+	assrt.Equal([]byte("bulb"), v)
+	value := []byte("lamp")
+	assrt.NoError(nc.Set(ctx, "device:d4", value, 0))
+	value[0] = 'X'
+	v, _ = nc.Get(ctx, "device:d4")
+	assrt.Equal([]byte("lamp"), v)
+
+	// 本地缓存过期
+	c = s.conf()
+	c.TTL = 30 * time.Millisecond
+	nc2 := s.start(c)
+	defer nc2.Close()
+	nc2.Get(ctx, "device:d1")
+	nc2.Get(ctx, "device:d1")
+	time.Sleep(40 * time.Millisecond)
+	v, _ = nc2.Get(ctx, "device:d1")
+	assrt.Equal([]byte("socket"), v)
+	assrt.Equal(uint64(2), nc2.Stats().Misses)
+}
+
+/*
+ * 2. 测试通过失效通知保持多个实例一致
+ */
+func (s *testNearCacheSuite) TestInvalidate() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	a := s.start(s.conf())
+	defer a.Close()
+	b := s.start(s.conf())
+	defer b.Close()
+	s.mr.Set("device:d1", "plug")
+	s.mr.Set("device:d2", "bulb")
+	for _, nc := range []*nearcache.Cache{a, b} {
+		nc.Get(ctx, "device:d1")
+		nc.Get(ctx, "device:d2")
+	}
+
+	assrt.NoError(a.Set(ctx, "device:d1", []byte("socket"), time.Hour))
+	assrt.Equal(time.Hour, s.mr.TTL("device:d1"))
+	v, _ := a.Get(ctx, "device:d1")
+	assrt.Equal([]byte("socket"), v)
+	assrt.Eventually(func() bool {
+		return b.Stats().Invalidations == 1
+	}, time.Second, 5*time.Millisecond)
+	v, _ = b.Get(ctx, "device:d1")
+	assrt.Equal([]byte("socket"), v)
+	assrt.Equal(uint64(0), a.Stats().Invalidations)
+
+	assrt.NoError(b.Delete(ctx, "device:d1"))
+	assrt.Eventually(func() bool {
+		return a.Stats().Invalidations == 1
+	}, time.Second, 5*time.Millisecond)
+	_, err := a.Get(ctx, "device:d1")
+	assrt.Equal(redis.ErrNil, err)
+
+	// 没有通过Cache修改redis时手动发布
+	s.mr.Set("device:d2", "hub")
+	assrt.NoError(a.Invalidate(ctx))
+	assrt.Eventually(func() bool {
+		return b.Stats().Size == 0
+	}, time.Second, 5*time.Millisecond)
+	v, _ = b.Get(ctx, "device:d2")
+	assrt.Equal([]byte("hub"), v)
+	v, _ = a.Get(ctx, "device:d2")
+	assrt.Equal([]byte("hub"), v)
+}
+
+/*
+ * 3. 测试Start之前和订阅断开期间不使用本地缓存
+ */
+func (s *testNearCacheSuite) TestSubscriptionLost() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	nc := nearcache.New(s.rc, s.conf())
+	errs := int32(0)
+	nc.OnError(func(err error) {
+		atomic.AddInt32(&errs, 1)
+	})
+	s.mr.Set("device:d1", "plug")
+	nc.Get(ctx, "device:d1")
+	nc.Get(ctx, "device:d1")
+	assrt.Equal(nearcache.Stats{Misses: 2}, nc.Stats())
+
+	assrt.NoError(nc.Start())
+	assrt.Error(nc.Start())
+	nc.Get(ctx, "device:d1")
+	assrt.Equal(1, nc.Stats().Size)
+
+	s.mr.Close()
+	assrt.Eventually(func() bool {
+		return nc.Stats().Size == 0
+	}, time.Second, 5*time.Millisecond)
+	assrt.NoError(s.mr.Restart())
+	s.mr.Set("device:d1", "socket")
+	assrt.Eventually(func() bool {
+		v, err := nc.Get(ctx, "device:d1")
+		return err == nil && string(v) == "socket" && nc.Stats().Size == 1
+	}, time.Second, 10*time.Millisecond)
+	assrt.True(atomic.LoadInt32(&errs) > 0)
+
+	assrt.NoError(nc.Close())
+	assrt.Error(nc.Start())
+	assrt.Equal(0, nc.Stats().Size)
+}
+
+// 转发到miniredis的代理，Stall之后已有的连接不再转发也不断开，模拟网络中断
+type stallProxy struct {
+	ln      net.Listener
+	backend string
+	mu      sync.Mutex
+	stalled []chan struct{}
+}
+
+func newStallProxy(backend string) (*stallProxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &stallProxy{ln: ln, backend: backend}
+	go p.serve()
+	return p, nil
+}
+
+func (p *stallProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		backend, err := net.Dial("tcp", p.backend)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		stall := make(chan struct{})
+		p.mu.Lock()
+		p.stalled = append(p.stalled, stall)
+		p.mu.Unlock()
+		go pipe(conn, backend, stall)
+		go pipe(backend, conn, stall)
+	}
+}
+
+func pipe(dst, src net.Conn, stall chan struct{}) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			dst.Close()
+			return
+		}
+		select {
+		case <-stall:
+			// 丢弃数据，不关闭连接
+			io.Copy(io.Discard, src)
+			return
+		default:
+		}
+		dst.Write(buf[:n])
+	}
+}
+
+func (p *stallProxy) Stall() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, stall := range p.stalled {
+		close(stall)
+	}
+	p.stalled = nil
+}
+
+func (p *stallProxy) Close() {
+	p.ln.Close()
+}
+
+/*
+ * 4. 测试订阅连接没有断开但不再响应时，健康检查失败后停止使用本地缓存，重连后恢复
+ */
+func (s *testNearCacheSuite) TestHealthCheck() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	proxy, err := newStallProxy(s.mr.Addr())
+	s.Require().NoError(err)
+	defer proxy.Close()
+	rc := redistest.Config(proxy.ln.Addr().String(), "")
+	// pool中的连接同样不再响应，超时后丢弃
+	rc.ReadTimeout = 100 * time.Millisecond
+	r := redis.New(rc)
+	defer r.Pool().Close()
+
+	c := s.conf()
+	c.PingInterval = 20 * time.Millisecond
+	c.PingTimeout = 20 * time.Millisecond
+	nc := nearcache.New(r, c)
+	errs := int32(0)
+	nc.OnError(func(err error) {
+		atomic.AddInt32(&errs, 1)
+	})
+	assrt.NoError(nc.Start())
+	defer nc.Close()
+	s.mr.Set("device:d1", "plug")
+	nc.Get(ctx, "device:d1")
+	assrt.Equal(1, nc.Stats().Size)
+
+	proxy.Stall()
+	assrt.Eventually(func() bool {
+		return atomic.LoadInt32(&errs) > 0 && nc.Stats().Size == 0
+	}, time.Second, 5*time.Millisecond)
+	// 重连后恢复使用本地缓存
+	assrt.Eventually(func() bool {
+		nc.Get(ctx, "device:d1")
+		return nc.Stats().Size == 1
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestNearCacheSuite(t *testing.T) {
+	suite.Run(t, new(testNearCacheSuite))
+}
@@ -0,0 +1,336 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/configurator/validate"
+	"meross_iot/library/logger"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPingInterval  = 10 * time.Second
+	DefaultPingTimeout   = 5 * time.Second
+	DefaultMinRetryDelay = 100 * time.Millisecond
+	DefaultMaxRetryDelay = 10 * time.Second
+)
+
+// Config 订阅连接的健康检查和重连配置
+type Config struct {
+	// 每隔PingInterval在订阅连接上发送PING
+	PingInterval time.Duration `validate:"gt=0"`
+	// 超过PingInterval+PingTimeout没有收到任何回复(包括PING的回复)时认为连接已经断开
+	PingTimeout time.Duration `validate:"gt=0"`
+	// 重连间隔从MinRetryDelay开始每次翻倍，最大为MaxRetryDelay，连接成功后重置
+	MinRetryDelay time.Duration `validate:"gt=0"`
+	MaxRetryDelay time.Duration `validate:"gt=0"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		PingInterval:  DefaultPingInterval,
+		PingTimeout:   DefaultPingTimeout,
+		MinRetryDelay: DefaultMinRetryDelay,
+		MaxRetryDelay: DefaultMaxRetryDelay,
+	}
+}
+
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (c *Config) Validate(section string) error {
+	return validate.Struct(section, c)
+}
+
+// Message 收到的消息，通过PSubscribe订阅时Pattern为匹配的模式，否则为空
+type Message struct {
+	Pattern string
+	Channel string
+	Data    []byte
+}
+
+// Handler 在接收消息的goroutine中按顺序调用，不应长时间阻塞
+type Handler func(ctx context.Context, msg *Message)
+
+/*
+ * Subscriber 管理一个订阅连接，按channel和pattern把消息分发给注册的Handler
+ * 连接断开或健康检查失败时按退避间隔重连，并恢复所有channel和pattern的订阅
+ * 断开期间发布的消息会丢失，需要时在OnConnect中重新加载状态
+ */
+type Subscriber struct {
+	conf *Config
+	rc   *redis.Redis
+
+	// 保护订阅表，同时串行化订阅连接上的写操作
+	mu       sync.Mutex
+	channels map[string]Handler
+	patterns map[string]Handler
+	ps       redis.PubSub
+	running  bool
+	// 订阅表从空变为非空时通知Run建立连接
+	wake chan struct{}
+
+	onError   func(err error)
+	onConnect func()
+}
+
+func New(r *redis.Redis, c *Config) *Subscriber {
+	if err := c.Validate("pubsub"); err != nil {
+		panic(fmt.Errorf("wrong pubsub config, %s\n", err))
+	}
+	return &Subscriber{
+		conf:      c,
+		rc:        r,
+		channels:  make(map[string]Handler),
+		patterns:  make(map[string]Handler),
+		wake:      make(chan struct{}, 1),
+		onError:   logger.ErrorReporter("pubsub", ""),
+		onConnect: func() {},
+	}
+}
+
+// OnError 设置连接断开、重连失败时的回调
+func (s *Subscriber) OnError(fn func(err error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onError = fn
+}
+
+// OnConnect 设置每次连接成功并恢复订阅后的回调，用于重新加载断开期间错过的状态
+func (s *Subscriber) OnConnect(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onConnect = fn
+}
+
+// Subscribe 注册channel的Handler，已经注册时替换；Run运行中时立即订阅
+func (s *Subscriber) Subscribe(channel string, h Handler) error {
+	return s.add(s.channels, channel, h, redis.PubSub.Subscribe)
+}
+
+// PSubscribe 注册pattern的Handler，已经注册时替换；Run运行中时立即订阅
+func (s *Subscriber) PSubscribe(pattern string, h Handler) error {
+	return s.add(s.patterns, pattern, h, redis.PubSub.PSubscribe)
+}
+
+// Unsubscribe 取消channel的订阅，重连后不再恢复
+func (s *Subscriber) Unsubscribe(channels ...string) error {
+	return s.remove(s.channels, channels, redis.PubSub.Unsubscribe)
+}
+
+// PUnsubscribe 取消pattern的订阅，重连后不再恢复
+func (s *Subscriber) PUnsubscribe(patterns ...string) error {
+	return s.remove(s.patterns, patterns, redis.PubSub.PUnsubscribe)
+}
+
+/*
+ * Run 建立订阅连接并分发消息，直到ctx结束后返回nil
+ * 没有任何订阅时不建立连接；同一时间只能有一个Run
+ */
+func (s *Subscriber) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return fmt.Errorf("pubsub subscriber is already running")
+	}
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	delay := s.conf.MinRetryDelay
+	for ctx.Err() == nil {
+		if s.idle() {
+			select {
+			case <-ctx.Done():
+			case <-s.wake:
+			}
+			continue
+		}
+		ps, err := s.connect()
+		if err == nil {
+			var confirmed bool
+			if confirmed, err = s.receive(ctx, ps); confirmed {
+				delay = s.conf.MinRetryDelay
+			}
+		}
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		s.report(err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > s.conf.MaxRetryDelay {
+			delay = s.conf.MaxRetryDelay
+		}
+	}
+	return nil
+}
+
+func (s *Subscriber) add(m map[string]Handler, name string, h Handler, sub func(redis.PubSub, ...interface{}) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := m[name]
+	m[name] = h
+	if len(s.channels)+len(s.patterns) == 1 {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	if s.ps == nil || exists {
+		return nil
+	}
+	return s.write(sub, name)
+}
+
+func (s *Subscriber) remove(m map[string]Handler, names []string, unsub func(redis.PubSub, ...interface{}) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	args := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		if _, ok := m[name]; ok {
+			delete(m, name)
+			args = append(args, name)
+		}
+	}
+	if s.ps == nil || len(args) == 0 {
+		return nil
+	}
+	return s.write(unsub, args...)
+}
+
+// 调用方持有s.mu；写失败时关闭连接，由Run重连并恢复订阅
+func (s *Subscriber) write(fn func(redis.PubSub, ...interface{}) error, args ...interface{}) error {
+	if err := fn(s.ps, args...); err != nil {
+		s.ps.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *Subscriber) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.channels)+len(s.patterns) == 0
+}
+
+// 建立连接并订阅所有channel和pattern，在s.mu中完成，期间注册的订阅不会遗漏
+func (s *Subscriber) connect() (redis.PubSub, error) {
+	ps, err := s.rc.PubSubConn()
+	if err != nil {
+		return nil, fmt.Errorf("fail to subscribe: %s", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := subscribeAll(ps, s.channels, redis.PubSub.Subscribe); err != nil {
+		ps.Close()
+		return nil, fmt.Errorf("fail to subscribe: %s", err)
+	}
+	if err := subscribeAll(ps, s.patterns, redis.PubSub.PSubscribe); err != nil {
+		ps.Close()
+		return nil, fmt.Errorf("fail to subscribe: %s", err)
+	}
+	s.ps = ps
+	return ps, nil
+}
+
+func subscribeAll(ps redis.PubSub, m map[string]Handler, sub func(redis.PubSub, ...interface{}) error) error {
+	if len(m) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(m))
+	for name := range m {
+		args = append(args, name)
+	}
+	return sub(ps, args...)
+}
+
+/*
+ * 接收并分发消息，连接断开、健康检查失败、订阅全部取消或ctx结束时关闭连接并返回
+ * 收到第一个订阅的确认后才算连接成功，调用OnConnect，返回的confirmed为true
+ */
+func (s *Subscriber) receive(ctx context.Context, ps redis.PubSub) (confirmed bool, err error) {
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		s.mu.Lock()
+		s.ps = nil
+		s.mu.Unlock()
+		ps.Close()
+	}()
+	go s.ping(ctx, ps, done)
+
+	timeout := s.conf.PingInterval + s.conf.PingTimeout
+	for {
+		switch m := ps.ReceiveWithTimeout(timeout).(type) {
+		case redis.SubMsg:
+			if h := s.handler(s.channels, m.Channel); h != nil {
+				h(ctx, &Message{Channel: m.Channel, Data: m.Data})
+			}
+		case redis.PsubMsg:
+			if h := s.handler(s.patterns, m.Pattern); h != nil {
+				h(ctx, &Message{Pattern: m.Pattern, Channel: m.Channel, Data: m.Data})
+			}
+		case redis.Subscription:
+			if !confirmed {
+				confirmed = true
+				s.callback()
+			}
+			// 连接上已经没有订阅，不再收到PING的回复，等待新的订阅时重新连接
+			if m.Count == 0 && s.idle() {
+				return confirmed, nil
+			}
+		case error:
+			return confirmed, fmt.Errorf("subscription lost: %s", m)
+		}
+	}
+}
+
+// 定时发送PING，ctx结束时关闭连接使Receive返回
+func (s *Subscriber) ping(ctx context.Context, ps redis.PubSub, done chan struct{}) {
+	ticker := time.NewTicker(s.conf.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			ps.Close()
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			err := ps.Ping("")
+			s.mu.Unlock()
+			if err != nil {
+				ps.Close()
+				return
+			}
+		}
+	}
+}
+
+func (s *Subscriber) handler(m map[string]Handler, name string) Handler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return m[name]
+}
+
+func (s *Subscriber) callback() {
+	s.mu.Lock()
+	fn := s.onConnect
+	s.mu.Unlock()
+	fn()
+}
+
+func (s *Subscriber) report(err error) {
+	s.mu.Lock()
+	fn := s.onError
+	s.mu.Unlock()
+	fn(err)
+}
@@ -0,0 +1,317 @@
+package pubsub_test
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/pubsub"
+	"meross_iot/library/internal/redistest"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 转发到miniredis的代理，freeze后已有连接不再转发数据也不断开，模拟网络中断
+type freezeProxy struct {
+	ln     net.Listener
+	target string
+	frozen int32
+	mu     sync.Mutex
+	conns  []*int32
+}
+
+func newFreezeProxy(target string) (*freezeProxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &freezeProxy{ln: ln, target: target}
+	go p.serve()
+	return p, nil
+}
+
+func (p *freezeProxy) serve() {
+	for {
+		client, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		frozen := new(int32)
+		p.mu.Lock()
+		p.conns = append(p.conns, frozen)
+		p.mu.Unlock()
+		go p.pipe(client, server, frozen)
+		go p.pipe(server, client, frozen)
+	}
+}
+
+func (p *freezeProxy) pipe(dst, src net.Conn, frozen *int32) {
+	defer dst.Close()
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(frozen) == 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// 冻结已有的连接，新连接正常转发
+func (p *freezeProxy) freeze() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, frozen := range p.conns {
+		atomic.StoreInt32(frozen, 1)
+	}
+}
+
+func (p *freezeProxy) Close() {
+	p.ln.Close()
+}
+
+type received struct {
+	mu   sync.Mutex
+	msgs []pubsub.Message
+}
+
+func (r *received) handler(ctx context.Context, msg *pubsub.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, *msg)
+}
+
+func (r *received) get() []pubsub.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]pubsub.Message(nil), r.msgs...)
+}
+
+type testSubscriberSuite struct {
+	suite.Suite
+	driver string
+	mr     *miniredis.Miniredis
+	proxy  *freezeProxy
+	rc     *redis.Redis
+}
+
+func (s *testSubscriberSuite) SetupTest() {
+	mr, err := miniredis.Run()
+	s.Require().NoError(err)
+	s.mr = mr
+	proxy, err := newFreezeProxy(mr.Addr())
+	s.Require().NoError(err)
+	s.proxy = proxy
+	c := redistest.Config(proxy.ln.Addr().String(), s.driver)
+	s.rc = redis.New(c)
+}
+
+func (s *testSubscriberSuite) TearDownTest() {
+	s.rc.Pool().Close()
+	s.proxy.Close()
+	s.mr.Close()
+}
+
+func (s *testSubscriberSuite) conf() *pubsub.Config {
+	c := pubsub.NewConfig()
+	c.PingInterval = 30 * time.Millisecond
+	c.PingTimeout = 30 * time.Millisecond
+	c.MinRetryDelay = 10 * time.Millisecond
+	c.MaxRetryDelay = 40 * time.Millisecond
+	return c
+}
+
+func (s *testSubscriberSuite) run(sub *pubsub.Subscriber) (context.CancelFunc, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- sub.Run(ctx)
+	}()
+	return cancel, done
+}
+
+func (s *testSubscriberSuite) subscribed(channel string, patterns int) bool {
+	return s.mr.PubSubNumSub(channel)[channel] == 1 && s.mr.PubSubNumPat() == patterns
+}
+
+/*
+ * 1. 测试按channel和pattern分发消息，运行中订阅和取消订阅
+ */
+func (s *testSubscriberSuite) TestDispatch() {
+	assrt := assert.New(s.T())
+	sub := pubsub.New(s.rc, s.conf())
+	online, all := &received{}, &received{}
+	assrt.NoError(sub.Subscribe("device:online", online.handler))
+	assrt.NoError(sub.PSubscribe("device:*", all.handler))
+	cancel, done := s.run(sub)
+	defer cancel()
+	assrt.Eventually(func() bool {
+		return s.subscribed("device:online", 1)
+	}, time.Second, 5*time.Millisecond)
+	assrt.Error(sub.Run(context.Background()))
+
+	s.mr.Publish("device:online", "d1")
+	s.mr.Publish("device:offline", "d2")
+	assrt.Eventually(func() bool {
+		return len(all.get()) == 2
+	}, time.Second, 5*time.Millisecond)
+	assrt.Equal([]pubsub.Message{{Channel: "device:online", Data: []byte("d1")}}, online.get())
+	assrt.Equal([]pubsub.Message{
+		{Pattern: "device:*", Channel: "device:online", Data: []byte("d1")},
+		{Pattern: "device:*", Channel: "device:offline", Data: []byte("d2")},
+	}, all.get())
+
+	// 运行中订阅新的channel，替换已有的handler
+	offline := &received{}
+	assrt.NoError(sub.Subscribe("device:offline", offline.handler))
+	online2 := &received{}
+	assrt.NoError(sub.Subscribe("device:online", online2.handler))
+	assrt.NoError(sub.PUnsubscribe("device:*"))
+	assrt.Eventually(func() bool {
+		return s.subscribed("device:offline", 0)
+	}, time.Second, 5*time.Millisecond)
+	s.mr.Publish("device:online", "d3")
+	s.mr.Publish("device:offline", "d4")
+	assrt.Eventually(func() bool {
+		return len(offline.get()) == 1 && len(online2.get()) == 1
+	}, time.Second, 5*time.Millisecond)
+	assrt.Equal(1, len(online.get()))
+	assrt.Equal(2, len(all.get()))
+
+	cancel()
+	select {
+	case err := <-done:
+		assrt.NoError(err)
+	case <-time.After(time.Second):
+		assrt.Fail("Run should return after ctx is done")
+	}
+}
+
+/*
+ * 2. 测试连接断开后重连并恢复订阅
+ */
+func (s *testSubscriberSuite) TestReconnect() {
+	assrt := assert.New(s.T())
+	sub := pubsub.New(s.rc, s.conf())
+	connects, errs := int32(0), int32(0)
+	sub.OnConnect(func() {
+		atomic.AddInt32(&connects, 1)
+	})
+	sub.OnError(func(err error) {
+		atomic.AddInt32(&errs, 1)
+	})
+	r := &received{}
+	assrt.NoError(sub.Subscribe("device:online", r.handler))
+	assrt.NoError(sub.PSubscribe("device:*", r.handler))
+	cancel, _ := s.run(sub)
+	defer cancel()
+	assrt.Eventually(func() bool {
+		return s.subscribed("device:online", 1)
+	}, time.Second, 5*time.Millisecond)
+
+	s.mr.Close()
+	// 断开期间注册的订阅在重连后生效
+	assrt.NoError(sub.Subscribe("device:offline", r.handler))
+	time.Sleep(100 * time.Millisecond)
+	assrt.NoError(s.mr.Restart())
+	assrt.Eventually(func() bool {
+		return s.subscribed("device:online", 1) && s.subscribed("device:offline", 1)
+	}, time.Second, 5*time.Millisecond)
+	assrt.Eventually(func() bool {
+		return atomic.LoadInt32(&connects) == 2 && atomic.LoadInt32(&errs) > 1
+	}, time.Second, 5*time.Millisecond)
+	s.mr.Publish("device:offline", "d1")
+	assrt.Eventually(func() bool {
+		return len(r.get()) == 2
+	}, time.Second, 5*time.Millisecond)
+}
+
+/*
+ * 3. 测试连接没有断开但不再响应时，健康检查超时后重连
+ */
+func (s *testSubscriberSuite) TestHealthCheck() {
+	assrt := assert.New(s.T())
+	sub := pubsub.New(s.rc, s.conf())
+	connects := int32(0)
+	sub.OnConnect(func() {
+		atomic.AddInt32(&connects, 1)
+	})
+	sub.OnError(func(err error) {})
+	r := &received{}
+	assrt.NoError(sub.Subscribe("device:online", r.handler))
+	cancel, _ := s.run(sub)
+	defer cancel()
+	assrt.Eventually(func() bool {
+		return s.subscribed("device:online", 0)
+	}, time.Second, 5*time.Millisecond)
+	// 有PING的回复时不会重连
+	time.Sleep(150 * time.Millisecond)
+	assrt.Equal(int32(1), atomic.LoadInt32(&connects))
+
+	s.proxy.freeze()
+	s.mr.Publish("device:online", "lost")
+	assrt.Eventually(func() bool {
+		return atomic.LoadInt32(&connects) == 2
+	}, time.Second, 5*time.Millisecond)
+	assrt.Eventually(func() bool {
+		s.mr.Publish("device:online", "d1")
+		return len(r.get()) > 0
+	}, time.Second, 10*time.Millisecond)
+	assrt.Equal("d1", string(r.get()[0].Data))
+}
+
+/*
+ * 4. 测试没有订阅时不建立连接，全部取消订阅后断开
+ */
+func (s *testSubscriberSuite) TestIdle() {
+	assrt := assert.New(s.T())
+	sub := pubsub.New(s.rc, s.conf())
+	connects := int32(0)
+	sub.OnConnect(func() {
+		atomic.AddInt32(&connects, 1)
+	})
+	cancel, done := s.run(sub)
+	defer cancel()
+	time.Sleep(50 * time.Millisecond)
+	assrt.Equal(int32(0), atomic.LoadInt32(&connects))
+	assrt.Equal(0, s.mr.CurrentConnectionCount())
+
+	r := &received{}
+	assrt.NoError(sub.Subscribe("device:online", r.handler))
+	assrt.Eventually(func() bool {
+		return s.subscribed("device:online", 0)
+	}, time.Second, 5*time.Millisecond)
+	assrt.NoError(sub.Unsubscribe("device:online", "device:none"))
+	assrt.Eventually(func() bool {
+		return s.mr.CurrentConnectionCount() == 0
+	}, time.Second, 5*time.Millisecond)
+
+	assrt.NoError(sub.Subscribe("device:online", r.handler))
+	assrt.Eventually(func() bool {
+		return s.subscribed("device:online", 0)
+	}, time.Second, 5*time.Millisecond)
+	assrt.Equal(int32(2), atomic.LoadInt32(&connects))
+	cancel()
+	assrt.NoError(<-done)
+}
+
+func TestSubscriberRedigoSuite(t *testing.T) {
+	suite.Run(t, &testSubscriberSuite{driver: redis.DriverRedigo})
+}
+
+func TestSubscriberGoRedisSuite(t *testing.T) {
+	suite.Run(t, &testSubscriberSuite{driver: redis.DriverGoRedis})
+}
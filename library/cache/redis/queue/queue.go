@@ -0,0 +1,450 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/configurator/validate"
+	"meross_iot/library/logger"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultPrefix            = "queue:"
+	DefaultVisibilityTimeout = 30 * time.Second
+	DefaultMaxAttempts       = 5
+	DefaultBackoffMin        = time.Second
+	DefaultBackoffMax        = 10 * time.Minute
+	DefaultConcurrency       = 1
+	DefaultPollInterval      = time.Second
+
+	MinPriority = 0
+	MaxPriority = 9
+)
+
+var (
+	// Enqueue时已经有相同Unique的任务没有完成
+	ErrDuplicate = errors.New("queue: duplicate unique job")
+	// 任务已经超过可见性超时被重新投递，或者已经被确认
+	ErrLeaseLost = errors.New("queue: job lease lost")
+)
+
+// Config 一个队列的配置
+type Config struct {
+	// 所有key的前缀，队列名作为hash tag，同一个队列的key在cluster中位于同一个slot
+	Prefix string `validate:"required"`
+	Name   string `validate:"required"`
+	// 任务被取出后超过这个时间没有确认时重新投递，Run在处理期间每隔1/3自动续期
+	VisibilityTimeout time.Duration `validate:"gt=0"`
+	// Job.MaxAttempts为0时的最大执行次数，超过后进入dead列表
+	MaxAttempts int `validate:"min=1"`
+	// 第n次失败后等待BackoffMin*2^(n-1)再重试，最大为BackoffMax
+	BackoffMin time.Duration `validate:"gt=0"`
+	BackoffMax time.Duration `validate:"gt=0"`
+	// Run同时处理的任务数
+	Concurrency int `validate:"min=1"`
+	// Run没有取到任务时的等待时间
+	PollInterval time.Duration `validate:"gt=0"`
+}
+
+func NewConfig(name string) *Config {
+	return &Config{
+		Prefix:            DefaultPrefix,
+		Name:              name,
+		VisibilityTimeout: DefaultVisibilityTimeout,
+		MaxAttempts:       DefaultMaxAttempts,
+		BackoffMin:        DefaultBackoffMin,
+		BackoffMax:        DefaultBackoffMax,
+		Concurrency:       DefaultConcurrency,
+		PollInterval:      DefaultPollInterval,
+	}
+}
+
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (c *Config) Validate(section string) error {
+	return validate.Struct(section, c)
+}
+
+// Job 一个任务，Enqueue时填写Payload和可选项，Reserve和Dead返回时填写执行信息
+type Job struct {
+	ID      string
+	Payload []byte
+	// MinPriority到MaxPriority，越大越先执行，同一优先级先进先出
+	Priority int
+	// 延迟执行的时间
+	Delay time.Duration
+	// 为0时使用Config.MaxAttempts
+	MaxAttempts int
+	// 不为空时同一时间只能有一个相同Unique的任务，任务完成或进入dead列表后释放
+	Unique string
+
+	// 当前是第几次执行，也用于确认时校验任务没有被重新投递
+	Attempt int
+	// 上一次失败的错误
+	LastError string
+}
+
+/*
+ * 数据结构，base为prefix + "{" + name + "}:"
+ * - ready: zset，分数为(MaxPriority-priority)*1e13+入队序号，越小越先执行
+ * - seq: 入队序号，同一优先级按进入ready的顺序执行
+ * - delayed: zset，分数为可以执行的时间(ms)，包括延迟任务和等待重试的任务
+ * - active: zset，分数为可见性超时的时间(ms)
+ * - dead: list，超过最大执行次数的任务
+ * - job:<id>: hash，payload、priority、attempt、max、unique、error
+ * - unique:<unique>: string，值为任务id
+ * 脚本使用redis的TIME，在脚本中拼接job和unique的key，与KEYS在同一个slot
+ */
+const prelude = `
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local base = ARGV[1]
+local function ready(key, id)
+	local p = tonumber(redis.call("HGET", base .. "job:" .. id, "priority"))
+	if p then
+		redis.call("ZADD", key, (9 - p) * 1e13 + redis.call("INCR", base .. "seq"), id)
+	end
+end
+local function release(id)
+	local u = redis.call("HGET", base .. "job:" .. id, "unique")
+	if u and u ~= "" and redis.call("GET", base .. "unique:" .. u) == id then
+		redis.call("DEL", base .. "unique:" .. u)
+	end
+end
+local function leased(active, id, attempt)
+	return redis.call("ZSCORE", active, id) and redis.call("HGET", base .. "job:" .. id, "attempt") == attempt
+end
+`
+
+// KEYS: ready, delayed; ARGV: base, id, payload, priority, delay, max, unique
+const enqueueScript = prelude + `
+local id = ARGV[2]
+if ARGV[7] ~= "" and not redis.call("SET", base .. "unique:" .. ARGV[7], id, "NX") then
+	return 0
+end
+redis.call("HMSET", base .. "job:" .. id, "payload", ARGV[3], "priority", ARGV[4], "attempt", 0, "max", ARGV[6], "unique", ARGV[7])
+local delay = tonumber(ARGV[5])
+if delay > 0 then
+	redis.call("ZADD", KEYS[2], now + delay, id)
+else
+	ready(KEYS[1], id)
+end
+return 1
+`
+
+// 先把到期的延迟任务移到ready，把可见性超时的任务重新投递或移到dead，再取出优先级最高的任务
+// KEYS: ready, delayed, active, dead; ARGV: base, visibility
+const reserveScript = prelude + `
+local due = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", now, "LIMIT", 0, 100)
+for _, id in ipairs(due) do
+	redis.call("ZREM", KEYS[2], id)
+	ready(KEYS[1], id)
+end
+local expired = redis.call("ZRANGEBYSCORE", KEYS[3], "-inf", now, "LIMIT", 0, 100)
+for _, id in ipairs(expired) do
+	redis.call("ZREM", KEYS[3], id)
+	local job = base .. "job:" .. id
+	local v = redis.call("HMGET", job, "attempt", "max")
+	if v[1] then
+		redis.call("HSET", job, "error", "visibility timeout")
+		if tonumber(v[1]) >= tonumber(v[2]) then
+			release(id)
+			redis.call("LPUSH", KEYS[4], id)
+		else
+			ready(KEYS[1], id)
+		end
+	end
+end
+local ids = redis.call("ZRANGE", KEYS[1], 0, 0)
+if #ids == 0 then
+	return false
+end
+local id = ids[1]
+local job = base .. "job:" .. id
+redis.call("ZREM", KEYS[1], id)
+local attempt = redis.call("HINCRBY", job, "attempt", 1)
+redis.call("ZADD", KEYS[3], now + tonumber(ARGV[2]), id)
+local v = redis.call("HMGET", job, "payload", "priority", "max", "unique", "error")
+return {id, v[1], v[2], attempt, v[3], v[4], v[5]}
+`
+
+// KEYS: active; ARGV: base, id, attempt
+const ackScript = prelude + `
+local id = ARGV[2]
+if not leased(KEYS[1], id, ARGV[3]) then
+	return 0
+end
+redis.call("ZREM", KEYS[1], id)
+release(id)
+redis.call("DEL", base .. "job:" .. id)
+return 1
+`
+
+// 返回0表示lease已经丢失，1表示等待重试，2表示进入dead列表
+// KEYS: active, delayed, dead; ARGV: base, id, attempt, backoff, error
+const failScript = prelude + `
+local id = ARGV[2]
+if not leased(KEYS[1], id, ARGV[3]) then
+	return 0
+end
+local job = base .. "job:" .. id
+redis.call("ZREM", KEYS[1], id)
+redis.call("HSET", job, "error", ARGV[5])
+if tonumber(ARGV[3]) >= tonumber(redis.call("HGET", job, "max")) then
+	release(id)
+	redis.call("LPUSH", KEYS[3], id)
+	return 2
+end
+redis.call("ZADD", KEYS[2], now + tonumber(ARGV[4]), id)
+return 1
+`
+
+// KEYS: active; ARGV: base, id, attempt, visibility
+const extendScript = prelude + `
+local id = ARGV[2]
+if not leased(KEYS[1], id, ARGV[3]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[4]), id)
+return 1
+`
+
+// KEYS: ready, dead; ARGV: base, id
+const requeueScript = prelude + `
+local id = ARGV[2]
+if redis.call("LREM", KEYS[2], 1, id) == 0 then
+	return 0
+end
+redis.call("HSET", base .. "job:" .. id, "attempt", 0)
+ready(KEYS[1], id)
+return 1
+`
+
+// KEYS: dead; ARGV: base, id
+const removeScript = prelude + `
+local id = ARGV[2]
+if redis.call("LREM", KEYS[1], 1, id) == 0 then
+	return 0
+end
+redis.call("DEL", base .. "job:" .. id)
+return 1
+`
+
+// Stats 各个状态的任务数量
+type Stats struct {
+	Ready   int64
+	Delayed int64
+	Active  int64
+	Dead    int64
+}
+
+/*
+ * Queue 基于redis的可靠任务队列
+ * 任务取出后在VisibilityTimeout内没有确认时重新投递，失败后按指数退避重试，超过最大次数后进入dead列表
+ * 所有状态变化在Lua脚本中原子执行
+ */
+type Queue struct {
+	conf *Config
+	pool redis.Pool
+	base string
+
+	enqueue, reserve, ack, fail, extend, requeue, remove redis.Script
+
+	onError func(err error)
+}
+
+func New(r *redis.Redis, c *Config) *Queue {
+	if err := c.Validate("queue"); err != nil {
+		panic(fmt.Errorf("wrong queue config, %s\n", err))
+	}
+	p := r.Pool()
+	return &Queue{
+		conf:    c,
+		pool:    p,
+		base:    c.Prefix + "{" + c.Name + "}:",
+		enqueue: p.Script(2, enqueueScript),
+		reserve: p.Script(4, reserveScript),
+		ack:     p.Script(1, ackScript),
+		fail:    p.Script(3, failScript),
+		extend:  p.Script(1, extendScript),
+		requeue: p.Script(2, requeueScript),
+		remove:  p.Script(1, removeScript),
+		onError: logger.ErrorReporter("queue", c.Name),
+	}
+}
+
+// OnError 设置Run中读写redis出错、任务处理失败时的回调，需在Run之前设置
+func (q *Queue) OnError(fn func(err error)) {
+	q.onError = fn
+}
+
+// Enqueue 写入任务，返回任务id；有相同Unique的任务没有完成时返回ErrDuplicate
+func (q *Queue) Enqueue(ctx context.Context, job *Job) (string, error) {
+	if job.Priority < MinPriority || job.Priority > MaxPriority {
+		return "", fmt.Errorf("queue: priority must be in [%d, %d], got %d", MinPriority, MaxPriority, job.Priority)
+	}
+	maxAttempts := job.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = q.conf.MaxAttempts
+	}
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	ok, err := redis.Bool(q.enqueue.Do(ctx, q.key("ready"), q.key("delayed"),
+		q.base, id, job.Payload, job.Priority, job.Delay.Milliseconds(), maxAttempts, job.Unique))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrDuplicate
+	}
+	return id, nil
+}
+
+// Reserve 取出一个可以执行的任务，没有任务时返回nil；任务需要在VisibilityTimeout内Ack、Fail或Extend
+func (q *Queue) Reserve(ctx context.Context) (*Job, error) {
+	v, err := redis.Values(q.reserve.Do(ctx, q.key("ready"), q.key("delayed"), q.key("active"), q.key("dead"),
+		q.base, q.conf.VisibilityTimeout.Milliseconds()))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != 7 {
+		return nil, fmt.Errorf("queue: unexpected script reply %v", v)
+	}
+	job := &Job{}
+	job.ID, _ = redis.String(v[0], nil)
+	job.Payload, _ = redis.Bytes(v[1], nil)
+	job.Priority, _ = redis.Int(v[2], nil)
+	job.Attempt, _ = redis.Int(v[3], nil)
+	job.MaxAttempts, _ = redis.Int(v[4], nil)
+	job.Unique, _ = redis.String(v[5], nil)
+	job.LastError, _ = redis.String(v[6], nil)
+	return job, nil
+}
+
+// Ack 确认任务已经完成并删除
+func (q *Queue) Ack(ctx context.Context, job *Job) error {
+	return q.leased(q.ack.Do(ctx, q.key("active"), q.base, job.ID, job.Attempt))
+}
+
+/*
+ * Fail 任务执行失败，没有超过最大执行次数时按指数退避重试，否则进入dead列表
+ * 返回的dead为true表示已经进入dead列表
+ */
+func (q *Queue) Fail(ctx context.Context, job *Job, cause error) (dead bool, err error) {
+	n, err := redis.Int(q.fail.Do(ctx, q.key("active"), q.key("delayed"), q.key("dead"),
+		q.base, job.ID, job.Attempt, q.backoff(job.Attempt).Milliseconds(), cause.Error()))
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, ErrLeaseLost
+	}
+	return n == 2, nil
+}
+
+// Extend 把任务的可见性超时延长到VisibilityTimeout之后
+func (q *Queue) Extend(ctx context.Context, job *Job) error {
+	return q.leased(q.extend.Do(ctx, q.key("active"), q.base, job.ID, job.Attempt, q.conf.VisibilityTimeout.Milliseconds()))
+}
+
+// Dead 返回dead列表中最近的count个任务
+func (q *Queue) Dead(ctx context.Context, count int) ([]*Job, error) {
+	conn, err := q.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ids, err := redis.Strings(conn.DoContext(ctx, "LRANGE", q.key("dead"), 0, count-1))
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(ids))
+	for _, id := range ids {
+		v, err := redis.StringMap(conn.DoContext(ctx, "HGETALL", q.key("job:"+id)))
+		if err != nil {
+			return nil, err
+		}
+		job := &Job{ID: id, Payload: []byte(v["payload"]), Unique: v["unique"], LastError: v["error"]}
+		job.Priority, _ = strconv.Atoi(v["priority"])
+		job.Attempt, _ = strconv.Atoi(v["attempt"])
+		job.MaxAttempts, _ = strconv.Atoi(v["max"])
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Requeue 把dead列表中的任务重新放回队列，执行次数清零；任务不在dead列表中时返回false
+func (q *Queue) Requeue(ctx context.Context, id string) (bool, error) {
+	return redis.Bool(q.requeue.Do(ctx, q.key("ready"), q.key("dead"), q.base, id))
+}
+
+// Remove 从dead列表中删除任务；任务不在dead列表中时返回false
+func (q *Queue) Remove(ctx context.Context, id string) (bool, error) {
+	return redis.Bool(q.remove.Do(ctx, q.key("dead"), q.base, id))
+}
+
+func (q *Queue) Stats(ctx context.Context) (*Stats, error) {
+	p := q.pool.Pipeline()
+	p.Send("ZCARD", q.key("ready"))
+	p.Send("ZCARD", q.key("delayed"))
+	p.Send("ZCARD", q.key("active"))
+	p.Send("LLEN", q.key("dead"))
+	rs, err := p.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := rs.FirstError(); err != nil {
+		return nil, err
+	}
+	s := &Stats{}
+	s.Ready, _ = rs.Int64(0)
+	s.Delayed, _ = rs.Int64(1)
+	s.Active, _ = rs.Int64(2)
+	s.Dead, _ = rs.Int64(3)
+	return s, nil
+}
+
+func (q *Queue) key(name string) string {
+	return q.base + name
+}
+
+// 第attempt次失败后的等待时间
+func (q *Queue) backoff(attempt int) time.Duration {
+	d := q.conf.BackoffMin
+	for i := 1; i < attempt && d < q.conf.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > q.conf.BackoffMax {
+		d = q.conf.BackoffMax
+	}
+	return d
+}
+
+func (q *Queue) leased(reply interface{}, err error) error {
+	ok, err := redis.Bool(reply, err)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,322 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/queue"
+	"meross_iot/library/internal/redistest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testQueueSuite struct {
+	suite.Suite
+	driver string
+	mr     *miniredis.Miniredis
+	rc     *redis.Redis
+	now    time.Time
+}
+
+func (s *testQueueSuite) SetupTest() {
+	mr, err := miniredis.Run()
+	s.Require().NoError(err)
+	s.mr = mr
+	c := redistest.Config(mr.Addr(), s.driver)
+	s.rc = redis.New(c)
+	s.now = time.Now()
+}
+
+func (s *testQueueSuite) TearDownTest() {
+	s.rc.Pool().Close()
+	s.mr.Close()
+}
+
+// 固定redis的TIME，用于测试延迟、退避和可见性超时
+func (s *testQueueSuite) advance(d time.Duration) {
+	s.now = s.now.Add(d)
+	s.mr.SetTime(s.now)
+}
+
+func (s *testQueueSuite) conf() *queue.Config {
+	c := queue.NewConfig("issue")
+	c.MaxAttempts = 3
+	c.PollInterval = 10 * time.Millisecond
+	return c
+}
+
+func (s *testQueueSuite) reserve(q *queue.Queue) *queue.Job {
+	job, err := q.Reserve(context.Background())
+	s.Require().NoError(err)
+	return job
+}
+
+/*
+ * 1. 测试按优先级和入队顺序取出，延迟任务到期后才能取出
+ */
+func (s *testQueueSuite) TestEnqueueReserve() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	s.advance(0)
+	q := queue.New(s.rc, s.conf())
+	assrt.Nil(s.reserve(q))
+	for _, job := range []*queue.Job{
+		{Payload: []byte("low-1")},
+		{Payload: []byte("high"), Priority: queue.MaxPriority},
+		{Payload: []byte("delayed"), Priority: queue.MaxPriority, Delay: time.Minute},
+		{Payload: []byte("low-2")},
+		{Payload: []byte("mid"), Priority: 5},
+	} {
+		_, err := q.Enqueue(ctx, job)
+		assrt.NoError(err)
+	}
+	_, err := q.Enqueue(ctx, &queue.Job{Priority: queue.MaxPriority + 1})
+	assrt.Error(err)
+	stats, err := q.Stats(ctx)
+	assrt.NoError(err)
+	assrt.Equal(&queue.Stats{Ready: 4, Delayed: 1}, stats)
+
+	order := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		job := s.reserve(q)
+		order = append(order, string(job.Payload))
+		assrt.Equal(1, job.Attempt)
+		assrt.Equal(3, job.MaxAttempts)
+		assrt.NoError(q.Ack(ctx, job))
+	}
+	assrt.Equal([]string{"high", "mid", "low-1", "low-2"}, order)
+	assrt.Nil(s.reserve(q))
+
+	s.advance(time.Minute)
+	job := s.reserve(q)
+	assrt.Equal("delayed", string(job.Payload))
+	assrt.Equal(queue.MaxPriority, job.Priority)
+	stats, _ = q.Stats(ctx)
+	assrt.Equal(&queue.Stats{Active: 1}, stats)
+	assrt.NoError(q.Ack(ctx, job))
+	assrt.Equal(queue.ErrLeaseLost, q.Ack(ctx, job))
+	assrt.Equal(1, len(s.mr.Keys()))
+}
+
+/*
+ * 2. 测试相同Unique的任务完成前不能重复入队
+ */
+func (s *testQueueSuite) TestUnique() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	s.advance(0)
+	q := queue.New(s.rc, s.conf())
+	id, err := q.Enqueue(ctx, &queue.Job{Payload: []byte("a"), Unique: "batch:1"})
+	assrt.NoError(err)
+	_, err = q.Enqueue(ctx, &queue.Job{Payload: []byte("b"), Unique: "batch:1"})
+	assrt.Equal(queue.ErrDuplicate, err)
+	_, err = q.Enqueue(ctx, &queue.Job{Payload: []byte("c"), Unique: "batch:2"})
+	assrt.NoError(err)
+
+	// 执行中和等待重试时仍然不能重复
+	job := s.reserve(q)
+	assrt.Equal(id, job.ID)
+	assrt.Equal("batch:1", job.Unique)
+	assrt.NoError(q.Ack(ctx, s.reserve(q)))
+	_, err = q.Fail(ctx, job, errors.New("timeout"))
+	assrt.NoError(err)
+	_, err = q.Enqueue(ctx, &queue.Job{Unique: "batch:1"})
+	assrt.Equal(queue.ErrDuplicate, err)
+	s.advance(time.Second)
+	assrt.Equal(id, s.reserve(q).ID)
+	assrt.NoError(q.Ack(ctx, &queue.Job{ID: id, Attempt: 2}))
+	_, err = q.Enqueue(ctx, &queue.Job{Unique: "batch:1"})
+	assrt.NoError(err)
+}
+
+/*
+ * 3. 测试失败后按指数退避重试，超过最大次数后进入dead列表
+ */
+func (s *testQueueSuite) TestRetryDead() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	s.advance(0)
+	q := queue.New(s.rc, s.conf())
+	id, err := q.Enqueue(ctx, &queue.Job{Payload: []byte("notify"), Unique: "n1"})
+	assrt.NoError(err)
+
+	job := s.reserve(q)
+	dead, err := q.Fail(ctx, job, errors.New("smtp down"))
+	assrt.NoError(err)
+	assrt.False(dead)
+	assrt.Nil(s.reserve(q))
+	s.advance(time.Second)
+	job = s.reserve(q)
+	assrt.Equal(2, job.Attempt)
+	assrt.Equal("smtp down", job.LastError)
+	_, err = q.Fail(ctx, job, errors.New("smtp down again"))
+	assrt.NoError(err)
+	// 第二次失败后等待2s
+	s.advance(time.Second)
+	assrt.Nil(s.reserve(q))
+	s.advance(time.Second)
+	job = s.reserve(q)
+	assrt.Equal(3, job.Attempt)
+	dead, err = q.Fail(ctx, job, errors.New("invalid address"))
+	assrt.NoError(err)
+	assrt.True(dead)
+	_, err = q.Fail(ctx, job, errors.New("invalid address"))
+	assrt.Equal(queue.ErrLeaseLost, err)
+
+	s.advance(time.Hour)
+	assrt.Nil(s.reserve(q))
+	jobs, err := q.Dead(ctx, 10)
+	assrt.NoError(err)
+	assrt.Equal([]*queue.Job{{ID: id, Payload: []byte("notify"), MaxAttempts: 3, Unique: "n1", Attempt: 3, LastError: "invalid address"}}, jobs)
+	// 进入dead列表后释放Unique
+	_, err = q.Enqueue(ctx, &queue.Job{Unique: "n1"})
+	assrt.NoError(err)
+	assrt.NoError(q.Ack(ctx, s.reserve(q)))
+
+	ok, err := q.Requeue(ctx, id)
+	assrt.NoError(err)
+	assrt.True(ok)
+	ok, _ = q.Requeue(ctx, id)
+	assrt.False(ok)
+	job = s.reserve(q)
+	assrt.Equal(id, job.ID)
+	assrt.Equal(1, job.Attempt)
+	q.Fail(ctx, job, errors.New("e1"))
+	q2 := queue.New(s.rc, func() *queue.Config {
+		c := s.conf()
+		c.BackoffMax = time.Second
+		return c
+	}())
+	for i := 0; i < 2; i++ {
+		s.advance(time.Second)
+		q2.Fail(ctx, s.reserve(q2), errors.New("e2"))
+	}
+	stats, _ := q.Stats(ctx)
+	assrt.Equal(&queue.Stats{Dead: 1}, stats)
+	ok, err = q.Remove(ctx, id)
+	assrt.NoError(err)
+	assrt.True(ok)
+	assrt.Equal(1, len(s.mr.Keys()))
+}
+
+/*
+ * 4. 测试超过可见性超时没有确认的任务被重新投递，旧的lease不能确认
+ */
+func (s *testQueueSuite) TestVisibilityTimeout() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	s.advance(0)
+	c := s.conf()
+	c.MaxAttempts = 2
+	q := queue.New(s.rc, c)
+	id, _ := q.Enqueue(ctx, &queue.Job{Payload: []byte("issue")})
+	first := s.reserve(q)
+	s.advance(20 * time.Second)
+	assrt.NoError(q.Extend(ctx, first))
+	s.advance(20 * time.Second)
+	assrt.Nil(s.reserve(q))
+
+	s.advance(20 * time.Second)
+	second := s.reserve(q)
+	assrt.Equal(id, second.ID)
+	assrt.Equal(2, second.Attempt)
+	assrt.Equal("visibility timeout", second.LastError)
+	assrt.Equal(queue.ErrLeaseLost, q.Ack(ctx, first))
+	assrt.Equal(queue.ErrLeaseLost, q.Extend(ctx, first))
+
+	// 最后一次执行超时后进入dead列表
+	s.advance(time.Minute)
+	assrt.Nil(s.reserve(q))
+	jobs, _ := q.Dead(ctx, 10)
+	assrt.Equal(1, len(jobs))
+	assrt.Equal(queue.ErrLeaseLost, q.Ack(ctx, second))
+}
+
+/*
+ * 5. 测试Run并发处理、失败重试和处理期间自动续期
+ */
+func (s *testQueueSuite) TestRun() {
+	assrt := assert.New(s.T())
+	c := s.conf()
+	c.Concurrency = 3
+	c.BackoffMin = 10 * time.Millisecond
+	c.VisibilityTimeout = 60 * time.Millisecond
+	q := queue.New(s.rc, c)
+	errs := int32(0)
+	q.OnError(func(err error) {
+		atomic.AddInt32(&errs, 1)
+	})
+	ids := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		id, err := q.Enqueue(context.Background(), &queue.Job{Payload: []byte(strconv.Itoa(i))})
+		assrt.NoError(err)
+		ids[id] = true
+	}
+
+	mu := sync.Mutex{}
+	attempts := make(map[string]int)
+	running, maxRunning := int32(0), int32(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- q.Run(ctx, func(ctx context.Context, job *queue.Job) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			mu.Lock()
+			attempts[job.ID]++
+			mu.Unlock()
+			switch string(job.Payload) {
+			case "0":
+				// 超过可见性超时，续期后不会被重复投递
+				time.Sleep(150 * time.Millisecond)
+			case "1":
+				if job.Attempt == 1 {
+					return errors.New("device offline")
+				}
+			default:
+				time.Sleep(20 * time.Millisecond)
+			}
+			return nil
+		})
+	}()
+	assrt.Eventually(func() bool {
+		stats, err := q.Stats(context.Background())
+		return err == nil && *stats == queue.Stats{}
+	}, 2*time.Second, 10*time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assrt.NoError(err)
+	case <-time.After(time.Second):
+		assrt.Fail("Run should return after ctx is done")
+	}
+	assrt.Equal(int32(3), maxRunning)
+	assrt.Equal(int32(1), atomic.LoadInt32(&errs))
+	assrt.Equal(6, len(attempts))
+	for id, n := range attempts {
+		assrt.True(ids[id])
+		if n != 1 {
+			assrt.Equal(2, n)
+		}
+	}
+}
+
+func TestQueueRedigoSuite(t *testing.T) {
+	suite.Run(t, &testQueueSuite{driver: redis.DriverRedigo})
+}
+
+func TestQueueGoRedisSuite(t *testing.T) {
+	suite.Run(t, &testQueueSuite{driver: redis.DriverGoRedis})
+}
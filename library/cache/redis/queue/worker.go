@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Handler 处理一个任务，返回nil时确认完成，返回错误时按退避重试；任务的lease丢失时ctx被取消
+type Handler func(ctx context.Context, job *Job) error
+
+/*
+ * Run 启动Concurrency个worker循环取出并处理任务，直到ctx结束
+ * ctx结束后不再取出新任务，等待正在执行的Handler返回后退出，返回nil
+ * 处理期间每隔VisibilityTimeout/3续期，Handler超过VisibilityTimeout没有返回也不会被重复投递
+ */
+func (q *Queue) Run(ctx context.Context, h Handler) error {
+	wg := sync.WaitGroup{}
+	for i := 0; i < q.conf.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx, h)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (q *Queue) work(ctx context.Context, h Handler) {
+	for ctx.Err() == nil {
+		job, err := q.Reserve(ctx)
+		if err != nil && ctx.Err() == nil {
+			q.onError(fmt.Errorf("fail to reserve job: %s", err))
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(q.conf.PollInterval):
+			}
+			continue
+		}
+		q.process(ctx, h, job)
+	}
+}
+
+func (q *Queue) process(ctx context.Context, h Handler, job *Job) {
+	// ctx结束后仍然确认正在处理的任务
+	bg := context.Background()
+	hctx, cancel := context.WithCancel(ctx)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		q.keepAlive(job, done)
+		cancel()
+	}()
+	err := h(hctx, job)
+	// 等待续期结束后再确认，避免确认之后续期报告lease丢失
+	close(done)
+	<-stopped
+	cancel()
+	if err == nil {
+		if err := q.Ack(bg, job); err != nil {
+			q.onError(fmt.Errorf("fail to ack job %s: %s", job.ID, err))
+		}
+		return
+	}
+	q.onError(fmt.Errorf("job %s attempt %d failed: %s", job.ID, job.Attempt, err))
+	if _, err := q.Fail(bg, job, err); err != nil {
+		q.onError(fmt.Errorf("fail to retry job %s: %s", job.ID, err))
+	}
+}
+
+// 续期直到Handler返回；lease丢失时返回，由调用方取消Handler的ctx
+func (q *Queue) keepAlive(job *Job, done chan struct{}) {
+	ticker := time.NewTicker(q.conf.VisibilityTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := q.Extend(context.Background(), job)
+			if err == ErrLeaseLost {
+				q.onError(fmt.Errorf("job %s: %s", job.ID, err))
+				return
+			}
+			if err != nil {
+				q.onError(fmt.Errorf("fail to extend job %s: %s", job.ID, err))
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyFunc 从请求中提取限流的维度，返回空字符串时该规则不限流
+type KeyFunc func(c *gin.Context) string
+
+// Rule 一条限流规则，redis key为前缀+Name+":"+KeyFunc的返回值
+type Rule struct {
+	Name  string
+	Limit *Limit
+	Key   KeyFunc
+}
+
+// KeyByIP 按连接的对端IP限流，不信任X-Forwarded-For等请求头，避免客户端伪造IP绕过限流
+func KeyByIP(c *gin.Context) string {
+	return remoteIP(c.Request)
+}
+
+/*
+ * KeyByForwardedIP 服务部署在反向代理后面时按客户端IP限流
+ * 对端IP是可信代理时，从右往左取X-Forwarded-For中第一个不是可信代理的IP；对端不是可信代理时与KeyByIP相同
+ * trustedProxies为代理的IP或CIDR，如10.0.0.0/8
+ */
+func KeyByForwardedIP(trustedProxies ...string) (KeyFunc, error) {
+	nets := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, p := range trustedProxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("wrong trusted proxy [%s]", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("wrong trusted proxy [%s], %s", p, err)
+		}
+		nets = append(nets, n)
+	}
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(c *gin.Context) string {
+		ip := remoteIP(c.Request)
+		if !trusted(ip) {
+			return ip
+		}
+		hops := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				break
+			}
+			ip = hop
+			if !trusted(hop) {
+				break
+			}
+		}
+		return ip
+	}, nil
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByParam 按路由参数限流，如设备uuid
+func KeyByParam(name string) KeyFunc {
+	return func(c *gin.Context) string {
+		return c.Param(name)
+	}
+}
+
+// KeyByHeader 按请求头限流，如调用方的app id
+func KeyByHeader(name string) KeyFunc {
+	return func(c *gin.Context) string {
+		return c.GetHeader(name)
+	}
+}
+
+/*
+ * GinMiddleware 依次检查所有规则，任意一条被拒绝时返回429和Retry-After
+ * 响应头RateLimit-Limit、RateLimit-Remaining、RateLimit-Reset(秒)取被拒绝的规则或剩余次数最少的规则
+ * 被拒绝之前已经检查过的规则仍然扣除了次数
+ * redis出错时不限流，错误通过c.Error记录，由后续的日志中间件输出
+ */
+func (l *Limiter) GinMiddleware(rules ...*Rule) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		shown := (*Result)(nil)
+		for _, rule := range rules {
+			key := rule.Key(c)
+			if key == "" {
+				continue
+			}
+			res, err := l.Allow(c.Request.Context(), rule.Name+":"+key, rule.Limit)
+			if err != nil {
+				c.Error(err)
+				continue
+			}
+			if !res.Allowed {
+				setHeaders(c, res)
+				c.Header("Retry-After", strconv.Itoa(seconds(res.RetryAfter)))
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+					"error": "too many requests",
+					"rule":  rule.Name,
+				})
+				return
+			}
+			if shown == nil || res.Remaining < shown.Remaining {
+				shown = res
+			}
+		}
+		if shown != nil {
+			setHeaders(c, shown)
+		}
+		c.Next()
+	}
+}
+
+func setHeaders(c *gin.Context, res *Result) {
+	c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(seconds(res.ResetAfter)))
+}
+
+// 向上取整，避免客户端提前重试
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
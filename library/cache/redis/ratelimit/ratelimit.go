@@ -0,0 +1,205 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/configurator/validate"
+	"time"
+)
+
+const (
+	AlgorithmTokenBucket   = "token-bucket"
+	AlgorithmSlidingWindow = "sliding-window"
+
+	DefaultPrefix = "ratelimit:"
+)
+
+/*
+ * 脚本使用redis的TIME作为时间，多个实例的时钟不一致也不影响限流
+ * 时间单位为毫秒，tostring最多保留14位有效数字，微秒时间戳会丢失精度
+ * 返回{是否允许, 剩余次数, 被拒绝时多久后重试(ms), 多久后恢复到满额(ms)}
+ */
+
+// 令牌桶，hash中保存剩余令牌数和上次更新的时间
+const tokenBucketScript = `
+redis.replicate_commands()
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local retry = 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+else
+	retry = math.ceil((n - tokens) / rate)
+end
+local reset = math.ceil((capacity - tokens) / rate)
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], reset + 1)
+return {allowed, math.floor(tokens), retry, reset}
+`
+
+// 滑动窗口日志，zset中保存窗口内每次请求的时间
+const slidingWindowScript = `
+redis.replicate_commands()
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+local retry = 0
+if count + n <= limit then
+	for i = 1, n do
+		redis.call("ZADD", KEYS[1], now, ARGV[4] .. ":" .. i)
+	end
+	count = count + n
+	allowed = 1
+else
+	local i = count + n - limit - 1
+	local oldest = redis.call("ZRANGE", KEYS[1], i, i, "WITHSCORES")
+	retry = tonumber(oldest[2]) + window - now
+end
+local reset = 0
+if count > 0 then
+	local newest = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+	reset = tonumber(newest[2]) + window - now
+	redis.call("PEXPIRE", KEYS[1], window)
+end
+return {allowed, limit - count, retry, reset}
+`
+
+// Limit 每个Period最多Rate次，可以直接作为配置段
+type Limit struct {
+	Algorithm string        `validate:"oneof=token-bucket sliding-window"`
+	Rate      int           `validate:"min=1"`
+	Period    time.Duration `validate:"gt=0"`
+	// 令牌桶的容量，即允许的突发次数，为0时等于Rate；滑动窗口不使用
+	Burst int `validate:"min=0"`
+}
+
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (l *Limit) Validate(section string) error {
+	return validate.Struct(section, l)
+}
+
+// 令牌桶的容量或滑动窗口内允许的次数
+func (l *Limit) capacity() int {
+	if l.Algorithm == AlgorithmTokenBucket && l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// Result 一次限流判断的结果
+type Result struct {
+	Allowed bool
+	// 容量，即RateLimit-Limit
+	Limit int
+	// 本次之后剩余的次数
+	Remaining int
+	// 被拒绝时需要等待的时间，允许时为0
+	RetryAfter time.Duration
+	// 恢复到满额需要的时间
+	ResetAfter time.Duration
+}
+
+// Limiter 基于redis的分布式限流，每个key的判断和更新在一个Lua脚本中原子执行
+type Limiter struct {
+	prefix        string
+	pool          redis.Pool
+	tokenBucket   redis.Script
+	slidingWindow redis.Script
+}
+
+// New prefix为空时使用DefaultPrefix
+func New(r *redis.Redis, prefix string) *Limiter {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	p := r.Pool()
+	return &Limiter{
+		prefix:        prefix,
+		pool:          p,
+		tokenBucket:   p.Script(1, tokenBucketScript),
+		slidingWindow: p.Script(1, slidingWindowScript),
+	}
+}
+
+func (l *Limiter) Allow(ctx context.Context, key string, limit *Limit) (*Result, error) {
+	return l.AllowN(ctx, key, limit, 1)
+}
+
+// AllowN 判断key是否还能执行n次，允许时扣除n次，拒绝时不扣除
+func (l *Limiter) AllowN(ctx context.Context, key string, limit *Limit, n int) (*Result, error) {
+	capacity := limit.capacity()
+	if n <= 0 || n > capacity {
+		return nil, fmt.Errorf("ratelimit: n must be in [1, %d], got %d", capacity, n)
+	}
+	key = l.prefix + key
+	period := limit.Period.Milliseconds()
+	if period <= 0 {
+		period = 1
+	}
+	v := []int64(nil)
+	err := error(nil)
+	switch limit.Algorithm {
+	case AlgorithmTokenBucket:
+		// 每毫秒补充的令牌数
+		rate := float64(limit.Rate) / float64(period)
+		v, err = redis.Int64s(l.tokenBucket.Do(ctx, key, capacity, rate, n))
+	case AlgorithmSlidingWindow:
+		id := ""
+		if id, err = newID(); err != nil {
+			return nil, err
+		}
+		v, err = redis.Int64s(l.slidingWindow.Do(ctx, key, capacity, period, n, id))
+	default:
+		return nil, fmt.Errorf("ratelimit: unsupported algorithm [%s]", limit.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != 4 {
+		return nil, fmt.Errorf("ratelimit: unexpected script reply %v", v)
+	}
+	return &Result{
+		Allowed:    v[0] == 1,
+		Limit:      capacity,
+		Remaining:  int(v[1]),
+		RetryAfter: time.Duration(v[2]) * time.Millisecond,
+		ResetAfter: time.Duration(v[3]) * time.Millisecond,
+	}, nil
+}
+
+// Reset 清除key的限流状态
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	conn, err := l.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.DoContext(ctx, "DEL", l.prefix+key)
+	return err
+}
+
+// 同一个窗口内的请求需要不同的member
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,277 @@
+package ratelimit_test
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/ratelimit"
+	"meross_iot/library/internal/redistest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testRateLimitSuite struct {
+	suite.Suite
+	driver string
+	mr     *miniredis.Miniredis
+	rc     *redis.Redis
+	now    time.Time
+}
+
+func (s *testRateLimitSuite) SetupTest() {
+	mr, err := miniredis.Run()
+	s.Require().NoError(err)
+	s.mr = mr
+	// 脚本使用redis的TIME，固定miniredis的时间
+	s.now = time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	s.mr.SetTime(s.now)
+	c := redistest.Config(mr.Addr(), s.driver)
+	s.rc = redis.New(c)
+}
+
+func (s *testRateLimitSuite) TearDownTest() {
+	s.rc.Pool().Close()
+	s.mr.Close()
+}
+
+func (s *testRateLimitSuite) advance(d time.Duration) {
+	s.now = s.now.Add(d)
+	s.mr.SetTime(s.now)
+}
+
+/*
+ * 1. 测试令牌桶，允许突发burst次，之后按rate补充
+ */
+func (s *testRateLimitSuite) TestTokenBucket() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	l := ratelimit.New(s.rc, "")
+	limit := &ratelimit.Limit{Algorithm: ratelimit.AlgorithmTokenBucket, Rate: 10, Period: time.Second, Burst: 5}
+	for i := 0; i < 5; i++ {
+		res, err := l.Allow(ctx, "caller", limit)
+		assrt.NoError(err)
+		assrt.True(res.Allowed)
+		assrt.Equal(5, res.Limit)
+		assrt.Equal(4-i, res.Remaining)
+	}
+	res, err := l.Allow(ctx, "caller", limit)
+	assrt.NoError(err)
+	assrt.False(res.Allowed)
+	assrt.Equal(0, res.Remaining)
+	assrt.Equal(100*time.Millisecond, res.RetryAfter)
+	assrt.Equal(500*time.Millisecond, res.ResetAfter)
+	assrt.True(s.mr.Exists("ratelimit:caller"))
+
+	s.advance(200 * time.Millisecond)
+	res, err = l.AllowN(ctx, "caller", limit, 2)
+	assrt.NoError(err)
+	assrt.True(res.Allowed)
+	assrt.Equal(0, res.Remaining)
+	res, err = l.Allow(ctx, "caller", limit)
+	assrt.NoError(err)
+	assrt.False(res.Allowed)
+
+	// 其他key不受影响
+	res, err = l.Allow(ctx, "other", limit)
+	assrt.NoError(err)
+	assrt.True(res.Allowed)
+
+	// burst为0时容量等于rate
+	limit.Burst = 0
+	res, err = l.Allow(ctx, "noBurst", limit)
+	assrt.NoError(err)
+	assrt.Equal(10, res.Limit)
+	assrt.Equal(9, res.Remaining)
+}
+
+/*
+ * 2. 测试滑动窗口，窗口内最早的请求过期后才能再次请求
+ */
+func (s *testRateLimitSuite) TestSlidingWindow() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	l := ratelimit.New(s.rc, "rl:")
+	limit := &ratelimit.Limit{Algorithm: ratelimit.AlgorithmSlidingWindow, Rate: 3, Period: time.Second}
+	res, err := l.Allow(ctx, "device", limit)
+	assrt.NoError(err)
+	assrt.True(res.Allowed)
+	assrt.Equal(2, res.Remaining)
+	assrt.Equal(time.Second, res.ResetAfter)
+
+	s.advance(300 * time.Millisecond)
+	res, err = l.AllowN(ctx, "device", limit, 2)
+	assrt.NoError(err)
+	assrt.True(res.Allowed)
+	assrt.Equal(0, res.Remaining)
+
+	s.advance(100 * time.Millisecond)
+	res, err = l.Allow(ctx, "device", limit)
+	assrt.NoError(err)
+	assrt.False(res.Allowed)
+	assrt.Equal(600*time.Millisecond, res.RetryAfter)
+	assrt.Equal(900*time.Millisecond, res.ResetAfter)
+	// 需要两个空位时等待第二早的请求过期
+	res, err = l.AllowN(ctx, "device", limit, 2)
+	assrt.NoError(err)
+	assrt.False(res.Allowed)
+	assrt.Equal(900*time.Millisecond, res.RetryAfter)
+
+	s.advance(600 * time.Millisecond)
+	res, err = l.Allow(ctx, "device", limit)
+	assrt.NoError(err)
+	assrt.True(res.Allowed)
+	assrt.Equal(0, res.Remaining)
+	assrt.True(s.mr.Exists("rl:device"))
+}
+
+/*
+ * 3. 测试参数错误和Reset
+ */
+func (s *testRateLimitSuite) TestWrongArgs() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	l := ratelimit.New(s.rc, "")
+	limit := &ratelimit.Limit{Algorithm: ratelimit.AlgorithmSlidingWindow, Rate: 1, Period: time.Minute}
+	_, err := l.AllowN(ctx, "caller", limit, 2)
+	assrt.Error(err)
+	_, err = l.AllowN(ctx, "caller", limit, 0)
+	assrt.Error(err)
+	_, err = l.Allow(ctx, "caller", &ratelimit.Limit{Algorithm: "fixed", Rate: 1, Period: time.Minute})
+	assrt.Error(err)
+	assrt.Error((&ratelimit.Limit{Algorithm: "fixed", Rate: 1, Period: time.Minute}).Validate("rateLimit"))
+	assrt.Error((&ratelimit.Limit{Algorithm: ratelimit.AlgorithmTokenBucket, Rate: 1}).Validate("rateLimit"))
+	assrt.NoError(limit.Validate("rateLimit"))
+
+	res, err := l.Allow(ctx, "caller", limit)
+	assrt.NoError(err)
+	assrt.True(res.Allowed)
+	res, err = l.Allow(ctx, "caller", limit)
+	assrt.NoError(err)
+	assrt.False(res.Allowed)
+	assrt.NoError(l.Reset(ctx, "caller"))
+	res, err = l.Allow(ctx, "caller", limit)
+	assrt.NoError(err)
+	assrt.True(res.Allowed)
+}
+
+/*
+ * 4. 测试gin中间件的响应头和429，redis不可用时不限流
+ */
+func (s *testRateLimitSuite) TestGinMiddleware() {
+	assrt := assert.New(s.T())
+	gin.SetMode(gin.TestMode)
+	l := ratelimit.New(s.rc, "")
+	errs := 0
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Next()
+		errs += len(c.Errors)
+	})
+	r.PUT("/device/:uuid", l.GinMiddleware(
+		&ratelimit.Rule{
+			Name:  "caller",
+			Limit: &ratelimit.Limit{Algorithm: ratelimit.AlgorithmTokenBucket, Rate: 10, Period: time.Minute},
+			Key:   ratelimit.KeyByHeader("X-App-Id"),
+		},
+		&ratelimit.Rule{
+			Name:  "device",
+			Limit: &ratelimit.Limit{Algorithm: ratelimit.AlgorithmSlidingWindow, Rate: 2, Period: time.Minute},
+			Key:   ratelimit.KeyByParam("uuid"),
+		},
+	), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	do := func(uuid, app string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/device/"+uuid, nil)
+		if app != "" {
+			req.Header.Set("X-App-Id", app)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("d1", "app1")
+	assrt.Equal(http.StatusOK, w.Code)
+	// 剩余次数最少的规则
+	assrt.Equal("2", w.Header().Get("RateLimit-Limit"))
+	assrt.Equal("1", w.Header().Get("RateLimit-Remaining"))
+	assrt.Equal("60", w.Header().Get("RateLimit-Reset"))
+	w = do("d1", "")
+	assrt.Equal(http.StatusOK, w.Code)
+	assrt.Equal("0", w.Header().Get("RateLimit-Remaining"))
+
+	s.advance(10 * time.Second)
+	w = do("d1", "app1")
+	assrt.Equal(http.StatusTooManyRequests, w.Code)
+	assrt.Equal("50", w.Header().Get("Retry-After"))
+	assrt.Equal("2", w.Header().Get("RateLimit-Limit"))
+	assrt.Contains(w.Body.String(), "device")
+
+	w = do("d2", "app1")
+	assrt.Equal(http.StatusOK, w.Code)
+	// 被device规则拒绝的请求也扣除了caller的次数，10秒补充的令牌不超过容量
+	res, err := l.Allow(context.Background(), "caller:app1", &ratelimit.Limit{Algorithm: ratelimit.AlgorithmTokenBucket, Rate: 10, Period: time.Minute})
+	assrt.NoError(err)
+	assrt.Equal(7, res.Remaining)
+	assrt.Equal(0, errs)
+
+	s.mr.Close()
+	w = do("d1", "app1")
+	assrt.Equal(http.StatusOK, w.Code)
+	assrt.Equal("", w.Header().Get("RateLimit-Limit"))
+	assrt.Equal(2, errs)
+}
+
+/*
+ * 5. 测试按IP限流的key：KeyByIP不信任请求头，KeyByForwardedIP只在对端是可信代理时读取X-Forwarded-For
+ */
+func (s *testRateLimitSuite) TestKeyByIP() {
+	assrt := assert.New(s.T())
+	gin.SetMode(gin.TestMode)
+	forwarded, err := ratelimit.KeyByForwardedIP("10.0.0.0/8", "192.168.1.1")
+	assrt.NoError(err)
+	cases := []struct {
+		remote    string
+		xff       string
+		ip        string
+		forwarded string
+	}{
+		{"1.2.3.4:5678", "", "1.2.3.4", "1.2.3.4"},
+		// 对端不是可信代理时忽略伪造的请求头
+		{"1.2.3.4:5678", "5.6.7.8", "1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1:5678", "5.6.7.8", "10.0.0.1", "5.6.7.8"},
+		// 跳过可信代理，客户端在最左边伪造的IP不生效
+		{"10.0.0.1:5678", "9.9.9.9, 5.6.7.8, 192.168.1.1", "10.0.0.1", "5.6.7.8"},
+		{"10.0.0.1:5678", "10.0.0.2", "10.0.0.1", "10.0.0.2"},
+		{"[::1]:5678", "5.6.7.8", "::1", "::1"},
+	}
+	for _, c := range cases {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		ctx.Request.RemoteAddr = c.remote
+		if c.xff != "" {
+			ctx.Request.Header.Set("X-Forwarded-For", c.xff)
+		}
+		assrt.Equal(c.ip, ratelimit.KeyByIP(ctx), c.remote+" "+c.xff)
+		assrt.Equal(c.forwarded, forwarded(ctx), c.remote+" "+c.xff)
+	}
+
+	_, err = ratelimit.KeyByForwardedIP("10.0.0.0/33")
+	assrt.Error(err)
+	_, err = ratelimit.KeyByForwardedIP("proxy")
+	assrt.Error(err)
+}
+
+func TestRateLimitRedigoSuite(t *testing.T) {
+	suite.Run(t, &testRateLimitSuite{driver: redis.DriverRedigo})
+}
+
+func TestRateLimitGoRedisSuite(t *testing.T) {
+	suite.Run(t, &testRateLimitSuite{driver: redis.DriverGoRedis})
+}
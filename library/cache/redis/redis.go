@@ -1,7 +1,10 @@
 package redis
 
 import (
+	"context"
 	"fmt"
+	"meross_iot/library/configurator/validate"
+	"sync"
 	"time"
 )
 
@@ -27,26 +30,40 @@ const (
 type Config struct {
 	Driver string
 	// net
-	Host string
-	Port int
-	Password string
-	Database int
+	Host string `validate:"required"`
+	Port int `validate:"min=1,max=65535"`
+	Password string `secret:"true"`
+	Database int `validate:"min=0,max=15"`
 	// conn
-	Timeout time.Duration
-	ReadTimeout time.Duration
-	WriteTimeout time.Duration
-	Keepalive time.Duration
+	Timeout time.Duration `validate:"min=0"`
+	ReadTimeout time.Duration `validate:"min=0"`
+	WriteTimeout time.Duration `validate:"min=0"`
+	Keepalive time.Duration `validate:"min=0"`
 	// pool
-	MaxActiveConns int
-	MaxIdleConns int
-	IdleTimeout time.Duration
-	ConnMaxLife time.Duration
-	PingOnBorrow time.Duration
+	MaxActiveConns int `validate:"min=0"`
+	MaxIdleConns int `validate:"min=0"`
+	IdleTimeout time.Duration `validate:"min=0"`
+	ConnMaxLife time.Duration `validate:"min=0"`
+	PingOnBorrow time.Duration `validate:"min=0"`
+	// sentinel，SentinelAddrs不为空时通过sentinel查询master地址，忽略Host和Port
+	SentinelAddrs []string
+	MasterName string
+	SentinelPassword string `secret:"true"`
+	// 只读命令发送到replica，只在使用sentinel时生效，读取replica可能读到旧数据
+	ReplicaReads bool
+	// cluster，ClusterAddrs不为空时使用cluster模式，为初始连接的节点地址，忽略Host和Port
+	ClusterAddrs []string
 }
 
 type Redis struct {
 	conf *Config
+	mu sync.Mutex
 	pool Pool
+	// 没有配置sentinel时为nil
+	sentinel *sentinel
+	// 没有配置cluster时为nil
+	cluster *cluster
+	hooks *hookChain
 }
 
 func NewConfig() *Config {
@@ -67,61 +84,138 @@ func NewConfig() *Config {
 	}
 }
 
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (c *Config) Validate(section string) error {
+	errs := validate.Errors{}
+	errs.Append(section, validate.Struct(section, c))
+	if c.Driver != DriverRedigo && c.Driver != DriverGoRedis {
+		key := "driver"
+		if section != "" {
+			key = section + "." + key
+		}
+		errs.Append(key, fmt.Errorf("unsupported redis client driver [%s]", c.Driver))
+	}
+	errs.Append(section, c.validateMode(section))
+	return errs.Err()
+}
+
+// 校验sentinel和cluster模式的配置
+func (c *Config) validateMode(section string) error {
+	errs := validate.Errors{}
+	keyName := func(key string) string {
+		if section != "" {
+			return section + "." + key
+		}
+		return key
+	}
+	if len(c.SentinelAddrs) > 0 && c.MasterName == "" {
+		errs.Append(keyName("masterName"), fmt.Errorf("master name is required when sentinel addrs are set"))
+	}
+	if len(c.ClusterAddrs) > 0 {
+		if len(c.SentinelAddrs) > 0 {
+			errs.Append(keyName("clusterAddrs"), fmt.Errorf("cluster and sentinel can not be used together"))
+		}
+		if c.Driver != DriverRedigo {
+			errs.Append(keyName("driver"), fmt.Errorf("cluster mode only supports driver [%s]", DriverRedigo))
+		}
+	}
+	return errs.Err()
+}
+
+// String 输出配置时隐藏密码
+func (c *Config) String() string {
+	return validate.Redact(c)
+}
+
 func New(c *Config) *Redis {
 	if c == nil {
 		panic(fmt.Errorf("redis config is empty"))
 	}
-	if c.Database < 0 || c.Database > 15 {
-		panic(fmt.Errorf("wrong redis config: %+v\n", c))
-	}
-	if c.Timeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.Keepalive < 0 {
-		panic(fmt.Errorf("wrong redis config: %+v\n", c))
+	// driver在创建连接时检查
+	if err := validate.Struct("redis", c); err != nil {
+		panic(fmt.Errorf("wrong redis config, %s\n", err))
 	}
-	if c.MaxActiveConns < 0 || c.MaxIdleConns < 0 || c.IdleTimeout < 0 {
-		panic(fmt.Errorf("wrong redis config: %+v\n", c))
-	}
-	if c.ConnMaxLife < 0 || c.PingOnBorrow < 0 {
-		panic(fmt.Errorf("wrong redis config: %+v\n", c))
+	if err := c.validateMode("redis"); err != nil {
+		panic(fmt.Errorf("wrong redis config, %s\n", err))
 	}
 	return &Redis{
 		conf: c,
+		sentinel: newSentinel(c),
+		cluster: newCluster(c),
+		hooks: &hookChain{},
 	}
 }
 
+// 同一个Redis实例共用一个pool，便于统计和关闭
 func (r *Redis) Pool() Pool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.pool != nil {
 		return r.pool
 	}
+	if r.cluster != nil {
+		r.pool = newHookPool(newClusterPool(r.cluster), r.hooks)
+		return r.pool
+	}
 	driver := r.conf.Driver
 	switch driver {
 	case DriverRedigo:
-		return newRedigoPool(r.conf)
+		r.pool = newHookPool(newRedigoPool(r.conf, r.sentinel), r.hooks)
 	case DriverGoRedis:
-		return nil
+		r.pool = newHookPool(newGoRedisPool(r.conf, r.sentinel), r.hooks)
 	default:
 		panic(fmt.Errorf("unsupported redis client driver [%s]\n", driver))
 	}
+	return r.pool
+}
+
+// Ping 从pool借一个连接执行PING，用于健康检查
+func (r *Redis) Ping(ctx context.Context) error {
+	conn, err := r.Pool().BorrowWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	pong, err := String(conn.Do("PING"))
+	if err != nil {
+		return err
+	}
+	if pong != "PONG" {
+		return fmt.Errorf("unexpected PING reply [%s]", pong)
+	}
+	return nil
 }
 
 func (r *Redis) PubSubConn() (PubSub, error) {
+	// cluster中PUBLISH会广播到所有节点，连接任意一个节点即可
+	if r.cluster != nil {
+		addr, err := r.cluster.anyAddr()
+		if err != nil {
+			return nil, err
+		}
+		return newRedigoPubSubConn(r.cluster.nodeConf(addr), nil)
+	}
 	driver := r.conf.Driver
 	switch driver {
 	case DriverRedigo:
-		return newRedigoPubSubConn(r.conf)
+		return newRedigoPubSubConn(r.conf, r.sentinel)
 	case DriverGoRedis:
-		return nil, nil
+		return newGoRedisPubSubConn(r.conf, r.sentinel)
 	default:
 		panic(fmt.Errorf("unsupported redis client driver [%s]\n", driver))
 	}
 }
 
 func (r *Redis) BlockedConn() (BlockedConn, error) {
+	if r.cluster != nil {
+		return newClusterBlockedConn(r.cluster), nil
+	}
 	driver := r.conf.Driver
 	switch driver {
 	case DriverRedigo:
-		return newRedigoBlockedConn(r.conf)
+		return newRedigoBlockedConn(r.conf, r.sentinel)
 	case DriverGoRedis:
-		return nil, nil
+		return newGoRedisBlockedConn(r.conf, r.sentinel)
 	default:
 		panic(fmt.Errorf("unsupported redis client driver [%s]\n", driver))
 	}
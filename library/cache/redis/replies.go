@@ -0,0 +1,146 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandError pipeline中单个命令的错误，包含命令在pipeline中的位置、命令名和key，不包含参数，避免泄露敏感数据
+type CommandError struct {
+	Index   int
+	Command string
+	Key     string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("redis pipeline command #%d [%s]: %s", e.Index, e.Command, e.Err)
+	}
+	return fmt.Sprintf("redis pipeline command #%d [%s %s]: %s", e.Index, e.Command, e.Key, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func (r *Replies) Len() int {
+	return len(r.replies)
+}
+
+// At 返回第i个命令的结果，服务端错误为Error，与Connection.Do的返回值一致
+func (r *Replies) At(i int) (interface{}, error) {
+	if i < 0 || i >= len(r.replies) {
+		return nil, fmt.Errorf("redis pipeline reply index %d out of range [0, %d)", i, len(r.replies))
+	}
+	rp := r.replies[i]
+	return rp.reply, rp.err
+}
+
+// Each 按顺序遍历结果，fn返回false时停止
+func (r *Replies) Each(fn func(i int, reply interface{}, err error) bool) {
+	for i, rp := range r.replies {
+		if !fn(i, rp.reply, rp.err) {
+			return
+		}
+	}
+}
+
+// FirstError 返回第一个失败的命令的错误，全部成功时返回nil
+func (r *Replies) FirstError() error {
+	for i, rp := range r.replies {
+		if rp.err != nil {
+			return r.commandError(i)
+		}
+	}
+	return nil
+}
+
+// Errors 返回所有失败的命令的错误
+func (r *Replies) Errors() []*CommandError {
+	errs := make([]*CommandError, 0)
+	for i, rp := range r.replies {
+		if rp.err != nil {
+			errs = append(errs, r.commandError(i))
+		}
+	}
+	return errs
+}
+
+func (r *Replies) commandError(i int) *CommandError {
+	rp := r.replies[i]
+	e := &CommandError{Index: i, Err: rp.err}
+	if rp.cmd != nil {
+		e.Command = strings.ToUpper(rp.cmd.command)
+		e.Key, _ = commandKey(rp.cmd.command, rp.cmd.args)
+	}
+	return e
+}
+
+/*
+ * 类型转换，与utils.go中的同名函数一致，如r.Int(0)等同于redis.Int(r.At(0))
+ */
+
+func (r *Replies) Int(i int) (int, error) {
+	return Int(r.At(i))
+}
+
+func (r *Replies) Int64(i int) (int64, error) {
+	return Int64(r.At(i))
+}
+
+func (r *Replies) Uint64(i int) (uint64, error) {
+	return Uint64(r.At(i))
+}
+
+func (r *Replies) Float64(i int) (float64, error) {
+	return Float64(r.At(i))
+}
+
+func (r *Replies) String(i int) (string, error) {
+	return String(r.At(i))
+}
+
+func (r *Replies) Bytes(i int) ([]byte, error) {
+	return Bytes(r.At(i))
+}
+
+func (r *Replies) Bool(i int) (bool, error) {
+	return Bool(r.At(i))
+}
+
+func (r *Replies) Values(i int) ([]interface{}, error) {
+	return Values(r.At(i))
+}
+
+func (r *Replies) Strings(i int) ([]string, error) {
+	return Strings(r.At(i))
+}
+
+func (r *Replies) ByteSlices(i int) ([][]byte, error) {
+	return ByteSlices(r.At(i))
+}
+
+func (r *Replies) Ints(i int) ([]int, error) {
+	return Ints(r.At(i))
+}
+
+func (r *Replies) Int64s(i int) ([]int64, error) {
+	return Int64s(r.At(i))
+}
+
+func (r *Replies) Float64s(i int) ([]float64, error) {
+	return Float64s(r.At(i))
+}
+
+func (r *Replies) StringMap(i int) (map[string]string, error) {
+	return StringMap(r.At(i))
+}
+
+func (r *Replies) IntMap(i int) (map[string]int, error) {
+	return IntMap(r.At(i))
+}
+
+func (r *Replies) Int64Map(i int) (map[string]int64, error) {
+	return Int64Map(r.At(i))
+}
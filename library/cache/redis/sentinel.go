@@ -0,0 +1,234 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	redigo "github.com/gomodule/redigo/redis"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 两次重新查询master的最小间隔，避免连接大量出错时频繁连接sentinel
+const sentinelRefreshInterval = time.Second
+
+/*
+ * 通过sentinel查询master和replica地址，两个driver共用
+ * 每次建立连接时查询master地址；连接出错或收到READONLY时在后台重新查询，master变化后由pool重建连接
+ */
+type sentinel struct {
+	mu         sync.Mutex
+	addrs      []string
+	masterName string
+	password   string
+	conf       *Config
+	// 上一次查询到的master地址，用于判断是否发生了切换
+	master string
+	// 同一时间只有一个refresh，refreshed为上一次refresh的时间(UnixNano)
+	refreshing int32
+	refreshed  int64
+}
+
+func newSentinel(c *Config) *sentinel {
+	if len(c.SentinelAddrs) == 0 {
+		return nil
+	}
+	addrs := make([]string, len(c.SentinelAddrs))
+	copy(addrs, c.SentinelAddrs)
+	return &sentinel{
+		addrs:      addrs,
+		masterName: c.MasterName,
+		password:   c.SentinelPassword,
+		conf:       c,
+	}
+}
+
+// 依次查询sentinel，成功的sentinel移到最前面，下次优先使用
+func (s *sentinel) query(args ...interface{}) (interface{}, error) {
+	s.mu.Lock()
+	addrs := make([]string, len(s.addrs))
+	copy(addrs, s.addrs)
+	s.mu.Unlock()
+	errs := make([]string, 0, len(addrs))
+	for i, addr := range addrs {
+		reply, err := s.queryOne(addr, args...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+			continue
+		}
+		if i > 0 {
+			s.mu.Lock()
+			s.promote(addr)
+			s.mu.Unlock()
+		}
+		return reply, nil
+	}
+	return nil, fmt.Errorf("no sentinel is available for master [%s]: %s", s.masterName, strings.Join(errs, "; "))
+}
+
+func (s *sentinel) queryOne(addr string, args ...interface{}) (interface{}, error) {
+	conn, err := redigo.Dial("tcp", addr,
+		redigo.DialConnectTimeout(s.conf.Timeout),
+		redigo.DialReadTimeout(s.conf.ReadTimeout),
+		redigo.DialWriteTimeout(s.conf.WriteTimeout),
+		redigo.DialPassword(s.password),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do("SENTINEL", args...)
+}
+
+func (s *sentinel) promote(addr string) {
+	for i, a := range s.addrs {
+		if a == addr {
+			copy(s.addrs[1:i+1], s.addrs[:i])
+			s.addrs[0] = addr
+			return
+		}
+	}
+}
+
+// masterAddr 查询当前master的地址
+func (s *sentinel) masterAddr() (string, error) {
+	parts, err := redigo.Strings(s.query("get-master-addr-by-name", s.masterName))
+	if err == redigo.ErrNil {
+		return "", fmt.Errorf("sentinel: unknown master [%s]", s.masterName)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(parts) != 2 {
+		return "", fmt.Errorf("sentinel: unexpected master addr reply %v", parts)
+	}
+	addr := net.JoinHostPort(parts[0], parts[1])
+	s.mu.Lock()
+	if s.master == "" {
+		s.master = addr
+	}
+	s.mu.Unlock()
+	return addr, nil
+}
+
+// replicaAddr 随机返回一个正常的replica地址，没有可用的replica时返回master地址
+func (s *sentinel) replicaAddr() (string, error) {
+	replies, err := redigo.Values(s.query("replicas", s.masterName))
+	if _, ok := err.(redigo.Error); ok {
+		// redis 5之前只支持slaves
+		replies, err = redigo.Values(s.query("slaves", s.masterName))
+	}
+	if err != nil {
+		return "", err
+	}
+	addrs := make([]string, 0, len(replies))
+	for _, r := range replies {
+		m, err := redigo.StringMap(r, nil)
+		if err != nil {
+			return "", err
+		}
+		if !replicaAvailable(m["flags"]) {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(m["ip"], m["port"]))
+	}
+	if len(addrs) == 0 {
+		return s.masterAddr()
+	}
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
+func replicaAvailable(flags string) bool {
+	for _, f := range strings.Split(flags, ",") {
+		switch f {
+		case "s_down", "o_down", "disconnected":
+			return false
+		}
+	}
+	return true
+}
+
+// refresh 重新查询master地址，返回master是否发生了切换
+func (s *sentinel) refresh() bool {
+	addr, err := s.masterAddr()
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := s.master != addr
+	s.master = addr
+	return changed
+}
+
+/*
+ * refreshAsync 在后台重新查询master，master发生了切换时调用onChange
+ * 已经有refresh在进行或距上一次refresh不足sentinelRefreshInterval时直接返回
+ */
+func (s *sentinel) refreshAsync(onChange func()) {
+	if time.Since(time.Unix(0, atomic.LoadInt64(&s.refreshed))) < sentinelRefreshInterval {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&s.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.refreshing, 0)
+		changed := s.refresh()
+		atomic.StoreInt64(&s.refreshed, time.Now().UnixNano())
+		if changed {
+			onChange()
+		}
+	}()
+}
+
+// 连接断开或master降级为replica时返回的错误，需要重新查询master；超时不代表master切换，不重新查询
+func isFailoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var re Error
+	if errors.As(err, &re) {
+		return strings.HasPrefix(string(re), "READONLY ")
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return !ne.Timeout()
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// 只读命令，开启ReplicaReads时发送到replica
+var readOnlyCommands = map[string]bool{
+	"GET": true, "MGET": true, "STRLEN": true, "GETRANGE": true, "EXISTS": true, "TYPE": true,
+	"TTL": true, "PTTL": true, "HGET": true, "HMGET": true, "HGETALL": true, "HKEYS": true,
+	"HVALS": true, "HLEN": true, "HEXISTS": true, "HSTRLEN": true, "LRANGE": true, "LLEN": true,
+	"LINDEX": true, "SMEMBERS": true, "SISMEMBER": true, "SCARD": true, "SRANDMEMBER": true,
+	"ZRANGE": true, "ZREVRANGE": true, "ZRANGEBYSCORE": true, "ZREVRANGEBYSCORE": true,
+	"ZSCORE": true, "ZCARD": true, "ZCOUNT": true, "ZRANK": true, "ZREVRANK": true,
+	"SCAN": true, "HSCAN": true, "SSCAN": true, "ZSCAN": true, "BITCOUNT": true, "GETBIT": true,
+	"PFCOUNT": true, "XRANGE": true, "XREVRANGE": true, "XLEN": true,
+}
+
+func isReadOnlyCommand(command string) bool {
+	return readOnlyCommands[strings.ToUpper(command)]
+}
+
+// 不使用sentinel时直接返回配置的地址
+func genAddrFunc(c *Config, st *sentinel, replica bool) func() (string, error) {
+	if st == nil {
+		address := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+		return func() (string, error) {
+			return address, nil
+		}
+	}
+	if replica {
+		return st.replicaAddr
+	}
+	return st.masterAddr
+}
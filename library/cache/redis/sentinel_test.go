@@ -0,0 +1,324 @@
+package redis_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/internal/redistest"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testMasterName = "mymaster"
+
+// 模拟sentinel，只支持查询master和replica地址
+type fakeSentinel struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	master   string
+	replicas [][2]string
+	// 查询master地址的次数
+	queries int
+}
+
+func newFakeSentinel() (*fakeSentinel, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	fs := &fakeSentinel{ln: ln}
+	go fs.serve()
+	return fs, nil
+}
+
+func (fs *fakeSentinel) Addr() string {
+	return fs.ln.Addr().String()
+}
+
+func (fs *fakeSentinel) Close() {
+	fs.ln.Close()
+}
+
+func (fs *fakeSentinel) Queries() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.queries
+}
+
+func (fs *fakeSentinel) SetMaster(addr string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.master = addr
+}
+
+// AddReplica 添加replica，flags如"slave"或"slave,s_down"
+func (fs *fakeSentinel) AddReplica(addr, flags string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.replicas = append(fs.replicas, [2]string{addr, flags})
+}
+
+func (fs *fakeSentinel) serve() {
+	for {
+		conn, err := fs.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fs.handle(conn)
+	}
+}
+
+func (fs *fakeSentinel) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := redistest.ReadCommand(r)
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, fs.reply(args))
+	}
+}
+
+func (fs *fakeSentinel) reply(args []string) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	cmd := strings.ToUpper(args[0])
+	switch {
+	case cmd == "PING":
+		return "+PONG\r\n"
+	case cmd == "AUTH":
+		return "+OK\r\n"
+	case cmd == "SENTINEL" && len(args) == 3 && args[2] != testMasterName:
+		return "*-1\r\n"
+	case cmd == "SENTINEL" && len(args) == 3 && args[1] == "get-master-addr-by-name":
+		fs.queries++
+		if fs.master == "" {
+			return "*-1\r\n"
+		}
+		host, port, _ := net.SplitHostPort(fs.master)
+		return "*2\r\n" + redistest.Bulk(host) + redistest.Bulk(port)
+	case cmd == "SENTINEL" && len(args) == 3 && args[1] == "replicas":
+		s := fmt.Sprintf("*%d\r\n", len(fs.replicas))
+		for _, rp := range fs.replicas {
+			host, port, _ := net.SplitHostPort(rp[0])
+			s += "*6\r\n" + redistest.Bulk("ip") + redistest.Bulk(host) + redistest.Bulk("port") + redistest.Bulk(port) + redistest.Bulk("flags") + redistest.Bulk(rp[1])
+		}
+		return s
+	}
+	return "-ERR unknown command\r\n"
+}
+
+type testSentinelSuite struct {
+	suite.Suite
+	driver  string
+	fs      *fakeSentinel
+	master  *miniredis.Miniredis
+	replica *miniredis.Miniredis
+}
+
+func (s *testSentinelSuite) SetupTest() {
+	err := error(nil)
+	s.fs, err = newFakeSentinel()
+	s.Require().NoError(err)
+	s.master, err = miniredis.Run()
+	s.Require().NoError(err)
+	s.replica, err = miniredis.Run()
+	s.Require().NoError(err)
+	s.fs.SetMaster(s.master.Addr())
+}
+
+func (s *testSentinelSuite) TearDownTest() {
+	s.fs.Close()
+	s.master.Close()
+	s.replica.Close()
+}
+
+// 第一个sentinel不可用
+func (s *testSentinelSuite) conf() *redis.Config {
+	c := redis.NewConfig()
+	c.Driver = s.driver
+	c.Host = "127.0.0.2"
+	c.SentinelAddrs = []string{"127.0.0.1:1", s.fs.Addr()}
+	c.MasterName = testMasterName
+	c.PingOnBorrow = 0
+	return c
+}
+
+/*
+ * 1. 测试通过sentinel查询master地址，跳过不可用的sentinel
+ */
+func (s *testSentinelSuite) TestMaster() {
+	assrt := assert.New(s.T())
+	p := redis.New(s.conf()).Pool()
+	defer p.Close()
+	conn, err := p.Borrow()
+	assrt.NoError(err)
+	_, err = conn.Do("SET", "test:sentinel", "a")
+	assrt.NoError(err)
+	conn.Close()
+	assrt.True(s.master.Exists("test:sentinel"))
+	assrt.False(s.replica.Exists("test:sentinel"))
+
+	r := redis.New(s.conf())
+	bc, err := r.BlockedConn()
+	assrt.NoError(err)
+	reply, err := redis.String(bc.DoWithTimeout(0, "GET", "test:sentinel"))
+	assrt.NoError(err)
+	assrt.Equal("a", reply)
+	bc.Close()
+}
+
+/*
+ * 2. 测试master切换后重新查询master，之后借出的连接连接到新的master
+ */
+func (s *testSentinelSuite) TestFailover() {
+	assrt := assert.New(s.T())
+	p := redis.New(s.conf()).Pool()
+	defer p.Close()
+	conn, err := p.Borrow()
+	assrt.NoError(err)
+	_, err = conn.Do("SET", "test:failover", "a")
+	assrt.NoError(err)
+	conn.Close()
+
+	s.fs.SetMaster(s.replica.Addr())
+	s.master.Close()
+	// 空闲连接已断开，出错后重新查询master，最多失败一次
+	for i := 0; i < 2; i++ {
+		conn, err = p.Borrow()
+		if err != nil {
+			continue
+		}
+		_, err = conn.Do("SET", "test:failover", "b")
+		conn.Close()
+		if err == nil {
+			break
+		}
+	}
+	assrt.NoError(err)
+	v, _ := s.replica.Get("test:failover")
+	assrt.Equal("b", v)
+}
+
+/*
+ * 3. 测试只读命令发送到replica，跳过下线的replica
+ */
+func (s *testSentinelSuite) TestReplicaReads() {
+	assrt := assert.New(s.T())
+	s.fs.AddReplica("127.0.0.1:1", "slave,s_down")
+	s.fs.AddReplica(s.replica.Addr(), "slave")
+	s.replica.Set("test:replica", "b")
+	c := s.conf()
+	c.ReplicaReads = true
+	p := redis.New(c).Pool()
+	defer p.Close()
+	conn, err := p.Borrow()
+	assrt.NoError(err)
+	defer conn.Close()
+	reply, err := redis.String(conn.Do("GET", "test:replica"))
+	assrt.NoError(err)
+	assrt.Equal("b", reply)
+	_, err = conn.Do("SET", "test:replica", "a")
+	assrt.NoError(err)
+	v, _ := s.master.Get("test:replica")
+	assrt.Equal("a", v)
+	v, _ = s.replica.Get("test:replica")
+	assrt.Equal("b", v)
+
+	// 事务中的只读命令发送到master
+	tx, err := p.Tx(context.Background())
+	assrt.NoError(err)
+	defer tx.Close()
+	assrt.NoError(tx.Watch("test:replica"))
+	reply, err = redis.String(tx.Do("GET", "test:replica"))
+	assrt.NoError(err)
+	assrt.Equal("a", reply)
+}
+
+/*
+ * 4. 测试master不存在和配置错误
+ */
+func (s *testSentinelSuite) TestWrongMaster() {
+	assrt := assert.New(s.T())
+	c := s.conf()
+	c.MasterName = "unknown"
+	p := redis.New(c).Pool()
+	defer p.Close()
+	// go-redis不检查连接时在第一次执行命令时才建立连接
+	conn, err := p.Borrow()
+	if err == nil {
+		_, err = conn.Do("PING")
+		conn.Close()
+	}
+	assrt.Error(err)
+	_, err = redis.New(c).PubSubConn()
+	assrt.Error(err)
+
+	c.MasterName = ""
+	assrt.Error(c.Validate("mainCache"))
+	assrt.Panics(func() {
+		redis.New(c)
+	})
+}
+
+/*
+ * 5. 测试超时不重新查询master，连续出错时只在后台查询一次sentinel
+ */
+func (s *testSentinelSuite) TestRefresh() {
+	assrt := assert.New(s.T())
+	c := s.conf()
+	c.MaxActiveConns = 5
+	p := redis.New(c).Pool()
+	defer p.Close()
+	conn, err := p.Borrow()
+	assrt.NoError(err)
+	_, err = conn.Do("SET", "test:refresh", "a")
+	assrt.NoError(err)
+	conn.Close()
+	queries := s.fs.Queries()
+
+	conn, err = p.Borrow()
+	assrt.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, err = conn.DoContext(ctx, "BLPOP", "test:refresh:list", 1)
+	cancel()
+	conn.Close()
+	assrt.Error(err)
+	time.Sleep(50 * time.Millisecond)
+	assrt.Equal(queries, s.fs.Queries())
+
+	// 先借出全部连接，建立连接时的查询不计入
+	conns := make([]redis.Connection, 0, c.MaxActiveConns)
+	for i := 0; i < c.MaxActiveConns; i++ {
+		conn, err = p.Borrow()
+		assrt.NoError(err)
+		_, err = conn.Do("SET", "test:refresh", "b")
+		assrt.NoError(err)
+		conns = append(conns, conn)
+	}
+	queries = s.fs.Queries()
+	for _, conn := range conns {
+		_, err = conn.Do("EVAL", `return redis.error_reply("READONLY You can't write against a read only replica.")`, 0)
+		assrt.Error(err)
+		conn.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+	assrt.Equal(queries+1, s.fs.Queries())
+}
+
+func TestSentinelRedigoSuite(t *testing.T) {
+	suite.Run(t, &testSentinelSuite{driver: redis.DriverRedigo})
+}
+
+func TestSentinelGoRedisSuite(t *testing.T) {
+	suite.Run(t, &testSentinelSuite{driver: redis.DriverGoRedis})
+}
@@ -0,0 +1,403 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/configurator/validate"
+	"meross_iot/library/logger"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StartNewest = "$"
+	StartOldest = "0"
+
+	DefaultCount         = 10
+	DefaultBlock         = 2 * time.Second
+	DefaultConcurrency   = 1
+	DefaultClaimIdle     = time.Minute
+	DefaultClaimInterval = 30 * time.Second
+	DefaultRetryDelay    = time.Second
+
+	// XREADGROUP的超时比BLOCK多出的时间
+	blockMargin = time.Second
+)
+
+// Config consumer group中一个consumer的配置
+type Config struct {
+	Stream string `validate:"required"`
+	Group  string `validate:"required"`
+	// 同一个group中的consumer名称不能重复，默认为hostname-pid；重启后使用相同的名称可以先处理自己未确认的消息
+	Consumer string `validate:"required"`
+	// 创建group时的起始位置，StartNewest只消费之后写入的消息，StartOldest从头消费
+	StartID string `validate:"required"`
+	// 每次读取和认领的最大数量
+	Count int `validate:"min=1"`
+	// XREADGROUP的BLOCK时间
+	Block time.Duration `validate:"gt=0"`
+	// 同时执行Handler的数量
+	Concurrency int `validate:"min=1"`
+	// 其他consumer的消息超过该时间没有确认时认领过来重新处理，为0时不认领
+	ClaimIdle time.Duration `validate:"min=0"`
+	// 检查需要认领的消息的间隔
+	ClaimInterval time.Duration `validate:"gt=0"`
+	// 读取出错后重试的间隔
+	RetryDelay time.Duration `validate:"gt=0"`
+}
+
+func NewConfig(stream, group string) *Config {
+	host, _ := os.Hostname()
+	return &Config{
+		Stream:        stream,
+		Group:         group,
+		Consumer:      fmt.Sprintf("%s-%d", host, os.Getpid()),
+		StartID:       StartNewest,
+		Count:         DefaultCount,
+		Block:         DefaultBlock,
+		Concurrency:   DefaultConcurrency,
+		ClaimIdle:     DefaultClaimIdle,
+		ClaimInterval: DefaultClaimInterval,
+		RetryDelay:    DefaultRetryDelay,
+	}
+}
+
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (c *Config) Validate(section string) error {
+	return validate.Struct(section, c)
+}
+
+// Handler 处理一条消息，返回nil时确认消息；返回错误时不确认，消息超过ClaimIdle后被重新认领处理
+type Handler func(ctx context.Context, msg *Message) error
+
+// Consumer consumer group中的一个consumer
+type Consumer struct {
+	conf *Config
+	rc   *redis.Redis
+	pool redis.Pool
+
+	// 同时只有一个XREADGROUP使用BlockedConn
+	readMu sync.Mutex
+	mu     sync.Mutex
+	bc     redis.BlockedConn
+	// 服务端不支持XAUTOCLAIM(redis 6.2之前)时使用XPENDING和XCLAIM
+	noAutoClaim bool
+	onError     func(err error)
+}
+
+func NewConsumer(r *redis.Redis, c *Config) *Consumer {
+	if err := c.Validate("stream"); err != nil {
+		panic(fmt.Errorf("wrong stream consumer config, %s\n", err))
+	}
+	return &Consumer{
+		conf:    c,
+		rc:      r,
+		pool:    r.Pool(),
+		onError: logger.ErrorReporter("stream consumer", c.Stream+"/"+c.Group),
+	}
+}
+
+// OnError 设置Run中读取、认领、确认出错和Handler返回错误时的回调，需在Run之前设置
+func (c *Consumer) OnError(fn func(err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onError = fn
+}
+
+// CreateGroup 创建consumer group，stream不存在时自动创建，group已存在时不报错
+func (c *Consumer) CreateGroup(ctx context.Context) error {
+	_, err := c.do(ctx, "XGROUP", "CREATE", c.conf.Stream, c.conf.Group, c.conf.StartID, "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+/*
+ * Read 读取新消息，没有消息时最多阻塞Block，返回空列表；ctx结束时立即返回ctx.Err()
+ * id为">"时读取新消息，为"0"时读取已经投递给自己但还没有确认的消息
+ */
+func (c *Consumer) Read(ctx context.Context, id string, count int) ([]*Message, error) {
+	args := []interface{}{"GROUP", c.conf.Group, c.conf.Consumer, "COUNT", count}
+	if id == ">" {
+		args = append(args, "BLOCK", c.conf.Block.Milliseconds())
+	}
+	args = append(args, "STREAMS", c.conf.Stream, id)
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	bc, err := c.blockedConn()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.conf.Block+blockMargin)
+	defer cancel()
+	reply, err := bc.DoContext(ctx, "XREADGROUP", args...)
+	if err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			// 连接可能已经断开，下次重新建立
+			c.resetBlockedConn(bc)
+		}
+		return nil, err
+	}
+	return parseStreams(reply)
+}
+
+// Ack 确认消息，确认后从pending列表中删除
+func (c *Consumer) Ack(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := []interface{}{c.conf.Stream, c.conf.Group}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := c.do(ctx, "XACK", args...)
+	return err
+}
+
+/*
+ * Claim 把超过minIdle没有确认的消息认领给自己，用于处理已经退出的consumer的消息
+ * redis 6.2及以上使用XAUTOCLAIM，之前的版本使用XPENDING和XCLAIM
+ * 已经被删除的消息不返回，由redis(7.0及以上)或调用方确认
+ */
+func (c *Consumer) Claim(ctx context.Context, minIdle time.Duration, count int) ([]*Message, error) {
+	c.mu.Lock()
+	noAutoClaim := c.noAutoClaim
+	c.mu.Unlock()
+	if !noAutoClaim {
+		msgs, err := c.autoClaim(ctx, minIdle, count)
+		if err == nil || !isUnknownCommand(err) {
+			return msgs, err
+		}
+		c.mu.Lock()
+		c.noAutoClaim = true
+		c.mu.Unlock()
+	}
+	return c.pendingClaim(ctx, minIdle, count)
+}
+
+func (c *Consumer) autoClaim(ctx context.Context, minIdle time.Duration, count int) ([]*Message, error) {
+	msgs := make([]*Message, 0)
+	start := "0-0"
+	for len(msgs) < count {
+		v, err := redis.Values(c.do(ctx, "XAUTOCLAIM", c.conf.Stream, c.conf.Group, c.conf.Consumer,
+			minIdle.Milliseconds(), start, "COUNT", count-len(msgs)))
+		if err != nil {
+			return nil, err
+		}
+		// redis 7.0起多一个已删除消息的列表
+		if len(v) < 2 {
+			return nil, fmt.Errorf("stream: unexpected XAUTOCLAIM reply %v", v)
+		}
+		if start, err = redis.String(v[0], nil); err != nil {
+			return nil, err
+		}
+		claimed, err := parseEntries(c.conf.Stream, v[1])
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, claimed...)
+		if start == "0-0" {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+func (c *Consumer) pendingClaim(ctx context.Context, minIdle time.Duration, count int) ([]*Message, error) {
+	// 每条为[id, consumer, idle(ms), 投递次数]
+	pending, err := redis.Values(c.do(ctx, "XPENDING", c.conf.Stream, c.conf.Group, "-", "+", count))
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{c.conf.Stream, c.conf.Group, c.conf.Consumer, minIdle.Milliseconds()}
+	for _, p := range pending {
+		fields, err := redis.Values(p, nil)
+		if err != nil || len(fields) != 4 {
+			return nil, fmt.Errorf("stream: unexpected XPENDING entry %v", p)
+		}
+		idle, err := redis.Int64(fields[2], nil)
+		if err != nil {
+			return nil, err
+		}
+		if time.Duration(idle)*time.Millisecond >= minIdle {
+			id, _ := redis.String(fields[0], nil)
+			args = append(args, id)
+		}
+	}
+	if len(args) == 4 {
+		return nil, nil
+	}
+	reply, err := c.do(ctx, "XCLAIM", args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseEntries(c.conf.Stream, reply)
+}
+
+/*
+ * Run 先处理自己未确认的消息，再循环读取新消息，按Concurrency并发执行Handler，直到ctx结束
+ * ClaimIdle大于0时每隔ClaimInterval认领其他consumer超时未确认的消息
+ * ctx结束后不再读取，等待正在执行的Handler返回后退出；只有创建group失败时返回错误
+ */
+func (c *Consumer) Run(ctx context.Context, h Handler) error {
+	if err := c.CreateGroup(ctx); err != nil {
+		return err
+	}
+	defer c.closeBlockedConn()
+	msgs := make(chan *Message)
+	wg := sync.WaitGroup{}
+	for i := 0; i < c.conf.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range msgs {
+				c.handle(ctx, h, msg)
+			}
+		}()
+	}
+	defer func() {
+		close(msgs)
+		wg.Wait()
+	}()
+
+	dispatch := func(batch []*Message) bool {
+		for _, msg := range batch {
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		return true
+	}
+	if !c.drainOwn(ctx, dispatch) {
+		return nil
+	}
+	nextClaim := time.Now()
+	for ctx.Err() == nil {
+		if c.conf.ClaimIdle > 0 && !time.Now().Before(nextClaim) {
+			nextClaim = time.Now().Add(c.conf.ClaimInterval)
+			batch, err := c.Claim(ctx, c.conf.ClaimIdle, c.conf.Count)
+			if err != nil {
+				c.report(fmt.Errorf("fail to claim: %s", err))
+			} else if !dispatch(batch) {
+				return nil
+			}
+		}
+		batch, err := c.Read(ctx, ">", c.conf.Count)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			c.report(fmt.Errorf("fail to read: %s", err))
+			c.sleep(ctx)
+			continue
+		}
+		if !dispatch(batch) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// 处理重启前投递给自己但还没有确认的消息，返回false表示ctx已经结束
+func (c *Consumer) drainOwn(ctx context.Context, dispatch func([]*Message) bool) bool {
+	start := "0"
+	for ctx.Err() == nil {
+		batch, err := c.Read(ctx, start, c.conf.Count)
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil {
+			c.report(fmt.Errorf("fail to read pending messages: %s", err))
+			c.sleep(ctx)
+			continue
+		}
+		if len(batch) == 0 {
+			return true
+		}
+		if !dispatch(batch) {
+			return false
+		}
+		start = batch[len(batch)-1].ID
+	}
+	return false
+}
+
+func (c *Consumer) handle(ctx context.Context, h Handler, msg *Message) {
+	// 消息已被删除，没有内容可以处理
+	if msg.Values != nil {
+		if err := h(ctx, msg); err != nil {
+			c.report(fmt.Errorf("fail to handle message %s: %s", msg.ID, err))
+			return
+		}
+	}
+	if err := c.Ack(context.Background(), msg.ID); err != nil {
+		c.report(fmt.Errorf("fail to ack message %s: %s", msg.ID, err))
+	}
+}
+
+func (c *Consumer) sleep(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(c.conf.RetryDelay):
+	}
+}
+
+func (c *Consumer) do(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	conn, err := c.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.DoContext(ctx, command, args...)
+}
+
+// XREADGROUP会阻塞连接，使用单独的BlockedConn，不占用pool中的连接
+func (c *Consumer) blockedConn() (redis.BlockedConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bc != nil {
+		return c.bc, nil
+	}
+	bc, err := c.rc.BlockedConn()
+	if err != nil {
+		return nil, err
+	}
+	c.bc = bc
+	return bc, nil
+}
+
+func (c *Consumer) resetBlockedConn(bc redis.BlockedConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bc == bc {
+		c.bc = nil
+	}
+	bc.Close()
+}
+
+func (c *Consumer) closeBlockedConn() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bc != nil {
+		c.bc.Close()
+		c.bc = nil
+	}
+}
+
+func (c *Consumer) report(err error) {
+	c.mu.Lock()
+	fn := c.onError
+	c.mu.Unlock()
+	fn(err)
+}
+
+func isUnknownCommand(err error) bool {
+	_, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(strings.ToLower(err.Error()), "err unknown command")
+}
@@ -0,0 +1,123 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"meross_iot/library/cache/redis"
+	"sort"
+)
+
+// Message stream中的一条消息
+type Message struct {
+	ID     string
+	Stream string
+	// 消息已经被XDEL或MAXLEN删除时为nil
+	Values map[string]string
+}
+
+// Producer 向stream写入消息
+type Producer struct {
+	pool   redis.Pool
+	stream string
+	// 大于0时用MAXLEN ~限制stream的长度，超过时删除最早的消息
+	maxLen int64
+}
+
+func NewProducer(r *redis.Redis, stream string, maxLen int64) *Producer {
+	return &Producer{pool: r.Pool(), stream: stream, maxLen: maxLen}
+}
+
+// Add 写入一条消息，返回消息ID；字段按名称排序，便于比较
+func (p *Producer) Add(ctx context.Context, values map[string]interface{}) (string, error) {
+	if len(values) == 0 {
+		return "", fmt.Errorf("stream: empty message")
+	}
+	args := make([]interface{}, 0, 5+2*len(values))
+	args = append(args, p.stream)
+	if p.maxLen > 0 {
+		args = append(args, "MAXLEN", "~", p.maxLen)
+	}
+	args = append(args, "*")
+	fields := make([]string, 0, len(values))
+	for f := range values {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		args = append(args, f, values[f])
+	}
+	conn, err := p.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return redis.String(conn.DoContext(ctx, "XADD", args...))
+}
+
+// Len 返回stream中的消息数量
+func (p *Producer) Len(ctx context.Context) (int64, error) {
+	conn, err := p.pool.BorrowWithContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return redis.Int64(conn.DoContext(ctx, "XLEN", p.stream))
+}
+
+// 解析XREADGROUP的返回值：[[stream, [[id, [field, value, ...]], ...]], ...]
+func parseStreams(reply interface{}) ([]*Message, error) {
+	streams, err := redis.Values(reply, nil)
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, 0)
+	for _, s := range streams {
+		pair, err := redis.Values(s, nil)
+		if err != nil || len(pair) != 2 {
+			return nil, fmt.Errorf("stream: unexpected reply %v", s)
+		}
+		name, err := redis.String(pair[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseEntries(name, pair[1])
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, entries...)
+	}
+	return msgs, nil
+}
+
+// 解析消息列表：[[id, [field, value, ...]], ...]，XCLAIM中已删除的消息为nil
+func parseEntries(stream string, reply interface{}) ([]*Message, error) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, 0, len(entries))
+	for _, e := range entries {
+		if e == nil {
+			continue
+		}
+		pair, err := redis.Values(e, nil)
+		if err != nil || len(pair) != 2 {
+			return nil, fmt.Errorf("stream: unexpected entry %v", e)
+		}
+		id, err := redis.String(pair[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		msg := &Message{ID: id, Stream: stream}
+		if pair[1] != nil {
+			if msg.Values, err = redis.StringMap(pair[1], nil); err != nil {
+				return nil, err
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,607 @@
+package stream_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/stream"
+	"meross_iot/library/internal/redistest"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* *********************************
+ * ******** fake stream server *****
+ * *********************************/
+
+// miniredis不支持XPENDING、XCLAIM、XAUTOCLAIM，用一个只支持stream命令的服务端模拟
+type fakeStreams struct {
+	ln        net.Listener
+	mu        sync.Mutex
+	seq       int64
+	entries   map[string][]*fakeEntry
+	groups    map[string]map[string]*fakeGroup
+	autoClaim bool
+}
+
+type fakeEntry struct {
+	seq    int64
+	fields []string
+}
+
+type fakeGroup struct {
+	last    int64
+	pending map[int64]*fakePending
+}
+
+type fakePending struct {
+	consumer  string
+	delivered time.Time
+	count     int
+}
+
+func newFakeStreams(autoClaim bool) (*fakeStreams, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	fs := &fakeStreams{
+		ln:        ln,
+		entries:   make(map[string][]*fakeEntry),
+		groups:    make(map[string]map[string]*fakeGroup),
+		autoClaim: autoClaim,
+	}
+	go fs.serve()
+	return fs, nil
+}
+
+func (fs *fakeStreams) Addr() string {
+	return fs.ln.Addr().String()
+}
+
+func (fs *fakeStreams) Close() {
+	fs.ln.Close()
+}
+
+// age 让所有pending的消息空闲时间增加d
+func (fs *fakeStreams) age(d time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, groups := range fs.groups {
+		for _, g := range groups {
+			for _, p := range g.pending {
+				p.delivered = p.delivered.Add(-d)
+			}
+		}
+	}
+}
+
+func (fs *fakeStreams) pending(key, group string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return len(fs.groups[key][group].pending)
+}
+
+func (fs *fakeStreams) serve() {
+	for {
+		conn, err := fs.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fs.handle(conn)
+	}
+}
+
+func (fs *fakeStreams) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := redistest.ReadCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, redistest.Encode(fs.reply(args))); err != nil {
+			return
+		}
+	}
+}
+
+func (fs *fakeStreams) reply(args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+	if cmd == "XREADGROUP" {
+		return fs.readGroup(args[1:])
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	switch cmd {
+	case "PING":
+		return redistest.Status("PONG")
+	case "XADD":
+		return fs.add(args[1:])
+	case "XLEN":
+		return len(fs.entries[args[1]])
+	case "XDEL":
+		n := 0
+		for _, id := range args[2:] {
+			if i := fs.index(args[1], parseID(id)); i >= 0 {
+				fs.entries[args[1]] = append(fs.entries[args[1]][:i], fs.entries[args[1]][i+1:]...)
+				n++
+			}
+		}
+		return n
+	case "XGROUP":
+		return fs.createGroup(args[2], args[3], args[4])
+	case "XACK":
+		g := fs.groups[args[1]][args[2]]
+		n := 0
+		for _, id := range args[3:] {
+			if _, ok := g.pending[parseID(id)]; ok {
+				delete(g.pending, parseID(id))
+				n++
+			}
+		}
+		return n
+	case "XPENDING":
+		g := fs.groups[args[1]][args[2]]
+		count, _ := strconv.Atoi(args[5])
+		reply := make([]interface{}, 0)
+		for _, seq := range g.sorted(0) {
+			if len(reply) == count {
+				break
+			}
+			p := g.pending[seq]
+			reply = append(reply, []interface{}{formatID(seq), p.consumer, int(time.Since(p.delivered).Milliseconds()), p.count})
+		}
+		return reply
+	case "XCLAIM":
+		g := fs.groups[args[1]][args[2]]
+		minIdle, _ := strconv.ParseInt(args[4], 10, 64)
+		reply := make([]interface{}, 0)
+		for _, id := range args[5:] {
+			if e := fs.claim(args[1], g, parseID(id), args[3], minIdle); e != nil {
+				reply = append(reply, e)
+			}
+		}
+		return reply
+	case "XAUTOCLAIM":
+		if !fs.autoClaim {
+			return redistest.Error("ERR unknown command 'XAUTOCLAIM'")
+		}
+		g := fs.groups[args[1]][args[2]]
+		minIdle, _ := strconv.ParseInt(args[4], 10, 64)
+		count, _ := strconv.Atoi(args[7])
+		claimed, deleted := make([]interface{}, 0), make([]interface{}, 0)
+		next := "0-0"
+		for _, seq := range g.sorted(parseID(args[5])) {
+			if len(claimed)+len(deleted) == count {
+				next = formatID(seq)
+				break
+			}
+			if fs.index(args[1], seq) < 0 {
+				delete(g.pending, seq)
+				deleted = append(deleted, formatID(seq))
+				continue
+			}
+			if e := fs.claim(args[1], g, seq, args[3], minIdle); e != nil {
+				claimed = append(claimed, e)
+			}
+		}
+		return []interface{}{next, claimed, deleted}
+	}
+	return redistest.Error("ERR unknown command '" + args[0] + "'")
+}
+
+func (fs *fakeStreams) add(args []string) interface{} {
+	key, args := args[0], args[1:]
+	maxLen := -1
+	if strings.ToUpper(args[0]) == "MAXLEN" {
+		maxLen, _ = strconv.Atoi(args[2])
+		args = args[3:]
+	}
+	fs.seq++
+	fs.entries[key] = append(fs.entries[key], &fakeEntry{seq: fs.seq, fields: args[1:]})
+	if maxLen >= 0 && len(fs.entries[key]) > maxLen {
+		fs.entries[key] = fs.entries[key][len(fs.entries[key])-maxLen:]
+	}
+	return formatID(fs.seq)
+}
+
+func (fs *fakeStreams) createGroup(key, group, id string) interface{} {
+	if _, ok := fs.groups[key][group]; ok {
+		return redistest.Error("BUSYGROUP Consumer Group name already exists")
+	}
+	if fs.groups[key] == nil {
+		fs.groups[key] = make(map[string]*fakeGroup)
+	}
+	g := &fakeGroup{pending: make(map[int64]*fakePending)}
+	if id == "$" {
+		g.last = fs.seq
+	}
+	fs.groups[key][group] = g
+	return redistest.Status("OK")
+}
+
+func (fs *fakeStreams) readGroup(args []string) interface{} {
+	group, consumer := args[1], args[2]
+	count, block := 0, time.Duration(-1)
+	args = args[3:]
+	for len(args) > 0 && strings.ToUpper(args[0]) != "STREAMS" {
+		n, _ := strconv.Atoi(args[1])
+		if strings.ToUpper(args[0]) == "COUNT" {
+			count = n
+		} else {
+			block = time.Duration(n) * time.Millisecond
+		}
+		args = args[2:]
+	}
+	key, id := args[1], args[2]
+	deadline := time.Now().Add(block)
+	for {
+		fs.mu.Lock()
+		g, ok := fs.groups[key][group]
+		if !ok {
+			fs.mu.Unlock()
+			return redistest.Error("NOGROUP No such key or consumer group")
+		}
+		entries := make([]interface{}, 0)
+		if id == ">" {
+			for _, e := range fs.entries[key] {
+				if e.seq <= g.last || (count > 0 && len(entries) == count) {
+					continue
+				}
+				g.last = e.seq
+				g.pending[e.seq] = &fakePending{consumer: consumer, delivered: time.Now(), count: 1}
+				entries = append(entries, e.reply())
+			}
+		} else {
+			for _, seq := range g.sorted(parseID(id) + 1) {
+				if count > 0 && len(entries) == count {
+					break
+				}
+				if g.pending[seq].consumer != consumer {
+					continue
+				}
+				var e interface{} = []interface{}{formatID(seq), nil}
+				if i := fs.index(key, seq); i >= 0 {
+					e = fs.entries[key][i].reply()
+				}
+				entries = append(entries, e)
+			}
+		}
+		fs.mu.Unlock()
+		if len(entries) > 0 || id != ">" {
+			return []interface{}{[]interface{}{key, entries}}
+		}
+		if block < 0 || time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// 空闲时间不小于minIdle时认领，返回消息内容
+func (fs *fakeStreams) claim(key string, g *fakeGroup, seq int64, consumer string, minIdle int64) interface{} {
+	p, ok := g.pending[seq]
+	if !ok || time.Since(p.delivered).Milliseconds() < minIdle {
+		return nil
+	}
+	i := fs.index(key, seq)
+	if i < 0 {
+		return nil
+	}
+	p.consumer, p.delivered = consumer, time.Now()
+	p.count++
+	return fs.entries[key][i].reply()
+}
+
+func (fs *fakeStreams) index(key string, seq int64) int {
+	for i, e := range fs.entries[key] {
+		if e.seq == seq {
+			return i
+		}
+	}
+	return -1
+}
+
+func (g *fakeGroup) sorted(from int64) []int64 {
+	seqs := make([]int64, 0, len(g.pending))
+	for seq := range g.pending {
+		if seq >= from {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+func (e *fakeEntry) reply() interface{} {
+	fields := make([]interface{}, 0, len(e.fields))
+	for _, f := range e.fields {
+		fields = append(fields, f)
+	}
+	return []interface{}{formatID(e.seq), fields}
+}
+
+func formatID(seq int64) string {
+	return strconv.FormatInt(seq, 10) + "-0"
+}
+
+func parseID(id string) int64 {
+	seq, _ := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	return seq
+}
+
+/* *********************************
+ * ************ tests **************
+ * *********************************/
+
+type testStreamSuite struct {
+	suite.Suite
+	driver string
+	fs     *fakeStreams
+	rc     *redis.Redis
+}
+
+func (s *testStreamSuite) SetupTest() {
+	fs, err := newFakeStreams(true)
+	s.Require().NoError(err)
+	s.fs = fs
+	c := redistest.Config(fs.Addr(), s.driver)
+	s.rc = redis.New(c)
+}
+
+func (s *testStreamSuite) TearDownTest() {
+	s.rc.Pool().Close()
+	s.fs.Close()
+}
+
+func (s *testStreamSuite) conf(consumer string) *stream.Config {
+	c := stream.NewConfig("events", "workers")
+	c.Consumer = consumer
+	c.StartID = stream.StartOldest
+	c.Block = 50 * time.Millisecond
+	c.RetryDelay = 10 * time.Millisecond
+	c.ClaimIdle = 0
+	return c
+}
+
+func (s *testStreamSuite) produce(n int) []string {
+	p := stream.NewProducer(s.rc, "events", 0)
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := p.Add(context.Background(), map[string]interface{}{"n": i, "type": "online"})
+		s.Require().NoError(err)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+/*
+ * 1. 测试写入、读取和确认
+ */
+func (s *testStreamSuite) TestProduceConsume() {
+	assrt := assert.New(s.T())
+	ctx := context.Background()
+	p := stream.NewProducer(s.rc, "events", 3)
+	for i := 0; i < 5; i++ {
+		_, err := p.Add(ctx, map[string]interface{}{"n": i})
+		assrt.NoError(err)
+	}
+	n, err := p.Len(ctx)
+	assrt.NoError(err)
+	assrt.Equal(int64(3), n)
+	_, err = p.Add(ctx, nil)
+	assrt.Error(err)
+
+	c := stream.NewConsumer(s.rc, s.conf("c1"))
+	assrt.NoError(c.CreateGroup(ctx))
+	assrt.NoError(c.CreateGroup(ctx))
+	msgs, err := c.Read(ctx, ">", 2)
+	assrt.NoError(err)
+	assrt.Equal(2, len(msgs))
+	assrt.Equal("events", msgs[0].Stream)
+	assrt.Equal(map[string]string{"n": "2"}, msgs[0].Values)
+	assrt.Equal(map[string]string{"n": "3"}, msgs[1].Values)
+	assrt.Equal(2, s.fs.pending("events", "workers"))
+
+	// 没有确认的消息可以用"0"重新读取
+	own, err := c.Read(ctx, "0", 10)
+	assrt.NoError(err)
+	assrt.Equal(msgs, own)
+	assrt.NoError(c.Ack(ctx, msgs[0].ID, msgs[1].ID))
+	assrt.Equal(0, s.fs.pending("events", "workers"))
+
+	msgs, err = c.Read(ctx, ">", 10)
+	assrt.NoError(err)
+	assrt.Equal(1, len(msgs))
+	// 没有新消息时阻塞Block后返回空
+	start := time.Now()
+	msgs, err = c.Read(ctx, ">", 10)
+	assrt.NoError(err)
+	assrt.Equal(0, len(msgs))
+	assrt.True(time.Since(start) >= 50*time.Millisecond)
+
+	bad := s.conf("c1")
+	bad.Group = "none"
+	_, err = stream.NewConsumer(s.rc, bad).Read(ctx, ">", 1)
+	assrt.Error(err)
+}
+
+/*
+ * 2. 测试认领其他consumer超时未确认的消息，包括不支持XAUTOCLAIM时
+ */
+func (s *testStreamSuite) TestClaim() {
+	for _, autoClaim := range []bool{true, false} {
+		s.fs.mu.Lock()
+		s.fs.autoClaim = autoClaim
+		s.fs.mu.Unlock()
+		assrt := assert.New(s.T())
+		ctx := context.Background()
+		conf := s.conf("dead")
+		conf.Group = fmt.Sprintf("claim-%v", autoClaim)
+		dead := stream.NewConsumer(s.rc, conf)
+		assrt.NoError(dead.CreateGroup(ctx))
+		s.produce(3)
+		msgs, err := dead.Read(ctx, ">", 3)
+		assrt.NoError(err)
+		assrt.Equal(3, len(msgs))
+
+		conf = s.conf("alive")
+		conf.Group = fmt.Sprintf("claim-%v", autoClaim)
+		alive := stream.NewConsumer(s.rc, conf)
+		claimed, err := alive.Claim(ctx, time.Minute, 10)
+		assrt.NoError(err)
+		assrt.Equal(0, len(claimed))
+
+		s.fs.age(2 * time.Minute)
+		claimed, err = alive.Claim(ctx, time.Minute, 2)
+		assrt.NoError(err)
+		assrt.Equal(msgs[:2], claimed)
+		claimed, err = alive.Claim(ctx, time.Minute, 10)
+		assrt.NoError(err)
+		assrt.Equal(msgs[2:], claimed)
+		own, err := alive.Read(ctx, "0", 10)
+		assrt.NoError(err)
+		assrt.Equal(msgs, own)
+		assrt.NoError(alive.Ack(ctx, msgs[0].ID, msgs[1].ID, msgs[2].ID))
+	}
+}
+
+/*
+ * 3. 测试Run按Concurrency并发处理，ctx结束后中断阻塞的读取立即退出
+ */
+func (s *testStreamSuite) TestRun() {
+	assrt := assert.New(s.T())
+	conf := s.conf("c1")
+	conf.Concurrency = 3
+	conf.Block = 5 * time.Second
+	c := stream.NewConsumer(s.rc, conf)
+	ids := s.produce(12)
+	running, maxRunning := int32(0), int32(0)
+	mu := sync.Mutex{}
+	handled := make([]string, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx, func(ctx context.Context, msg *stream.Message) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			handled = append(handled, msg.ID)
+			mu.Unlock()
+			return nil
+		})
+	}()
+	assrt.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == len(ids)
+	}, 2*time.Second, 10*time.Millisecond)
+	ids = append(ids, s.produce(3)...)
+	assrt.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == len(ids)
+	}, 2*time.Second, 10*time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assrt.NoError(err)
+	case <-time.After(time.Second):
+		assrt.Fail("Run should return after ctx is done")
+	}
+	assrt.Equal(int32(3), maxRunning)
+	sort.Strings(handled)
+	sort.Strings(ids)
+	assrt.Equal(ids, handled)
+	assrt.Eventually(func() bool {
+		return s.fs.pending("events", "workers") == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+/*
+ * 4. 测试处理失败的消息在重启后和超时后被重新处理
+ */
+func (s *testStreamSuite) TestRunRetry() {
+	assrt := assert.New(s.T())
+	conf := s.conf("c1")
+	c := stream.NewConsumer(s.rc, conf)
+	errs := int32(0)
+	c.OnError(func(err error) {
+		atomic.AddInt32(&errs, 1)
+	})
+	ids := s.produce(2)
+	attempts := make(map[string]int)
+	mu := sync.Mutex{}
+	handler := func(ctx context.Context, msg *stream.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[msg.ID]++
+		if msg.ID == ids[0] && attempts[msg.ID] == 1 {
+			return errors.New("device offline")
+		}
+		return nil
+	}
+	count := func(id string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts[id]
+	}
+
+	// 第一次失败后没有确认，重启后先处理自己未确认的消息
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.Run(ctx, handler)
+	assrt.Eventually(func() bool {
+		return count(ids[1]) == 1 && s.fs.pending("events", "workers") == 1
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	assrt.Equal(int32(1), atomic.LoadInt32(&errs))
+	ctx, cancel = context.WithCancel(context.Background())
+	go c.Run(ctx, handler)
+	assrt.Eventually(func() bool {
+		return count(ids[0]) == 2 && s.fs.pending("events", "workers") == 0
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+
+	// 运行中失败的消息超过ClaimIdle后重新认领
+	mu.Lock()
+	attempts = make(map[string]int)
+	mu.Unlock()
+	conf = s.conf("c2")
+	conf.Group = "retry"
+	conf.ClaimIdle = 30 * time.Millisecond
+	conf.ClaimInterval = 10 * time.Millisecond
+	c = stream.NewConsumer(s.rc, conf)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx, handler)
+	assrt.Eventually(func() bool {
+		return count(ids[0]) == 2 && s.fs.pending("events", "retry") == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestStreamRedigoSuite(t *testing.T) {
+	suite.Run(t, &testStreamSuite{driver: redis.DriverRedigo})
+}
+
+func TestStreamGoRedisSuite(t *testing.T) {
+	suite.Run(t, &testStreamSuite{driver: redis.DriverGoRedis})
+}
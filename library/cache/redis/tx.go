@@ -0,0 +1,192 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrTxConflict WATCH的key在EXEC之前被修改，事务没有执行
+var ErrTxConflict = errors.New("redis: transaction aborted, watched keys changed")
+
+var errTxDone = errors.New("redis: transaction is already executed or closed")
+
+// 冲突重试前等待的时间，避免多个客户端同时重试
+const txRetryDelay = 5 * time.Millisecond
+
+/*
+ * 基于Connection实现，所有driver和cluster共用
+ * cluster模式下WATCH的key和事务中的key需要在同一个slot，由clusterConn把事务固定在一个节点
+ */
+type tx struct {
+	conn    Connection
+	cmds    []*cmd
+	watched bool
+	// 已发送MULTI，还没有发送EXEC
+	multi bool
+	done  bool
+}
+
+func newTx(ctx context.Context, p Pool) (Tx, error) {
+	conn, err := p.BorrowWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tx{conn: conn}, nil
+}
+
+func (t *tx) Watch(keys ...interface{}) error {
+	if t.done {
+		return errTxDone
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if _, err := t.conn.Do("WATCH", keys...); err != nil {
+		return err
+	}
+	t.watched = true
+	return nil
+}
+
+func (t *tx) Do(command string, args ...interface{}) (interface{}, error) {
+	if t.done {
+		return nil, errTxDone
+	}
+	return t.conn.Do(command, args...)
+}
+
+func (t *tx) Send(command string, args ...interface{}) {
+	t.cmds = append(t.cmds, &cmd{command: command, args: args})
+}
+
+/*
+ * 命令入队出错时(如参数错误)redis拒绝执行整个事务，返回第一个出错命令的CommandError
+ * 事务执行后单个命令的错误放在对应的reply中
+ */
+func (t *tx) Exec() (*Replies, error) {
+	if t.done {
+		return nil, errTxDone
+	}
+	t.done = true
+	if _, err := t.conn.Do("MULTI"); err != nil {
+		return nil, err
+	}
+	t.multi = true
+	queueErr := (*CommandError)(nil)
+	for i, c := range t.cmds {
+		if _, err := t.conn.Do(c.command, c.args...); err != nil {
+			var re Error
+			if !errors.As(err, &re) {
+				return nil, err
+			}
+			if queueErr == nil {
+				queueErr = &CommandError{Index: i, Command: strings.ToUpper(c.command), Err: err}
+				queueErr.Key, _ = commandKey(c.command, c.args)
+			}
+		}
+	}
+	v, err := t.conn.Do("EXEC")
+	// EXEC之后WATCH自动取消
+	t.multi, t.watched = false, false
+	if queueErr != nil {
+		return nil, queueErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrTxConflict
+	}
+	results, ok := v.([]interface{})
+	if !ok || len(results) != len(t.cmds) {
+		return nil, fmt.Errorf("redis: unexpected EXEC reply %T", v)
+	}
+	rps := make([]*reply, 0, len(results))
+	for i, r := range results {
+		rp := &reply{cmd: t.cmds[i], reply: r}
+		if re, ok := r.(Error); ok {
+			rp.reply, rp.err = nil, re
+		}
+		rps = append(rps, rp)
+	}
+	return &Replies{replies: rps}, nil
+}
+
+// Close 没有执行EXEC时取消事务和WATCH，然后归还连接，避免连接带着事务状态回到pool
+func (t *tx) Close() error {
+	if t.multi {
+		t.conn.Do("DISCARD")
+	} else if t.watched {
+		t.conn.Do("UNWATCH")
+	}
+	t.done = true
+	return t.conn.Close()
+}
+
+// 连接上的事务状态，事务中的只读命令不能发送到replica，go-redis driver按入队的命令转换EXEC的结果
+type txState struct {
+	// MULTI之后入队的命令，不在事务中时为nil
+	queued   []*cmd
+	watching bool
+}
+
+func (s *txState) inTx() bool {
+	return s.queued != nil || s.watching
+}
+
+func (s *txState) track(command string, args []interface{}, err error) {
+	switch strings.ToUpper(command) {
+	case "MULTI":
+		if err == nil {
+			s.queued = make([]*cmd, 0)
+		}
+	case "EXEC", "DISCARD":
+		s.queued, s.watching = nil, false
+	case "WATCH":
+		if err == nil {
+			s.watching = true
+		}
+	case "UNWATCH":
+		s.watching = false
+	default:
+		if s.queued != nil {
+			s.queued = append(s.queued, &cmd{command: command, args: args})
+		}
+	}
+}
+
+/*
+ * RunTx 执行check-and-set事务：fn中用Watch监视key，用Do读取，用Send加入命令，fn返回后由RunTx执行EXEC
+ * WATCH的key被修改时重新执行fn，最多重试maxRetries次，仍然冲突时返回ErrTxConflict；fn返回错误时不执行事务
+ */
+func RunTx(ctx context.Context, p Pool, maxRetries int, fn func(tx Tx) error) (*Replies, error) {
+	for attempt := 0; ; attempt++ {
+		replies, err := runTxOnce(ctx, p, fn)
+		if err != ErrTxConflict {
+			return replies, err
+		}
+		if attempt >= maxRetries {
+			return nil, fmt.Errorf("%w after %d attempts", ErrTxConflict, attempt+1)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(txRetryDelay):
+		}
+	}
+}
+
+func runTxOnce(ctx context.Context, p Pool, fn func(tx Tx) error) (*Replies, error) {
+	t, err := p.Tx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+	if err := fn(t); err != nil {
+		return nil, err
+	}
+	return t.Exec()
+}
@@ -0,0 +1,51 @@
+// encrypt 生成加密的配置值
+// 主密钥通过环境变量MEROSS_MASTER_KEY或MEROSS_MASTER_KEY_FILE指定，明文从标准输入读取，避免留在shell历史中：
+//
+//	echo -n 'password' | MEROSS_MASTER_KEY=... go run ./library/configurator/cmd/encrypt
+//
+// 生成新的主密钥：
+//
+//	go run ./library/configurator/cmd/encrypt -gen-key
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"meross_iot/library/configurator"
+	"os"
+)
+
+var genKey = flag.Bool("gen-key", false, "generate a new base64 encoded master key and exit")
+
+func main() {
+	flag.Parse()
+	if *genKey {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			fail(err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return
+	}
+	key, err := configurator.MasterKey()
+	if err != nil {
+		fail(err)
+	}
+	plaintext, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fail(err)
+	}
+	value, err := configurator.Encrypt(key, string(plaintext))
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(value)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
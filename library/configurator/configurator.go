@@ -1,58 +1,490 @@
 package configurator
 
 import (
+	"errors"
 	"fmt"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
+	"meross_iot/library/configurator/validate"
+	"os"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type entity struct {
 	name string
 	path string
+	// 热加载时整体替换v，读取方拿到的是某一时刻完整的配置
+	mu sync.RWMutex
 	v *viper.Viper
+	// 继承的配置名，见Extend
+	base string
+	// 配置文件之外的配置来源，见AddSource
+	sources []Source
+	// 实际读取的配置文件，按优先级从低到高
+	files []string
+	// 值来自密钥引用的配置项，Dump时隐藏
+	secrets map[string]bool
+	// 合并配置文件和sources后、覆盖环境变量和解析密钥引用之前的配置，继承时合并这份配置
+	raw map[string]interface{}
+	subs []*subscription
 }
 
 const CONF_EXT  = "toml"
 
-var container = make(map[string]*entity)
+// SupportedExts 支持的配置文件格式，按扩展名识别
+var SupportedExts = []string{CONF_EXT, "yaml", "yml", "json"}
 
+var (
+	// ErrNotLoaded 配置文件未加载
+	ErrNotLoaded = errors.New("config entry is not loaded")
+	// ErrKeyNotSet 配置文件中没有该配置项
+	ErrKeyNotSet = errors.New("config key is not set")
+)
+
+var (
+	containerMu sync.RWMutex
+	container   = make(map[string]*entity)
+)
+
+// Load 加载所有配置文件，有任何错误时panic，错误信息包含所有出错的配置文件
 func Load(confPaths map[string]string) {
-	for name, confPath := range confPaths  {
-		if _, ok := container[name]; ok {
-			panic("Config entry [" + name + "] is already loaded\n")
-		}
-		container[name] = &entity{
-			name : name,
-			path : confPath,
-			v : viper.New(),
-		}
-		confPath = path.Clean(confPath)
-		ext := strings.TrimLeft(path.Ext(confPath), ".")
-		if ext != CONF_EXT {
-			panic(fmt.Errorf("Fatal error config file ext is not toml: [%s]\n", ext))
-		}
-		container[name].v.SetConfigType(CONF_EXT)
-		container[name].v.AddConfigPath(path.Dir(confPath))
-		container[name].v.SetConfigName(path.Base(confPath))
-		err := container[name].v.ReadInConfig()
+	if err := TryLoad(confPaths); err != nil {
+		panic(fmt.Errorf("Viper fatal error when loading config files, %s\n", err))
+	}
+}
+
+// TryLoad 加载所有配置文件，返回所有出错配置文件的聚合错误，加载失败的配置不会被注册
+func TryLoad(confPaths map[string]string) error {
+	names := make([]string, 0, len(confPaths))
+	for name := range confPaths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := validate.Errors{}
+	for _, name := range names {
+		e, err := load(name, confPaths[name])
 		if err != nil {
-			panic(fmt.Errorf("Viper fatal error when loading config file : name [%s] path[%s] err[%s] \n",
-				name, confPath, err))
+			errs.Append(name, err)
+			continue
+		}
+		errs.Append(name, register(e))
+	}
+	return errs.Err()
+}
+
+func load(name, confPath string) (*entity, error) {
+	return loadLayered(name, confPath, "", nil)
+}
+
+// 配置的优先级从低到高：base配置、配置文件、环境overlay文件、sources、环境变量，最后解析密钥引用
+func loadLayered(name, confPath, base string, sources []Source) (*entity, error) {
+	confPath = path.Clean(confPath)
+	ext, err := configType(confPath)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{confPath}
+	if env := Env(); env != "" {
+		overlay := OverlayPath(confPath, env)
+		if _, err := existFile(overlay); err == nil {
+			files = append(files, overlay)
+		}
+	}
+	settings := make(map[string]interface{})
+	if base != "" {
+		b, err := lookup(base)
+		if err != nil {
+			return nil, err
+		}
+		// 合并base解析密钥引用之前的配置，密钥引用只在最后解析一次
+		mergeSettings(settings, b.rawSettings())
+	}
+	for _, f := range files {
+		fv := viper.New()
+		fv.SetConfigType(ext)
+		fv.SetConfigFile(f)
+		if err := fv.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("fail to read config file [%s]: %s", f, err)
+		}
+		mergeSettings(settings, fv.AllSettings())
+	}
+	for _, src := range sources {
+		m, err := src.Read()
+		if err != nil {
+			return nil, fmt.Errorf("fail to read config source [%s]: %s", src.Name(), err)
+		}
+		mergeSettings(settings, m)
+	}
+	// viper合并时会引用settings中的map，另存一份
+	raw := make(map[string]interface{})
+	mergeSettings(raw, settings)
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, fmt.Errorf("fail to merge config file [%s]: %s", confPath, err)
+	}
+	if err := applyEnv(v); err != nil {
+		return nil, fmt.Errorf("fail to apply env to config file [%s]: %s", confPath, err)
+	}
+	secrets, err := resolveSecrets(v)
+	if err != nil {
+		return nil, err
+	}
+	return &entity{
+		name:    name,
+		path:    confPath,
+		v:       v,
+		base:    base,
+		sources: sources,
+		files:   files,
+		secrets: secrets,
+		raw:     raw,
+	}, nil
+}
+
+// 按扩展名返回配置文件格式，环境overlay文件与原配置文件格式相同
+func configType(confPath string) (string, error) {
+	ext := strings.ToLower(strings.TrimLeft(path.Ext(confPath), "."))
+	for _, supported := range SupportedExts {
+		if ext == supported {
+			return ext, nil
+		}
+	}
+	return "", fmt.Errorf("config file ext [%s] is not supported, should be one of %v", ext, SupportedExts)
+}
+
+var (
+	envMu     sync.RWMutex
+	envPrefix string
+)
+
+// SetEnvPrefix 设置覆盖配置项的环境变量前缀，需要在Load之前调用
+// 前缀为空时不用环境变量覆盖配置项，避免LOG_LEVEL这类通用的环境变量意外覆盖配置
+func SetEnvPrefix(prefix string) {
+	envMu.Lock()
+	defer envMu.Unlock()
+	envPrefix = strings.ToUpper(prefix)
+}
+
+// EnvKey 返回配置项对应的环境变量名，前缀为certificate时mainDb.password对应CERTIFICATE_MAINDB_PASSWORD
+func EnvKey(key string) string {
+	envMu.RLock()
+	defer envMu.RUnlock()
+	return envKey(envPrefix, key)
+}
+
+func envKey(prefix, key string) string {
+	return prefix + "_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// 用环境变量覆盖配置文件中已有的配置项，只在out中有默认值的配置项见bindEnv
+// viper的AutomaticEnv对UnmarshalKey读取整段配置不生效，Set又会覆盖掉同段的其他配置项，
+// 所以直接把环境变量合并进配置
+func applyEnv(v *viper.Viper) error {
+	envMu.RLock()
+	prefix := envPrefix
+	envMu.RUnlock()
+	if prefix == "" {
+		return nil
+	}
+	overrides := make(map[string]interface{})
+	for _, key := range v.AllKeys() {
+		name := envKey(prefix, key)
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		val, err := convertEnv(env, v.Get(key))
+		if err != nil {
+			return fmt.Errorf("env [%s] for key [%s]: %s", name, key, err)
+		}
+		setKey(overrides, key, val)
+	}
+	if len(overrides) == 0 {
+		return nil
+	}
+	return v.MergeConfigMap(overrides)
+}
+
+/*
+ * 配置文件中没有、只在out中有默认值的配置项不在AllKeys中，applyEnv覆盖不到，
+ * Bind时按out的字段计算配置项，用环境变量覆盖这些配置项；字段名按mapstructure tag，支持squash
+ */
+func bindEnv(v *viper.Viper, key string, out interface{}) error {
+	envMu.RLock()
+	prefix := envPrefix
+	envMu.RUnlock()
+	if prefix == "" {
+		return nil
+	}
+	overrides := make(map[string]interface{})
+	collectEnv(v, prefix, key, reflect.TypeOf(out), overrides)
+	if len(overrides) == 0 {
+		return nil
+	}
+	ov := viper.New()
+	if err := ov.MergeConfigMap(overrides); err != nil {
+		return err
+	}
+	if key == "" {
+		return ov.Unmarshal(out)
+	}
+	return ov.UnmarshalKey(key, out)
+}
+
+func collectEnv(v *viper.Viper, prefix, key string, t reflect.Type, overrides map[string]interface{}) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Map, reflect.Interface, reflect.Func, reflect.Chan:
+		return
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			break
 		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(f.Tag.Get("mapstructure"), ",")
+			if tag[0] == "-" {
+				continue
+			}
+			if len(tag) > 1 && tag[1] == "squash" {
+				collectEnv(v, prefix, key, f.Type, overrides)
+				continue
+			}
+			name := tag[0]
+			if name == "" {
+				name = f.Name
+			}
+			sub := strings.ToLower(name)
+			if key != "" {
+				sub = key + "." + sub
+			}
+			collectEnv(v, prefix, sub, f.Type, overrides)
+		}
+		return
+	}
+	// 配置文件中已有的配置项已经由applyEnv覆盖
+	if key == "" || v.IsSet(key) {
+		return
+	}
+	if env, ok := os.LookupEnv(envKey(prefix, key)); ok {
+		setKey(overrides, key, env)
+	}
+}
+
+// 按key路径把val写入嵌套的map，如mainDb.password写入m["mainDb"]["password"]
+func setKey(m map[string]interface{}, key string, val interface{}) {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := m[part].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			m[part] = sub
+		}
+		m = sub
+	}
+	m[parts[len(parts)-1]] = val
+}
+
+// viper合并配置时要求类型一致，按配置文件中原值的类型转换环境变量
+// toml的整数是int64，yaml是int，json是float64
+func convertEnv(env string, origin interface{}) (interface{}, error) {
+	switch origin.(type) {
+	case int64:
+		return cast.ToInt64E(env)
+	case int:
+		return cast.ToIntE(env)
+	case float64:
+		return cast.ToFloat64E(env)
+	case bool:
+		return cast.ToBoolE(env)
+	case []interface{}:
+		parts := strings.Split(env, ",")
+		vals := make([]interface{}, len(parts))
+		for i, part := range parts {
+			vals[i] = strings.TrimSpace(part)
+		}
+		return vals, nil
+	default:
+		return env, nil
 	}
 }
 
+// Locate 按优先级查找配置文件：命令行参数、环境变量、候选路径
+// 命令行参数或环境变量指定的文件不存在时直接返回错误，不再回退到候选路径
+func Locate(flagValue, envName string, candidates ...string) (string, error) {
+	if flagValue != "" {
+		return existFile(flagValue)
+	}
+	if envValue := os.Getenv(envName); envValue != "" {
+		return existFile(envValue)
+	}
+	for _, candidate := range candidates {
+		if p, err := existFile(candidate); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("config file not found, set it by flag or env [%s], candidates: %v", envName, candidates)
+}
+
+func existFile(p string) (string, error) {
+	p = path.Clean(p)
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("config path [%s] is a directory", p)
+	}
+	return p, nil
+}
+
+// Is 返回配置对应的viper实例，name未加载时返回nil
+//
+// Deprecated: 使用Bind、Get读取配置，不要直接操作viper
 func Is(name string) *viper.Viper {
+	e, err := lookup(name)
+	if err != nil {
+		return nil
+	}
+	return e.viper()
+}
+
+// Path 返回配置文件路径，name未加载时返回空字符串
+func Path(name string) string {
+	e, err := lookup(name)
+	if err != nil {
+		return ""
+	}
+	return e.path
+}
+
+// Names 返回所有已加载的配置名，按名称排序
+func Names() []string {
+	containerMu.RLock()
+	defer containerMu.RUnlock()
+	names := make([]string, 0, len(container))
+	for name := range container {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get 返回配置项的值，name未加载或key不存在时返回错误
+func Get(name, key string) (interface{}, error) {
+	e, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.Get(key)
+}
+
+// MustGet 同Get，出错时panic，用于启动阶段读取必须存在的配置
+func MustGet(name, key string) interface{} {
+	v, err := Get(name, key)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// Validator 实现了该接口的配置段在Bind时调用Validate校验，section为配置段的key路径
+type Validator interface {
+	Validate(section string) error
+}
+
+// Bind 把配置段解析到out并校验，out必须是指针
+// out中已有的值作为默认值，配置文件中没有的配置项保持不变，所以通常传入NewConfig()的返回值
+// 配置文件中没有的字段也可以用环境变量覆盖，见bindEnv
+// out实现了Validator时调用它的Validate，否则out为struct时按validate tag校验
+func Bind(name, key string, out interface{}) error {
+	e, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	return e.Bind(key, out)
+}
+
+// MustBind 同Bind，出错时panic
+func MustBind(name, key string, out interface{}) {
+	if err := Bind(name, key, out); err != nil {
+		panic(err)
+	}
+}
+
+func register(e *entity) error {
+	containerMu.Lock()
+	defer containerMu.Unlock()
+	if _, ok := container[e.name]; ok {
+		return fmt.Errorf("config entry is already loaded")
+	}
+	container[e.name] = e
+	return nil
+}
+
+func lookup(name string) (*entity, error) {
+	containerMu.RLock()
+	defer containerMu.RUnlock()
 	e, ok := container[name]
 	if !ok {
-		return nil
+		return nil, fmt.Errorf("config entry [%s]: %w", name, ErrNotLoaded)
 	}
+	return e, nil
+}
+
+func (e *entity) viper() *viper.Viper {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	return e.v
 }
 
-func (e *entity) Get(key string) interface{} {
-	return e.v.Get(key)
+func (e *entity) rawSettings() map[string]interface{} {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.raw
 }
 
+func (e *entity) secretKeys() map[string]bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.secrets
+}
 
+func (e *entity) Get(key string) (interface{}, error) {
+	v := e.viper()
+	if !v.IsSet(key) {
+		return nil, fmt.Errorf("config key [%s] in [%s]: %w", key, e.name, ErrKeyNotSet)
+	}
+	return v.Get(key), nil
+}
+
+func (e *entity) Bind(key string, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("config key [%s] in [%s]: bind target must be a non-nil pointer", key, e.name)
+	}
+	v := e.viper()
+	if err := v.UnmarshalKey(key, out); err != nil {
+		return &validate.FieldError{Key: key, Message: err.Error()}
+	}
+	if err := bindEnv(v, key, out); err != nil {
+		return &validate.FieldError{Key: key, Message: err.Error()}
+	}
+	if v, ok := out.(Validator); ok {
+		return v.Validate(key)
+	}
+	if rv.Elem().Kind() == reflect.Struct {
+		return validate.Struct(key, out)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package configurator_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/configurator"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testHTTPConf struct {
+	Addr    string        `validate:"required"`
+	Timeout time.Duration `validate:"min=0"`
+	Retry   int
+}
+
+type testServerConf struct {
+	Name string
+	HTTP testHTTPConf `mapstructure:"http"`
+}
+
+type testLimitConf struct {
+	Max int
+}
+
+func (c *testLimitConf) Validate(section string) error {
+	if c.Max > 10 {
+		return fmt.Errorf("%s.max is too large", section)
+	}
+	return nil
+}
+
+type testConfiguratorSuite struct {
+	confDirSuite
+}
+
+/*
+ * 1. 测试Bind保留默认值并校验配置段
+ */
+func (s *testConfiguratorSuite) TestBind() {
+	assrt := assert.New(s.T())
+	p := s.write("bind.toml", "[http]\naddr = \":8080\"\ntimeout = \"3s\"\n[bad]\ntimeout = \"-1s\"\n[limit]\nmax = 11\n")
+	assrt.NoError(configurator.TryLoad(map[string]string{"bind": p}))
+
+	c := &testHTTPConf{Retry: 3}
+	assrt.NoError(configurator.Bind("bind", "http", c))
+	assrt.Equal(&testHTTPConf{Addr: ":8080", Timeout: 3 * time.Second, Retry: 3}, c)
+
+	// 配置段不存在时保持默认值，并按validate tag校验
+	c = &testHTTPConf{Addr: ":80"}
+	assrt.NoError(configurator.Bind("bind", "missing", c))
+	assrt.Equal(":80", c.Addr)
+	err := configurator.Bind("bind", "bad", &testHTTPConf{})
+	assrt.EqualError(err, "2 config error(s):\n  bad.addr: is required\n  bad.timeout: must be >= 0")
+
+	// 实现了Validator的配置段使用自己的校验
+	assrt.EqualError(configurator.Bind("bind", "limit", &testLimitConf{}), "limit.max is too large")
+
+	assrt.Error(configurator.Bind("bind", "http", testHTTPConf{}))
+	err = configurator.Bind("notLoaded", "http", c)
+	assrt.True(errors.Is(err, configurator.ErrNotLoaded))
+	assrt.Panics(func() { configurator.MustBind("bind", "bad", &testHTTPConf{}) })
+}
+
+/*
+ * 2. 测试Get和MustGet
+ */
+func (s *testConfiguratorSuite) TestGet() {
+	assrt := assert.New(s.T())
+	p := s.write("get.toml", "[http]\naddr = \":8080\"\n")
+	assrt.NoError(configurator.TryLoad(map[string]string{"get": p}))
+
+	v, err := configurator.Get("get", "http.addr")
+	assrt.NoError(err)
+	assrt.Equal(":8080", v)
+	_, err = configurator.Get("get", "http.port")
+	assrt.True(errors.Is(err, configurator.ErrKeyNotSet))
+	_, err = configurator.Get("notLoaded", "http.addr")
+	assrt.True(errors.Is(err, configurator.ErrNotLoaded))
+	assrt.Nil(configurator.Is("notLoaded"))
+	assrt.Equal(":8080", configurator.MustGet("get", "http.addr"))
+	assrt.Panics(func() { configurator.MustGet("get", "http.port") })
+}
+
+/*
+ * 3. 测试并发加载和读取，同名配置只能加载一次
+ */
+func (s *testConfiguratorSuite) TestConcurrentLoad() {
+	assrt := assert.New(s.T())
+	p := s.write("concurrent.toml", "[http]\naddr = \":8080\"\n")
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- configurator.TryLoad(map[string]string{"concurrent": p})
+		}()
+		go func() {
+			defer wg.Done()
+			configurator.Get("concurrent", "http.addr")
+			configurator.Names()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	assrt.Equal(9, failed)
+	assrt.Contains(configurator.Names(), "concurrent")
+}
+
+/*
+ * 4. 测试查找配置文件的优先级：命令行参数、环境变量、候选路径
+ */
+func (s *testConfiguratorSuite) TestLocate() {
+	assrt := assert.New(s.T())
+	flagFile := s.write("flag.toml", "")
+	envFile := s.write("env.toml", "")
+	candidate := s.write("candidate.toml", "")
+	missing := filepath.Join(s.dir, "missing.toml")
+	const envName = "TEST_LOCATE_CONFIG"
+	defer os.Unsetenv(envName)
+	cases := []struct {
+		name       string
+		flag       string
+		env        string
+		candidates []string
+		want       string
+		err        bool
+	}{
+		{name: "flag first", flag: flagFile, env: envFile, candidates: []string{candidate}, want: flagFile},
+		{name: "env when no flag", env: envFile, candidates: []string{candidate}, want: envFile},
+		{name: "first existing candidate", candidates: []string{missing, s.dir, candidate}, want: candidate},
+		{name: "missing flag file does not fall back", flag: missing, env: envFile, candidates: []string{candidate}, err: true},
+		{name: "missing env file does not fall back", env: missing, candidates: []string{candidate}, err: true},
+		{name: "flag is a directory", flag: s.dir, err: true},
+		{name: "no candidate", candidates: []string{missing}, err: true},
+	}
+	for _, c := range cases {
+		os.Setenv(envName, c.env)
+		p, err := configurator.Locate(c.flag, envName, c.candidates...)
+		if c.err {
+			assrt.Error(err, c.name)
+			continue
+		}
+		assrt.NoError(err, c.name)
+		assrt.Equal(c.want, p, c.name)
+	}
+}
+
+/*
+ * 5. 测试环境变量覆盖配置文件中没有、只有默认值的配置项
+ */
+func (s *testConfiguratorSuite) TestBindEnv() {
+	assrt := assert.New(s.T())
+	configurator.SetEnvPrefix("test")
+	defer configurator.SetEnvPrefix("")
+	envs := map[string]string{
+		"TEST_SERVER_HTTP_RETRY":   "4",
+		"TEST_SERVER_HTTP_TIMEOUT": "2s",
+		"TEST_SERVER_NAME":         "hub",
+		"TEST_MISSING_ADDR":        ":9090",
+	}
+	for k, v := range envs {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	p := s.write("bindEnv.toml", "[server.http]\naddr = \":8080\"\n")
+	assrt.NoError(configurator.TryLoad(map[string]string{"bindEnv": p}))
+
+	c := &testServerConf{Name: "default", HTTP: testHTTPConf{Retry: 3}}
+	assrt.NoError(configurator.Bind("bindEnv", "server", c))
+	assrt.Equal(&testServerConf{Name: "hub", HTTP: testHTTPConf{Addr: ":8080", Timeout: 2 * time.Second, Retry: 4}}, c)
+
+	// 配置段不存在时也可以覆盖
+	h := &testHTTPConf{}
+	assrt.NoError(configurator.Bind("bindEnv", "missing", h))
+	assrt.Equal(&testHTTPConf{Addr: ":9090"}, h)
+
+	os.Setenv("TEST_SERVER_HTTP_RETRY", "many")
+	assrt.Error(configurator.Bind("bindEnv", "server", &testServerConf{}))
+}
+
+func TestConfiguratorSuite(t *testing.T) {
+	suite.Run(t, new(testConfiguratorSuite))
+}
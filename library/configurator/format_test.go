@@ -0,0 +1,74 @@
+package configurator_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/configurator"
+	"os"
+	"testing"
+	"time"
+)
+
+type testFormatSuite struct {
+	confDirSuite
+}
+
+/*
+ * 1. 测试toml、yaml、yml、json格式的配置内容一致
+ */
+func (s *testFormatSuite) TestFormats() {
+	assrt := assert.New(s.T())
+	paths := map[string]string{
+		"formatToml": s.write("format.toml", "[http]\naddr = \":8080\"\ntimeout = \"3s\"\nretry = 2\n"),
+		"formatYaml": s.write("format.yaml", "http:\n  addr: \":8080\"\n  timeout: 3s\n  retry: 2\n"),
+		"formatYml":  s.write("format.yml", "http:\n  addr: \":8080\"\n  timeout: 3s\n  retry: 2\n"),
+		"formatJson": s.write("format.JSON", `{"http": {"addr": ":8080", "timeout": "3s", "retry": 2}}`),
+	}
+	assrt.NoError(configurator.TryLoad(paths))
+	for name := range paths {
+		c := &testHTTPConf{}
+		assrt.NoError(configurator.Bind(name, "http", c), name)
+		assrt.Equal(&testHTTPConf{Addr: ":8080", Timeout: 3 * time.Second, Retry: 2}, c, name)
+	}
+}
+
+/*
+ * 2. 测试不同格式的配置文件混合使用：继承、overlay和环境变量覆盖
+ */
+func (s *testFormatSuite) TestMixed() {
+	assrt := assert.New(s.T())
+	os.Setenv(configurator.EnvName, "dev")
+	configurator.SetEnvPrefix("test")
+	defer configurator.SetEnvPrefix("")
+	os.Setenv("TEST_HTTP_RETRY", "5")
+	defer os.Unsetenv("TEST_HTTP_RETRY")
+	// 没有前缀的环境变量不覆盖配置
+	os.Setenv("HTTP_ADDR", ":7070")
+	defer os.Unsetenv("HTTP_ADDR")
+	global := s.write("mixed.yaml", "http:\n  addr: \":8080\"\n  timeout: 3s\n  retry: 2\n")
+	s.write("mixed.dev.yaml", "http:\n  timeout: 5s\n")
+	app := s.write("mixed.json", `{"http": {"addr": ":9090"}}`)
+	assrt.NoError(configurator.TryLoad(map[string]string{"mixedGlobal": global, "mixedApp": app}))
+	assrt.NoError(configurator.Extend("mixedApp", "mixedGlobal"))
+	c := &testHTTPConf{}
+	assrt.NoError(configurator.Bind("mixedApp", "http", c))
+	assrt.Equal(&testHTTPConf{Addr: ":9090", Timeout: 5 * time.Second, Retry: 5}, c)
+}
+
+/*
+ * 3. 测试不支持的格式和格式错误的配置文件
+ */
+func (s *testFormatSuite) TestUnsupported() {
+	assrt := assert.New(s.T())
+	ini := s.write("unsupported.ini", "[http]\naddr = :8080\n")
+	bad := s.write("bad.json", `{"http": `)
+	err := configurator.TryLoad(map[string]string{"unsupported": ini, "badJson": bad})
+	assrt.Error(err)
+	assrt.Contains(err.Error(), "unsupported: config file ext [ini] is not supported")
+	assrt.Contains(err.Error(), "badJson: fail to read config file")
+	assrt.Panics(func() { configurator.Load(map[string]string{"unsupported": ini}) })
+}
+
+func TestFormatSuite(t *testing.T) {
+	suite.Run(t, new(testFormatSuite))
+}
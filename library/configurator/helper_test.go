@@ -0,0 +1,34 @@
+package configurator_test
+
+import (
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"meross_iot/library/configurator"
+	"os"
+	"path/filepath"
+)
+
+// 各个suite共用的fixture，每个测试在单独的临时目录中写配置文件
+type confDirSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *confDirSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "configurator")
+	s.Require().NoError(err)
+	s.dir = dir
+}
+
+func (s *confDirSuite) TearDownTest() {
+	os.Unsetenv(configurator.EnvName)
+	os.RemoveAll(s.dir)
+}
+
+// 在临时目录中写入配置文件并返回路径，name可以包含子目录
+func (s *confDirSuite) write(name, content string) string {
+	p := filepath.Join(s.dir, name)
+	s.Require().NoError(os.MkdirAll(filepath.Dir(p), 0755))
+	s.Require().NoError(ioutil.WriteFile(p, []byte(content), 0600))
+	return p
+}
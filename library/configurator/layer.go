@@ -0,0 +1,190 @@
+package configurator
+
+import (
+	"fmt"
+	"meross_iot/library/configurator/validate"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// EnvName 环境变量，指定运行环境，如dev、prod
+	EnvName = "MEROSS_ENV"
+)
+
+// SecretKeys 配置项名(key的最后一段)包含这些词时，Dump隐藏它的值
+var SecretKeys = []string{"password", "secret", "token"}
+
+var envPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Env 返回当前运行环境，未设置或格式不合法时返回空字符串，不加载任何overlay
+func Env() string {
+	env := os.Getenv(EnvName)
+	if !envPattern.MatchString(env) {
+		return ""
+	}
+	return env
+}
+
+// OverlayPath 返回配置文件在env环境下的overlay文件路径，如config.toml对应config.dev.toml
+// overlay文件可以只包含需要覆盖的配置项，文件不存在时忽略
+func OverlayPath(confPath, env string) string {
+	ext := filepath.Ext(confPath)
+	return strings.TrimSuffix(confPath, ext) + "." + env + ext
+}
+
+// Extend 声明name继承base：base中的配置项在name中都可以读到，name中的同名配置项覆盖base
+// 如Extend("app", "global")后，app配置中可以只覆盖mainCache.maxActiveConns，mainCache其他配置项仍来自global
+// base重新加载时name也会随之重新加载
+func Extend(name, base string) error {
+	e, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	for b := base; b != ""; {
+		if b == name {
+			return fmt.Errorf("config entry [%s] can not extend [%s]: circular extension", name, base)
+		}
+		be, err := lookup(b)
+		if err != nil {
+			return err
+		}
+		be.mu.RLock()
+		b = be.base
+		be.mu.RUnlock()
+	}
+	e.mu.Lock()
+	e.base = base
+	e.mu.Unlock()
+	return Reload(name)
+}
+
+// Source 配置文件之外的配置来源，如多实例共享的redis配置
+// 优先级高于配置文件和环境overlay文件，低于环境变量；同一配置的多个Source后添加的优先
+type Source interface {
+	// Name 用于Dump和错误信息，如redis:meross:config:certificate
+	Name() string
+	// Read 返回嵌套map形式的配置，每次加载和热加载时都会调用，返回错误时加载失败并保留旧配置
+	Read() (map[string]interface{}, error)
+}
+
+// AddSource 给name添加配置来源并立即重新加载，Source内容变化时调用Reload(name)使其生效
+// 添加后加载失败时返回错误，不添加该Source
+func AddSource(name string, src Source) error {
+	e, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	e.mu.RLock()
+	base := e.base
+	sources := append(append([]Source(nil), e.sources...), src)
+	e.mu.RUnlock()
+	if _, err := loadLayered(e.name, e.path, base, sources); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.sources = sources
+	e.mu.Unlock()
+	return Reload(name)
+}
+
+// Sources 返回name实际读取的配置文件和配置来源，按优先级从低到高，包含继承的配置
+func Sources(name string) ([]string, error) {
+	e, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.RLock()
+	base := e.base
+	files := append([]string(nil), e.files...)
+	for _, src := range e.sources {
+		files = append(files, src.Name())
+	}
+	e.mu.RUnlock()
+	if base == "" {
+		return files, nil
+	}
+	baseFiles, err := Sources(base)
+	if err != nil {
+		return nil, err
+	}
+	return append(baseFiles, files...), nil
+}
+
+// Dump 输出合并后实际生效的配置，每行一个配置项，按key排序，用于排查配置问题
+// 敏感配置项和值来自密钥引用的配置项都会被隐藏
+func Dump(name string) (string, error) {
+	e, err := lookup(name)
+	if err != nil {
+		return "", err
+	}
+	sources, err := Sources(name)
+	if err != nil {
+		return "", err
+	}
+	v := e.viper()
+	secrets := e.secretKeys()
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys)+2)
+	lines = append(lines, fmt.Sprintf("# config [%s], env [%s]", name, Env()))
+	lines = append(lines, "# sources: "+strings.Join(sources, ", "))
+	for _, key := range keys {
+		val := fmt.Sprintf("%v", v.Get(key))
+		if (IsSecretKey(key) || secrets[key]) && val != "" {
+			val = validate.Mask
+		}
+		lines = append(lines, fmt.Sprintf("%s = %s", key, val))
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// IsSecretKey 判断配置项是否为敏感配置项
+func IsSecretKey(key string) bool {
+	last := strings.ToLower(key[strings.LastIndex(key, ".")+1:])
+	for _, s := range SecretKeys {
+		if strings.Contains(last, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// 把src深度合并到dst，同名配置项以src为准
+func mergeSettings(dst, src map[string]interface{}) {
+	for k, sv := range src {
+		// viper的key不区分大小写，统一转为小写再合并
+		k = strings.ToLower(k)
+		sm, ok := sv.(map[string]interface{})
+		if !ok {
+			dst[k] = sv
+			continue
+		}
+		dm, ok := dst[k].(map[string]interface{})
+		if !ok {
+			dm = make(map[string]interface{})
+			dst[k] = dm
+		}
+		mergeSettings(dm, sm)
+	}
+}
+
+// 调用方不能持有containerMu
+func extenders(name string) []string {
+	children := make([]string, 0)
+	for _, n := range Names() {
+		e, err := lookup(n)
+		if err != nil {
+			continue
+		}
+		e.mu.RLock()
+		if e.base == name {
+			children = append(children, n)
+		}
+		e.mu.RUnlock()
+	}
+	return children
+}
@@ -0,0 +1,74 @@
+package configurator_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/configurator"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testLayerSuite struct {
+	confDirSuite
+}
+
+/*
+ * 1. 测试app配置继承global配置，环境overlay覆盖配置文件
+ */
+func (s *testLayerSuite) TestExtend() {
+	assrt := assert.New(s.T())
+	os.Setenv(configurator.EnvName, "dev")
+	global := s.write("global/config.toml", "[cache]\nhost = \"127.0.0.1\"\nport = 6379\nmaxActive = 5\n[db]\npassword = \"meross\"\n")
+	s.write("global/config.dev.toml", "[cache]\nhost = \"10.0.0.1\"\n")
+	app := s.write("app/config.toml", "[cache]\nmaxActive = 10\n[http]\naddr = \":8080\"\n")
+	s.write("app/config.prod.toml", "[http]\naddr = \":80\"\n")
+	assrt.NoError(configurator.TryLoad(map[string]string{"layerGlobal": global, "layerApp": app}))
+	assrt.NoError(configurator.Extend("layerApp", "layerGlobal"))
+	assrt.Error(configurator.Extend("layerGlobal", "layerApp"))
+	assrt.Error(configurator.Extend("layerApp", "notLoaded"))
+
+	assrt.Equal("10.0.0.1", configurator.MustGet("layerApp", "cache.host"))
+	assrt.EqualValues(6379, configurator.MustGet("layerApp", "cache.port"))
+	assrt.EqualValues(10, configurator.MustGet("layerApp", "cache.maxActive"))
+	assrt.Equal(":8080", configurator.MustGet("layerApp", "http.addr"))
+	// global配置不受app配置影响
+	assrt.EqualValues(5, configurator.MustGet("layerGlobal", "cache.maxActive"))
+	_, err := configurator.Get("layerGlobal", "http.addr")
+	assrt.Error(err)
+
+	sources, err := configurator.Sources("layerApp")
+	assrt.NoError(err)
+	assrt.Equal([]string{global, filepath.Join(s.dir, "global/config.dev.toml"), app}, sources)
+
+	// global重新加载后app随之更新
+	s.write("global/config.toml", "[cache]\nhost = \"127.0.0.1\"\nport = 6380\nmaxActive = 5\n")
+	assrt.NoError(configurator.Reload("layerGlobal"))
+	assrt.EqualValues(6380, configurator.MustGet("layerApp", "cache.port"))
+}
+
+/*
+ * 2. 测试Dump输出生效配置并隐藏敏感配置项
+ */
+func (s *testLayerSuite) TestDump() {
+	assrt := assert.New(s.T())
+	p := s.write("dump.toml", "[db]\npassword = \"meross\"\nuser = \"root\"\n[cache]\npassword = \"\"\n")
+	assrt.NoError(configurator.TryLoad(map[string]string{"dump": p}))
+	dump, err := configurator.Dump("dump")
+	assrt.NoError(err)
+	assrt.Equal("# config [dump], env []\n# sources: "+p+"\ncache.password = \ndb.password = ******\ndb.user = root\n", dump)
+	assrt.NotContains(dump, "meross")
+	assrt.True(configurator.IsSecretKey("redis.authToken"))
+	assrt.False(configurator.IsSecretKey("password.user"))
+}
+
+func (s *testLayerSuite) TestOverlayPath() {
+	assrt := assert.New(s.T())
+	assrt.Equal("/a/config.dev.toml", configurator.OverlayPath("/a/config.toml", "dev"))
+	os.Setenv(configurator.EnvName, "../prod")
+	assrt.Equal("", configurator.Env())
+}
+
+func TestLayerSuite(t *testing.T) {
+	suite.Run(t, new(testLayerSuite))
+}
@@ -0,0 +1,280 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/spf13/viper"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/cache/redis/pubsub"
+	"meross_iot/library/configurator"
+	"meross_iot/library/configurator/validate"
+	"meross_iot/library/logger"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFormat     = "json"
+	DefaultRetryDelay = time.Second
+
+	// pool中可能有多个断开的空闲连接
+	maxStaleRetries = 3
+)
+
+// Config remote配置源的配置
+type Config struct {
+	// 保存配置内容的redis key，key不存在时相当于没有远程配置
+	Key string `validate:"required"`
+	// 配置更新后在该channel发布通知
+	Channel string `validate:"required"`
+	// 配置内容的格式
+	Format string `validate:"oneof=json yaml yml toml"`
+	// 订阅断开后重连的间隔
+	RetryDelay time.Duration `validate:"gt=0"`
+	// 每隔PingInterval在订阅连接上发送PING，超过PingInterval+PingTimeout没有收到回复时认为订阅已经断开
+	PingInterval time.Duration `validate:"gt=0"`
+	PingTimeout  time.Duration `validate:"gt=0"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Format:       DefaultFormat,
+		RetryDelay:   DefaultRetryDelay,
+		PingInterval: pubsub.DefaultPingInterval,
+		PingTimeout:  pubsub.DefaultPingTimeout,
+	}
+}
+
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (c *Config) Validate(section string) error {
+	return validate.Struct(section, c)
+}
+
+// Source 从redis key读取配置，实现configurator.Source
+// 通过configurator.AddSource添加后，配置优先级高于配置文件，低于环境变量
+type Source struct {
+	conf *Config
+	rc   *redis.Redis
+	// 由Open创建的redis client，Close时关闭连接池
+	owned bool
+
+	sub *pubsub.Subscriber
+
+	mu sync.Mutex
+	// 上一次读取成功的配置，redis出错时使用
+	last map[string]interface{}
+	// Watch之后不为nil，cancel结束Subscriber的Run，Run返回后关闭stopped
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	closed  bool
+	onError func(err error)
+}
+
+func New(rc *redis.Redis, c *Config) *Source {
+	if err := c.Validate("remote"); err != nil {
+		panic(fmt.Errorf("wrong remote config, %s\n", err))
+	}
+	return &Source{
+		conf: c,
+		rc:   rc,
+		sub: pubsub.New(rc, &pubsub.Config{
+			PingInterval:  c.PingInterval,
+			PingTimeout:   c.PingTimeout,
+			MinRetryDelay: c.RetryDelay,
+			MaxRetryDelay: c.RetryDelay,
+		}),
+		onError: logger.ErrorReporter("remote config", c.Key),
+	}
+}
+
+// Open 用redisConf创建只给Source使用的redis client，Close时一起关闭
+func Open(redisConf *redis.Config, c *Config) *Source {
+	s := New(redis.New(redisConf), c)
+	s.owned = true
+	return s
+}
+
+// OnError 设置订阅断开、重新加载失败时的回调，需在Watch之前设置
+func (s *Source) OnError(fn func(err error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onError = fn
+}
+
+func (s *Source) Name() string {
+	return "redis:" + s.conf.Key
+}
+
+/*
+ * Read 读取并解析配置内容，key不存在时返回空配置，内容格式错误时返回错误
+ * redis出错时通过OnError报告，返回上一次读取成功的配置(没有时为空配置)，不影响配置文件的加载和热加载
+ */
+func (s *Source) Read() (map[string]interface{}, error) {
+	data, err := s.get()
+	if err != nil && err != redis.ErrNil {
+		s.report(fmt.Errorf("fail to read, keep using the last good config: %s", err))
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.last == nil {
+			return map[string]interface{}{}, nil
+		}
+		return s.last, nil
+	}
+	m := map[string]interface{}{}
+	if err == nil {
+		if m, err = s.parse(data); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	s.last = m
+	s.mu.Unlock()
+	return m, nil
+}
+
+// redis重启后pool中空闲的连接已经断开，连接出错时换一个连接重试
+func (s *Source) get() ([]byte, error) {
+	for i := 0; ; i++ {
+		conn, err := s.rc.Pool().Borrow()
+		if err != nil {
+			return nil, err
+		}
+		data, err := redis.Bytes(conn.Do("GET", s.conf.Key))
+		broken := conn.Error() != nil
+		conn.Close()
+		if err != nil && broken && i < maxStaleRetries {
+			continue
+		}
+		return data, err
+	}
+}
+
+func (s *Source) parse(data []byte) (map[string]interface{}, error) {
+	v := viper.New()
+	v.SetConfigType(s.conf.Format)
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("fail to parse %s config: %s", s.conf.Format, err)
+	}
+	return v.AllSettings(), nil
+}
+
+// Publish 写入新的配置内容并通知所有实例重新加载，内容格式错误时不写入
+func (s *Source) Publish(ctx context.Context, doc []byte) error {
+	if _, err := s.parse(doc); err != nil {
+		return err
+	}
+	conn, err := s.rc.Pool().BorrowWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Do("SET", s.conf.Key, doc); err != nil {
+		return err
+	}
+	_, err = conn.Do("PUBLISH", s.conf.Channel, s.conf.Key)
+	return err
+}
+
+/*
+ * Watch 订阅通知channel，收到订阅确认后返回，之后收到通知时重新加载names；第一次订阅失败时返回错误，可以重新Watch
+ * 订阅由pubsub.Subscriber管理，断开或健康检查失败后每隔RetryDelay重连，重连成功后也重新加载一次，避免错过断开期间的更新
+ */
+func (s *Source) Watch(names ...string) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return fmt.Errorf("remote config source is closed")
+	}
+	if s.cancel != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("remote config source is already watching")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	s.cancel, s.stopped = cancel, stopped
+	s.mu.Unlock()
+
+	once := sync.Once{}
+	ready := make(chan error, 1)
+	s.sub.OnConnect(func() {
+		reconnected := true
+		once.Do(func() {
+			reconnected = false
+			ready <- nil
+		})
+		if reconnected {
+			s.reload(names)
+		}
+	})
+	s.sub.OnError(func(err error) {
+		first := false
+		once.Do(func() {
+			first = true
+			ready <- err
+		})
+		if !first {
+			s.report(err)
+		}
+	})
+	s.sub.Subscribe(s.conf.Channel, func(ctx context.Context, m *pubsub.Message) {
+		s.reload(names)
+	})
+	go func() {
+		defer close(stopped)
+		s.sub.Run(ctx)
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			s.stop()
+			return err
+		}
+		return nil
+	case <-stopped:
+		return fmt.Errorf("remote config source is closed")
+	}
+}
+
+// Close 停止订阅，由Open创建时关闭redis连接池
+func (s *Source) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	s.stop()
+	if s.owned {
+		return s.rc.Pool().Close()
+	}
+	return nil
+}
+
+// 结束Subscriber的Run并等待返回，之后可以重新Watch
+func (s *Source) stop() {
+	s.mu.Lock()
+	cancel, stopped := s.cancel, s.stopped
+	s.cancel, s.stopped = nil, nil
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-stopped
+	}
+}
+
+func (s *Source) reload(names []string) {
+	for _, name := range names {
+		if err := configurator.Reload(name); err != nil {
+			s.report(fmt.Errorf("fail to reload config [%s]: %s", name, err))
+		}
+	}
+}
+
+func (s *Source) report(err error) {
+	s.mu.Lock()
+	fn := s.onError
+	s.mu.Unlock()
+	fn(err)
+}
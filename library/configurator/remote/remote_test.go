@@ -0,0 +1,177 @@
+package remote_test
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/configurator"
+	"meross_iot/library/configurator/remote"
+	"meross_iot/library/internal/redistest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testRemoteSuite struct {
+	suite.Suite
+	mr  *miniredis.Miniredis
+	rc  *redis.Redis
+	dir string
+}
+
+func (s *testRemoteSuite) SetupTest() {
+	mr, err := miniredis.Run()
+	s.Require().NoError(err)
+	s.mr = mr
+	c := redistest.Config(mr.Addr(), "")
+	s.rc = redis.New(c)
+	s.dir, err = ioutil.TempDir("", "remote")
+	s.Require().NoError(err)
+}
+
+func (s *testRemoteSuite) TearDownTest() {
+	s.rc.Pool().Close()
+	s.mr.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *testRemoteSuite) load(name string) {
+	p := filepath.Join(s.dir, name+".toml")
+	s.Require().NoError(ioutil.WriteFile(p, []byte("[log]\nlevel = \"error\"\n[http]\naddr = \":8080\"\n"), 0644))
+	s.Require().NoError(configurator.TryLoad(map[string]string{name: p}))
+}
+
+func (s *testRemoteSuite) conf(key string) *remote.Config {
+	c := remote.NewConfig()
+	c.Key = key
+	c.Channel = key + ":changed"
+	c.RetryDelay = 50 * time.Millisecond
+	return c
+}
+
+/*
+ * 1. 测试远程配置覆盖配置文件，key不存在时不影响配置文件
+ */
+func (s *testRemoteSuite) TestRead() {
+	assrt := assert.New(s.T())
+	s.load("remoteRead")
+	src := remote.New(s.rc, s.conf("config:read"))
+	assrt.Equal("redis:config:read", src.Name())
+	assrt.NoError(configurator.AddSource("remoteRead", src))
+	assrt.Equal("error", configurator.MustGet("remoteRead", "log.level"))
+
+	s.mr.Set("config:read", `{"log": {"level": "debug"}}`)
+	assrt.NoError(configurator.Reload("remoteRead"))
+	assrt.Equal("debug", configurator.MustGet("remoteRead", "log.level"))
+	assrt.Equal(":8080", configurator.MustGet("remoteRead", "http.addr"))
+	sources, err := configurator.Sources("remoteRead")
+	assrt.NoError(err)
+	assrt.Equal("redis:config:read", sources[len(sources)-1])
+
+	// 格式错误时保留旧配置，不能添加格式错误的Source
+	s.mr.Set("config:read", `{"log": `)
+	assrt.Error(configurator.Reload("remoteRead"))
+	assrt.Equal("debug", configurator.MustGet("remoteRead", "log.level"))
+	s.load("remoteReadBad")
+	assrt.Error(configurator.AddSource("remoteReadBad", src))
+}
+
+/*
+ * 2. 测试Publish后通过订阅通知重新加载，断线重连后继续生效
+ */
+func (s *testRemoteSuite) TestWatch() {
+	assrt := assert.New(s.T())
+	s.load("remoteWatch")
+	src := remote.New(s.rc, s.conf("config:watch"))
+	src.OnError(func(err error) {})
+	assrt.NoError(configurator.AddSource("remoteWatch", src))
+	changed := make(chan interface{}, 10)
+	assrt.NoError(configurator.OnChange("remoteWatch", "log.level", func(old, new interface{}) {
+		changed <- new
+	}))
+	assrt.NoError(src.Watch("remoteWatch"))
+	assrt.Error(src.Watch("remoteWatch"))
+	defer src.Close()
+
+	ctx := context.Background()
+	assrt.Error(src.Publish(ctx, []byte(`{"log": `)))
+	assrt.NoError(src.Publish(ctx, []byte(`{"log": {"level": "info"}}`)))
+	s.expect(changed, "info")
+
+	// 断线期间的更新在重连后生效
+	s.mr.Close()
+	s.mr.Set("config:watch", `{"log": {"level": "warn"}}`)
+	s.Require().NoError(s.mr.Restart())
+	s.expect(changed, "warn")
+	assrt.NoError(src.Publish(ctx, []byte(`{"log": {"level": "debug"}}`)))
+	s.expect(changed, "debug")
+}
+
+/*
+ * 3. 测试Open创建的Source在Close时关闭自己的连接池
+ */
+func (s *testRemoteSuite) TestOpen() {
+	assrt := assert.New(s.T())
+	s.load("remoteOpen")
+	c := redistest.Config(s.mr.Addr(), "")
+	src := remote.Open(c, s.conf("config:open"))
+	src.OnError(func(err error) {})
+	s.mr.Set("config:open", `{"log": {"level": "info"}}`)
+	assrt.NoError(configurator.AddSource("remoteOpen", src))
+	assrt.NoError(src.Watch("remoteOpen"))
+	assrt.Equal("info", configurator.MustGet("remoteOpen", "log.level"))
+	assrt.True(s.mr.CurrentConnectionCount() > 0)
+	assrt.NoError(src.Close())
+	assrt.Eventually(func() bool {
+		return s.mr.CurrentConnectionCount() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+/*
+ * 4. 测试redis不可用时使用上一次读取成功的配置，不影响配置文件的重新加载
+ */
+func (s *testRemoteSuite) TestReadFailure() {
+	assrt := assert.New(s.T())
+	errs := make(chan error, 10)
+	src := remote.New(s.rc, s.conf("config:failure"))
+	src.OnError(func(err error) {
+		errs <- err
+	})
+	s.mr.Set("config:failure", `{"log": {"level": "info"}}`)
+	s.load("remoteFailure")
+	assrt.NoError(configurator.AddSource("remoteFailure", src))
+	assrt.Equal("info", configurator.MustGet("remoteFailure", "log.level"))
+
+	s.mr.Close()
+	p := filepath.Join(s.dir, "remoteFailure.toml")
+	s.Require().NoError(ioutil.WriteFile(p, []byte("[log]\nlevel = \"error\"\n[http]\naddr = \":9090\"\n"), 0644))
+	assrt.NoError(configurator.Reload("remoteFailure"))
+	assrt.Equal("info", configurator.MustGet("remoteFailure", "log.level"))
+	assrt.Equal(":9090", configurator.MustGet("remoteFailure", "http.addr"))
+	assrt.Error(<-errs)
+
+	// 从未读取成功时相当于没有远程配置
+	s.load("remoteFailureNew")
+	src = remote.New(s.rc, s.conf("config:failure"))
+	src.OnError(func(err error) {})
+	assrt.NoError(configurator.AddSource("remoteFailureNew", src))
+	assrt.Equal("error", configurator.MustGet("remoteFailureNew", "log.level"))
+	s.Require().NoError(s.mr.Restart())
+}
+
+func (s *testRemoteSuite) expect(changed chan interface{}, level string) {
+	select {
+	case v := <-changed:
+		s.Equal(level, v)
+	case <-time.After(2 * time.Second):
+		s.Fail("config is not reloaded", level)
+	}
+}
+
+func TestRemoteSuite(t *testing.T) {
+	suite.Run(t, new(testRemoteSuite))
+}
@@ -0,0 +1,219 @@
+package configurator
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"meross_iot/library/configurator/validate"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// EncPrefix 加密配置项的前缀，如password = "enc:base64密文"，由enc resolver解密
+	EncPrefix = "enc:"
+	// MasterKeyEnv 环境变量，base64编码的32字节AES-256主密钥
+	MasterKeyEnv = "MEROSS_MASTER_KEY"
+	// MasterKeyFileEnv 环境变量，主密钥文件路径，文件内容同MasterKeyEnv，MasterKeyEnv优先
+	MasterKeyFileEnv = "MEROSS_MASTER_KEY_FILE"
+)
+
+// Resolver 解析配置中的密钥引用，ref为引用中scheme之后的部分，如${file:/run/secrets/db}中的/run/secrets/db
+type Resolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// ResolverFunc 函数形式的Resolver
+type ResolverFunc func(ref string) (string, error)
+
+func (f ResolverFunc) Resolve(ref string) (string, error) {
+	return f(ref)
+}
+
+var (
+	resolverMu sync.RWMutex
+	resolvers  = map[string]Resolver{
+		"file": ResolverFunc(resolveFile),
+		"env":  ResolverFunc(resolveEnv),
+		"enc":  ResolverFunc(resolveEnc),
+	}
+	refPattern = regexp.MustCompile(`\$\{([a-zA-Z][a-zA-Z0-9_-]*):([^}]*)\}`)
+)
+
+// RegisterResolver 注册scheme对应的Resolver，已存在时替换，如接入vault后注册"vault"
+// 需要在加载配置文件之前注册
+func RegisterResolver(scheme string, r Resolver) {
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	resolvers[scheme] = r
+}
+
+// ResolveValue 解析配置值中的密钥引用，changed表示配置值中包含引用
+// ${scheme:ref}可以出现在值的任意位置，由scheme对应的Resolver解析；以enc:开头的整个值由enc Resolver解密
+func ResolveValue(val string) (resolved string, changed bool, err error) {
+	if strings.HasPrefix(val, EncPrefix) {
+		resolved, err = resolve("enc", strings.TrimPrefix(val, EncPrefix))
+		return resolved, true, err
+	}
+	if !refPattern.MatchString(val) {
+		return val, false, nil
+	}
+	resolved = refPattern.ReplaceAllStringFunc(val, func(ref string) string {
+		m := refPattern.FindStringSubmatch(ref)
+		v, e := resolve(m[1], m[2])
+		if e != nil && err == nil {
+			err = e
+		}
+		return v
+	})
+	if err != nil {
+		return "", true, err
+	}
+	return resolved, true, nil
+}
+
+func resolve(scheme, ref string) (string, error) {
+	resolverMu.RLock()
+	r, ok := resolvers[scheme]
+	resolverMu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("secret ref [%s:%s]: no resolver for scheme [%s]", scheme, ref, scheme)
+	}
+	v, err := r.Resolve(ref)
+	if err != nil {
+		if scheme == "enc" {
+			// 密文可能很长且没有排查价值，不放进错误信息
+			return "", fmt.Errorf("encrypted value: %s", err)
+		}
+		return "", fmt.Errorf("secret ref [%s:%s]: %s", scheme, ref, err)
+	}
+	return v, nil
+}
+
+// 解析所有字符串配置项中的密钥引用，返回被解析过的key
+func resolveSecrets(v *viper.Viper) (map[string]bool, error) {
+	overrides := make(map[string]interface{})
+	resolved := make(map[string]bool)
+	errs := validate.Errors{}
+	for _, key := range v.AllKeys() {
+		s, ok := v.Get(key).(string)
+		if !ok {
+			continue
+		}
+		val, changed, err := ResolveValue(s)
+		if err != nil {
+			errs.Append(key, err)
+			continue
+		}
+		if changed {
+			setKey(overrides, key, val)
+			resolved[key] = true
+		}
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	if len(overrides) == 0 {
+		return resolved, nil
+	}
+	return resolved, v.MergeConfigMap(overrides)
+}
+
+// docker和k8s的secret文件通常以换行结尾
+func resolveFile(ref string) (string, error) {
+	b, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func resolveEnv(ref string) (string, error) {
+	v, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("env is not set")
+	}
+	return v, nil
+}
+
+func resolveEnc(ref string) (string, error) {
+	key, err := MasterKey()
+	if err != nil {
+		return "", err
+	}
+	return Decrypt(key, ref)
+}
+
+// MasterKey 从MasterKeyEnv或MasterKeyFileEnv读取主密钥
+func MasterKey() ([]byte, error) {
+	encoded := os.Getenv(MasterKeyEnv)
+	if encoded == "" {
+		p := os.Getenv(MasterKeyFileEnv)
+		if p == "" {
+			return nil, fmt.Errorf("master key is not set, set env [%s] or [%s]", MasterKeyEnv, MasterKeyFileEnv)
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read master key file: %s", err)
+		}
+		encoded = strings.TrimSpace(string(b))
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %s", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// Encrypt 用AES-256-GCM加密配置值，返回带EncPrefix的值，可以直接写入配置文件
+func Encrypt(key []byte, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return EncPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt 解密Encrypt生成的值，value可以带或不带EncPrefix
+func Decrypt(key []byte, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, EncPrefix))
+	if err != nil {
+		return "", fmt.Errorf("ciphertext is not valid base64: %s", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("ciphertext is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("fail to decrypt, wrong master key or corrupted ciphertext")
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,57 @@
+package validate
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	// 字段带上secret:"true"的tag后，Redact会隐藏它的值
+	SecretTag = "secret"
+	Mask      = "******"
+)
+
+// Redact 按%+v的格式输出struct，secret字段的值被替换为Mask
+func Redact(v interface{}) string {
+	return redact(reflect.ValueOf(v))
+}
+
+func redact(rv reflect.Value) string {
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return "<nil>"
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Sprintf("%+v", rv.Interface())
+	}
+	rt := rv.Type()
+	fields := make([]string, 0, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		fv := rv.Field(i)
+		val := ""
+		switch {
+		case IsSecret(f):
+			if !fv.IsZero() {
+				val = Mask
+			}
+		case fv.Kind() == reflect.Struct || (fv.Kind() == reflect.Ptr && fv.Type().Elem().Kind() == reflect.Struct):
+			val = redact(fv)
+		default:
+			val = fmt.Sprintf("%+v", fv.Interface())
+		}
+		fields = append(fields, f.Name+":"+val)
+	}
+	return "{" + strings.Join(fields, " ") + "}"
+}
+
+// IsSecret 判断字段是否为敏感字段
+func IsSecret(f reflect.StructField) bool {
+	return f.Tag.Get(SecretTag) == "true"
+}
@@ -0,0 +1,120 @@
+package validate
+
+import (
+	"fmt"
+	"gopkg.in/go-playground/validator.v9"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var instance = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	// 错误信息中使用配置文件里的key，如MaxIdleConns对应maxIdleConns
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		return KeyName(f.Name)
+	})
+	return v
+}
+
+// KeyName 把struct字段名转换为配置文件中的key
+func KeyName(field string) string {
+	r, n := utf8.DecodeRuneInString(field)
+	return string(unicode.ToLower(r)) + field[n:]
+}
+
+// FieldError 单个配置项的错误，Key为完整的key路径，如mainDb.port
+type FieldError struct {
+	Key     string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+// Errors 聚合多个配置项的错误，一次性报告所有问题
+type Errors []*FieldError
+
+func (e Errors) Error() string {
+	lines := make([]string, 0, len(e)+1)
+	lines = append(lines, fmt.Sprintf("%d config error(s):", len(e)))
+	for _, fe := range e {
+		lines = append(lines, "  "+fe.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Append 追加错误，err为Errors时展开，其他错误以key作为key路径，err为nil时忽略
+func (e *Errors) Append(key string, err error) {
+	if err == nil {
+		return
+	}
+	switch err := err.(type) {
+	case Errors:
+		*e = append(*e, err...)
+	case *FieldError:
+		*e = append(*e, err)
+	default:
+		*e = append(*e, &FieldError{Key: key, Message: err.Error()})
+	}
+}
+
+// Err 没有错误时返回nil，避免返回值为nil的Errors被当成非nil的error
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Struct 按validate tag校验配置段，section为该配置段的key路径
+// 错误信息中只包含key和规则，不包含配置的值，避免泄露密码等敏感信息
+func Struct(section string, v interface{}) error {
+	err := instance.Struct(v)
+	if err == nil {
+		return nil
+	}
+	fieldErrs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return Errors{{Key: section, Message: err.Error()}}
+	}
+	errs := make(Errors, 0, len(fieldErrs))
+	for _, fe := range fieldErrs {
+		// Namespace的第一段是struct类型名，替换为section
+		key := fe.Namespace()
+		if i := strings.Index(key, "."); i >= 0 {
+			key = key[i+1:]
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		errs = append(errs, &FieldError{Key: key, Message: message(fe)})
+	}
+	return errs
+}
+
+func message(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min", "gte":
+		return "must be >= " + fe.Param()
+	case "max", "lte":
+		return "must be <= " + fe.Param()
+	case "gt":
+		return "must be > " + fe.Param()
+	case "lt":
+		return "must be < " + fe.Param()
+	case "oneof":
+		return "must be one of [" + fe.Param() + "]"
+	default:
+		if fe.Param() != "" {
+			return fmt.Sprintf("failed on rule [%s=%s]", fe.Tag(), fe.Param())
+		}
+		return fmt.Sprintf("failed on rule [%s]", fe.Tag())
+	}
+}
@@ -0,0 +1,78 @@
+package validate_test
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/configurator/validate"
+	"testing"
+	"time"
+)
+
+type testInner struct {
+	Token string `secret:"true"`
+	Level int    `validate:"min=1,max=3"`
+}
+
+type testConf struct {
+	Host     string        `validate:"required"`
+	Password string        `secret:"true"`
+	Timeout  time.Duration `validate:"min=0"`
+	Mode     string        `validate:"oneof=a b"`
+	Inner    testInner
+}
+
+type testValidateSuite struct {
+	suite.Suite
+}
+
+/*
+ * 1. 测试所有错误被一次性收集，并使用配置文件中的key路径
+ */
+func (s *testValidateSuite) TestStruct() {
+	assrt := assert.New(s.T())
+	c := &testConf{Timeout: -time.Second, Mode: "c", Password: "123456"}
+	err := validate.Struct("section", c)
+	assrt.Error(err)
+	errs, ok := err.(validate.Errors)
+	assrt.True(ok)
+	keys := make([]string, 0, len(errs))
+	for _, e := range errs {
+		keys = append(keys, e.Key)
+	}
+	assrt.Equal([]string{"section.host", "section.timeout", "section.mode", "section.inner.level"}, keys)
+	assrt.NotContains(err.Error(), "123456")
+
+	c = &testConf{Host: "h", Mode: "a", Inner: testInner{Level: 2}}
+	assrt.NoError(validate.Struct("section", c))
+}
+
+/*
+ * 2. 测试Errors的聚合
+ */
+func (s *testValidateSuite) TestErrors() {
+	assrt := assert.New(s.T())
+	errs := validate.Errors{}
+	assrt.NoError(errs.Err())
+	errs.Append("a", nil)
+	assrt.NoError(errs.Err())
+	errs.Append("a", errors.New("boom"))
+	errs.Append("b", validate.Struct("b", &testConf{Mode: "a", Inner: testInner{Level: 1}}))
+	assrt.Len(errs, 2)
+	assrt.Equal("2 config error(s):\n  a: boom\n  b.host: is required", errs.Err().Error())
+}
+
+/*
+ * 3. 测试敏感字段被隐藏
+ */
+func (s *testValidateSuite) TestRedact() {
+	assrt := assert.New(s.T())
+	c := &testConf{Host: "h", Password: "123456", Timeout: time.Second, Inner: testInner{Token: "abc"}}
+	assrt.Equal("{Host:h Password:****** Timeout:1s Mode: Inner:{Token:****** Level:0}}", validate.Redact(c))
+	c.Password = ""
+	assrt.Contains(validate.Redact(c), "Password: ")
+}
+
+func TestValidateSuite(t *testing.T) {
+	suite.Run(t, new(testValidateSuite))
+}
@@ -0,0 +1,175 @@
+package configurator
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"meross_iot/library/configurator/validate"
+	"meross_iot/library/logger"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// 编辑器保存文件时通常会触发多个事件，合并一段时间内的事件只重新加载一次
+	reloadDelay = 100 * time.Millisecond
+)
+
+type subscription struct {
+	key string
+	fn  func(old, new interface{})
+}
+
+var (
+	watchMu      sync.Mutex
+	watcher      *fsnotify.Watcher
+	watched      = make(map[string]*entity)
+	reloadTimers = make(map[string]*time.Timer)
+	errHandler   = func(name string, err error) {
+		logger.ErrorReporter("config reload", name)(err)
+	}
+)
+
+// OnError 设置热加载失败时的回调，加载失败时继续使用旧配置
+func OnError(fn func(name string, err error)) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	errHandler = fn
+}
+
+// OnChange 订阅配置项的变化，key为空时订阅整个配置文件
+// 配置重新加载后，key对应的值有变化时以新旧值调用fn，fn中通过Get、Bind读到的已经是新配置
+func OnChange(name, key string, fn func(old, new interface{})) error {
+	e, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.subs = append(e.subs, &subscription{key: key, fn: fn})
+	return nil
+}
+
+// Watch 监听配置文件的变化并自动重新加载，names为空时监听所有已加载的配置
+// 监听的是配置文件所在目录，以兼容先写临时文件再rename，以及k8s configmap通过symlink切换的更新方式
+func Watch(names ...string) error {
+	if len(names) == 0 {
+		names = Names()
+	}
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	if watcher == nil {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		watcher = w
+		go watchLoop(w)
+	}
+	for _, name := range names {
+		e, err := lookup(name)
+		if err != nil {
+			return err
+		}
+		if _, ok := watched[name]; ok {
+			continue
+		}
+		if err := watcher.Add(filepath.Dir(e.path)); err != nil {
+			return err
+		}
+		watched[name] = e
+	}
+	return nil
+}
+
+func watchLoop(w *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			dir := filepath.Dir(filepath.Clean(event.Name))
+			watchMu.Lock()
+			for name, e := range watched {
+				if filepath.Dir(e.path) == dir {
+					scheduleReload(name)
+				}
+			}
+			watchMu.Unlock()
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			watchMu.Lock()
+			handler := errHandler
+			watchMu.Unlock()
+			handler("", err)
+		}
+	}
+}
+
+// 调用方需持有watchMu
+func scheduleReload(name string) {
+	if t, ok := reloadTimers[name]; ok {
+		t.Reset(reloadDelay)
+		return
+	}
+	reloadTimers[name] = time.AfterFunc(reloadDelay, func() {
+		if err := Reload(name); err != nil {
+			watchMu.Lock()
+			handler := errHandler
+			watchMu.Unlock()
+			handler(name, err)
+		}
+	})
+}
+
+// Reload 重新加载配置文件，成功后替换配置并通知订阅者，失败时保留旧配置
+// 通过Extend继承了name的配置随后也会重新加载
+func Reload(name string) error {
+	e, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	e.mu.RLock()
+	base, sources := e.base, e.sources
+	e.mu.RUnlock()
+	ne, err := loadLayered(e.name, e.path, base, sources)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	old := e.v
+	e.v = ne.v
+	e.files = ne.files
+	e.secrets = ne.secrets
+	e.raw = ne.raw
+	subs := make([]*subscription, len(e.subs))
+	copy(subs, e.subs)
+	e.mu.Unlock()
+
+	for _, sub := range subs {
+		ov, nv := getKey(old, sub.key), getKey(ne.v, sub.key)
+		if !reflect.DeepEqual(ov, nv) {
+			sub.fn(ov, nv)
+		}
+	}
+	// 继承了该配置的配置也要重新加载
+	errs := validate.Errors{}
+	for _, child := range extenders(name) {
+		errs.Append(child, Reload(child))
+	}
+	return errs.Err()
+}
+
+func getKey(v *viper.Viper, key string) interface{} {
+	if key == "" {
+		return v.AllSettings()
+	}
+	return v.Get(key)
+}
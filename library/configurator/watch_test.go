@@ -0,0 +1,69 @@
+package configurator_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/configurator"
+	"testing"
+	"time"
+)
+
+type testWatchSuite struct {
+	confDirSuite
+}
+
+/*
+ * 1. 测试Reload后只通知值有变化的订阅者，加载失败时保留旧配置
+ */
+func (s *testWatchSuite) TestReload() {
+	assrt := assert.New(s.T())
+	p := s.write("reload.toml", "[log]\nlevel = \"error\"\n[http]\naddr = \":8080\"\n")
+	assrt.NoError(configurator.TryLoad(map[string]string{"reload": p}))
+	assrt.Error(configurator.OnChange("notLoaded", "log", func(old, new interface{}) {}))
+
+	var levels [][2]interface{}
+	httpChanged := 0
+	assrt.NoError(configurator.OnChange("reload", "log.level", func(old, new interface{}) {
+		levels = append(levels, [2]interface{}{old, new})
+	}))
+	assrt.NoError(configurator.OnChange("reload", "http", func(old, new interface{}) {
+		httpChanged++
+	}))
+
+	s.write("reload.toml", "[log]\nlevel = \"debug\"\n[http]\naddr = \":8080\"\n")
+	assrt.NoError(configurator.Reload("reload"))
+	assrt.Equal([][2]interface{}{{"error", "debug"}}, levels)
+	assrt.Equal(0, httpChanged)
+	assrt.Equal("debug", configurator.MustGet("reload", "log.level"))
+
+	s.write("reload.toml", "[log\nlevel = ")
+	assrt.Error(configurator.Reload("reload"))
+	assrt.Equal("debug", configurator.MustGet("reload", "log.level"))
+	assrt.Len(levels, 1)
+}
+
+/*
+ * 2. 测试Watch在文件变化后自动重新加载
+ */
+func (s *testWatchSuite) TestWatch() {
+	assrt := assert.New(s.T())
+	p := s.write("watch.toml", "[log]\nlevel = \"error\"\n")
+	assrt.NoError(configurator.TryLoad(map[string]string{"watch": p}))
+	changed := make(chan interface{}, 1)
+	assrt.NoError(configurator.OnChange("watch", "log.level", func(old, new interface{}) {
+		changed <- new
+	}))
+	assrt.NoError(configurator.Watch("watch"))
+
+	s.write("watch.toml", "[log]\nlevel = \"info\"\n")
+	select {
+	case v := <-changed:
+		assrt.Equal("info", v)
+	case <-time.After(2 * time.Second):
+		assrt.Fail("config is not reloaded")
+	}
+}
+
+func TestWatchSuite(t *testing.T) {
+	suite.Run(t, new(testWatchSuite))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/albertwidi/sqlt"
 	"github.com/go-sql-driver/mysql"
+	"meross_iot/library/configurator/validate"
 	"strconv"
 	"strings"
 	"time"
@@ -26,23 +27,24 @@ const (
 // mysql 总配置
 type Config struct {
 	// access
-	User string
-	Password string
-	Protocol string
-	Address string
-	Port int
-	DbName string
+	User string `validate:"required"`
+	Password string `secret:"true"`
+	Protocol string `validate:"oneof=tcp unix"`
+	// 多个地址用;分隔，第一个为master
+	Address string `validate:"required"`
+	Port int `validate:"min=1,max=65535"`
+	DbName string `validate:"required"`
 	// pool
-	Timeout time.Duration
-	ReadTimeout time.Duration
-	WriteTimeout time.Duration
-	ConnMaxLife time.Duration
-	MaxIdleConns int
-	MaxOpenConns int
+	Timeout time.Duration `validate:"min=0"`
+	ReadTimeout time.Duration `validate:"min=0"`
+	WriteTimeout time.Duration `validate:"min=0"`
+	ConnMaxLife time.Duration `validate:"min=0"`
+	MaxIdleConns int `validate:"min=0"`
+	MaxOpenConns int `validate:"min=0"`
 	// other
-	PacketMaxSize int
-	Collation string
-	Locale string
+	PacketMaxSize int `validate:"min=0"`
+	Collation string `validate:"required"`
+	Locale string `validate:"required"`
 	ParseTime bool
 	ColumnWithAlias bool
 	RejectReadOnly bool
@@ -65,10 +67,46 @@ func NewConfig() *Config {
 	}
 }
 
+// Validate 校验所有配置项，section为配置段的key路径，用于错误信息
+func (c *Config) Validate(section string) error {
+	errs := validate.Errors{}
+	errs.Append(section, validate.Struct(section, c))
+	if _, err := time.LoadLocation(c.Locale); c.Locale != "" && err != nil {
+		errs.Append(section+".locale", err)
+	}
+	return errs.Err()
+}
+
+// String 输出配置时隐藏密码
+func (c *Config) String() string {
+	return validate.Redact(c)
+}
+
 func New(c *Config) *sqlt.DB {
 	if c == nil {
 		panic(fmt.Errorf("mysql config is empty"))
 	}
+	if err := c.Validate("mysql"); err != nil {
+		panic(fmt.Errorf("wrong mysql config, %s\n", err))
+	}
+	DSNs, err := c.DSNs()
+	if err != nil {
+		panic(fmt.Errorf("mysql init failed with error: %s\n", err))
+	}
+	DSN := strings.Join(DSNs, ";")
+	db, err := sqlt.Open("mysql", DSN)
+	if err != nil {
+		panic(fmt.Errorf("init mysql failed with error: %s\n", err))
+	}
+	//设置pool option
+	db.SetConnMaxLifetime(c.ConnMaxLife)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetMaxOpenConnections(c.MaxOpenConns)
+	return db
+}
+
+// 按Address中;分隔的地址生成每个节点的DSN，第一个为master，其余为slave
+func (c *Config) DSNs() ([]string, error) {
 	mc := mysql.NewConfig()
 	mc.User = c.User
 	mc.Passwd = c.Password
@@ -81,7 +119,7 @@ func New(c *Config) *sqlt.DB {
 	mc.Collation = c.Collation
 	loc, err := time.LoadLocation(c.Locale)
 	if err != nil {
-		panic(fmt.Errorf("mysql init failed with error: %s\n", err))
+		return nil, err
 	}
 	mc.Loc = loc
 	mc.ParseTime = c.ParseTime
@@ -92,20 +130,9 @@ func New(c *Config) *sqlt.DB {
 	DSNs := make([]string, addrLen)
 	for i := 0; i < addrLen; i++ {
 		mc.Addr = addrs[i] + ":" + strconv.Itoa(c.Port)
-		fmt.Printf("%+v\n", mc)
 		DSNs[i] = mc.FormatDSN()
 	}
-	DSN := strings.Join(DSNs, ";")
-	fmt.Printf("%s\n", DSN)
-	db, err := sqlt.Open("mysql", DSN)
-	if err != nil {
-		panic(fmt.Errorf("init mysql failed with error: %s\n", err))
-	}
-	//设置pool option
-	db.SetConnMaxLifetime(c.ConnMaxLife)
-	db.SetMaxIdleConns(c.MaxIdleConns)
-	db.SetMaxOpenConnections(c.MaxOpenConns)
-	return db
+	return DSNs, nil
 }
 
 
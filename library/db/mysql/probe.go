@@ -0,0 +1,88 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Probe 为每个节点单独维护一个探活连接
+// sqlt只暴露master和轮询的slave，无法逐个节点探测
+type Probe struct {
+	nodes []*probeNode
+}
+
+type probeNode struct {
+	name string
+	addr string
+	db   *sql.DB
+}
+
+// NewProbe 按Config中的地址列表创建探活连接，节点命名与sqlt一致：master, slave-1, slave-2...
+// sql.Open不会建立连接，真正的连接在第一次Ping时建立
+func NewProbe(c *Config) (*Probe, error) {
+	if c == nil {
+		return nil, fmt.Errorf("mysql config is empty")
+	}
+	DSNs, err := c.DSNs()
+	if err != nil {
+		return nil, err
+	}
+	addrs := strings.Split(c.Address, ";")
+	p := &Probe{}
+	for i, DSN := range DSNs {
+		db, err := sql.Open("mysql", DSN)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(c.ConnMaxLife)
+		name := "master"
+		if i > 0 {
+			name = "slave-" + strconv.Itoa(i)
+		}
+		p.nodes = append(p.nodes, &probeNode{
+			name: name,
+			addr: addrs[i] + ":" + strconv.Itoa(c.Port),
+			db:   db,
+		})
+	}
+	return p, nil
+}
+
+// Nodes 返回所有节点名
+func (p *Probe) Nodes() []string {
+	names := make([]string, len(p.nodes))
+	for i, n := range p.nodes {
+		names[i] = n.name
+	}
+	return names
+}
+
+// PingNode ping指定节点
+func (p *Probe) PingNode(ctx context.Context, name string) error {
+	for _, n := range p.nodes {
+		if n.name != name {
+			continue
+		}
+		if err := n.db.PingContext(ctx); err != nil {
+			return fmt.Errorf("%s(%s): %s", n.name, n.addr, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown mysql node [%s]", name)
+}
+
+func (p *Probe) Close() error {
+	var err error
+	for _, n := range p.nodes {
+		if e := n.db.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package health
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+
+	DefaultTimeout = 2 * time.Second
+)
+
+// CheckFunc 检查一个依赖，返回nil表示可用
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// CheckResult 单个依赖的检查结果
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report 所有依赖的检查结果，任意一个依赖down则整体down
+type Report struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckResult `json:"checks,omitempty"`
+}
+
+type Health struct {
+	timeout  time.Duration
+	mu       sync.RWMutex
+	checks   []*check
+	shutdown bool
+}
+
+// New 创建一个Health，timeout为每个检查的超时时间，<=0时使用默认值
+func New(timeout time.Duration) *Health {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Health{timeout: timeout}
+}
+
+// Register 注册依赖检查，name在report中作为key，重复注册会panic
+func (h *Health) Register(name string, fn CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.checks {
+		if c.name == name {
+			panic("Health check [" + name + "] is already registered\n")
+		}
+	}
+	h.checks = append(h.checks, &check{name: name, fn: fn})
+}
+
+// Shutdown 标记进程正在关闭，之后readiness一直返回不可用，让负载均衡摘掉该实例
+func (h *Health) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shutdown = true
+}
+
+// Check 并发执行所有检查
+func (h *Health) Check(ctx context.Context) *Report {
+	h.mu.RLock()
+	checks := h.checks
+	shutdown := h.shutdown
+	h.mu.RUnlock()
+	if shutdown {
+		return &Report{Status: StatusDown}
+	}
+
+	report := &Report{
+		Status: StatusUp,
+		Checks: make(map[string]*CheckResult, len(checks)),
+	}
+	results := make([]*CheckResult, len(checks))
+	wg := sync.WaitGroup{}
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *check) {
+			defer wg.Done()
+			results[i] = h.run(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+	for i, c := range checks {
+		report.Checks[c.name] = results[i]
+		if results[i].Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+func (h *Health) run(ctx context.Context, c *check) *CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	start := time.Now()
+	err := c.fn(ctx)
+	r := &CheckResult{
+		Status:   StatusUp,
+		Duration: time.Since(start).String(),
+	}
+	if err != nil {
+		r.Status = StatusDown
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// LivenessHandler 只表示进程存活，不检查依赖，避免依赖故障时进程被反复重启
+func (h *Health) LivenessHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, &Report{Status: StatusUp})
+	}
+}
+
+// ReadinessHandler 检查所有依赖，有依赖不可用时返回503
+func (h *Health) ReadinessHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := h.Check(c.Request.Context())
+		code := http.StatusOK
+		if report.Status != StatusUp {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, report)
+	}
+}
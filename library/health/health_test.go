@@ -0,0 +1,94 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"meross_iot/library/health"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testHealthSuite struct {
+	suite.Suite
+}
+
+func serve(h gin.HandlerFunc) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.GET("/", h)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w
+}
+
+/*
+ * 1. 测试所有依赖可用时readyz返回200
+ */
+func (s *testHealthSuite) TestReadinessUp() {
+	assrt := assert.New(s.T())
+	h := health.New(0)
+	h.Register("a", func(ctx context.Context) error { return nil })
+	h.Register("b", func(ctx context.Context) error { return nil })
+	w := serve(h.ReadinessHandler())
+	assrt.Equal(http.StatusOK, w.Code)
+	report := &health.Report{}
+	assrt.NoError(json.Unmarshal(w.Body.Bytes(), report))
+	assrt.Equal(health.StatusUp, report.Status)
+	assrt.Len(report.Checks, 2)
+	assrt.Equal(health.StatusUp, report.Checks["a"].Status)
+}
+
+/*
+ * 2. 测试依赖失败和超时时readyz返回503，并报告每个依赖的状态
+ */
+func (s *testHealthSuite) TestReadinessDown() {
+	assrt := assert.New(s.T())
+	h := health.New(50 * time.Millisecond)
+	h.Register("ok", func(ctx context.Context) error { return nil })
+	h.Register("fail", func(ctx context.Context) error { return errors.New("boom") })
+	h.Register("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	w := serve(h.ReadinessHandler())
+	assrt.Equal(http.StatusServiceUnavailable, w.Code)
+	report := &health.Report{}
+	assrt.NoError(json.Unmarshal(w.Body.Bytes(), report))
+	assrt.Equal(health.StatusDown, report.Status)
+	assrt.Equal(health.StatusUp, report.Checks["ok"].Status)
+	assrt.Equal("boom", report.Checks["fail"].Error)
+	assrt.Equal(context.DeadlineExceeded.Error(), report.Checks["slow"].Error)
+}
+
+/*
+ * 3. 测试liveness不执行依赖检查
+ */
+func (s *testHealthSuite) TestLiveness() {
+	assrt := assert.New(s.T())
+	h := health.New(0)
+	h.Register("fail", func(ctx context.Context) error { return errors.New("boom") })
+	w := serve(h.LivenessHandler())
+	assrt.Equal(http.StatusOK, w.Code)
+	assrt.JSONEq(`{"status":"up"}`, w.Body.String())
+}
+
+/*
+ * 4. 测试重复注册
+ */
+func (s *testHealthSuite) TestRegisterTwice() {
+	h := health.New(0)
+	h.Register("a", func(ctx context.Context) error { return nil })
+	assert.Panics(s.T(), func() {
+		h.Register("a", func(ctx context.Context) error { return nil })
+	})
+}
+
+func TestHealthSuite(t *testing.T) {
+	suite.Run(t, new(testHealthSuite))
+}
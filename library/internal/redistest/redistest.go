@@ -0,0 +1,26 @@
+// Package redistest 是redis相关测试共用的fixture
+package redistest
+
+import (
+	"meross_iot/library/cache/redis"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+ * Config 返回连接addr(通常是miniredis.Addr())的配置，driver为空时使用默认driver
+ * 借出连接时不PING，连接超时为100ms，服务关闭后的测试能很快失败
+ */
+func Config(addr, driver string) *redis.Config {
+	c := redis.NewConfig()
+	if driver != "" {
+		c.Driver = driver
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	c.Host = host
+	c.Port, _ = strconv.Atoi(port)
+	c.PingOnBorrow = 0
+	c.Timeout = 100 * time.Millisecond
+	return c
+}
@@ -0,0 +1,77 @@
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Status 编码为status reply，普通的string编码为bulk string
+type Status string
+
+// Error 编码为error reply，内容包括错误前缀，如"ERR unknown command"
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Bulk 编码bulk string
+func Bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+/*
+ * Encode 按RESP编码模拟服务端的回复
+ * nil为null bulk string，string和[]byte为bulk string，int和int64为integer，error为error reply，[]interface{}为array
+ */
+func Encode(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "$-1\r\n"
+	case Status:
+		return "+" + string(v) + "\r\n"
+	case string:
+		return Bulk(v)
+	case []byte:
+		return Bulk(string(v))
+	case int:
+		return ":" + strconv.Itoa(v) + "\r\n"
+	case int64:
+		return ":" + strconv.FormatInt(v, 10) + "\r\n"
+	case error:
+		return "-" + v.Error() + "\r\n"
+	case []interface{}:
+		s := fmt.Sprintf("*%d\r\n", len(v))
+		for _, e := range v {
+			s += Encode(e)
+		}
+		return s
+	}
+	return fmt.Sprintf("-ERR unsupported reply %T\r\n", v)
+}
+
+// ReadCommand 读取客户端发送的一条命令，返回命令名和参数
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("wrong command line %q", line)
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(arg, "\r\n"))
+	}
+	return args, nil
+}
@@ -0,0 +1,62 @@
+package logger
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+const DefaultFlushInterval = time.Second
+
+// BufferedWriter 带缓冲的日志输出，每隔interval写出一次，退出前调用Flush写出剩余的日志
+type BufferedWriter struct {
+	mu   sync.Mutex
+	w    *bufio.Writer
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewBufferedWriter size为缓冲区字节数，interval为0时使用DefaultFlushInterval
+func NewBufferedWriter(w io.Writer, size int, interval time.Duration) *BufferedWriter {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	b := &BufferedWriter{w: bufio.NewWriterSize(w, size), stop: make(chan struct{})}
+	go b.loop(interval)
+	return b
+}
+
+// Write zerolog每条日志调用一次，加锁后多个goroutine的日志不会交错
+func (b *BufferedWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.w.Write(p)
+}
+
+func (b *BufferedWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.w.Flush()
+}
+
+// Close 停止定时写出并写出剩余的日志
+func (b *BufferedWriter) Close() error {
+	b.once.Do(func() {
+		close(b.stop)
+	})
+	return b.Flush()
+}
+
+func (b *BufferedWriter) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.Flush()
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package logger_test
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"meross_iot/library/logger"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bytes.Buffer不是并发安全的，定时写出和测试中的读取需要加锁
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+/*
+ * 1. 测试缓冲的日志在Flush或定时写出之前不输出
+ */
+func TestBufferedWriter(t *testing.T) {
+	assrt := assert.New(t)
+	out := &syncBuffer{}
+	w := logger.NewBufferedWriter(out, 1024, time.Hour)
+	w.Write([]byte("a\n"))
+	assrt.Equal("", out.String())
+	assrt.NoError(w.Flush())
+	assrt.Equal("a\n", out.String())
+	w.Write([]byte("b\n"))
+	assrt.NoError(w.Close())
+	assrt.Equal("a\nb\n", out.String())
+
+	w = logger.NewBufferedWriter(out, 1024, 10*time.Millisecond)
+	defer w.Close()
+	w.Write([]byte("c\n"))
+	assrt.Eventually(func() bool {
+		return out.String() == "a\nb\nc\n"
+	}, time.Second, 5*time.Millisecond)
+}
@@ -11,7 +11,10 @@ import (
 // Logger is the global logger.
 var svcName string
 var host string
-var instance zerolog.Logger
+var out io.Writer = os.Stderr
+// instance writes to stderr until Init is called, so that libraries
+// logging before Init do not panic.
+var instance = zerolog.New(os.Stderr)
 
 func Init(svc string, level zerolog.Level) {
 	svcName = svc
@@ -28,7 +31,28 @@ func Init(svc string, level zerolog.Level) {
 	zerolog.ErrorStackFieldName = "s"
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixMs
 	zerolog.SetGlobalLevel(level)
-	instance = zerolog.New(os.Stderr).With().Timestamp().Str("h", host).Str("svc", svcName).Logger()
+	instance = zerolog.New(out).With().Timestamp().Str("h", host).Str("svc", svcName).Logger()
+}
+
+// SetLevel changes the global minimum level at runtime, e.g. when the
+// config file is reloaded.
+func SetLevel(level zerolog.Level) {
+	zerolog.SetGlobalLevel(level)
+}
+
+// SetOutput sets the output of the global logger, e.g. a BufferedWriter.
+// It must be called before Init.
+func SetOutput(w io.Writer) {
+	out = w
+}
+
+// Flush flushes buffered log events of the global logger output, if the
+// output buffers them. It should be called before the process exits.
+func Flush() error {
+	if f, ok := out.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
 }
 
 // Output duplicates the global logger and sets w as its output.
@@ -0,0 +1,13 @@
+package logger
+
+// ErrorReporter 返回把错误以error级别输出到全局logger的回调，作为各组件OnError的默认值
+// component为组件名，如cache；name区分同一组件的多个实例，如key前缀，为空时不输出
+func ErrorReporter(component, name string) func(err error) {
+	return func(err error) {
+		e := Error().Err(err).Str("component", component)
+		if name != "" {
+			e = e.Str("name", name)
+		}
+		e.Msg(component + " error")
+	}
+}
@@ -0,0 +1,36 @@
+package logger_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"meross_iot/library/logger"
+	"os"
+	"testing"
+)
+
+/*
+ * 1. 测试ErrorReporter以error级别输出组件名、实例名和错误
+ */
+func TestErrorReporter(t *testing.T) {
+	assrt := assert.New(t)
+	// Init之前使用不会panic
+	logger.ErrorReporter("cache", "")(errors.New("before init"))
+
+	out := &syncBuffer{}
+	logger.SetOutput(out)
+	logger.Init("test", zerolog.ErrorLevel)
+	defer func() {
+		logger.SetOutput(os.Stderr)
+		logger.Init("test", zerolog.ErrorLevel)
+	}()
+	logger.ErrorReporter("cache", "device:")(errors.New("boom"))
+	fields := map[string]interface{}{}
+	assrt.NoError(json.Unmarshal([]byte(out.String()), &fields))
+	assrt.Equal("error", fields["l"])
+	assrt.Equal("cache", fields["component"])
+	assrt.Equal("device:", fields["name"])
+	assrt.Equal("boom", fields["e"])
+	assrt.Equal("cache error", fields["m"])
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const (
+	Namespace = "meross"
+)
+
+// 进程内唯一的registry，默认带上go runtime和进程指标
+var registry = newRegistry()
+
+func newRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(prometheus.NewGoCollector())
+	r.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	return r
+}
+
+// Registry 返回全局registry
+func Registry() *prometheus.Registry {
+	return registry
+}
+
+// MustRegister 注册collector，重复注册会panic
+func MustRegister(cs ...prometheus.Collector) {
+	registry.MustRegister(cs...)
+}
+
+// Handler 返回暴露全局registry的http handler
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// NewCounterVec 创建并注册一个counter
+func NewCounterVec(subsystem, name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	}, labels)
+	registry.MustRegister(c)
+	return c
+}
+
+// NewGaugeVec 创建并注册一个gauge
+func NewGaugeVec(subsystem, name, help string, labels ...string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	}, labels)
+	registry.MustRegister(g)
+	return g
+}
+
+// NewHistogramVec 创建并注册一个histogram，buckets为nil时使用prometheus默认值
+func NewHistogramVec(subsystem, name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	}, labels)
+	registry.MustRegister(h)
+	return h
+}
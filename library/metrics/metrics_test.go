@@ -0,0 +1,147 @@
+package metrics_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"meross_iot/library/cache/redis"
+	"meross_iot/library/internal/redistest"
+	"meross_iot/library/metrics"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testMetricsSuite struct {
+	suite.Suite
+	mr     *miniredis.Miniredis
+	conf   *redis.Config
+	engine *gin.Engine
+}
+
+func (s *testMetricsSuite) SetupSuite() {
+	err := error(nil)
+	s.mr, err = miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	c := redistest.Config(s.mr.Addr(), "")
+	s.conf = c
+	p := redis.New(c).Pool()
+	conn, _ := p.Borrow()
+	conn.Close()
+	metrics.RegisterRedisPool("test", p)
+	// 多个pool和库可以分别注册
+	metrics.RegisterRedisPool("test2", redis.New(c).Pool())
+	metrics.RegisterDB("main", fakeDB{open: 3})
+	metrics.RegisterDB("log", fakeDB{open: 1})
+
+	gin.SetMode(gin.TestMode)
+	s.engine = gin.New()
+	s.engine.Use(metrics.GinMiddleware())
+	s.engine.GET("/metrics", metrics.GinHandler())
+	s.engine.GET("/device/:uuid", func(c *gin.Context) {
+		c.String(http.StatusOK, c.Param("uuid"))
+	})
+}
+
+type fakeDB struct {
+	open int
+}
+
+func (db fakeDB) Stats() sql.DBStats {
+	return sql.DBStats{OpenConnections: db.open}
+}
+
+func (s *testMetricsSuite) TearDownSuite() {
+	s.mr.Close()
+}
+
+func (s *testMetricsSuite) scrape() string {
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	return string(body)
+}
+
+/*
+ * 1. 测试请求按路由模板统计，而不是按实际路径
+ */
+func (s *testMetricsSuite) TestGinMiddleware() {
+	assrt := assert.New(s.T())
+	for _, uuid := range []string{"a", "b"} {
+		w := httptest.NewRecorder()
+		s.engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/device/"+uuid, nil))
+		assrt.Equal(http.StatusOK, w.Code)
+	}
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/not/found", nil))
+	assrt.Equal(http.StatusNotFound, w.Code)
+
+	body := s.scrape()
+	assrt.Contains(body, `meross_http_requests_total{method="GET",route="/device/:uuid",status="200"} 2`)
+	assrt.Contains(body, `meross_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assrt.Contains(body, `meross_http_request_duration_seconds_count{method="GET",route="/device/:uuid",status="200"} 2`)
+}
+
+/*
+ * 2. 测试redis连接池指标，多个pool分别注册
+ */
+func (s *testMetricsSuite) TestRedisPool() {
+	assrt := assert.New(s.T())
+	body := s.scrape()
+	assrt.Contains(body, `meross_redis_pool_active_connections{pool="test"} 1`)
+	assrt.Contains(body, `meross_redis_pool_idle_connections{pool="test"} 1`)
+	assrt.Contains(body, `meross_redis_pool_active_connections{pool="test2"} 0`)
+}
+
+/*
+ * 4. 测试多个数据库连接池的指标
+ */
+func (s *testMetricsSuite) TestDB() {
+	assrt := assert.New(s.T())
+	body := s.scrape()
+	assrt.Contains(body, `meross_db_open_connections{db="main"} 3`)
+	assrt.Contains(body, `meross_db_open_connections{db="log"} 1`)
+}
+
+/*
+ * 3. 测试redis命令的Hook，按命令和结果统计，pipeline统计一次
+ */
+func (s *testMetricsSuite) TestRedisHook() {
+	assrt := assert.New(s.T())
+	r := redis.New(s.conf)
+	r.AddHook(metrics.RedisHook("hook"))
+	conn, err := r.Pool().Borrow()
+	assrt.NoError(err)
+	conn.Do("SET", "test:hook", "a")
+	conn.Do("GET", "test:hook")
+	conn.Do("GET", "test:hook")
+	_, err = conn.Do("LPUSH", "test:hook", "b")
+	assrt.Error(err)
+	conn.Close()
+	pipe := r.Pool().Pipeline()
+	pipe.Send("GET", "test:hook")
+	pipe.Send("GET", "test:hook")
+	_, err = pipe.Exec(context.Background())
+	assrt.NoError(err)
+	s.mr.Close()
+	_, err = r.Pool().Script(1, "return 1").Do(context.Background(), "test:hook")
+	assrt.Error(err)
+	assrt.NoError(s.mr.Restart())
+
+	body := s.scrape()
+	assrt.Contains(body, `meross_redis_commands_total{command="GET",pool="hook",status="ok"} 2`)
+	assrt.Contains(body, `meross_redis_commands_total{command="LPUSH",pool="hook",status="server_error"} 1`)
+	assrt.Contains(body, `meross_redis_commands_total{command="PIPELINE",pool="hook",status="ok"} 1`)
+	assrt.Contains(body, `meross_redis_commands_total{command="EVALSHA",pool="hook",status="error"} 1`)
+	assrt.Contains(body, `meross_redis_command_duration_seconds_count{command="SET",pool="hook"} 1`)
+}
+
+func TestMetricsSuite(t *testing.T) {
+	suite.Run(t, new(testMetricsSuite))
+}
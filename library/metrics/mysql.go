@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"database/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+// DBStater 由*sql.DB和*sqlx.DB实现
+type DBStater interface {
+	Stats() sql.DBStats
+}
+
+var (
+	dbMaxOpenDesc = newDBDesc("max_open_connections", "Maximum number of open connections to the database.")
+	dbOpenDesc    = newDBDesc("open_connections", "Number of established connections, both in use and idle.")
+	dbInUseDesc   = newDBDesc("in_use_connections", "Number of connections currently in use.")
+	dbIdleDesc    = newDBDesc("idle_connections", "Number of idle connections.")
+	dbWaitDesc    = newDBDesc("wait_count_total", "Total number of connections waited for.")
+	dbWaitDurDesc = newDBDesc("wait_duration_seconds_total", "Total time blocked waiting for a new connection.")
+	dbIdleClosed  = newDBDesc("max_idle_closed_total", "Total number of connections closed due to SetMaxIdleConns.")
+	dbLifeClosed  = newDBDesc("max_lifetime_closed_total", "Total number of connections closed due to SetConnMaxLifetime.")
+)
+
+func newDBDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(Namespace, "db", name), help, []string{"db"}, nil)
+}
+
+var dbStats = &dbStatsCollector{dbs: make(map[string]DBStater)}
+
+func init() {
+	registry.MustRegister(dbStats)
+}
+
+// 所有数据库连接池共用一个collector，每次采集时读取各个库的DBStats
+type dbStatsCollector struct {
+	mu  sync.Mutex
+	dbs map[string]DBStater
+}
+
+// RegisterDB 注册数据库连接池的DBStats指标，name用于区分多个库，同名时替换
+func RegisterDB(name string, db DBStater) {
+	dbStats.mu.Lock()
+	defer dbStats.mu.Unlock()
+	dbStats.dbs[name] = db
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dbMaxOpenDesc
+	ch <- dbOpenDesc
+	ch <- dbInUseDesc
+	ch <- dbIdleDesc
+	ch <- dbWaitDesc
+	ch <- dbWaitDurDesc
+	ch <- dbIdleClosed
+	ch <- dbLifeClosed
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, db := range c.dbs {
+		s := db.Stats()
+		ch <- prometheus.MustNewConstMetric(dbMaxOpenDesc, prometheus.GaugeValue, float64(s.MaxOpenConnections), name)
+		ch <- prometheus.MustNewConstMetric(dbOpenDesc, prometheus.GaugeValue, float64(s.OpenConnections), name)
+		ch <- prometheus.MustNewConstMetric(dbInUseDesc, prometheus.GaugeValue, float64(s.InUse), name)
+		ch <- prometheus.MustNewConstMetric(dbIdleDesc, prometheus.GaugeValue, float64(s.Idle), name)
+		ch <- prometheus.MustNewConstMetric(dbWaitDesc, prometheus.CounterValue, float64(s.WaitCount), name)
+		ch <- prometheus.MustNewConstMetric(dbWaitDurDesc, prometheus.CounterValue, s.WaitDuration.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(dbIdleClosed, prometheus.CounterValue, float64(s.MaxIdleClosed), name)
+		ch <- prometheus.MustNewConstMetric(dbLifeClosed, prometheus.CounterValue, float64(s.MaxLifetimeClosed), name)
+	}
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"meross_iot/library/cache/redis"
+	"sync"
+)
+
+const (
+	redisStatusOK = "ok"
+	// 服务端返回的错误，如WRONGTYPE、脚本错误
+	redisStatusServerError = "server_error"
+	// 连接、超时等错误
+	redisStatusError = "error"
+)
+
+var (
+	redisActiveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "redis_pool", "active_connections"),
+		"Number of connections in the redis pool, including idle ones.",
+		[]string{"pool"}, nil)
+	redisIdleDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "redis_pool", "idle_connections"),
+		"Number of idle connections in the redis pool.",
+		[]string{"pool"}, nil)
+
+	redisCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "redis",
+		Name:      "commands_total",
+		Help:      "Total number of redis commands by command and status, a pipeline is counted once.",
+	}, []string{"pool", "command", "status"})
+	redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "redis",
+		Name:      "command_duration_seconds",
+		Help:      "Redis command latencies in seconds by command.",
+		// 0.5ms到4s
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"pool", "command"})
+)
+
+var redisPools = &redisPoolCollector{pools: make(map[string]redis.Pool)}
+
+func init() {
+	registry.MustRegister(redisCommands, redisDuration, redisPools)
+}
+
+// 所有redis连接池共用一个collector，每次采集时读取各个Pool.Stat()
+type redisPoolCollector struct {
+	mu    sync.Mutex
+	pools map[string]redis.Pool
+}
+
+// RegisterRedisPool 注册redis连接池的状态指标，name用于区分多个pool，同名时替换
+func RegisterRedisPool(name string, p redis.Pool) {
+	redisPools.mu.Lock()
+	defer redisPools.mu.Unlock()
+	redisPools.pools[name] = p
+}
+
+func (c *redisPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- redisActiveDesc
+	ch <- redisIdleDesc
+}
+
+func (c *redisPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, pool := range c.pools {
+		stat := pool.Stat()
+		ch <- prometheus.MustNewConstMetric(redisActiveDesc, prometheus.GaugeValue, float64(stat.ActiveCount), name)
+		ch <- prometheus.MustNewConstMetric(redisIdleDesc, prometheus.GaugeValue, float64(stat.IdleCount), name)
+	}
+}
+
+// redis命令的Hook，按命令统计次数和耗时
+type redisHook struct {
+	name string
+}
+
+// RedisHook 返回统计redis命令次数和耗时的Hook，通过Redis.AddHook注册，name用于区分多个pool
+func RedisHook(name string) redis.Hook {
+	return &redisHook{name: name}
+}
+
+func (h *redisHook) Before(ctx context.Context, info *redis.CmdInfo) context.Context {
+	return ctx
+}
+
+func (h *redisHook) After(ctx context.Context, info *redis.CmdInfo) {
+	status := redisStatusOK
+	if info.Err != nil {
+		status = redisStatusError
+		if errors.As(info.Err, new(redis.Error)) {
+			status = redisStatusServerError
+		}
+	}
+	redisCommands.WithLabelValues(h.name, info.Name, status).Inc()
+	redisDuration.WithLabelValues(h.name, info.Name).Observe(info.Duration.Seconds())
+}